@@ -0,0 +1,298 @@
+// Filename: cmd/api/batch.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"todoapi.miguelavila.net/internals/data"
+	"todoapi.miguelavila.net/internals/validator"
+)
+
+// errBatchFailed is returned from the batch transaction to roll it back when one
+// of the operations failed
+var errBatchFailed = errors.New("batch operation failed")
+
+// batchOperation is a single create, update or delete in a batch request
+type batchOperation struct {
+	Op      string      `json:"op"`
+	ID      int64       `json:"id"`
+	Version *int32      `json:"version"`
+	Todo    todoChanges `json:"todo"`
+}
+
+// todoChanges holds the fields to set on a todo, nil fields are left unchanged
+type todoChanges struct {
+	Title       *string    `json:"title"`
+	Description *string    `json:"description"`
+	Project     *string    `json:"project"`
+	Completed   *bool      `json:"completed"`
+	DueAt       *time.Time `json:"due_at"`
+	RemindAt    *time.Time `json:"remind_at"`
+	Recurrence  *string    `json:"recurrence"`
+}
+
+// apply() copies the fields that were given onto the todo
+func (c todoChanges) apply(todo *data.Todo) {
+	if c.Title != nil {
+		todo.Title = *c.Title
+	}
+	if c.Description != nil {
+		todo.Description = *c.Description
+	}
+	if c.Project != nil {
+		todo.Project = *c.Project
+	}
+	if c.Completed != nil {
+		todo.Completed = *c.Completed
+	}
+	if c.DueAt != nil {
+		todo.DueAt = c.DueAt
+	}
+	if c.RemindAt != nil {
+		todo.RemindAt = c.RemindAt
+	}
+	if c.Recurrence != nil {
+		todo.Recurrence = *c.Recurrence
+	}
+}
+
+// batchResult reports the outcome of a single operation using the HTTP status
+// code the equivalent single request would have returned
+type batchResult struct {
+	Index   int               `json:"index"`
+	Op      string            `json:"op"`
+	ID      int64             `json:"id,omitempty"`
+	Status  int               `json:"status"`
+	Version int32             `json:"version,omitempty"`
+	Next    int64             `json:"next_occurrence_id,omitempty"`
+	Errors  map[string]string `json:"errors,omitempty"`
+}
+
+// batchTodosHandler for POST /v1/todos/batch endpoint. By default the operations
+// run in a single transaction and either all of them are applied or none are,
+// in best effort mode every operation is applied on its own
+func (app *application) batchTodosHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		BestEffort bool             `json:"best_effort"`
+		Operations []batchOperation `json:"operations"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badResquestReponse(w, r, err)
+		return
+	}
+
+	// Initialize a new instance of validator
+	v := validator.New()
+
+	v.Check(len(input.Operations) > 0, "operations", "must contain at least one operation")
+	v.Check(len(input.Operations) <= app.config.batch.maxSize, "operations", fmt.Sprintf("must not contain more than %d operations", app.config.batch.maxSize))
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	results := make([]batchResult, len(input.Operations))
+
+	// best effort: every operation stands on its own, an unexpected error only
+	// fails its own operation as the ones before it have been committed
+	if input.BestEffort {
+		for i := range input.Operations {
+			err = app.writeTodos(r.Context(), func(tw *todoWriter) error {
+				results[i], err = app.runBatchOperation(tw, i, input.Operations[i])
+				return err
+			})
+			if err != nil {
+				// nobody is waiting for the remaining results
+				if contextError(err) == context.Canceled {
+					app.clientClosedRequestResponse(w, r)
+					return
+				}
+				results[i] = app.batchErrorResult(r, i, input.Operations[i], err)
+			}
+		}
+
+		err = app.writeResponse(w, r, http.StatusOK, envelope{"committed": true, "results": results}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// all or nothing: a failed operation rolls back the transaction
+	err = app.writeTodos(r.Context(), func(tw *todoWriter) error {
+		failed := false
+		for i := range input.Operations {
+			results[i], err = app.runBatchOperation(tw, i, input.Operations[i])
+			if err != nil {
+				return err
+			}
+			if results[i].Status >= 400 {
+				failed = true
+			}
+		}
+		if failed {
+			return errBatchFailed
+		}
+		return nil
+	})
+
+	switch {
+	case errors.Is(err, errBatchFailed):
+		// the operations that succeeded were rolled back with the rest of the batch
+		for i := range results {
+			if results[i].Status < 400 {
+				results[i].Status = http.StatusFailedDependency
+				results[i].Version = 0
+				results[i].Next = 0
+				results[i].Errors = map[string]string{"batch": "rolled back because another operation failed"}
+			}
+		}
+		err = app.writeResponse(w, r, http.StatusUnprocessableEntity, envelope{"committed": false, "results": results}, nil)
+	case err != nil:
+		app.serverErrorResponse(w, r, err)
+		return
+	default:
+		err = app.writeResponse(w, r, http.StatusOK, envelope{"committed": true, "results": results}, nil)
+	}
+
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// batchErrorResult() reports an unexpected error as the result of an operation
+// that was applied on its own, with the status a single request would have got
+func (app *application) batchErrorResult(r *http.Request, index int, op batchOperation, err error) batchResult {
+	app.logError(r, err)
+
+	result := batchResult{Index: index, Op: op.Op, ID: op.ID}
+	if contextError(err) == context.DeadlineExceeded {
+		result.Status = http.StatusGatewayTimeout
+		result.Errors = map[string]string{"server": "the database did not answer in time, please try again"}
+		return result
+	}
+	result.Status = http.StatusInternalServerError
+	result.Errors = map[string]string{"server": "the server encountered a problem and could not process the operation"}
+	return result
+}
+
+// runBatchOperation() applies a single operation with the given writer. Failures
+// caused by the operation itself are reported in the result, only unexpected
+// errors are returned
+func (app *application) runBatchOperation(tw *todoWriter, index int, op batchOperation) (batchResult, error) {
+	result := batchResult{Index: index, Op: op.Op, ID: op.ID}
+
+	switch op.Op {
+	case "create":
+		todo := &data.Todo{}
+		op.Todo.apply(todo)
+
+		v := validator.New()
+		if data.ValidateTodo(v, todo); !v.Valid() {
+			result.Status = http.StatusUnprocessableEntity
+			result.Errors = v.Errors
+			return result, nil
+		}
+
+		err := tw.insert(todo)
+		if err != nil {
+			return result, err
+		}
+
+		result.ID = todo.ID
+		result.Status = http.StatusCreated
+		result.Version = todo.Version
+
+	case "update":
+		todo, ok, err := app.batchFetch(tw, op, &result)
+		if !ok || err != nil {
+			return result, err
+		}
+		wasCompleted := todo.Completed
+		op.Todo.apply(todo)
+
+		v := validator.New()
+		if data.ValidateTodo(v, todo); !v.Valid() {
+			result.Status = http.StatusUnprocessableEntity
+			result.Errors = v.Errors
+			return result, nil
+		}
+
+		next, err := tw.update(todo, wasCompleted)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				result.Status = http.StatusConflict
+				result.Errors = map[string]string{"version": "edit conflict, please fetch the todo again"}
+				return result, nil
+			default:
+				return result, err
+			}
+		}
+
+		result.Status = http.StatusOK
+		result.Version = todo.Version
+		if next != nil {
+			result.Next = next.ID
+		}
+
+	case "delete":
+		todo, ok, err := app.batchFetch(tw, op, &result)
+		if !ok || err != nil {
+			return result, err
+		}
+
+		err = tw.delete(todo)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				result.Status = http.StatusConflict
+				result.Errors = map[string]string{"version": "edit conflict, please fetch the todo again"}
+				return result, nil
+			default:
+				return result, err
+			}
+		}
+
+		result.Status = http.StatusOK
+
+	default:
+		result.Status = http.StatusUnprocessableEntity
+		result.Errors = map[string]string{"op": "must be one of create, update or delete"}
+	}
+
+	return result, nil
+}
+
+// batchFetch() loads the todo targeted by an update or delete operation and
+// checks it against the version the client expects, if any. It returns false
+// when the failure has been recorded in the result
+func (app *application) batchFetch(tw *todoWriter, op batchOperation, result *batchResult) (*data.Todo, bool, error) {
+	todo, err := tw.models.Todos.GetContext(tw.ctx, op.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			result.Status = http.StatusNotFound
+			result.Errors = map[string]string{"id": "todo not found"}
+			return nil, false, nil
+		default:
+			return nil, false, err
+		}
+	}
+
+	if op.Version != nil && *op.Version != todo.Version {
+		result.Status = http.StatusConflict
+		result.Errors = map[string]string{"version": "edit conflict, please fetch the todo again"}
+		return nil, false, nil
+	}
+
+	return todo, true, nil
+}
@@ -0,0 +1,82 @@
+// Filename: cmd/api/batch_test.go
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"todoapi.miguelavila.net/internals/data"
+)
+
+func TestTodoChangesApply(t *testing.T) {
+	due := time.Date(2026, 10, 20, 9, 0, 0, 0, time.UTC)
+	remind := time.Date(2026, 10, 20, 8, 0, 0, 0, time.UTC)
+	newDue := time.Date(2026, 11, 2, 9, 0, 0, 0, time.UTC)
+	newRemind := time.Date(2026, 11, 2, 8, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		changes      string
+		wantTitle    string
+		wantDueAt    *time.Time
+		wantRemindAt *time.Time
+	}{
+		{"nothing", `{}`, "old", &due, &remind},
+		{"title only", `{"title": "new"}`, "new", &due, &remind},
+		{"remind_at only", `{"remind_at": "2026-11-02T08:30:00Z"}`, "old", &due, &newRemind},
+		{"due_at only keeps remind_at", `{"due_at": "2026-11-02T09:00:00Z"}`, "old", &newDue, &remind},
+		{"both", `{"due_at": "2026-11-02T09:00:00Z", "remind_at": "2026-11-02T08:30:00Z"}`, "old", &newDue, &newRemind},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var op batchOperation
+			err := json.Unmarshal([]byte(`{"op": "update", "id": 1, "todo": `+tt.changes+`}`), &op)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dueAt, remindAt := due, remind
+			todo := &data.Todo{ID: 1, Title: "old", DueAt: &dueAt, RemindAt: &remindAt}
+			op.Todo.apply(todo)
+
+			if todo.Title != tt.wantTitle {
+				t.Errorf("title = %q, want %q", todo.Title, tt.wantTitle)
+			}
+			if !sameTime(todo.DueAt, tt.wantDueAt) {
+				t.Errorf("due_at = %v, want %v", todo.DueAt, tt.wantDueAt)
+			}
+			if !sameTime(todo.RemindAt, tt.wantRemindAt) {
+				t.Errorf("remind_at = %v, want %v", todo.RemindAt, tt.wantRemindAt)
+			}
+		})
+	}
+}
+
+func TestGraphQLTodoChangesRemindAt(t *testing.T) {
+	due := time.Date(2026, 10, 20, 9, 0, 0, 0, time.UTC)
+	remind := time.Date(2026, 10, 20, 8, 0, 0, 0, time.UTC)
+	newRemind := time.Date(2026, 11, 2, 8, 30, 0, 0, time.UTC)
+
+	// updateTodo(input: {remindAt: ...}) changes the reminder and keeps the due date
+	changes := graphQLTodoChanges(map[string]interface{}{"remindAt": newRemind})
+	todo := &data.Todo{ID: 1, Title: "old", DueAt: &due, RemindAt: &remind}
+	changes.apply(todo)
+
+	if !sameTime(todo.DueAt, &due) {
+		t.Errorf("due_at = %v, want %v", todo.DueAt, due)
+	}
+	if !sameTime(todo.RemindAt, &newRemind) {
+		t.Errorf("remind_at = %v, want %v", todo.RemindAt, newRemind)
+	}
+}
+
+// sameTime() reports whether two optional times are both unset or equal
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
@@ -0,0 +1,332 @@
+// Filename: cmd/api/calendar.go
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"todoapi.miguelavila.net/internals/data"
+	"todoapi.miguelavila.net/internals/ical"
+	"todoapi.miguelavila.net/internals/rrule"
+	"todoapi.miguelavila.net/internals/validator"
+)
+
+// createFeedHandler for POST /v1/feeds endpoint. It creates a secret token for
+// subscribing to the calendar feed, the token is only returned this once. A
+// token created with a project only sees the todos of that project, so each
+// person can be handed a feed of their own project
+func (app *application) createFeedHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name    string `json:"name"`
+		Project string `json:"project"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badResquestReponse(w, r, err)
+		return
+	}
+
+	feed := &data.FeedToken{Name: input.Name, Project: input.Project}
+
+	// Initialize a new instance of validator
+	v := validator.New()
+
+	if data.ValidateFeedToken(v, feed); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Feeds.Insert(feed)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/feeds/%d", feed.ID))
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"feed": feed, "url": "/v1/todos.ics?token=" + feed.Token}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listFeedsHandler for GET /v1/feeds endpoint
+func (app *application) listFeedsHandler(w http.ResponseWriter, r *http.Request) {
+	feeds, err := app.models.Feeds.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"feeds": feeds}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteFeedHandler for DELETE /v1/feeds/{id} endpoint, it revokes the token
+func (app *application) deleteFeedHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Feeds.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "feed successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// todosFeedHandler for GET /v1/todos.ics endpoint. It serves the todos as an
+// RFC 5545 calendar of VTODO components for calendar apps to subscribe to.
+// Calendar apps cannot send headers, so the feed token is a query parameter.
+// The project and completed parameters filter the todos as in GET /v1/todos,
+// a token scoped to a project only ever sees that project
+func (app *application) todosFeedHandler(w http.ResponseWriter, r *http.Request) {
+	// get the URL values in a map
+	qs := r.URL.Query()
+
+	feed, err := app.models.Feeds.GetByToken(qs.Get("token"))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidFeedTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// initialize a validator
+	v := validator.New()
+
+	project := app.readString(qs, "project", "")
+	if feed.Project != "" {
+		project = feed.Project
+	}
+	completed := app.readBool(qs, "completed", false, v)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="todos.ics"`)
+	w.Header().Set("Cache-Control", "private, max-age=300")
+
+	out := &countingWriter{w: w}
+	cal := ical.NewWriter(out)
+
+	cal.Begin("VCALENDAR")
+	cal.Line("VERSION", "2.0")
+	cal.Line("PRODID", "-//todoapi.miguelavila.net//Todo API "+version+"//EN")
+	cal.Line("CALSCALE", "GREGORIAN")
+	cal.Text("X-WR-CALNAME", "Todos")
+
+	filters := data.Filters{Sort: "id", SortList: todoSortList}
+	err = app.models.Todos.Export(r.Context(), "", "", project, completed, filters, func(todo *data.Todo) error {
+		writeVTODO(cal, todo)
+		return nil
+	})
+	if err == nil {
+		cal.End("VCALENDAR")
+		err = cal.Flush()
+	}
+	if err != nil {
+		// nothing has been sent yet, so there is still a status code to choose
+		if out.n == 0 {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		// abort the response so the calendar app does not keep a partial feed
+		app.logError(r, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// writeVTODO() writes a todo as a VTODO component. The version is the SEQUENCE
+// so calendar apps pick up changes, and a reminder becomes a VALARM
+func writeVTODO(cal *ical.Writer, todo *data.Todo) {
+	cal.Begin("VTODO")
+	cal.Line("UID", fmt.Sprintf("todo-%d@todoapi.miguelavila.net", todo.ID))
+	cal.Time("DTSTAMP", todo.UpdatedAt)
+	cal.Time("LAST-MODIFIED", todo.UpdatedAt)
+	cal.Line("SEQUENCE", strconv.FormatInt(int64(todo.Version), 10))
+	cal.Text("SUMMARY", todo.Title)
+	if todo.Description != "" {
+		cal.Text("DESCRIPTION", todo.Description)
+	}
+	if todo.Completed {
+		cal.Line("STATUS", "COMPLETED")
+	} else {
+		cal.Line("STATUS", "NEEDS-ACTION")
+	}
+	if todo.DueAt != nil {
+		cal.Time("DUE", *todo.DueAt)
+	}
+	if todo.Project != "" {
+		cal.Text("CATEGORIES", todo.Project)
+	}
+	if todo.Recurrence != "" {
+		rule, err := rrule.Parse(todo.Recurrence)
+		if err == nil {
+			cal.Line("RRULE", rule.String())
+		}
+	}
+	if todo.RemindAt != nil {
+		cal.Begin("VALARM")
+		cal.Line("ACTION", "DISPLAY")
+		cal.Text("DESCRIPTION", todo.Title)
+		cal.Time("TRIGGER;VALUE=DATE-TIME", *todo.RemindAt)
+		cal.End("VALARM")
+	}
+	cal.End("VTODO")
+}
+
+// parseICSImport() reads todos from the VTODO components of an iCalendar file.
+// SUMMARY is the title, DESCRIPTION the description (the summary when there is
+// none), the first of the CATEGORIES the project, STATUS:COMPLETED completes the
+// todo and DUE, RRULE and the trigger of the first VALARM map to the due date,
+// recurrence and reminder
+func parseICSImport(content []byte) ([]importRow, error) {
+	components, err := ical.Parse(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+
+	vtodos := []*ical.Component{}
+	for _, c := range components {
+		switch c.Name {
+		case "VCALENDAR":
+			for _, sub := range c.Components {
+				if sub.Name == "VTODO" {
+					vtodos = append(vtodos, sub)
+				}
+			}
+		case "VTODO":
+			vtodos = append(vtodos, c)
+		}
+	}
+	if len(components) == 0 {
+		return nil, errors.New("the file does not contain a calendar")
+	}
+
+	rows := []importRow{}
+	for _, c := range vtodos {
+		row := importRow{Line: c.Line, Todo: &data.Todo{}, Errors: map[string]string{}}
+
+		if p := c.Get("SUMMARY"); p != nil {
+			row.Todo.Title = ical.UnescapeText(p.Value)
+		}
+		row.Todo.Description = row.Todo.Title
+		if p := c.Get("DESCRIPTION"); p != nil && p.Value != "" {
+			row.Todo.Description = ical.UnescapeText(p.Value)
+		}
+		if p := c.Get("CATEGORIES"); p != nil {
+			row.Todo.Project = firstCategory(p.Value)
+		}
+		if p := c.Get("STATUS"); p != nil && strings.EqualFold(p.Value, "COMPLETED") {
+			row.Todo.Completed = true
+		}
+		if p := c.Get("RRULE"); p != nil {
+			row.Todo.Recurrence = p.Value
+		}
+		if p := c.Get("DUE"); p != nil {
+			due, err := p.Time()
+			if err != nil {
+				row.Errors["due_at"] = "DUE must be a DATE or DATE-TIME"
+			} else {
+				row.Todo.DueAt = &due
+			}
+		}
+
+		for _, alarm := range c.Components {
+			if alarm.Name != "VALARM" {
+				continue
+			}
+			remindAt, err := alarmTime(c, alarm)
+			if err != nil {
+				row.Errors["remind_at"] = err.Error()
+			} else {
+				row.Todo.RemindAt = remindAt
+			}
+			break
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// alarmTime() returns when a VALARM goes off. A relative trigger is measured
+// from the DUE of the todo when RELATED=END, and from its DTSTART (or its DUE
+// when it has no start) otherwise
+func alarmTime(vtodo *ical.Component, alarm *ical.Component) (*time.Time, error) {
+	trigger := alarm.Get("TRIGGER")
+	if trigger == nil {
+		return nil, errors.New("VALARM must have a TRIGGER")
+	}
+
+	if trigger.Params["VALUE"] == "DATE-TIME" {
+		t, err := trigger.Time()
+		if err != nil {
+			return nil, errors.New("TRIGGER must be a DATE-TIME")
+		}
+		return &t, nil
+	}
+
+	offset, err := ical.ParseDuration(trigger.Value)
+	if err != nil {
+		return nil, errors.New("TRIGGER must be a DURATION or a DATE-TIME")
+	}
+
+	related := vtodo.Get("DUE")
+	if trigger.Params["RELATED"] != "END" && vtodo.Get("DTSTART") != nil {
+		related = vtodo.Get("DTSTART")
+	}
+	if related == nil {
+		return nil, errors.New("a relative TRIGGER needs a DUE or DTSTART")
+	}
+
+	t, err := related.Time()
+	if err != nil {
+		return nil, errors.New("a relative TRIGGER needs a valid DUE or DTSTART")
+	}
+	t = t.Add(offset)
+	return &t, nil
+}
+
+// firstCategory() returns the first value of a CATEGORIES list, commas escaped
+// with a backslash are part of the value
+func firstCategory(value string) string {
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++
+		case ',':
+			return ical.UnescapeText(value[:i])
+		}
+	}
+	return ical.UnescapeText(value)
+}
@@ -0,0 +1,190 @@
+// Filename: cmd/api/calendar_test.go
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"todoapi.miguelavila.net/internals/data"
+	"todoapi.miguelavila.net/internals/ical"
+)
+
+// vcalendar() wraps content lines in a VCALENDAR
+func vcalendar(lines ...string) []byte {
+	lines = append([]string{"BEGIN:VCALENDAR", "VERSION:2.0"}, lines...)
+	lines = append(lines, "END:VCALENDAR")
+	return []byte(strings.Join(lines, "\r\n"))
+}
+
+func TestParseICSImport(t *testing.T) {
+	due := time.Date(2026, 10, 20, 9, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		content []byte
+		want    data.Todo
+		errors  map[string]string
+	}{
+		{
+			"summary only",
+			vcalendar("BEGIN:VTODO", "SUMMARY:Buy milk", "END:VTODO"),
+			data.Todo{Title: "Buy milk", Description: "Buy milk"},
+			nil,
+		},
+		{
+			"every field",
+			vcalendar("BEGIN:VTODO", `SUMMARY:Call\, then write`, `DESCRIPTION:About the\nreport`, `CATEGORIES:Work\, home,Later`,
+				"STATUS:COMPLETED", "DUE:20261020T090000Z", "RRULE:FREQ=WEEKLY", "BEGIN:VALARM", "TRIGGER:-PT15M", "END:VALARM", "END:VTODO"),
+			data.Todo{Title: "Call, then write", Description: "About the\nreport", Project: "Work, home", Completed: true, Recurrence: "FREQ=WEEKLY"},
+			nil,
+		},
+		{
+			"trigger related to the start",
+			vcalendar("BEGIN:VTODO", "SUMMARY:a", "DTSTART:20261019T090000Z", "DUE:20261020T090000Z", "BEGIN:VALARM", "TRIGGER:PT1H", "END:VALARM", "END:VTODO"),
+			data.Todo{Title: "a", Description: "a"},
+			nil,
+		},
+		{
+			"trigger related to the end",
+			vcalendar("BEGIN:VTODO", "SUMMARY:a", "DTSTART:20261019T090000Z", "DUE:20261020T090000Z", "BEGIN:VALARM", "TRIGGER;RELATED=END:-PT15M", "END:VALARM", "END:VTODO"),
+			data.Todo{Title: "a", Description: "a"},
+			nil,
+		},
+		{
+			"bad due date",
+			vcalendar("BEGIN:VTODO", "SUMMARY:a", "DUE:tomorrow", "END:VTODO"),
+			data.Todo{Title: "a", Description: "a"},
+			map[string]string{"due_at": "DUE must be a DATE or DATE-TIME"},
+		},
+		{
+			"alarm without a trigger",
+			vcalendar("BEGIN:VTODO", "SUMMARY:a", "BEGIN:VALARM", "ACTION:DISPLAY", "END:VALARM", "END:VTODO"),
+			data.Todo{Title: "a", Description: "a"},
+			map[string]string{"remind_at": "VALARM must have a TRIGGER"},
+		},
+		{
+			"relative trigger without a due date",
+			vcalendar("BEGIN:VTODO", "SUMMARY:a", "BEGIN:VALARM", "TRIGGER:-PT15M", "END:VALARM", "END:VTODO"),
+			data.Todo{Title: "a", Description: "a"},
+			map[string]string{"remind_at": "a relative TRIGGER needs a DUE or DTSTART"},
+		},
+		{
+			"bare VTODO",
+			[]byte("BEGIN:VTODO\r\nSUMMARY:a\r\nEND:VTODO"),
+			data.Todo{Title: "a", Description: "a"},
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := parseICSImport(tt.content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rows) != 1 {
+				t.Fatalf("got %d rows, want 1", len(rows))
+			}
+			got := rows[0].Todo
+			if got.Title != tt.want.Title || got.Description != tt.want.Description || got.Project != tt.want.Project ||
+				got.Completed != tt.want.Completed || got.Recurrence != tt.want.Recurrence {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if len(rows[0].Errors) != len(tt.errors) {
+				t.Errorf("got errors %v, want %v", rows[0].Errors, tt.errors)
+			}
+			for field, message := range tt.errors {
+				if rows[0].Errors[field] != message {
+					t.Errorf("got %s error %q, want %q", field, rows[0].Errors[field], message)
+				}
+			}
+		})
+	}
+
+	// the reminders of the rows above
+	rows, _ := parseICSImport(tests[1].content)
+	if rows[0].Todo.DueAt == nil || !rows[0].Todo.DueAt.Equal(due) || !rows[0].Todo.RemindAt.Equal(due.Add(-15*time.Minute)) {
+		t.Errorf("got due %v and reminder %v", rows[0].Todo.DueAt, rows[0].Todo.RemindAt)
+	}
+	rows, _ = parseICSImport(tests[2].content)
+	if !rows[0].Todo.RemindAt.Equal(due.Add(-23 * time.Hour)) {
+		t.Errorf("got reminder %v, want an hour after the start", rows[0].Todo.RemindAt)
+	}
+	rows, _ = parseICSImport(tests[3].content)
+	if !rows[0].Todo.RemindAt.Equal(due.Add(-15 * time.Minute)) {
+		t.Errorf("got reminder %v, want 15 minutes before the due date", rows[0].Todo.RemindAt)
+	}
+}
+
+func TestParseICSImportFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []byte
+		rows    int
+		err     bool
+	}{
+		{"empty", []byte(""), 0, true},
+		{"not a calendar", []byte("title,completed\nBuy milk,false"), 0, true},
+		{"no todos", vcalendar("BEGIN:VEVENT", "SUMMARY:Meeting", "END:VEVENT"), 0, false},
+		{"several todos", vcalendar("BEGIN:VTODO", "SUMMARY:a", "END:VTODO", "BEGIN:VEVENT", "END:VEVENT", "BEGIN:VTODO", "SUMMARY:b", "END:VTODO"), 2, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := parseICSImport(tt.content)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v", err)
+			}
+			if len(rows) != tt.rows {
+				t.Errorf("got %d rows, want %d", len(rows), tt.rows)
+			}
+		})
+	}
+}
+
+func TestWriteVTODORoundTrip(t *testing.T) {
+	due := time.Date(2026, 10, 20, 9, 0, 0, 0, time.UTC)
+	remindAt := due.Add(-time.Hour)
+	todo := &data.Todo{
+		ID:          7,
+		Title:       "Write the report; then send it, " + strings.Repeat("long ", 20),
+		Description: "Two\nlines",
+		Project:     "Work, home",
+		Completed:   true,
+		DueAt:       &due,
+		RemindAt:    &remindAt,
+		Recurrence:  "FREQ=WEEKLY;BYDAY=MO",
+		Version:     3,
+		UpdatedAt:   due,
+	}
+
+	var buf bytes.Buffer
+	cal := ical.NewWriter(&buf)
+	cal.Begin("VCALENDAR")
+	writeVTODO(cal, todo)
+	cal.End("VCALENDAR")
+	if err := cal.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"UID:todo-7@todoapi.miguelavila.net\r\n", "SEQUENCE:3\r\n", "STATUS:COMPLETED\r\n"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("the VTODO does not contain %q", want)
+		}
+	}
+
+	rows, err := parseICSImport(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := rows[0].Todo
+	if got.Title != todo.Title || got.Description != todo.Description || got.Project != todo.Project || !got.Completed {
+		t.Errorf("got %+v back", got)
+	}
+	if got.Recurrence != todo.Recurrence || !got.DueAt.Equal(due) || !got.RemindAt.Equal(remindAt) {
+		t.Errorf("got recurrence %q, due %v and reminder %v back", got.Recurrence, got.DueAt, got.RemindAt)
+	}
+}
@@ -0,0 +1,225 @@
+// Filename: cmd/api/compress.go
+
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressMinSize is the smallest body worth compressing, smaller bodies can
+// grow once the gzip header and trailer are added
+const compressMinSize = 1024
+
+// incompressibleTypes are content types that are already compressed, or event
+// streams that must reach the client as soon as they are flushed
+var incompressibleTypes = []string{
+	"image/", "audio/", "video/", "font/woff",
+	"application/gzip", "application/x-gzip", "application/zip", "application/zstd",
+	"text/event-stream",
+}
+
+// compress() compresses response bodies with gzip or deflate when the client
+// accepts them. Small bodies, already compressed types and responses that set
+// their own Content-Encoding are sent as they are
+func (app *application) compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// caches must keep the compressed and uncompressed responses apart
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Values("Accept-Encoding"))
+		if encoding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// not deferred, a handler that panics to abort its response must not
+		// have the compressed body finished for it
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		next.ServeHTTP(cw, r)
+		cw.close()
+	})
+}
+
+// negotiateEncoding() returns the content coding the Accept-Encoding header
+// prefers out of gzip and deflate, or an empty string for neither
+func negotiateEncoding(header []string) string {
+	qualities := map[string]float64{}
+	for _, value := range header {
+		for _, part := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			q := 1.0
+			if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				parsed, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					continue
+				}
+				q = parsed
+			}
+			qualities[strings.ToLower(strings.TrimSpace(name))] = q
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range []string{"gzip", "deflate"} {
+		q, ok := qualities[encoding]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// compressWriter holds back the status code and the start of the body until it
+// knows whether the response is worth compressing, which is once
+// compressMinSize bytes were written, the handler flushes or the handler returns
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	status   int
+	buf      []byte
+	decided  bool
+	hijacked bool
+	zw       interface {
+		io.WriteCloser
+		Flush() error
+	}
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.decided || cw.status != 0 {
+		return
+	}
+
+	// informational responses come before the final one
+	if status < 200 {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.status = status
+
+	// responses without a body go straight through
+	if status == http.StatusNoContent || status == http.StatusNotModified {
+		cw.decide()
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if cw.decided {
+		if cw.zw != nil {
+			return cw.zw.Write(b)
+		}
+		return cw.ResponseWriter.Write(b)
+	}
+
+	cw.buf = append(cw.buf, b...)
+	if len(cw.buf) >= compressMinSize {
+		err := cw.decide()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// decide() sends the status code, compressing the body when it is large enough
+// and of a compressible type, and writes out what was held back
+func (cw *compressWriter) decide() error {
+	cw.decided = true
+	h := cw.Header()
+
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	if len(cw.buf) >= compressMinSize && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		if cw.encoding == "gzip" {
+			cw.zw = gzip.NewWriter(cw.ResponseWriter)
+		} else {
+			cw.zw, _ = flate.NewWriter(cw.ResponseWriter, flate.DefaultCompression)
+		}
+	}
+
+	if cw.status != 0 {
+		cw.ResponseWriter.WriteHeader(cw.status)
+	}
+	if len(cw.buf) == 0 {
+		return nil
+	}
+
+	var err error
+	if cw.zw != nil {
+		_, err = cw.zw.Write(cw.buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(cw.buf)
+	}
+	cw.buf = nil
+	return err
+}
+
+// compressible() reports whether a content type is worth compressing
+func compressible(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// Flush() sends what was written so far, streaming responses are not held back
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide()
+	}
+	if cw.zw != nil {
+		cw.zw.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack() hands the connection over, e.g. for a WebSocket, nothing is
+// compressed after that
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer does not support hijacking")
+	}
+	cw.hijacked = true
+	return hijacker.Hijack()
+}
+
+// Unwrap() lets http.ResponseController reach the underlying writer
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// close() ends the response once the handler returns
+func (cw *compressWriter) close() {
+	if cw.hijacked {
+		return
+	}
+	if !cw.decided && (cw.status != 0 || len(cw.buf) > 0) {
+		cw.decide()
+	}
+	if cw.zw != nil {
+		cw.zw.Close()
+	}
+}
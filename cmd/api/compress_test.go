@@ -0,0 +1,202 @@
+// Filename: cmd/api/compress_test.go
+
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []string
+		want   string
+	}{
+		{"no header", nil, ""},
+		{"gzip", []string{"gzip"}, "gzip"},
+		{"deflate", []string{"deflate"}, "deflate"},
+		{"both prefers gzip", []string{"deflate, gzip"}, "gzip"},
+		{"quality", []string{"gzip;q=0.5, deflate"}, "deflate"},
+		{"gzip refused", []string{"gzip;q=0, deflate;q=0.1"}, "deflate"},
+		{"wildcard", []string{"*"}, "gzip"},
+		{"wildcard with gzip refused", []string{"gzip;q=0, *"}, "deflate"},
+		{"identity only", []string{"identity"}, ""},
+		{"unsupported", []string{"br, zstd"}, ""},
+		{"case and spaces", []string{" GZIP ; q=0.8 "}, "gzip"},
+		{"bad quality is ignored", []string{"gzip;q=x, deflate"}, "deflate"},
+		{"several headers", []string{"br", "deflate"}, "deflate"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := negotiateEncoding(tt.header); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// decodeBody() returns the body of a response, uncompressed
+func decodeBody(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+
+	var reader io.Reader = w.Body
+	switch w.Header().Get("Content-Encoding") {
+	case "gzip":
+		zr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = zr
+	case "deflate":
+		reader = flate.NewReader(w.Body)
+	}
+
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestCompress(t *testing.T) {
+	app := newTestApplication(t)
+	large := `{"todos": [` + strings.Repeat(`{"title": "a todo"},`, 100) + `{}]}`
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		contentType    string
+		presetEncoding string
+		status         int
+		body           string
+		wantEncoding   string
+	}{
+		{"gzip", "gzip", "application/json", "", http.StatusOK, large, "gzip"},
+		{"deflate", "deflate", "application/json", "", http.StatusOK, large, "deflate"},
+		{"not accepted", "", "application/json", "", http.StatusOK, large, ""},
+		{"small body", "gzip", "application/json", "", http.StatusOK, `{"status": "available"}`, ""},
+		{"already compressed type", "gzip", "image/png", "", http.StatusOK, large, ""},
+		{"event stream", "gzip", "text/event-stream", "", http.StatusOK, large, ""},
+		{"own encoding", "gzip", "application/json", "br", http.StatusOK, large, "br"},
+		{"error status", "gzip", "application/json", "", http.StatusUnprocessableEntity, large, "gzip"},
+		{"detected type", "gzip", "", "", http.StatusOK, strings.Repeat("plain text ", 200), "gzip"},
+		{"no content", "gzip", "", "", http.StatusNoContent, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.contentType != "" {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				if tt.presetEncoding != "" {
+					w.Header().Set("Content-Encoding", tt.presetEncoding)
+				}
+				w.Header().Set("Content-Length", "1")
+				w.WriteHeader(tt.status)
+				// written in pieces, the first ones under compressMinSize
+				for i := 0; i < len(tt.body); i += 100 {
+					end := i + 100
+					if end > len(tt.body) {
+						end = len(tt.body)
+					}
+					w.Write([]byte(tt.body[i:end]))
+				}
+			})
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/todos", nil)
+			if tt.acceptEncoding != "" {
+				r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+
+			app.compress(next).ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Errorf("got status %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("got Content-Encoding %q, want %q", got, tt.wantEncoding)
+			}
+			if !strings.Contains(w.Header().Get("Vary"), "Accept-Encoding") {
+				t.Errorf("got Vary %q, want Accept-Encoding in it", w.Header().Get("Vary"))
+			}
+			if tt.wantEncoding == "gzip" || tt.wantEncoding == "deflate" {
+				if w.Header().Get("Content-Length") != "" {
+					t.Errorf("got Content-Length %q on a compressed body", w.Header().Get("Content-Length"))
+				}
+				if got := decodeBody(t, w); got != tt.body {
+					t.Errorf("got body %q, want %q", got, tt.body)
+				}
+				return
+			}
+			if w.Body.String() != tt.body {
+				t.Errorf("got body %q, want %q", w.Body.String(), tt.body)
+			}
+		})
+	}
+}
+
+func TestCompressFlush(t *testing.T) {
+	app := newTestApplication(t)
+
+	// a small event flushed straight away is sent as it is written
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: 1\n\n"))
+		w.(http.Flusher).Flush()
+		if got := w.(*compressWriter).ResponseWriter.(*httptest.ResponseRecorder).Body.String(); got != "data: 1\n\n" {
+			t.Errorf("got %q sent before the handler returned", got)
+		}
+		w.Write([]byte("data: 2\n\n"))
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/todos/events", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+
+	app.compress(next).ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("got Content-Encoding %q on an event stream", w.Header().Get("Content-Encoding"))
+	}
+	if w.Body.String() != "data: 1\n\ndata: 2\n\n" {
+		t.Errorf("got body %q", w.Body.String())
+	}
+	if !w.Flushed {
+		t.Error("the flush did not reach the underlying writer")
+	}
+}
+
+func TestCompressPanicLeavesBodyUnfinished(t *testing.T) {
+	app := newTestApplication(t)
+	large := strings.Repeat("a", 2*compressMinSize)
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(large))
+		panic(http.ErrAbortHandler)
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/todos", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+
+	func() {
+		defer func() { recover() }()
+		app.compress(next).ServeHTTP(w, r)
+	}()
+
+	// the gzip trailer is missing, so the client sees a broken body
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(zr); err == nil {
+		t.Error("the aborted body was finished")
+	}
+}
@@ -0,0 +1,20 @@
+// Filename: cmd/api/debug.go
+
+package main
+
+import (
+	"net/http"
+)
+
+// debugQueriesHandler() shows how long the todo queries take and the most recent
+// slow ones, with their plans when -db-explain is set. It is only routed in dev
+func (app *application) debugQueriesHandler(w http.ResponseWriter, r *http.Request) {
+	data := envelope{
+		"queries":      app.models.Queries.Stats(),
+		"slow_queries": app.models.Queries.SlowQueries(),
+	}
+	err := app.writeResponse(w, r, http.StatusOK, data, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -3,19 +3,37 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+
+	"todoapi.miguelavila.net/internals/data"
 )
 
-// Log errors
+// Log errors, tagged with the id of the request
 func (app *application) logError(r *http.Request, err error) {
-	app.logger.Println(err)
+	app.logContext(r.Context(), "%v", err)
+}
+
+// logContext() logs a message tagged with the id of the request ctx belongs to
+func (app *application) logContext(ctx context.Context, format string, v ...interface{}) {
+	message := fmt.Sprintf(format, v...)
+	if id := requestIDFromContext(ctx); id != "" {
+		message = "request_id=" + id + " " + message
+	}
+	app.logger.Print(message)
 }
 
-// Send JSON-formatted error message
+// Send the error message in the format the client accepts, with the request id
+// to quote when reporting it
 func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
-	// create the json response
+	// create the response
 	env := envelope{"error": message}
-	err := app.writeJSON(w, status, env, nil)
+	if id := requestIDFromContext(r.Context()); id != "" {
+		env["request_id"] = id
+	}
+	err := app.writeResponse(w, r, status, env, nil)
 
 	if err != nil {
 		app.logError(r, err)
@@ -24,8 +42,19 @@ func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, st
 
 }
 
-// Server error message
+// Server error message, a query that was stopped because the client went away or
+// because it ran out of time is answered with 499 or 504 instead
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	switch contextError(err) {
+	case context.Canceled:
+		app.clientClosedRequestResponse(w, r)
+		return
+	case context.DeadlineExceeded:
+		app.logError(r, err)
+		app.gatewayTimeoutResponse(w, r)
+		return
+	}
+
 	//log the error
 	app.logError(r, err)
 	//prepare a message with error
@@ -56,3 +85,110 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 	message := "unable to update the record due to an edit conflict, please try again"
 	app.errorResponse(w, r, http.StatusConflict, message)
 }
+
+// Stale If-Match header sent by the client
+func (app *application) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	//prepare a message with error
+	message := "the resource has been modified since it was last fetched, please fetch it again"
+	app.errorResponse(w, r, http.StatusPreconditionFailed, message)
+}
+
+// Missing If-Match header on a conditional request
+func (app *application) preconditionRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	//prepare a message with error
+	message := "this request must be conditional, please provide an If-Match header"
+	app.errorResponse(w, r, http.StatusPreconditionRequired, message)
+}
+
+// Idempotency key reused while the first request is still being processed
+func (app *application) idempotencyInFlightResponse(w http.ResponseWriter, r *http.Request) {
+	//prepare a message with error
+	message := "a request with this Idempotency-Key is still being processed, please try again later"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+// Idempotency key reused with a different request
+func (app *application) idempotencyMismatchResponse(w http.ResponseWriter, r *http.Request) {
+	//prepare a message with error
+	message := "this Idempotency-Key has already been used with a different request"
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, message)
+}
+
+// Sync token from before the last purged tombstone
+func (app *application) syncTokenExpiredResponse(w http.ResponseWriter, r *http.Request) {
+	//prepare a message with error
+	message := "the sync token has expired, please pull again without a token"
+	app.errorResponse(w, r, http.StatusGone, message)
+}
+
+// Request body sent in a format the endpoint does not accept
+func (app *application) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request, supported string) {
+	//prepare a message with error
+	message := fmt.Sprintf("the Content-Type of the request body is not supported, use one of: %s", supported)
+	app.errorResponse(w, r, http.StatusUnsupportedMediaType, message)
+}
+
+// notAcceptableMessage tells the client which formats it can accept
+const notAcceptableMessage = "the requested media type is not supported, accept application/json, application/xml or application/msgpack"
+
+// The client accepts none of the formats responses are sent in
+func (app *application) notAcceptableResponse(w http.ResponseWriter, r *http.Request) {
+	app.errorResponse(w, r, http.StatusNotAcceptable, notAcceptableMessage)
+}
+
+// No connection slots left for a long lived connection
+func (app *application) tooManyConnectionsResponse(w http.ResponseWriter, r *http.Request) {
+	//prepare a message with error
+	message := "the server has too many open connections, please try again later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+// Missing, unknown or revoked calendar feed token
+func (app *application) invalidFeedTokenResponse(w http.ResponseWriter, r *http.Request) {
+	//prepare a message with error
+	message := "invalid or missing feed token, create one with POST /v1/feeds"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+// Missing or wrong admin key for managing feed tokens
+func (app *application) invalidAdminKeyResponse(w http.ResponseWriter, r *http.Request) {
+	//prepare a message with error
+	message := "invalid or missing admin key, send it as a bearer token in the Authorization header"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+// Feed tokens cannot be managed without an admin key outside of dev
+func (app *application) feedsAdminDisabledResponse(w http.ResponseWriter, r *http.Request) {
+	//prepare a message with error
+	message := "feed tokens can only be managed once the server has a feeds admin key"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// contextError() returns context.Canceled when err comes from a query stopped
+// because the client closed the request, context.DeadlineExceeded when the query
+// ran out of time and nil for any other error. Only err is looked at, an
+// unrelated error that happens to come after the client left is still one
+func contextError(err error) error {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return context.Canceled
+	case errors.Is(err, context.DeadlineExceeded) || data.IsQueryCanceled(err):
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// The client closed the request before the response was ready, nginx's 499 is
+// used as there is no standard status for it and the client will not see it
+func (app *application) clientClosedRequestResponse(w http.ResponseWriter, r *http.Request) {
+	//prepare a message with error
+	message := "the client closed the request"
+	app.errorResponse(w, r, 499, message)
+}
+
+// A query took longer than the query timeout
+func (app *application) gatewayTimeoutResponse(w http.ResponseWriter, r *http.Request) {
+	//prepare a message with error
+	message := "the database did not answer in time, please try again"
+	app.errorResponse(w, r, http.StatusGatewayTimeout, message)
+}
@@ -0,0 +1,70 @@
+// Filename: cmd/api/errors_test.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestContextError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"canceled", context.Canceled, context.Canceled},
+		{"wrapped canceled", fmt.Errorf("listing todos: %w", context.Canceled), context.Canceled},
+		{"deadline", context.DeadlineExceeded, context.DeadlineExceeded},
+		{"query canceled", &pq.Error{Code: "57014"}, context.DeadlineExceeded},
+		{"other query error", &pq.Error{Code: "23505"}, nil},
+		{"other error", errors.New("disk full"), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := contextError(tt.err); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerErrorResponse(t *testing.T) {
+	app := newTestApplication(t)
+
+	tests := []struct {
+		name     string
+		err      error
+		canceled bool
+		status   int
+	}{
+		{"client closed the request", context.Canceled, true, 499},
+		{"unrelated error after the client left", errors.New("disk full"), true, http.StatusInternalServerError},
+		{"unrelated error", errors.New("disk full"), false, http.StatusInternalServerError},
+		{"query timeout", context.DeadlineExceeded, false, http.StatusGatewayTimeout},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/todos", nil)
+			if tt.canceled {
+				ctx, cancel := context.WithCancel(r.Context())
+				cancel()
+				r = r.WithContext(ctx)
+			}
+			w := httptest.NewRecorder()
+
+			app.serverErrorResponse(w, r, tt.err)
+			if w.Code != tt.status {
+				t.Errorf("got status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+// Filename: cmd/api/events.go
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"todoapi.miguelavila.net/internals/events"
+)
+
+// todoEventsHandler for GET /v1/todos/events endpoint. It streams todo changes as
+// Server-Sent Events. A client that reconnects with the Last-Event-ID header (or
+// the last_event_id query parameter) is sent the events it missed first, and a
+// reset event when they are no longer available
+func (app *application) todoEventsHandler(w http.ResponseWriter, r *http.Request) {
+	lastID := int64(0)
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	if lastEventID != "" {
+		id, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || id < 0 {
+			app.badResquestReponse(w, r, fmt.Errorf("invalid Last-Event-ID %q", lastEventID))
+			return
+		}
+		lastID = id
+	}
+
+	// the stream outlives the server's write timeout
+	rc := http.NewResponseController(w)
+	err := rc.SetWriteDeadline(time.Time{})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	sub, backlog, complete := app.events.Subscribe(lastID)
+	defer app.events.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// tell the client how long to wait before reconnecting
+	fmt.Fprintf(w, "retry: %d\n\n", app.config.events.retry.Milliseconds())
+
+	if !complete {
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, event := range backlog {
+		err = writeEvent(w, event)
+		if err != nil {
+			return
+		}
+	}
+	if rc.Flush() != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(app.config.events.heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-sub.C:
+			// the subscription was dropped, the client will resume from the last id
+			if !ok {
+				return
+			}
+			err = writeEvent(w, event)
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		}
+
+		if err != nil || rc.Flush() != nil {
+			return
+		}
+	}
+}
+
+// writeEvent() writes an event in the text/event-stream format
+func writeEvent(w http.ResponseWriter, event events.Event) error {
+	js, err := json.Marshal(event.Data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, js)
+	return err
+}
@@ -0,0 +1,191 @@
+// Filename: cmd/api/export.go
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"todoapi.miguelavila.net/internals/data"
+	"todoapi.miguelavila.net/internals/validator"
+)
+
+// todoCSVHeader are the columns of a CSV export, in order
+var todoCSVHeader = []string{"id", "title", "description", "project", "completed", "due_at", "remind_at", "recurrence", "occurrence", "version", "updated_at"}
+
+// exportTodosHandler for GET /v1/todos/export endpoint. It streams every todo
+// matching the same filters and sort as GET /v1/todos as CSV or newline delimited
+// JSON, flushing as it goes
+func (app *application) exportTodosHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Title       string
+		Description string
+		Project     string
+		Completed   bool
+		Format      string
+		data.Filters
+	}
+
+	// initialize a validator
+	v := validator.New()
+
+	// get the URL values in a map
+	qs := r.URL.Query()
+
+	// use the helper method to extract the values
+	input.Title = app.readString(qs, "title", "")
+	input.Description = app.readString(qs, "description", "")
+	input.Project = app.readString(qs, "project", "")
+	input.Completed = app.readBool(qs, "completed", false, v)
+	input.Format = app.readString(qs, "format", "csv")
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortList = todoSortList
+
+	v.Check(validator.In(input.Format, "csv", "ndjson"), "format", "must be csv or ndjson")
+	v.Check(validator.In(input.Filters.Sort, input.Filters.SortList...), "sort", "invalid sort value")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// a large export outlives the server's write timeout
+	rc := http.NewResponseController(w)
+	err := rc.SetWriteDeadline(time.Time{})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	filename := fmt.Sprintf("todos-%s.%s", time.Now().UTC().Format("20060102-150405"), input.Format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Cache-Control", "no-store")
+
+	// rows are buffered and flushed in batches, the counter tells us whether
+	// anything has reached the client yet
+	out := &countingWriter{w: w}
+	buf := bufio.NewWriterSize(out, 64*1024)
+
+	var write func(*data.Todo) error
+	switch input.Format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		cw := csv.NewWriter(buf)
+		cw.Write(todoCSVHeader)
+		cw.Flush()
+		write = func(todo *data.Todo) error {
+			cw.Write(todoCSVRecord(todo))
+			// the csv writer buffers too, hand the row over to buf
+			cw.Flush()
+			return cw.Error()
+		}
+	case "ndjson":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(buf)
+		write = func(todo *data.Todo) error {
+			return enc.Encode(todo)
+		}
+	}
+
+	rows := 0
+	err = app.models.Todos.Export(r.Context(), input.Title, input.Description, input.Project, input.Completed, input.Filters, func(todo *data.Todo) error {
+		err := write(todo)
+		if err != nil {
+			return err
+		}
+
+		// send what we have every so often so the client sees progress
+		rows++
+		if rows%500 == 0 {
+			err = buf.Flush()
+			if err != nil {
+				return err
+			}
+			return rc.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		// nothing has been sent yet, so there is still a status code to choose
+		if out.n == 0 {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		// abort the response so the client does not take a partial export as complete
+		app.logError(r, err)
+		panic(http.ErrAbortHandler)
+	}
+
+	buf.Flush()
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// todoCSVRecord() formats a todo as a row of a CSV export
+func todoCSVRecord(todo *data.Todo) []string {
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+
+	return []string{
+		strconv.FormatInt(todo.ID, 10),
+		csvText(todo.Title),
+		csvText(todo.Description),
+		csvText(todo.Project),
+		strconv.FormatBool(todo.Completed),
+		formatTime(todo.DueAt),
+		formatTime(todo.RemindAt),
+		csvText(todo.Recurrence),
+		strconv.FormatInt(int64(todo.Occurrence), 10),
+		strconv.FormatInt(int64(todo.Version), 10),
+		todo.UpdatedAt.Format(time.RFC3339),
+	}
+}
+
+// csvFormulaPrefixes start a cell that a spreadsheet would run as a formula
+const csvFormulaPrefixes = "=+-@\t\r"
+
+// csvText() makes text safe to open in a spreadsheet, a cell that would be read
+// as a formula is prefixed with a quote so that it is shown as text. Text already
+// starting with quotes before such a character gets one more, so that
+// csvUntext() can always take it off again
+func csvText(value string) string {
+	if csvFormula(value) {
+		return "'" + value
+	}
+	return value
+}
+
+// csvUntext() undoes csvText(), so that an export imports as it was
+func csvUntext(value string) string {
+	if strings.HasPrefix(value, "'") && csvFormula(value[1:]) {
+		return value[1:]
+	}
+	return value
+}
+
+// csvFormula() reports whether text, after any leading quotes, starts like a formula
+func csvFormula(value string) bool {
+	value = strings.TrimLeft(value, "'")
+	return value != "" && strings.IndexByte(csvFormulaPrefixes, value[0]) >= 0
+}
@@ -0,0 +1,49 @@
+// Filename: cmd/api/export_test.go
+
+package main
+
+import (
+	"testing"
+
+	"todoapi.miguelavila.net/internals/data"
+)
+
+func TestCSVText(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"buy milk", "buy milk"},
+		{"", ""},
+		{"=HYPERLINK(\"http://example.com\")", "'=HYPERLINK(\"http://example.com\")"},
+		{"+1 555 0100", "'+1 555 0100"},
+		{"-2 days", "'-2 days"},
+		{"@home", "'@home"},
+		{"\tindented", "'\tindented"},
+		{"\rreturn", "'\rreturn"},
+		{"a=b", "a=b"},
+		{"'quoted", "'quoted"},
+		{"'=already quoted", "''=already quoted"},
+	}
+
+	for _, tt := range tests {
+		if got := csvText(tt.value); got != tt.want {
+			t.Errorf("csvText(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+		// an export imports as it was
+		if got := csvUntext(csvText(tt.value)); got != tt.value {
+			t.Errorf("csvUntext(csvText(%q)) = %q", tt.value, got)
+		}
+	}
+}
+
+func TestTodoCSVRecordEscapesText(t *testing.T) {
+	todo := &data.Todo{ID: 1, Title: "=1+1", Description: "@sum", Project: "-x", Version: 1}
+	record := todoCSVRecord(todo)
+
+	for i, want := range map[int]string{1: "'=1+1", 2: "'@sum", 3: "'-x"} {
+		if record[i] != want {
+			t.Errorf("%s = %q, want %q", todoCSVHeader[i], record[i], want)
+		}
+	}
+}
@@ -0,0 +1,514 @@
+// Filename: cmd/api/graphql.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+
+	"todoapi.miguelavila.net/internals/data"
+	"todoapi.miguelavila.net/internals/validator"
+)
+
+// graphQLHandler for POST /v1/graphql endpoint. Queries deeper or more complex
+// than the configured limits are rejected before they run
+func (app *application) graphQLHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Query         string                 `json:"query"`
+		OperationName string                 `json:"operationName"`
+		Variables     map[string]interface{} `json:"variables"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badResquestReponse(w, r, err)
+		return
+	}
+
+	// Initialize a new instance of validator
+	v := validator.New()
+
+	v.Check(input.Query != "", "query", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// syntax errors are left for graphql.Do() to report
+	doc, err := parser.Parse(parser.ParseParams{Source: input.Query})
+	if err == nil {
+		depth, complexity, err := measureQuery(doc, input.Variables)
+		switch {
+		case err != nil:
+			app.writeGraphQLErrors(w, r, err.Error(), "GRAPHQL_VALIDATION_FAILED")
+			return
+		case depth > app.config.graphql.maxDepth:
+			app.writeGraphQLErrors(w, r, fmt.Sprintf("query depth %d exceeds the limit of %d", depth, app.config.graphql.maxDepth), "QUERY_TOO_DEEP")
+			return
+		case complexity > app.config.graphql.maxComplexity:
+			app.writeGraphQLErrors(w, r, fmt.Sprintf("query complexity %d exceeds the limit of %d", complexity, app.config.graphql.maxComplexity), "QUERY_TOO_COMPLEX")
+			return
+		}
+	}
+
+	result := graphql.Do(graphql.Params{
+		Schema:         app.graphQLSchema(),
+		RequestString:  input.Query,
+		OperationName:  input.OperationName,
+		VariableValues: input.Variables,
+		Context:        r.Context(),
+	})
+
+	env := envelope{"data": result.Data}
+	if len(result.Errors) > 0 {
+		env["errors"] = result.Errors
+	}
+	err = app.writeResponse(w, r, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// writeGraphQLErrors() sends a request error in the GraphQL response format
+func (app *application) writeGraphQLErrors(w http.ResponseWriter, r *http.Request, message string, code string) {
+	env := envelope{"errors": []envelope{{"message": message, "extensions": envelope{"code": code}}}}
+	err := app.writeResponse(w, r, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// graphQLError is an error returned by a resolver, the code and validation
+// errors are sent in the extensions of the GraphQL error
+type graphQLError struct {
+	message string
+	code    string
+	errors  map[string]string
+}
+
+func (e *graphQLError) Error() string {
+	return e.message
+}
+
+func (e *graphQLError) Extensions() map[string]interface{} {
+	extensions := map[string]interface{}{"code": e.code}
+	if len(e.errors) > 0 {
+		extensions["errors"] = e.errors
+	}
+	return extensions
+}
+
+// graphQLResultError() converts a failed batch result to the error of the
+// equivalent GraphQL mutation
+func graphQLResultError(result batchResult) error {
+	switch result.Status {
+	case http.StatusNotFound:
+		return &graphQLError{message: "the requested resource could not be found", code: "NOT_FOUND"}
+	case http.StatusConflict:
+		return &graphQLError{message: "unable to update the record due to an edit conflict, please try again", code: "EDIT_CONFLICT", errors: result.Errors}
+	default:
+		return &graphQLError{message: "failed validation", code: "FAILED_VALIDATION", errors: result.Errors}
+	}
+}
+
+// graphQLSchema() returns the schema, it is built on first use
+func (app *application) graphQLSchema() graphql.Schema {
+	app.graphqlOnce.Do(func() {
+		schema, err := app.newGraphQLSchema()
+		if err != nil {
+			// the schema is static, an error is a programming mistake
+			panic(err)
+		}
+		app.graphql = schema
+	})
+	return app.graphql
+}
+
+// newGraphQLSchema() builds the schema. Fields resolve to the data.Todo and
+// data.Metadata fields of the same name, the mutations go through
+// runBatchOperation() so they validate and check versions as the REST endpoints do
+func (app *application) newGraphQLSchema() (graphql.Schema, error) {
+	todoType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Todo",
+		Fields: graphql.Fields{
+			"id":          &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+			"title":       &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"description": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"project":     &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"completed":   &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"dueAt":       &graphql.Field{Type: graphql.DateTime},
+			"remindAt":    &graphql.Field{Type: graphql.DateTime},
+			"recurrence":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"occurrence":  &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"version":     &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"updatedAt":   &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+		},
+	})
+
+	metadataType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Metadata",
+		Fields: graphql.Fields{
+			"currentPage":  &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"pageSize":     &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"firstPage":    &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"lastPage":     &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"totalRecords": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		},
+	})
+
+	todoListType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "TodoList",
+		Fields: graphql.Fields{
+			"todos":    &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(todoType)))},
+			"metadata": &graphql.Field{Type: graphql.NewNonNull(metadataType)},
+		},
+	})
+
+	filterType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "TodoFilter",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"title":       &graphql.InputObjectFieldConfig{Type: graphql.String, Description: "full text search on the title"},
+			"description": &graphql.InputObjectFieldConfig{Type: graphql.String, Description: "full text search on the description"},
+			"project":     &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"completed":   &graphql.InputObjectFieldConfig{Type: graphql.Boolean},
+		},
+	})
+
+	todoInputType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "TodoInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"title":       &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"description": &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"project":     &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"completed":   &graphql.InputObjectFieldConfig{Type: graphql.Boolean},
+			"dueAt":       &graphql.InputObjectFieldConfig{Type: graphql.DateTime},
+			"remindAt":    &graphql.InputObjectFieldConfig{Type: graphql.DateTime},
+			"recurrence":  &graphql.InputObjectFieldConfig{Type: graphql.String},
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"todo": &graphql.Field{
+				Type: todoType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: app.resolveTodo,
+			},
+			"todos": &graphql.Field{
+				Type: graphql.NewNonNull(todoListType),
+				Args: graphql.FieldConfigArgument{
+					"filter":   &graphql.ArgumentConfig{Type: filterType},
+					"sort":     &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: "id"},
+					"page":     &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 1},
+					"pageSize": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 10},
+				},
+				Resolve: app.resolveTodos,
+			},
+		},
+	})
+
+	versionArg := &graphql.ArgumentConfig{Type: graphql.Int, Description: "fail with EDIT_CONFLICT unless the todo is at this version"}
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createTodo": &graphql.Field{
+				Type: graphql.NewNonNull(todoType),
+				Args: graphql.FieldConfigArgument{
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(todoInputType)},
+				},
+				Resolve: app.resolveTodoMutation("create"),
+			},
+			"updateTodo": &graphql.Field{
+				Type: graphql.NewNonNull(todoType),
+				Args: graphql.FieldConfigArgument{
+					"id":      &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+					"version": versionArg,
+					"input":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(todoInputType)},
+				},
+				Resolve: app.resolveTodoMutation("update"),
+			},
+			"deleteTodo": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.ID),
+				Args: graphql.FieldConfigArgument{
+					"id":      &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+					"version": versionArg,
+				},
+				Resolve: app.resolveTodoMutation("delete"),
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query, Mutation: mutation})
+}
+
+// graphQLID() parses an ID argument
+func graphQLID(args map[string]interface{}) (int64, error) {
+	text, _ := args["id"].(string)
+	id, err := strconv.ParseInt(text, 10, 64)
+	if err != nil || id < 1 {
+		return 0, &graphQLError{message: "the requested resource could not be found", code: "NOT_FOUND"}
+	}
+	return id, nil
+}
+
+// resolveTodo() resolves todo(id)
+func (app *application) resolveTodo(p graphql.ResolveParams) (interface{}, error) {
+	id, err := graphQLID(p.Args)
+	if err != nil {
+		return nil, nil
+	}
+
+	todo, err := app.models.Todos.GetContext(p.Context, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, nil
+		default:
+			return nil, app.graphQLServerError(p.Context, err)
+		}
+	}
+	return todo, nil
+}
+
+// resolveTodos() resolves todos(filter, sort, page, pageSize) with the same
+// filters and validation as GET /v1/todos
+func (app *application) resolveTodos(p graphql.ResolveParams) (interface{}, error) {
+	filter, _ := p.Args["filter"].(map[string]interface{})
+	title, _ := filter["title"].(string)
+	description, _ := filter["description"].(string)
+	project, _ := filter["project"].(string)
+	completed, _ := filter["completed"].(bool)
+
+	filters := data.Filters{SortList: todoSortList}
+	filters.Sort, _ = p.Args["sort"].(string)
+	filters.Page, _ = p.Args["page"].(int)
+	filters.PageSize, _ = p.Args["pageSize"].(int)
+
+	// initialize a validator
+	v := validator.New()
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		return nil, &graphQLError{message: "failed validation", code: "FAILED_VALIDATION", errors: v.Errors}
+	}
+
+	todos, metadata, err := app.models.Todos.GetAllContext(p.Context, title, description, project, completed, filters)
+	if err != nil {
+		return nil, app.graphQLServerError(p.Context, err)
+	}
+	return map[string]interface{}{"todos": todos, "metadata": metadata}, nil
+}
+
+// resolveTodoMutation() resolves createTodo, updateTodo and deleteTodo as the
+// equivalent batch operation, each mutation in its own transaction
+func (app *application) resolveTodoMutation(opName string) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		op := batchOperation{Op: opName}
+
+		if opName != "create" {
+			id, err := graphQLID(p.Args)
+			if err != nil {
+				return nil, err
+			}
+			op.ID = id
+		}
+		if version, ok := p.Args["version"].(int); ok {
+			v := int32(version)
+			op.Version = &v
+		}
+		if input, ok := p.Args["input"].(map[string]interface{}); ok {
+			op.Todo = graphQLTodoChanges(input)
+		}
+
+		var result batchResult
+		err := app.writeTodos(p.Context, func(tw *todoWriter) error {
+			var err error
+			result, err = app.runBatchOperation(tw, 0, op)
+			return err
+		})
+		if err != nil {
+			return nil, app.graphQLServerError(p.Context, err)
+		}
+		if result.Status >= 400 {
+			return nil, graphQLResultError(result)
+		}
+
+		if opName == "delete" {
+			return strconv.FormatInt(op.ID, 10), nil
+		}
+
+		todo, err := app.models.Todos.GetContext(p.Context, result.ID)
+		if err != nil {
+			return nil, app.graphQLServerError(p.Context, err)
+		}
+		return todo, nil
+	}
+}
+
+// graphQLTodoChanges() converts a TodoInput argument to the changes of a batch
+// operation, fields that were not given are left nil
+func graphQLTodoChanges(input map[string]interface{}) todoChanges {
+	var changes todoChanges
+	if value, ok := input["title"].(string); ok {
+		changes.Title = &value
+	}
+	if value, ok := input["description"].(string); ok {
+		changes.Description = &value
+	}
+	if value, ok := input["project"].(string); ok {
+		changes.Project = &value
+	}
+	if value, ok := input["completed"].(bool); ok {
+		changes.Completed = &value
+	}
+	if value, ok := input["dueAt"].(time.Time); ok {
+		changes.DueAt = &value
+	}
+	if value, ok := input["remindAt"].(time.Time); ok {
+		changes.RemindAt = &value
+	}
+	if value, ok := input["recurrence"].(string); ok {
+		changes.Recurrence = &value
+	}
+	return changes
+}
+
+// graphQLServerError() logs an unexpected error and hides its details from the
+// client, a query that ran out of time is reported as such
+func (app *application) graphQLServerError(ctx context.Context, err error) error {
+	switch contextError(err) {
+	case context.Canceled:
+		return &graphQLError{message: "the client closed the request", code: "CLIENT_CLOSED_REQUEST"}
+	case context.DeadlineExceeded:
+		app.logContext(ctx, "%v", err)
+		return &graphQLError{message: "the database did not answer in time, please try again", code: "TIMEOUT"}
+	}
+
+	app.logContext(ctx, "%v", err)
+	return &graphQLError{message: "the server encountered a problem and could not process the request", code: "INTERNAL_SERVER_ERROR"}
+}
+
+// measureQuery() returns the depth and complexity of the deepest and most
+// complex operation in a query. Every field costs one, and the fields selected
+// for the todos of a page cost once per todo the page may hold. A
+// fragment that spreads itself is an error, graphql.Do() would recurse forever
+func measureQuery(doc *ast.Document, variables map[string]interface{}) (int, int, error) {
+	fragments := map[string]*ast.FragmentDefinition{}
+	for _, def := range doc.Definitions {
+		if fragment, ok := def.(*ast.FragmentDefinition); ok {
+			fragments[fragment.Name.Value] = fragment
+		}
+	}
+
+	// unused fragments are checked for cycles too
+	for name, fragment := range fragments {
+		_, _, err := measureSelections(fragment.SelectionSet, fragments, variables, 0, map[string]bool{name: true})
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	maxDepth, maxComplexity := 0, 0
+	for _, def := range doc.Definitions {
+		if op, ok := def.(*ast.OperationDefinition); ok {
+			depth, complexity, err := measureSelections(op.SelectionSet, fragments, variables, 0, map[string]bool{})
+			if err != nil {
+				return 0, 0, err
+			}
+			if depth > maxDepth {
+				maxDepth = depth
+			}
+			if complexity > maxComplexity {
+				maxComplexity = complexity
+			}
+		}
+	}
+	return maxDepth, maxComplexity, nil
+}
+
+// measureSelections() measures a selection set, expanding holds the fragments
+// being expanded to find cycles. pageSize is set while measuring the fields of a
+// TodoList, the size of the page its todos field holds
+func measureSelections(set *ast.SelectionSet, fragments map[string]*ast.FragmentDefinition, variables map[string]interface{}, pageSize int, expanding map[string]bool) (int, int, error) {
+	if set == nil {
+		return 0, 0, nil
+	}
+
+	depth, complexity := 0, 0
+	for _, selection := range set.Selections {
+		var d, c int
+		var err error
+		switch s := selection.(type) {
+		case *ast.Field:
+			switch {
+			// the todos of a page, TodoList.todos
+			case s.Name.Value == "todos" && pageSize > 0:
+				d, c, err = measureSelections(s.SelectionSet, fragments, variables, 0, expanding)
+				c *= pageSize
+			// the page itself, Query.todos
+			case s.Name.Value == "todos":
+				d, c, err = measureSelections(s.SelectionSet, fragments, variables, pageSizeArgument(s, variables), expanding)
+			default:
+				d, c, err = measureSelections(s.SelectionSet, fragments, variables, 0, expanding)
+			}
+			d, c = d+1, c+1
+		case *ast.InlineFragment:
+			d, c, err = measureSelections(s.SelectionSet, fragments, variables, pageSize, expanding)
+		case *ast.FragmentSpread:
+			fragment := fragments[s.Name.Value]
+			if fragment == nil {
+				continue
+			}
+			if expanding[s.Name.Value] {
+				return 0, 0, fmt.Errorf("cannot spread fragment %q within itself", s.Name.Value)
+			}
+			expanding[s.Name.Value] = true
+			d, c, err = measureSelections(fragment.SelectionSet, fragments, variables, pageSize, expanding)
+			delete(expanding, s.Name.Value)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		if d > depth {
+			depth = d
+		}
+		complexity += c
+	}
+	return depth, complexity, nil
+}
+
+// pageSizeArgument() returns the pageSize argument of a todos field, given
+// inline or as a variable, or the default page size
+func pageSizeArgument(field *ast.Field, variables map[string]interface{}) int {
+	for _, arg := range field.Arguments {
+		if arg.Name.Value != "pageSize" {
+			continue
+		}
+		switch value := arg.Value.(type) {
+		case *ast.IntValue:
+			n, err := strconv.Atoi(value.Value)
+			if err == nil && n > 0 {
+				return n
+			}
+		case *ast.Variable:
+			switch n := variables[value.Name.Value].(type) {
+			case float64:
+				if n > 0 {
+					return int(n)
+				}
+			}
+		}
+	}
+	return 10
+}
@@ -0,0 +1,134 @@
+// Filename: cmd/api/graphql_test.go
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+func TestMeasureQuery(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		variables  map[string]interface{}
+		depth      int
+		complexity int
+	}{
+		{"single todo", `{ todo(id: 1) { id title } }`, nil, 2, 3},
+		{"default page", `{ todos { todos { id } } }`, nil, 3, 12},
+		{"page size", `{ todos(pageSize: 100) { todos { id title } metadata { totalRecords } } }`, nil, 3, 204},
+		{"page size variable", `query($n: Int) { todos(pageSize: $n) { todos { id } } }`, map[string]interface{}{"n": float64(50)}, 3, 52},
+		{"missing variable", `query($n: Int) { todos(pageSize: $n) { todos { id } } }`, nil, 3, 12},
+		{"invalid page size", `{ todos(pageSize: 0) { todos { id } } }`, nil, 3, 12},
+		{"metadata only", `{ todos(pageSize: 100) { metadata { totalRecords lastPage } } }`, nil, 3, 4},
+		{"two pages", `{ a: todos(pageSize: 5) { todos { id } } b: todos(pageSize: 20) { todos { id } } }`, nil, 3, 29},
+		{"fragment", `{ todos(pageSize: 20) { ...page } } fragment page on TodoList { todos { ...fields } } fragment fields on Todo { id title }`, nil, 3, 42},
+		{"inline fragment", `{ todos(pageSize: 20) { ... on TodoList { todos { id } } } }`, nil, 3, 22},
+		{"unknown fragment", `{ todo(id: 1) { ...missing id } }`, nil, 2, 2},
+		{"mutation", `mutation { createTodo(input: {title: "a"}) { id version } }`, nil, 2, 3},
+		{"deepest operation", `query a { todo(id: 1) { id } } query b { todos { todos { id } } }`, nil, 3, 12},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := parser.Parse(parser.ParseParams{Source: tt.query})
+			if err != nil {
+				t.Fatal(err)
+			}
+			depth, complexity, err := measureQuery(doc, tt.variables)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if depth != tt.depth || complexity != tt.complexity {
+				t.Errorf("got depth %d and complexity %d, want %d and %d", depth, complexity, tt.depth, tt.complexity)
+			}
+		})
+	}
+}
+
+func TestMeasureQueryFragmentCycles(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		cycle string
+	}{
+		{"spreads itself", `{ todo(id: 1) { ...a } } fragment a on Todo { id ...a }`, "a"},
+		{"through another", `{ todo(id: 1) { ...a } } fragment a on Todo { ...b } fragment b on Todo { ...a }`, "a"},
+		{"in an inline fragment", `{ todo(id: 1) { ...a } } fragment a on Todo { ... on Todo { ...a } }`, "a"},
+		{"unused", `{ todo(id: 1) { id } } fragment a on Todo { ...a }`, "a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := parser.Parse(parser.ParseParams{Source: tt.query})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = measureQuery(doc, nil)
+			if err == nil || !strings.Contains(err.Error(), `"`+tt.cycle+`"`) {
+				t.Errorf("got %v, want the cycle through %q reported", err, tt.cycle)
+			}
+		})
+	}
+
+	// a fragment spread twice side by side is not a cycle
+	doc, err := parser.Parse(parser.ParseParams{Source: `{ a: todo(id: 1) { ...f } b: todo(id: 2) { ...f } } fragment f on Todo { id }`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, complexity, err := measureQuery(doc, nil); err != nil || complexity != 4 {
+		t.Errorf("got complexity %d and error %v, want 4 and none", complexity, err)
+	}
+}
+
+func TestGraphQLHandlerLimits(t *testing.T) {
+	tests := []struct {
+		name          string
+		query         string
+		maxDepth      int
+		maxComplexity int
+		code          string
+	}{
+		{"too deep", `{ todos { todos { id } } }`, 2, 1000, "QUERY_TOO_DEEP"},
+		{"too complex", `{ todos(pageSize: 100) { todos { id title } } }`, 8, 100, "QUERY_TOO_COMPLEX"},
+		{"fragment cycle", `{ todo(id: 1) { ...a } } fragment a on Todo { ...a }`, 8, 1000, "GRAPHQL_VALIDATION_FAILED"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.graphql.maxDepth = tt.maxDepth
+			app.config.graphql.maxComplexity = tt.maxComplexity
+
+			body, _ := json.Marshal(map[string]string{"query": tt.query})
+			r := httptest.NewRequest(http.MethodPost, "/v1/graphql", strings.NewReader(string(body)))
+			w := httptest.NewRecorder()
+
+			app.graphQLHandler(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+			}
+
+			var response struct {
+				Errors []struct {
+					Message    string `json:"message"`
+					Extensions struct {
+						Code string `json:"code"`
+					} `json:"extensions"`
+				} `json:"errors"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if len(response.Errors) != 1 || response.Errors[0].Extensions.Code != tt.code {
+				t.Errorf("got %s, want a %s error", w.Body.String(), tt.code)
+			}
+		})
+	}
+}
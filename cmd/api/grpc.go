@@ -0,0 +1,375 @@
+// Filename: cmd/api/grpc.go
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"todoapi.miguelavila.net/internals/data"
+	"todoapi.miguelavila.net/internals/events"
+	"todoapi.miguelavila.net/internals/todopb"
+	"todoapi.miguelavila.net/internals/validator"
+)
+
+// startGRPCServer() serves the TodoService on the gRPC port until the server
+// shuts down. The port is bound before returning so a port in use stops startup
+func (app *application) startGRPCServer() error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", app.config.grpc.port))
+	if err != nil {
+		return err
+	}
+
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(app.recoverUnaryPanic),
+		grpc.ChainStreamInterceptor(app.recoverStreamPanic),
+	)
+	todopb.RegisterTodoServiceServer(srv, &todoServer{app: app})
+
+	app.background(func() {
+		app.logger.Printf("Starting gRPC server at %s", listener.Addr())
+		err := srv.Serve(listener)
+		if err != nil {
+			app.logger.Printf("gRPC server: %v", err)
+		}
+	})
+
+	// the watch streams have ended by the time quit is closed, as the event hub
+	// is closed when the http server shuts down
+	app.background(func() {
+		<-app.quit
+		srv.GracefulStop()
+		app.logger.Printf("stopped gRPC server at %s", listener.Addr())
+	})
+
+	return nil
+}
+
+// recoverUnaryPanic() turns a panic in an RPC into an INTERNAL error instead of
+// crashing the server
+func (app *application) recoverUnaryPanic(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = app.grpcInternalError(fmt.Errorf("%s: %v", info.FullMethod, p))
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// recoverStreamPanic() turns a panic in a streaming RPC into an INTERNAL error
+func (app *application) recoverStreamPanic(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = app.grpcInternalError(fmt.Errorf("%s: %v", info.FullMethod, p))
+		}
+	}()
+	return handler(srv, ss)
+}
+
+// grpcInternalError() logs an unexpected error and hides its details from the
+// client. Queries stopped by the RPC being canceled or by the query timeout are
+// reported as CANCELLED and DEADLINE_EXCEEDED
+func (app *application) grpcInternalError(err error) error {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, "the client canceled the request")
+	case errors.Is(err, context.DeadlineExceeded) || data.IsQueryCanceled(err):
+		app.logger.Println(err)
+		return status.Error(codes.DeadlineExceeded, "the database did not answer in time, please try again")
+	}
+
+	app.logger.Println(err)
+	return status.Error(codes.Internal, "the server encountered a problem and could not process the request")
+}
+
+// grpcValidationError() reports failed validation as INVALID_ARGUMENT, the
+// fields are listed in order so the message is stable
+func grpcValidationError(errs map[string]string) error {
+	fields := make([]string, 0, len(errs))
+	for field, message := range errs {
+		fields = append(fields, field+": "+message)
+	}
+	sort.Strings(fields)
+	return status.Error(codes.InvalidArgument, "failed validation: "+strings.Join(fields, "; "))
+}
+
+// todoServer implements the TodoService with the same models and write path as
+// the http handlers, so changes made over gRPC are versioned, recorded in the
+// outbox and published to the event streams
+type todoServer struct {
+	todopb.UnimplementedTodoServiceServer
+	app *application
+}
+
+// CreateTodo() creates a todo
+func (s *todoServer) CreateTodo(ctx context.Context, req *todopb.CreateTodoRequest) (*todopb.Todo, error) {
+	op := batchOperation{Op: "create", Todo: todoChanges{
+		Title:       &req.Title,
+		Description: &req.Description,
+		Project:     &req.Project,
+		Completed:   &req.Completed,
+		DueAt:       protoTime(req.DueAt),
+		RemindAt:    protoTime(req.RemindAt),
+		Recurrence:  &req.Recurrence,
+	}}
+
+	result, err := s.write(ctx, op)
+	if err != nil {
+		return nil, err
+	}
+	// a replica may not have the todo yet
+	return s.get(data.WithPrimary(ctx), result.ID)
+}
+
+// GetTodo() returns a todo
+func (s *todoServer) GetTodo(ctx context.Context, req *todopb.GetTodoRequest) (*todopb.Todo, error) {
+	return s.get(ctx, req.Id)
+}
+
+// UpdateTodo() changes the fields that are set in the request
+func (s *todoServer) UpdateTodo(ctx context.Context, req *todopb.UpdateTodoRequest) (*todopb.Todo, error) {
+	op := batchOperation{Op: "update", ID: req.Id, Version: req.Version, Todo: todoChanges{
+		Title:       req.Title,
+		Description: req.Description,
+		Project:     req.Project,
+		Completed:   req.Completed,
+		DueAt:       protoTime(req.DueAt),
+		RemindAt:    protoTime(req.RemindAt),
+		Recurrence:  req.Recurrence,
+	}}
+
+	_, err := s.write(ctx, op)
+	if err != nil {
+		return nil, err
+	}
+	return s.get(data.WithPrimary(ctx), req.Id)
+}
+
+// DeleteTodo() deletes a todo
+func (s *todoServer) DeleteTodo(ctx context.Context, req *todopb.DeleteTodoRequest) (*todopb.DeleteTodoResponse, error) {
+	_, err := s.write(ctx, batchOperation{Op: "delete", ID: req.Id, Version: req.Version})
+	if err != nil {
+		return nil, err
+	}
+	return &todopb.DeleteTodoResponse{}, nil
+}
+
+// ListTodos() returns a page of todos, filtered and sorted as GET /v1/todos
+func (s *todoServer) ListTodos(ctx context.Context, req *todopb.ListTodosRequest) (*todopb.ListTodosResponse, error) {
+	page, err := decodePageToken(req.PageToken)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "failed validation: page_token: must be a token returned by ListTodos")
+	}
+
+	filters := data.Filters{Page: page, PageSize: int(req.PageSize), Sort: req.Sort, SortList: todoSortList}
+	if filters.PageSize == 0 {
+		filters.PageSize = 10
+	}
+	if filters.Sort == "" {
+		filters.Sort = "id"
+	}
+
+	// initialize a validator
+	v := validator.New()
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		return nil, grpcValidationError(v.Errors)
+	}
+
+	todos, metadata, err := s.app.models.Todos.GetAllContext(ctx, req.Title, req.Description, req.Project, req.Completed, filters)
+	if err != nil {
+		return nil, s.app.grpcInternalError(err)
+	}
+
+	resp := &todopb.ListTodosResponse{TotalSize: int32(metadata.TotalRecords)}
+	for _, todo := range todos {
+		resp.Todos = append(resp.Todos, todoToProto(todo))
+	}
+	if metadata.CurrentPage < metadata.LastPage {
+		resp.NextPageToken = encodePageToken(metadata.CurrentPage + 1)
+	}
+	return resp, nil
+}
+
+// WatchTodos() streams the todo changes selected by the request. When the events
+// after after_event_id have left the log it fails with OUT_OF_RANGE and the
+// client must fetch the todos again, when the stream is dropped it ends with
+// UNAVAILABLE and the client resumes from the last event it received
+func (s *todoServer) WatchTodos(req *todopb.WatchTodosRequest, stream todopb.TodoService_WatchTodosServer) error {
+	sub, missed, ok := s.app.events.Subscribe(req.AfterEventId)
+	if !ok {
+		return status.Error(codes.OutOfRange, "events after after_event_id are no longer available, fetch the todos again")
+	}
+	defer s.app.events.Unsubscribe(sub)
+
+	todoIDs := make(map[int64]bool)
+	for _, id := range req.TodoIds {
+		todoIDs[id] = true
+	}
+	projects := make(map[string]bool)
+	for _, project := range req.Projects {
+		projects[project] = true
+	}
+	wanted := func(event events.Event) bool {
+		// any of the todos of a bulk import may be selected
+		if len(todoIDs) == 0 && len(projects) == 0 || event.Type == data.EventTodosImported {
+			return true
+		}
+		return todoIDs[event.TodoID] || (event.Project != "" && projects[event.Project])
+	}
+
+	send := func(event events.Event) error {
+		if !wanted(event) {
+			return nil
+		}
+		msg, err := eventToProto(event)
+		if err != nil {
+			return s.app.grpcInternalError(err)
+		}
+		return stream.Send(msg)
+	}
+
+	for _, event := range missed {
+		err := send(event)
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event, ok := <-sub.C:
+			if !ok {
+				return status.Error(codes.Unavailable, "the stream was closed, resume after the last event received")
+			}
+			err := send(event)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// get() fetches a todo for a response
+func (s *todoServer) get(ctx context.Context, id int64) (*todopb.Todo, error) {
+	todo, err := s.app.models.Todos.GetContext(ctx, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.NotFound, "the requested resource could not be found")
+		default:
+			return nil, s.app.grpcInternalError(err)
+		}
+	}
+	return todoToProto(todo), nil
+}
+
+// write() runs an operation as the batch endpoint does and maps a failed result
+// to its status code
+func (s *todoServer) write(ctx context.Context, op batchOperation) (batchResult, error) {
+	var result batchResult
+	err := s.app.writeTodos(ctx, func(tw *todoWriter) error {
+		var err error
+		result, err = s.app.runBatchOperation(tw, 0, op)
+		return err
+	})
+	if err != nil {
+		return result, s.app.grpcInternalError(err)
+	}
+
+	switch {
+	case result.Status == 404:
+		return result, status.Error(codes.NotFound, "the requested resource could not be found")
+	case result.Status == 409:
+		return result, status.Error(codes.Aborted, "unable to update the record due to an edit conflict, please try again")
+	case result.Status >= 400:
+		return result, grpcValidationError(result.Errors)
+	}
+	return result, nil
+}
+
+// todoToProto() converts a todo to its message
+func todoToProto(todo *data.Todo) *todopb.Todo {
+	msg := &todopb.Todo{
+		Id:          todo.ID,
+		Title:       todo.Title,
+		Description: todo.Description,
+		Project:     todo.Project,
+		Completed:   todo.Completed,
+		Recurrence:  todo.Recurrence,
+		Occurrence:  todo.Occurrence,
+		Version:     todo.Version,
+		UpdatedAt:   timestamppb.New(todo.UpdatedAt),
+	}
+	if todo.DueAt != nil {
+		msg.DueAt = timestamppb.New(*todo.DueAt)
+	}
+	if todo.RemindAt != nil {
+		msg.RemindAt = timestamppb.New(*todo.RemindAt)
+	}
+	return msg
+}
+
+// eventToProto() converts an event, its data holds the todo as it was written
+func eventToProto(event events.Event) (*todopb.TodoEvent, error) {
+	var payload struct {
+		Todo *data.Todo `json:"todo"`
+	}
+	err := json.Unmarshal(event.Data, &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &todopb.TodoEvent{Id: event.ID, Type: event.Type, Time: timestamppb.New(event.Time)}
+	if payload.Todo != nil {
+		msg.Todo = todoToProto(payload.Todo)
+	}
+	return msg, nil
+}
+
+// protoTime() converts an optional timestamp
+func protoTime(ts *timestamppb.Timestamp) *time.Time {
+	if ts == nil {
+		return nil
+	}
+	t := ts.AsTime()
+	return &t
+}
+
+// encodePageToken() returns the opaque token for a page of ListTodos
+func encodePageToken(page int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("page:" + strconv.Itoa(page)))
+}
+
+// decodePageToken() returns the page held by a token, an empty token is the first page
+func decodePageToken(token string) (int, error) {
+	if token == "" {
+		return 1, nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, err
+	}
+
+	page, err := strconv.Atoi(strings.TrimPrefix(string(b), "page:"))
+	if err != nil || page < 1 || !strings.HasPrefix(string(b), "page:") {
+		return 0, errors.New("invalid page token")
+	}
+	return page, nil
+}
@@ -15,9 +15,9 @@ func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Reques
 			"version":     version,
 		},
 	}
-	err := app.writeJSON(w, http.StatusOK, data, nil)
+	err := app.writeResponse(w, r, http.StatusOK, data, nil)
 	if err != nil {
-		app.logger.Println(err)
+		app.logError(r, err)
 		return
 	}
 }
@@ -3,44 +3,62 @@
 package main
 
 import (
+	"compress/gzip"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
+	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"todoapi.miguelavila.net/internals/data"
 	"todoapi.miguelavila.net/internals/validator"
 )
 
 type envelope map[string]interface{}
 
-func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
-	// Convert our map into a JSON object
-	// js, err := json.Marshal(data)
-	// Format the JSON object for cmd -- Takes more resources than printing it normally
-	js, err := json.MarshalIndent(data, "", "\t")
+// writeResponse() sends data in the format negotiated from the Accept header:
+// compact JSON by default, indented with ?pretty=true, XML or MessagePack. A
+// client that accepts none of them gets a 406 Not Acceptable in JSON, requests
+// that change data are turned away by checkAccept() before that can happen
+func (app *application) writeResponse(w http.ResponseWriter, r *http.Request, status int, data envelope, headers http.Header) error {
+	format, ok := negotiateFormat(r)
+	if !ok {
+		format = responseFormats[0]
+		if status != http.StatusNotAcceptable {
+			status = http.StatusNotAcceptable
+			data = envelope{"error": notAcceptableMessage}
+			headers = nil
+		}
+	}
 
+	pretty, _ := strconv.ParseBool(r.URL.Query().Get("pretty"))
+	body, err := format.encode(data, pretty)
 	if err != nil {
 		return err
 	}
 
 	// Add a newline to make viewing on the terminal easier
-	js = append(js, '\n')
+	if format.contentType != "application/msgpack" {
+		body = append(body, '\n')
+	}
 
 	// Add the headers
 	for key, value := range headers {
 		w.Header()[key] = value
 	}
 
-	// Specify that we will serve our responses using JSON
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Add("Vary", "Accept")
 	w.WriteHeader(status)
-	// Write the I I byte slice containing the JSON response body
-	w.Write(js)
+	w.Write(body)
 	return nil
 }
 
@@ -60,15 +78,19 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 }
 
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
-	// use http.MaxBytesReader() to limit size of response body
+	// use http.MaxBytesReader() to limit size of response body, after it is decompressed
 	maxBytes := 1_048_576
-	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+	body, err := requestBody(w, r, int64(maxBytes))
+	if err != nil {
+		return err
+	}
+	r.Body = body
 
 	dec := json.NewDecoder(r.Body)
 	dec.DisallowUnknownFields()
 
 	//Decode the response body into the target destination
-	err := dec.Decode(dst)
+	err = dec.Decode(dst)
 
 	// Check for bad responses
 	if err != nil {
@@ -92,6 +114,9 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 			return fmt.Errorf("body contains incorrect JSON type (at character %q)", unmarshalTypeError.Offset)
 		case errors.Is(err, io.EOF):
 			return errors.New("body must not be empty")
+		// Check for timestamps in the wrong format
+		case isTimeError(err):
+			return errors.New("body contains an invalid timestamp, use RFC 3339 format (e.g. 2006-01-02T15:04:05Z)")
 
 		// Check for unmappable fields
 		case strings.HasPrefix(err.Error(), "json: unknown field "):
@@ -117,6 +142,24 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 	return nil
 }
 
+// requestBody() returns the request body limited to maxBytes. A body sent with
+// Content-Encoding: gzip is decompressed, and the limit applies to the
+// decompressed body so a small upload cannot expand without bound
+func requestBody(w http.ResponseWriter, r *http.Request, maxBytes int64) (io.ReadCloser, error) {
+	switch strings.ToLower(r.Header.Get("Content-Encoding")) {
+	case "", "identity":
+		return http.MaxBytesReader(w, r.Body, maxBytes), nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, errors.New("body is not valid gzip")
+		}
+		return http.MaxBytesReader(w, zr, maxBytes), nil
+	default:
+		return nil, fmt.Errorf("body has an unsupported Content-Encoding %q, use gzip", r.Header.Get("Content-Encoding"))
+	}
+}
+
 // readString() method returns a string value from the query string
 // or returns an default value if no matching value is found
 func (app *application) readString(qs url.Values, key string, defaultValue string) string {
@@ -177,3 +220,166 @@ func (app *application) readBool(qs url.Values, key string, defaultValue bool, v
 	}
 	return valueBool
 }
+
+// todoETag() returns the strong entity tag of a todo. The version is bumped on
+// every update so the id and version together identify a representation
+func todoETag(todo *data.Todo) string {
+	return fmt.Sprintf(`"%d-%d"`, todo.ID, todo.Version)
+}
+
+// listETag() returns a weak entity tag for a listing of todos. It is derived from
+// the id and version of every todo on the page and the pagination metadata
+func listETag(todos []*data.Todo, metadata data.Metadata) string {
+	hash := sha256.New()
+	for _, todo := range todos {
+		fmt.Fprintf(hash, "%d-%d;", todo.ID, todo.Version)
+	}
+	fmt.Fprintf(hash, "%+v", metadata)
+
+	return fmt.Sprintf(`W/"%x"`, hash.Sum(nil)[:16])
+}
+
+// etagMatches() reports whether an If-Match or If-None-Match header value matches
+// the etag. If-Match uses the strong comparison so weak tags never match it,
+// If-None-Match uses the weak comparison which ignores the W/ prefix
+func etagMatches(header string, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+			continue
+		}
+		if !strings.HasPrefix(candidate, "W/") && candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified() checks the If-None-Match header against the etag, if it matches a
+// 304 - Not Modified response is sent and true is returned
+func (app *application) notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	ifNoneMatch := strings.Join(r.Header.Values("If-None-Match"), ",")
+	if ifNoneMatch == "" || !etagMatches(ifNoneMatch, etag, true) {
+		return false
+	}
+
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// checkIfMatch() checks the If-Match header against the current representation
+// of the todo. It sends a 412 - Precondition Failed response when the client's
+// copy is stale (or a 428 when the header is required but missing) and returns
+// false, in which case the handler must not modify the todo
+func (app *application) checkIfMatch(w http.ResponseWriter, r *http.Request, todo *data.Todo) bool {
+	ifMatch := strings.Join(r.Header.Values("If-Match"), ",")
+	if ifMatch == "" {
+		if app.config.requireIfMatch {
+			app.preconditionRequiredResponse(w, r)
+			return false
+		}
+		return true
+	}
+
+	if !etagMatches(ifMatch, todoETag(todo), false) {
+		app.preconditionFailedResponse(w, r)
+		return false
+	}
+	return true
+}
+
+// readMediaType() returns the media type of the request body without parameters,
+// a missing Content-Type header is treated as application/json
+func (app *application) readMediaType(r *http.Request) string {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return "application/json"
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+// jsonType() names the JSON type a Go kind is decoded from
+func jsonType(kind reflect.Kind) string {
+	switch kind {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	default:
+		return "number"
+	}
+}
+
+// isTimeError() reports whether decoding failed on a malformed timestamp
+func isTimeError(err error) bool {
+	var parseError *time.ParseError
+	return errors.As(err, &parseError) || strings.HasPrefix(err.Error(), "Time.UnmarshalJSON")
+}
+
+// nullableTime is used for timestamps that may be null in request bodies, Set
+// tells a member that was sent as null apart from one that was left out
+type nullableTime struct {
+	Set   bool
+	Value *time.Time
+}
+
+func (n *nullableTime) UnmarshalJSON(b []byte) error {
+	n.Set = true
+	if string(b) == "null" {
+		n.Value = nil
+		return nil
+	}
+
+	var value time.Time
+	err := json.Unmarshal(b, &value)
+	if err != nil {
+		return err
+	}
+	n.Value = &value
+	return nil
+}
+
+// readTime() method converts a string value from the query to a time, either an
+// RFC 3339 timestamp or a date. If the value cannot be converted then a validation
+// error is added to the validation error map
+func (app *application) readTime(qs url.Values, key string, defaultValue time.Time, v *validator.Validator) time.Time {
+	// Get the value
+	value := qs.Get(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	valueTime, err := parseTime(value)
+	if err != nil {
+		v.AddError(key, err.Error())
+		return defaultValue
+	}
+	return valueTime
+}
+
+// parseTime() converts an RFC 3339 timestamp or a date to a time
+func parseTime(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		valueTime, err := time.Parse(layout, value)
+		if err == nil {
+			return valueTime, nil
+		}
+	}
+	return time.Time{}, errors.New("must be an RFC 3339 timestamp or a date (2006-01-02)")
+}
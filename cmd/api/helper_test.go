@@ -0,0 +1,154 @@
+// Filename: cmd/api/helper_test.go
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"todoapi.miguelavila.net/internals/data"
+)
+
+func TestEtagMatches(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		etag   string
+		weak   bool
+		want   bool
+	}{
+		{"strong match", `"7-3"`, `"7-3"`, false, true},
+		{"strong mismatch", `"7-2"`, `"7-3"`, false, false},
+		{"strong ignores weak candidates", `W/"7-3"`, `"7-3"`, false, false},
+		{"strong in a list", `"7-1", "7-3"`, `"7-3"`, false, true},
+		{"strong wildcard", `*`, `"7-3"`, false, true},
+		{"weak match", `W/"abc"`, `W/"abc"`, true, true},
+		{"weak ignores the prefix", `"abc"`, `W/"abc"`, true, true},
+		{"weak mismatch", `W/"abd"`, `W/"abc"`, true, false},
+		{"weak in a list with spaces", ` W/"x" ,W/"abc" `, `W/"abc"`, true, true},
+		{"weak wildcard", `*`, `W/"abc"`, true, true},
+		{"unquoted never matches", `7-3`, `"7-3"`, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := etagMatches(tt.header, tt.etag, tt.weak); got != tt.want {
+				t.Errorf("etagMatches(%q, %q, %t) = %t, want %t", tt.header, tt.etag, tt.weak, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	app := newTestApplication(t)
+	etag := `W/"abc"`
+
+	tests := []struct {
+		name        string
+		ifNoneMatch []string
+		want        bool
+	}{
+		{"no header", nil, false},
+		{"matching", []string{`W/"abc"`}, true},
+		{"matching strong form", []string{`"abc"`}, true},
+		{"stale", []string{`W/"old"`}, false},
+		{"matching in a second header", []string{`W/"old"`, `W/"abc"`}, true},
+		{"wildcard", []string{"*"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/todos", nil)
+			for _, value := range tt.ifNoneMatch {
+				r.Header.Add("If-None-Match", value)
+			}
+			w := httptest.NewRecorder()
+
+			got := app.notModified(w, r, etag)
+			if got != tt.want {
+				t.Fatalf("got %t, want %t", got, tt.want)
+			}
+			if !got {
+				return
+			}
+			if w.Code != http.StatusNotModified {
+				t.Errorf("got status %d, want %d", w.Code, http.StatusNotModified)
+			}
+			if w.Header().Get("ETag") != etag {
+				t.Errorf("got ETag %q, want %q", w.Header().Get("ETag"), etag)
+			}
+			if w.Body.Len() != 0 {
+				t.Errorf("got body %q, want none", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestCheckIfMatch(t *testing.T) {
+	todo := &data.Todo{ID: 7, Version: 3}
+
+	tests := []struct {
+		name           string
+		ifMatch        string
+		requireIfMatch bool
+		want           bool
+		status         int
+	}{
+		{"no header", "", false, true, 0},
+		{"no header when required", "", true, false, http.StatusPreconditionRequired},
+		{"current", `"7-3"`, true, true, 0},
+		{"stale", `"7-2"`, false, false, http.StatusPreconditionFailed},
+		{"another todo", `"8-3"`, false, false, http.StatusPreconditionFailed},
+		{"weak", `W/"7-3"`, false, false, http.StatusPreconditionFailed},
+		{"wildcard", `*`, true, true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.requireIfMatch = tt.requireIfMatch
+
+			r := httptest.NewRequest(http.MethodPatch, "/v1/todos/7", nil)
+			if tt.ifMatch != "" {
+				r.Header.Set("If-Match", tt.ifMatch)
+			}
+			w := httptest.NewRecorder()
+
+			if got := app.checkIfMatch(w, r, todo); got != tt.want {
+				t.Fatalf("got %t, want %t", got, tt.want)
+			}
+			if tt.status != 0 && w.Code != tt.status {
+				t.Errorf("got status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestETags(t *testing.T) {
+	todo := &data.Todo{ID: 7, Version: 3}
+	if got := todoETag(todo); got != `"7-3"` {
+		t.Errorf(`got todo ETag %s, want "7-3"`, got)
+	}
+
+	todos := []*data.Todo{{ID: 1, Version: 1}, {ID: 2, Version: 4}}
+	metadata := data.Metadata{CurrentPage: 1, PageSize: 20, TotalRecords: 2}
+
+	etag := listETag(todos, metadata)
+	if !strings.HasPrefix(etag, `W/"`) {
+		t.Errorf("got list ETag %s, want a weak one", etag)
+	}
+	if listETag(todos, metadata) != etag {
+		t.Error("the list ETag changed for the same listing")
+	}
+
+	updated := []*data.Todo{{ID: 1, Version: 1}, {ID: 2, Version: 5}}
+	if listETag(updated, metadata) == etag {
+		t.Error("the list ETag did not change when a todo was updated")
+	}
+	metadata.TotalRecords = 3
+	if listETag(todos, metadata) == etag {
+		t.Error("the list ETag did not change with the metadata")
+	}
+}
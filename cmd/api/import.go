@@ -0,0 +1,455 @@
+// Filename: cmd/api/import.go
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"todoapi.miguelavila.net/internals/data"
+	"todoapi.miguelavila.net/internals/validator"
+)
+
+const (
+	// largest file accepted by the import endpoint
+	maxImportSize = 10 << 20
+	// most todos imported from a single file
+	maxImportRows = 10000
+)
+
+// importRow is a todo read from an imported file along with the line it starts
+// on, Errors holds the problems found while reading it
+type importRow struct {
+	Line   int
+	Todo   *data.Todo
+	Errors map[string]string
+}
+
+// importResult reports what happened to a single row of an imported file
+type importResult struct {
+	Line   int               `json:"line"`
+	Status string            `json:"status"`
+	ID     int64             `json:"id,omitempty"`
+	Title  string            `json:"title,omitempty"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// importTodosHandler for POST /v1/todos/import endpoint. The file is uploaded in
+// the "file" field of a multipart form, as CSV with a header row, a JSON array of
+// todos, a todo.txt list or an iCalendar file of VTODOs. The format is taken from the "format" field or the
+// file's extension. Every row is validated, the valid ones are inserted together
+// and the invalid ones skipped, unless dry_run is true in which case nothing is
+// written. The report gives the outcome of each row by line number
+func (app *application) importTodosHandler(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		app.unsupportedMediaTypeResponse(w, r, "multipart/form-data")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	err := r.ParseMultipartForm(1 << 20)
+	if err != nil {
+		app.badResquestReponse(w, r, fmt.Errorf("invalid multipart form: %w", err))
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		app.badResquestReponse(w, r, errors.New("the todos must be uploaded in the file field"))
+		return
+	}
+	defer file.Close()
+
+	// initialize a validator
+	v := validator.New()
+
+	dryRun := app.readBool(r.Form, "dry_run", false, v)
+	format := app.readString(r.Form, "format", importFormat(header.Filename))
+	v.Check(validator.In(format, importFormats...), "format", "must be one of "+strings.Join(importFormats, ", "))
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var rows []importRow
+	switch format {
+	case "csv":
+		rows, err = parseCSVImport(content)
+	case "json":
+		rows, err = parseJSONImport(content)
+	case "todotxt":
+		rows, err = parseTodoTxtImport(content)
+	case "ics":
+		rows, err = parseICSImport(content)
+	}
+	if err == nil && len(rows) > maxImportRows {
+		err = fmt.Errorf("the file must not contain more than %d todos", maxImportRows)
+	}
+	if err != nil {
+		app.failedValidationResponse(w, r, map[string]string{"file": err.Error()})
+		return
+	}
+
+	results := make([]importResult, len(rows))
+	valid := []*data.Todo{}
+	for i, row := range rows {
+		results[i] = importResult{Line: row.Line, Status: "skipped", Errors: row.Errors}
+		if row.Todo != nil {
+			results[i].Title = row.Todo.Title
+		}
+		if len(row.Errors) > 0 {
+			continue
+		}
+
+		v := validator.New()
+		if data.ValidateTodo(v, row.Todo); !v.Valid() {
+			results[i].Errors = v.Errors
+			continue
+		}
+
+		results[i].Status = "valid"
+		valid = append(valid, row.Todo)
+	}
+
+	if !dryRun && len(valid) > 0 {
+		err = app.writeTodos(r.Context(), func(tw *todoWriter) error {
+			err := tw.startBulk()
+			if err != nil {
+				return err
+			}
+			for _, todo := range valid {
+				err := tw.insert(todo)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		j := 0
+		for i := range results {
+			if results[i].Status == "valid" {
+				results[i].Status = "inserted"
+				results[i].ID = valid[j].ID
+				j++
+			}
+		}
+	}
+
+	inserted := 0
+	if !dryRun {
+		inserted = len(valid)
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{
+		"dry_run":  dryRun,
+		"format":   format,
+		"valid":    len(valid),
+		"inserted": inserted,
+		"skipped":  len(rows) - len(valid),
+		"rows":     results,
+	}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// importFormats are the file formats the import endpoint reads
+var importFormats = []string{"csv", "json", "todotxt", "ics"}
+
+// importFormat() guesses the format of an uploaded file from its extension
+func importFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv":
+		return "csv"
+	case ".json":
+		return "json"
+	case ".txt":
+		return "todotxt"
+	case ".ics":
+		return "ics"
+	}
+	return ""
+}
+
+// importColumns maps the column names accepted in a CSV header to todo fields
+var importColumns = map[string]string{
+	"title":       "title",
+	"name":        "title",
+	"description": "description",
+	"notes":       "description",
+	"project":     "project",
+	"completed":   "completed",
+	"done":        "completed",
+	"due_at":      "due_at",
+	"due":         "due_at",
+	"remind_at":   "remind_at",
+	"recurrence":  "recurrence",
+}
+
+// parseCSVImport() reads todos from CSV with a header row naming the columns.
+// Columns that do not map to a todo field, like the id and version of an
+// export, are ignored
+func parseCSVImport(content []byte) ([]importRow, error) {
+	cr := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(content, []byte("\ufeff"))))
+	cr.FieldsPerRecord = -1
+
+	header, err := cr.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("the file is empty")
+		}
+		return nil, err
+	}
+
+	columns := make([]string, len(header))
+	hasTitle := false
+	for i, name := range header {
+		columns[i] = importColumns[strings.ToLower(strings.TrimSpace(name))]
+		hasTitle = hasTitle || columns[i] == "title"
+	}
+	if !hasTitle {
+		return nil, errors.New("the header row must have a title column")
+	}
+
+	rows := []importRow{}
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// a malformed quote leaves the rest of the file unreadable
+			var parseError *csv.ParseError
+			if errors.As(err, &parseError) {
+				rows = append(rows, importRow{Line: parseError.StartLine, Errors: map[string]string{"row": parseError.Err.Error()}})
+				break
+			}
+			return nil, err
+		}
+
+		line, _ := cr.FieldPos(0)
+		row := importRow{Line: line, Todo: &data.Todo{}, Errors: map[string]string{}}
+		for i, value := range record {
+			if i >= len(columns) || columns[i] == "" {
+				continue
+			}
+			setImportField(&row, columns[i], csvUntext(strings.TrimSpace(value)))
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// setImportField() sets a todo field from its text in an imported file
+func setImportField(row *importRow, field string, value string) {
+	switch field {
+	case "title":
+		row.Todo.Title = value
+	case "description":
+		row.Todo.Description = value
+	case "project":
+		row.Todo.Project = value
+	case "recurrence":
+		row.Todo.Recurrence = value
+	case "completed":
+		if value == "" {
+			return
+		}
+		completed, err := strconv.ParseBool(value)
+		if err != nil {
+			row.Errors[field] = "must be true or false"
+			return
+		}
+		row.Todo.Completed = completed
+	case "due_at", "remind_at":
+		if value == "" {
+			return
+		}
+		t, err := parseTime(value)
+		if err != nil {
+			row.Errors[field] = err.Error()
+			return
+		}
+		if field == "due_at" {
+			row.Todo.DueAt = &t
+		} else {
+			row.Todo.RemindAt = &t
+		}
+	}
+}
+
+// parseJSONImport() reads todos from a JSON array of objects with the same keys
+// as the todos returned by the API. Unknown keys are ignored, and a member with
+// the wrong type only skips the todo it is in
+func parseJSONImport(content []byte) ([]importRow, error) {
+	dec := json.NewDecoder(bytes.NewReader(content))
+
+	tok, err := dec.Token()
+	if err != nil || tok != json.Delim('[') {
+		return nil, errors.New("the file must contain a JSON array of todos")
+	}
+
+	rows := []importRow{}
+	for dec.More() {
+		// the element starts after the separator and any whitespace
+		start := int(dec.InputOffset())
+		for start < len(content) && strings.ContainsRune(" \t\r\n,", rune(content[start])) {
+			start++
+		}
+		line := 1 + bytes.Count(content[:start], []byte("\n"))
+
+		var input struct {
+			Title       string `json:"title"`
+			Description string `json:"description"`
+			Project     string `json:"project"`
+			Completed   bool   `json:"completed"`
+			DueAt       string `json:"due_at"`
+			RemindAt    string `json:"remind_at"`
+			Recurrence  string `json:"recurrence"`
+		}
+
+		row := importRow{Line: line, Todo: &data.Todo{}, Errors: map[string]string{}}
+		err := dec.Decode(&input)
+		if err != nil {
+			var unmarshalTypeError *json.UnmarshalTypeError
+			if !errors.As(err, &unmarshalTypeError) {
+				return nil, fmt.Errorf("badly-formed JSON (at line %d)", line)
+			}
+			key := unmarshalTypeError.Field
+			if key == "" {
+				key = "todo"
+			}
+			row.Errors[key] = "must be a JSON " + jsonType(unmarshalTypeError.Type.Kind())
+			rows = append(rows, row)
+			continue
+		}
+
+		row.Todo.Title = input.Title
+		row.Todo.Description = input.Description
+		row.Todo.Project = input.Project
+		row.Todo.Completed = input.Completed
+		row.Todo.Recurrence = input.Recurrence
+		setImportField(&row, "due_at", input.DueAt)
+		setImportField(&row, "remind_at", input.RemindAt)
+		rows = append(rows, row)
+	}
+
+	_, err = dec.Token()
+	if err != nil {
+		return nil, errors.New("the file must contain a JSON array of todos")
+	}
+
+	return rows, nil
+}
+
+var (
+	todoTxtDate     = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+	todoTxtPriority = regexp.MustCompile(`^\([A-Z]\)$`)
+	todoTxtRec      = regexp.MustCompile(`^\+?(\d+)([dwmy])$`)
+)
+
+// parseTodoTxtImport() reads todos from the todo.txt format, one per line:
+//
+//	x (A) 2026-10-01 Call the plumber +home @phone due:2026-10-20 rec:1w
+//
+// A leading x marks a completed todo, the first +project is the todo's project,
+// due: sets the due date and rec: a daily, weekly, monthly or yearly recurrence.
+// Priorities and dates are dropped from the title, and as todo.txt has no
+// description the whole line becomes the description
+func parseTodoTxtImport(content []byte) ([]importRow, error) {
+	rows := []importRow{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		row := importRow{Line: line, Todo: &data.Todo{Description: text}, Errors: map[string]string{}}
+		words := strings.Fields(text)
+
+		// completion marker, priority and the completion and creation dates
+		if words[0] == "x" {
+			row.Todo.Completed = true
+			words = words[1:]
+		}
+		if len(words) > 0 && todoTxtPriority.MatchString(words[0]) {
+			words = words[1:]
+		}
+		for i := 0; i < 2 && len(words) > 0 && todoTxtDate.MatchString(words[0]); i++ {
+			words = words[1:]
+		}
+
+		title := []string{}
+		for _, word := range words {
+			switch {
+			case strings.HasPrefix(word, "+") && len(word) > 1 && row.Todo.Project == "":
+				row.Todo.Project = word[1:]
+			case strings.HasPrefix(word, "due:"):
+				setImportField(&row, "due_at", strings.TrimPrefix(word, "due:"))
+			case strings.HasPrefix(word, "rec:"):
+				recurrence, ok := todoTxtRecurrence(strings.TrimPrefix(word, "rec:"))
+				if !ok {
+					row.Errors["recurrence"] = "must be a number followed by d, w, m or y"
+					continue
+				}
+				row.Todo.Recurrence = recurrence
+			default:
+				title = append(title, word)
+			}
+		}
+		row.Todo.Title = strings.Join(title, " ")
+
+		rows = append(rows, row)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+// todoTxtRecurrence() converts a todo.txt rec: value such as 2w to a recurrence rule
+func todoTxtRecurrence(value string) (string, bool) {
+	match := todoTxtRec.FindStringSubmatch(value)
+	if match == nil {
+		return "", false
+	}
+
+	freq := map[string]string{"d": "DAILY", "w": "WEEKLY", "m": "MONTHLY", "y": "YEARLY"}[match[2]]
+	interval, err := strconv.Atoi(match[1])
+	if err != nil || interval < 1 {
+		return "", false
+	}
+	if interval == 1 {
+		return "FREQ=" + freq, true
+	}
+	return fmt.Sprintf("FREQ=%s;INTERVAL=%d", freq, interval), true
+}
@@ -0,0 +1,131 @@
+// Filename: cmd/api/listener.go
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"todoapi.miguelavila.net/internals/data"
+	"todoapi.miguelavila.net/internals/events"
+)
+
+// todoNotification is the payload of a todos_changed notification, it is sent by
+// the notify_todos_changed trigger when a change to a todo is committed
+type todoNotification struct {
+	Op      string `json:"op"`
+	ID      int64  `json:"id"`
+	Version int32  `json:"version"`
+	Project string `json:"project"`
+	// Count is the number of todos of an IMPORT, whose ID is the last of them
+	Count int `json:"count"`
+}
+
+// startChangeListener() listens for the todos_changed notifications sent by
+// every instance writing to the database and publishes them to the local event
+// hub, so clients are told about changes made through other instances. Changes
+// made through this instance are also notified, the hub ignores the ones it has
+// already published
+func (app *application) startChangeListener() {
+	listener := pq.NewListener(app.config.db.dsn, app.config.listen.minReconnect, app.config.listen.maxReconnect, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventDisconnected:
+			app.logger.Printf("listener: disconnected: %v", err)
+		case pq.ListenerEventReconnected:
+			app.logger.Printf("listener: reconnected")
+		case pq.ListenerEventConnectionAttemptFailed:
+			app.logger.Printf("listener: reconnect failed: %v", err)
+		}
+	})
+
+	err := listener.Listen("todos_changed")
+	if err != nil {
+		app.logger.Printf("listener: %v", err)
+	}
+
+	app.background(func() {
+		defer listener.Close()
+
+		for {
+			select {
+			case <-app.quit:
+				return
+			case n := <-listener.Notify:
+				// a nil notification follows a reconnect, notifications sent while
+				// the connection was down are lost
+				if n == nil {
+					app.logger.Printf("listener: connection re-established, changes may have been missed")
+					continue
+				}
+				app.publishNotification(n.Extra)
+			case <-time.After(90 * time.Second):
+				// make sure the connection is still alive, the listener reconnects if not
+				go listener.Ping()
+			}
+		}
+	})
+}
+
+// publishNotification() turns a todos_changed payload into an event on the hub.
+// Created and updated todos are read back so the event carries the whole todo,
+// and a deleted todo is read from its tombstone, like the events published by
+// the instance that made the change
+func (app *application) publishNotification(payload string) {
+	var n todoNotification
+	err := json.Unmarshal([]byte(payload), &n)
+	if err != nil {
+		app.logger.Printf("listener: invalid notification %q: %v", payload, err)
+		return
+	}
+
+	// a bulk import is a single event, not one per todo
+	if n.Op == "IMPORT" {
+		app.events.Publish(bulkEvent(n.Count, n.ID))
+		return
+	}
+
+	event := events.Event{TodoID: n.ID, Project: n.Project, Version: n.Version}
+	var todo interface{}
+
+	switch n.Op {
+	case "INSERT", "UPDATE":
+		event.Type = data.EventTodoUpdated
+		if n.Op == "INSERT" {
+			event.Type = data.EventTodoCreated
+		}
+
+		current, err := app.models.Todos.Get(n.ID)
+		if err != nil {
+			// deleted again before we got to it, the delete will be notified too
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				app.logger.Printf("listener: %v", err)
+			}
+			return
+		}
+		todo = current
+	case "DELETE":
+		event.Type = data.EventTodoDeleted
+
+		deleted, err := app.models.Todos.GetDeleted(n.ID, n.Version)
+		if err != nil {
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				app.logger.Printf("listener: %v", err)
+				return
+			}
+			// tombstones written before the todo was kept with them
+			deleted = &data.Todo{ID: n.ID, Project: n.Project, Version: n.Version}
+		}
+		todo = deleted
+	default:
+		return
+	}
+
+	event.Data, err = json.Marshal(envelope{"todo": todo})
+	if err != nil {
+		app.logger.Printf("listener: %v", err)
+		return
+	}
+	app.events.Publish(event)
+}
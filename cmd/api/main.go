@@ -5,15 +5,21 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/graphql-go/graphql"
 	_ "github.com/lib/pq"
 	"todoapi.miguelavila.net/internals/data"
+	"todoapi.miguelavila.net/internals/events"
+	"todoapi.miguelavila.net/internals/notify"
+	"todoapi.miguelavila.net/internals/trace"
 )
 
 // App Version
@@ -21,21 +27,105 @@ const version = "1.0.0"
 
 // App config
 type config struct {
-	port int
-	env  string // dev, stg, prd, etc...1
-	db   struct {
-		dsn          string
-		maxOpenConns int
-		maxIdleConns int
-		maxIdleTime  string
+	port           int
+	env            string // dev, stg, prd, etc...1
+	requireIfMatch bool
+	allowPutCreate bool
+	db             struct {
+		dsn                  string
+		maxOpenConns         int
+		maxIdleConns         int
+		maxIdleTime          string
+		queryTimeout         time.Duration
+		slowQuery            time.Duration
+		explain              bool
+		replicaDSNs          []string
+		replicaCheckInterval time.Duration
+		readYourWrites       time.Duration
+	}
+	idempotency struct {
+		ttl   time.Duration
+		lease time.Duration
+	}
+	batch struct {
+		maxSize int
+	}
+	sync struct {
+		tombstoneRetention time.Duration
+	}
+	feeds struct {
+		adminKey string
+	}
+	reminders struct {
+		enabled     bool
+		interval    time.Duration
+		batchSize   int
+		maxAttempts int
+		backoff     time.Duration
+		notifier    string // log, smtp or webhook
+		webhookURL  string
+	}
+	webhooks struct {
+		enabled     bool
+		interval    time.Duration
+		batchSize   int
+		maxAttempts int
+		backoff     time.Duration
+		timeout     time.Duration
+		workers     int
+	}
+	events struct {
+		logSize   int
+		buffer    int
+		heartbeat time.Duration
+		retry     time.Duration
+	}
+	listen struct {
+		enabled      bool
+		minReconnect time.Duration
+		maxReconnect time.Duration
+	}
+	websocket struct {
+		maxConns       int
+		allowedOrigins []string
+	}
+	grpc struct {
+		port int
+	}
+	graphql struct {
+		maxDepth      int
+		maxComplexity int
+	}
+	openapi struct {
+		validateRequests  bool
+		validateResponses bool
+	}
+	trace struct {
+		exporter string // none, stdout or otlp-file
+		otlpFile string
+	}
+	smtp struct {
+		host      string
+		port      int
+		username  string
+		password  string
+		sender    string
+		recipient string
 	}
 }
 
 // dependencies injections
 type application struct {
-	config config
-	logger *log.Logger
-	models data.Models
+	config      config
+	logger      *log.Logger
+	models      data.Models
+	notifier    notify.Notifier
+	events      *events.Hub
+	wsConns     chan struct{}
+	graphql     graphql.Schema
+	graphqlOnce sync.Once
+	wg          sync.WaitGroup
+	quit        chan struct{}
 }
 
 func main() {
@@ -43,17 +133,84 @@ func main() {
 	//read in the flag that are needed to populate the config ~ flag for using as extra cmd
 	flag.IntVar(&cfg.port, "port", 4000, "API port")
 	flag.StringVar(&cfg.env, "env", "dev", "(dev | stg | prd)")
+	flag.BoolVar(&cfg.requireIfMatch, "require-if-match", false, "Require an If-Match header on PATCH and DELETE requests")
 	flag.StringVar(&cfg.db.dsn, "db-dsn", os.Getenv("TODO_DB_DSN"), "PostgreSQL DSN")
 	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
 	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-open-conns", 25, "PostgreSQL max idle open connections")
 	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-open-time", "15m", "PostgreSQL max connections idle time")
+	flag.DurationVar(&cfg.db.queryTimeout, "db-query-timeout", 3*time.Second, "How long a todo query may run before it is canceled")
+	flag.DurationVar(&cfg.db.slowQuery, "db-slow-query", 200*time.Millisecond, "Log todo queries taking longer than this, 0 disables the slow query log")
+	flag.BoolVar(&cfg.db.explain, "db-explain", false, "Capture EXPLAIN ANALYZE plans of slow read queries for /debug/queries (dev only)")
+	flag.Func("db-replica-dsn", "PostgreSQL DSN of a read replica, repeat for several replicas", func(val string) error {
+		cfg.db.replicaDSNs = append(cfg.db.replicaDSNs, val)
+		return nil
+	})
+	flag.DurationVar(&cfg.db.replicaCheckInterval, "db-replica-check-interval", 10*time.Second, "How often the read replicas are health checked")
+	flag.DurationVar(&cfg.db.readYourWrites, "db-read-your-writes", 5*time.Second, "How long a client reads from the primary after it writes, 0 disables")
+	flag.BoolVar(&cfg.allowPutCreate, "allow-put-create", false, "Allow PUT to create todos with a client chosen id")
+	flag.DurationVar(&cfg.idempotency.ttl, "idempotency-ttl", 24*time.Hour, "How long responses for an Idempotency-Key are kept")
+	flag.DurationVar(&cfg.idempotency.lease, "idempotency-lease", time.Minute, "How long a request in progress holds its Idempotency-Key before a retry may take it over")
+	flag.IntVar(&cfg.batch.maxSize, "batch-max-size", 100, "Maximum number of operations in a batch request")
+	flag.DurationVar(&cfg.sync.tombstoneRetention, "sync-tombstone-retention", 30*24*time.Hour, "How long deleted todos are remembered for sync, older sync tokens expire, 0 keeps them forever")
+	flag.StringVar(&cfg.feeds.adminKey, "feeds-admin-key", os.Getenv("TODO_FEEDS_ADMIN_KEY"), "Bearer key needed to create, list and revoke calendar feed tokens, without one they can only be managed in dev")
+	flag.BoolVar(&cfg.reminders.enabled, "reminders", true, "Run the background reminder scheduler")
+	flag.DurationVar(&cfg.reminders.interval, "reminder-interval", 30*time.Second, "How often to poll for due reminders")
+	flag.IntVar(&cfg.reminders.batchSize, "reminder-batch-size", 50, "Maximum reminders claimed per poll")
+	flag.IntVar(&cfg.reminders.maxAttempts, "reminder-max-attempts", 5, "Delivery attempts before a reminder is given up on")
+	flag.DurationVar(&cfg.reminders.backoff, "reminder-backoff", time.Minute, "Wait before the first retry of a failed reminder, doubled on every retry")
+	flag.StringVar(&cfg.reminders.notifier, "reminder-notifier", "log", "How reminders are delivered (log | smtp | webhook)")
+	flag.StringVar(&cfg.reminders.webhookURL, "reminder-webhook-url", "", "URL reminders are posted to by the webhook notifier")
+	flag.BoolVar(&cfg.webhooks.enabled, "webhooks", true, "Run the background webhook dispatcher")
+	flag.DurationVar(&cfg.webhooks.interval, "webhook-interval", 5*time.Second, "How often to poll for webhook events and deliveries")
+	flag.IntVar(&cfg.webhooks.batchSize, "webhook-batch-size", 50, "Maximum events or deliveries claimed per poll")
+	flag.IntVar(&cfg.webhooks.maxAttempts, "webhook-max-attempts", 8, "Delivery attempts before a webhook delivery fails")
+	flag.DurationVar(&cfg.webhooks.backoff, "webhook-backoff", 30*time.Second, "Wait before the first retry of a failed delivery, doubled on every retry")
+	flag.DurationVar(&cfg.webhooks.timeout, "webhook-timeout", 10*time.Second, "Timeout for a single webhook delivery")
+	flag.IntVar(&cfg.webhooks.workers, "webhook-workers", 4, "Number of webhooks called at the same time, deliveries to one webhook are sent one at a time")
+	flag.IntVar(&cfg.events.logSize, "events-log-size", 1000, "Number of recent todo events kept for clients resuming a stream")
+	flag.IntVar(&cfg.events.buffer, "events-buffer", 64, "Events buffered per stream before a slow client is disconnected")
+	flag.DurationVar(&cfg.events.heartbeat, "events-heartbeat", 15*time.Second, "Interval between heartbeats on event streams")
+	flag.DurationVar(&cfg.events.retry, "events-retry", 3*time.Second, "Reconnection delay suggested to event stream clients")
+	flag.BoolVar(&cfg.listen.enabled, "db-listen", true, "Listen for todo changes made through other instances")
+	flag.DurationVar(&cfg.listen.minReconnect, "db-listen-min-reconnect", 10*time.Second, "Wait before reconnecting the change listener")
+	flag.DurationVar(&cfg.listen.maxReconnect, "db-listen-max-reconnect", time.Minute, "Longest wait between change listener reconnection attempts")
+	flag.IntVar(&cfg.websocket.maxConns, "ws-max-conns", 1000, "Maximum number of open WebSocket connections")
+	flag.Func("ws-allowed-origins", "Comma separated origins allowed to open WebSocket connections (default same origin)", func(val string) error {
+		cfg.websocket.allowedOrigins = strings.Split(val, ",")
+		return nil
+	})
+	flag.IntVar(&cfg.grpc.port, "grpc-port", 4001, "gRPC port, 0 disables the gRPC server")
+	flag.IntVar(&cfg.graphql.maxDepth, "graphql-max-depth", 8, "Maximum depth of a GraphQL query")
+	flag.IntVar(&cfg.graphql.maxComplexity, "graphql-max-complexity", 1000, "Maximum complexity of a GraphQL query, every field counts once per todo listed")
+	flag.BoolVar(&cfg.openapi.validateRequests, "openapi-validate", false, "Validate requests against the OpenAPI document before they reach the handlers")
+	flag.BoolVar(&cfg.openapi.validateResponses, "openapi-validate-responses", false, "Log responses that do not match the OpenAPI document (dev only)")
+	flag.StringVar(&cfg.trace.exporter, "trace-exporter", "none", "Where trace spans are exported (none | stdout | otlp-file)")
+	flag.StringVar(&cfg.trace.otlpFile, "trace-otlp-file", "", "File the otlp-file exporter appends OTLP/JSON spans to")
+	flag.StringVar(&cfg.smtp.host, "smtp-host", "localhost", "SMTP host")
+	flag.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
+	flag.StringVar(&cfg.smtp.username, "smtp-username", "", "SMTP username")
+	flag.StringVar(&cfg.smtp.password, "smtp-password", os.Getenv("TODO_SMTP_PASSWORD"), "SMTP password")
+	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Todo API <no-reply@todoapi.miguelavila.net>", "SMTP sender")
+	flag.StringVar(&cfg.smtp.recipient, "smtp-recipient", "", "Comma separated recipients of reminder emails")
 	flag.Parse()
 
 	//create a logger ~ use := for undeclared var
 	logger := log.New(os.Stdout, "", log.Ldate|log.Ltime)
 
+	// choose where trace spans go
+	exporter, err := newTraceExporter(cfg)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if exporter != nil {
+		trace.SetExporter(exporter, func(err error) {
+			logger.Printf("trace: %v", err)
+		})
+		defer exporter.Close()
+	}
+
 	//create the connection pool
-	db, err := openDB(cfg)
+	db, err := openDB(cfg, cfg.db.dsn)
 	if err != nil {
 		logger.Fatal(err)
 	}
@@ -63,43 +220,120 @@ func main() {
 	// log successful connection
 	logger.Printf("database connection pool established")
 
+	// todo reads go to the replicas when there are any
+	var replicas *data.Replicas
+	if len(cfg.db.replicaDSNs) > 0 {
+		var replicaDBs []*sql.DB
+		for _, dsn := range cfg.db.replicaDSNs {
+			replicaDB, err := newPool(cfg, dsn)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			defer replicaDB.Close()
+			replicaDBs = append(replicaDBs, replicaDB)
+		}
+		replicas = data.NewReplicas(replicaDBs)
+
+		// a replica that is down does not stop the server, reads leave it out
+		// until the health checks see it come back
+		replicas.CheckHealth(5*time.Second, func(index int, err error) {
+			logger.Printf("replicas: replica %d is down, reading from the others: %v", index, err)
+		})
+		logger.Printf("%d read replica connection pools established", len(replicaDBs))
+	}
+
+	// choose how reminders are delivered
+	notifier, err := newNotifier(cfg, logger)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
 	//create instances of out api
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: *data.NewModels(db),
+		config:   cfg,
+		logger:   logger,
+		notifier: notifier,
+		events:   events.NewHub(cfg.events.logSize, cfg.events.buffer),
+		wsConns:  make(chan struct{}, cfg.websocket.maxConns),
+		quit:     make(chan struct{}),
 	}
 
-	//create our http server
-	srv := &http.Server{
-		Addr:         fmt.Sprintf(":%d", cfg.port),
-		Handler:      app.routes(),
-		IdleTimeout:  time.Minute,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 30 * time.Second,
+	// time the todo queries, plans of slow ones are only captured in dev
+	queries := data.NewQueryLog(cfg.db.slowQuery, cfg.db.explain && cfg.env == "dev", func(ctx context.Context, message string) {
+		app.logContext(ctx, "%s", message)
+	})
+	app.models = *data.NewModels(db, cfg.db.queryTimeout, queries, replicas)
+
+	// every route must be in the OpenAPI document
+	err = app.checkOpenAPI()
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	// start the background workers
+	if cfg.reminders.enabled {
+		app.startReminderScheduler()
+	}
+	if cfg.webhooks.enabled {
+		app.startWebhookDispatcher()
+	}
+	if cfg.listen.enabled {
+		app.startChangeListener()
+	}
+	if cfg.sync.tombstoneRetention > 0 {
+		app.startTombstonePurge()
+	}
+	if replicas != nil {
+		app.startReplicaHealthChecks()
+	}
+	if cfg.grpc.port > 0 {
+		err = app.startGRPCServer()
+		if err != nil {
+			logger.Fatal(err)
+		}
 	}
 
-	logger.Printf("Starting %s server at %s", cfg.env, srv.Addr)
 	//start the server
-	err = srv.ListenAndServe()
-	logger.Fatal(err)
+	err = app.serve()
+	if err != nil {
+		logger.Fatal(err)
+	}
 
 }
 
-// openDB return a *sql.DB instance
-func openDB(cfg config) (*sql.DB, error) {
-	db, err := sql.Open("postgres", cfg.db.dsn)
-	if err != nil {
-		return nil, err
+// newNotifier() returns the reminder notifier selected in the config
+func newNotifier(cfg config, logger *log.Logger) (notify.Notifier, error) {
+	switch cfg.reminders.notifier {
+	case "log":
+		return notify.LogNotifier{Logger: logger}, nil
+	case "webhook":
+		if cfg.reminders.webhookURL == "" {
+			return nil, errors.New("-reminder-webhook-url must be set for the webhook notifier")
+		}
+		return notify.WebhookNotifier{URL: cfg.reminders.webhookURL}, nil
+	case "smtp":
+		if cfg.smtp.recipient == "" {
+			return nil, errors.New("-smtp-recipient must be set for the smtp notifier")
+		}
+		return notify.SMTPNotifier{
+			Host:       cfg.smtp.host,
+			Port:       cfg.smtp.port,
+			Username:   cfg.smtp.username,
+			Password:   cfg.smtp.password,
+			Sender:     cfg.smtp.sender,
+			Recipients: strings.Split(cfg.smtp.recipient, ","),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown reminder notifier %q", cfg.reminders.notifier)
 	}
+}
 
-	db.SetMaxOpenConns(cfg.db.maxOpenConns)
-	db.SetMaxIdleConns(cfg.db.maxIdleConns)
-	duration, err := time.ParseDuration(cfg.db.maxIdleTime)
+// openDB return a *sql.DB instance for the primary or a replica
+func openDB(cfg config, dsn string) (*sql.DB, error) {
+	db, err := newPool(cfg, dsn)
 	if err != nil {
 		return nil, err
 	}
-	db.SetConnMaxIdleTime(duration)
 
 	// create a context with a 5 section timeout deadline
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -108,8 +342,29 @@ func openDB(cfg config) (*sql.DB, error) {
 	err = db.PingContext(ctx)
 
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 
 	return db, nil
 }
+
+// newPool() sets up a connection pool without connecting, so that a database
+// that is down can be connected to later
+func newPool(cfg config, dsn string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(cfg.db.maxOpenConns)
+	db.SetMaxIdleConns(cfg.db.maxIdleConns)
+	duration, err := time.ParseDuration(cfg.db.maxIdleTime)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	db.SetConnMaxIdleTime(duration)
+
+	return db, nil
+}
@@ -0,0 +1,383 @@
+// Filename: cmd/api/middleware.go
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"todoapi.miguelavila.net/internals/data"
+	"todoapi.miguelavila.net/internals/openapi"
+)
+
+// responseRecorder passes a response through to the client while keeping a copy
+// of the status code, headers and body that were written
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	headers http.Header
+	body    bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+		rec.headers = rec.ResponseWriter.Header().Clone()
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// perRequestHeaders belong to the request that set them and are neither stored
+// with an idempotent response nor replayed, e.g. the replay keeps the X-Request-ID
+// of the request it answers
+var perRequestHeaders = []string{"X-Request-Id", "Traceparent", "Tracestate", "X-Read-Primary-Until", "Set-Cookie", "Date"}
+
+// replayableHeaders() returns the headers of a response without the ones that
+// belong to the request it answered
+func replayableHeaders(headers http.Header) http.Header {
+	replayable := headers.Clone()
+	for _, name := range perRequestHeaders {
+		replayable.Del(name)
+	}
+	return replayable
+}
+
+// checkAccept() turns away a request that changes data when the client accepts
+// none of the response formats, so it gets its 406 before anything is written
+// rather than after. Reads are left to writeResponse(), as some of them, such as
+// the event stream and the exports, answer in formats of their own
+func (app *application) checkAccept(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if _, ok := negotiateFormat(r); !ok {
+				app.notAcceptableResponse(w, r)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireFeedsAdmin() lets a request through to the feed token endpoints only
+// when it carries the admin key as a bearer token, as anyone holding a feed token
+// can read the todos. Without a configured key the tokens can only be managed
+// in dev
+func (app *application) requireFeedsAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := app.config.feeds.adminKey
+		if key == "" {
+			if app.config.env != "dev" {
+				app.feedsAdminDisabledResponse(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(key)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			app.invalidAdminKeyResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// idempotent() makes a handler safe to retry when the client sends an
+// Idempotency-Key header. The first response for a key is stored and replayed
+// for repeats of the same request until the key expires. A request that never
+// finishes, e.g. because the server stopped, holds its key for the lease only
+func (app *application) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > 255 {
+			app.badResquestReponse(w, r, errors.New("Idempotency-Key header must not be more than 255 characters"))
+			return
+		}
+
+		fingerprint, err := fingerprintRequest(w, r)
+		if err != nil {
+			app.badResquestReponse(w, r, err)
+			return
+		}
+
+		claimedAt, claimed, err := app.models.Idempotency.Claim(key, fingerprint, app.config.idempotency.lease)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// a record already exists for the key
+		if !claimed {
+			record, err := app.models.Idempotency.Get(key)
+			if err != nil {
+				switch {
+				// the record expired between the claim and the lookup
+				case errors.Is(err, data.ErrRecordNotFound):
+					app.idempotencyInFlightResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+
+			switch {
+			case record.Fingerprint != fingerprint:
+				app.idempotencyMismatchResponse(w, r)
+			case record.Status == 0:
+				app.idempotencyInFlightResponse(w, r)
+			default:
+				// replay the stored response, records stored before the per
+				// request headers were left out may still hold them
+				for name, value := range replayableHeaders(record.Headers) {
+					w.Header()[name] = value
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(record.Status)
+				w.Write(record.Body)
+			}
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+
+		// free the key if the handler panics so the client is able to retry
+		defer func() {
+			if err := recover(); err != nil {
+				app.models.Idempotency.Release(key, claimedAt)
+				panic(err)
+			}
+		}()
+
+		next.ServeHTTP(rec, r)
+
+		if !storableStatus(rec.status) {
+			err = app.models.Idempotency.Release(key, claimedAt)
+		} else {
+			err = app.models.Idempotency.Complete(key, claimedAt, rec.status, replayableHeaders(rec.headers), rec.body.Bytes(), app.config.idempotency.ttl)
+		}
+		if err != nil {
+			app.logError(r, err)
+		}
+	})
+}
+
+// storableStatus() reports whether a response is stored for its idempotency key.
+// Server errors and requests the client closed are not, so that a retry gets
+// another chance, and neither is a 406, which writeResponse() sends in place of
+// what the handler wrote and which would hide the result of a write for the ttl
+func storableStatus(status int) bool {
+	return status != 0 && status < 500 && status != 499 && status != http.StatusNotAcceptable
+}
+
+// fingerprintRequest() reads the decompressed body of the request to fingerprint
+// it, so a gzipped request is the same as its plain copy, and hands the handler
+// a fresh copy of the body
+func fingerprintRequest(w http.ResponseWriter, r *http.Request) (string, error) {
+	maxBytes := 1_048_576
+	reader, err := requestBody(w, r, int64(maxBytes))
+	if err != nil {
+		return "", err
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			err = fmt.Errorf("body must not exceed %d bytes", maxBytes)
+		}
+		return "", err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.Header.Del("Content-Encoding")
+
+	return requestFingerprint(r, body), nil
+}
+
+// requestFingerprint() identifies the request an idempotency key was first used
+// with. JSON bodies are compacted so that whitespace does not change the result
+func requestFingerprint(r *http.Request, body []byte) string {
+	var compacted bytes.Buffer
+	if json.Compact(&compacted, body) == nil {
+		body = compacted.Bytes()
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// validateOpenAPI() checks requests against the OpenAPI document before they are
+// dispatched. A body that is not JSON gets a 400, path parameters, query strings,
+// headers and bodies that do not match their schemas get a 422 with the problems
+// keyed by JSON pointer into the request, e.g. /body/title or /query/page. In dev
+// it can also log responses that do not match the document
+func (app *application) validateOpenAPI(next http.Handler) http.Handler {
+	validateResponses := app.config.openapi.validateResponses && app.config.env == "dev"
+	if !app.config.openapi.validateRequests && !validateResponses {
+		return next
+	}
+
+	doc := app.openAPI()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op, _, params := doc.Find(r.Method, r.URL.Path)
+		// let the router answer requests the document does not describe
+		if op == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if app.config.openapi.validateRequests {
+			errs := openapi.Errors{}
+			for _, param := range op.Parameters {
+				var text string
+				var ok bool
+				switch param.In {
+				case "path":
+					text, ok = params[param.Name]
+				case "query":
+					text, ok = r.URL.Query().Get(param.Name), r.URL.Query().Has(param.Name)
+				case "header":
+					text, ok = r.Header.Get(param.Name), r.Header.Get(param.Name) != ""
+				}
+				pointer := "/" + param.In + "/" + param.Name
+				if !ok {
+					if param.Required {
+						errs[pointer] = "must be provided"
+					}
+					continue
+				}
+				doc.Validate(param.Schema, doc.ParamValue(param.Schema, text), pointer, errs)
+			}
+
+			// a body is validated against the schema of its media type, media types
+			// the document does not list are left for the handler to reject
+			var media openapi.MediaType
+			if op.RequestBody != nil {
+				media = op.RequestBody.Content[app.readMediaType(r)]
+			}
+			if media.Schema != nil {
+				maxBytes := 1_048_576
+				reader, err := requestBody(w, r, int64(maxBytes))
+				if err != nil {
+					app.badResquestReponse(w, r, err)
+					return
+				}
+				body, err := io.ReadAll(reader)
+				if err != nil {
+					var maxBytesError *http.MaxBytesError
+					if errors.As(err, &maxBytesError) {
+						err = fmt.Errorf("body must not exceed %d bytes", maxBytes)
+					}
+					app.badResquestReponse(w, r, err)
+					return
+				}
+				// the handler gets the body already decompressed
+				r.Body = io.NopCloser(bytes.NewReader(body))
+				r.Header.Del("Content-Encoding")
+
+				if len(bytes.TrimSpace(body)) == 0 {
+					if op.RequestBody.Required {
+						app.badResquestReponse(w, r, errors.New("body must not be empty"))
+						return
+					}
+				} else {
+					value, err := decodeJSONValue(body)
+					if err != nil {
+						app.badResquestReponse(w, r, err)
+						return
+					}
+					doc.Validate(media.Schema, value, "/body", errs)
+				}
+			}
+
+			if len(errs) > 0 {
+				app.failedValidationResponse(w, r, errs)
+				return
+			}
+		}
+
+		// streams and files are left alone, the recorder would hold them in memory
+		success := op.Responses["200"]
+		if success == nil {
+			success = op.Responses["201"]
+		}
+		if !validateResponses || success == nil || success.Content["application/json"].Schema == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if !strings.HasPrefix(rec.headers.Get("Content-Type"), "application/json") {
+			return
+		}
+		response := doc.ResolveResponse(op.Responses[strconv.Itoa(rec.status)])
+		if response == nil {
+			app.logContext(r.Context(), "openapi: %s %s returned %d, which is not in the document", r.Method, r.URL.Path, rec.status)
+			return
+		}
+		schema := response.Content["application/json"].Schema
+		if schema == nil {
+			return
+		}
+		value, err := decodeJSONValue(rec.body.Bytes())
+		if err != nil {
+			app.logContext(r.Context(), "openapi: %s %s returned a %d body that is not JSON: %v", r.Method, r.URL.Path, rec.status, err)
+			return
+		}
+		errs := openapi.Errors{}
+		doc.Validate(schema, value, "", errs)
+		if len(errs) > 0 {
+			js, _ := json.Marshal(errs)
+			app.logContext(r.Context(), "openapi: %s %s returned a %d body that does not match the document: %s", r.Method, r.URL.Path, rec.status, js)
+		}
+	})
+}
+
+// decodeJSONValue() decodes a single JSON value keeping numbers as json.Number,
+// so integers can be told apart from other numbers
+func decodeJSONValue(body []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+
+	var value interface{}
+	err := dec.Decode(&value)
+	if err != nil {
+		var syntaxError *json.SyntaxError
+		if errors.As(err, &syntaxError) {
+			return nil, fmt.Errorf("body contains badly-formed JSON body (at character %d)", syntaxError.Offset)
+		}
+		return nil, errors.New("body contains badly-formed JSON body")
+	}
+	if dec.More() {
+		return nil, errors.New("body must only contain a single JSON value")
+	}
+	return value, nil
+}
@@ -0,0 +1,352 @@
+// Filename: cmd/api/middleware_test.go
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateOpenAPIPatchMediaTypes(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.openapi.validateRequests = true
+
+	// the handler gets the body the validator let through
+	var reached string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		reached = string(body)
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := app.validateOpenAPI(next)
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantStatus  int
+		wantBody    string
+	}{
+		{"json patch", "application/json-patch+json", `[{"op": "replace", "path": "/completed", "value": true}]`, http.StatusOK, ""},
+		{"json patch test and remove", "application/json-patch+json", `[{"op": "test", "path": "/title", "value": "a"}, {"op": "remove", "path": "/due_at"}]`, http.StatusOK, ""},
+		{"invalid json patch", "application/json-patch+json", `[{"path": "/completed"}]`, http.StatusUnprocessableEntity, `"/body/0/op"`},
+		{"merge patch clearing a field", "application/merge-patch+json", `{"description": null}`, http.StatusOK, ""},
+		{"merge patch with a charset", "application/merge-patch+json; charset=utf-8", `{"due_at": null, "completed": true}`, http.StatusOK, ""},
+		{"json", "application/json", `{"completed": true}`, http.StatusOK, ""},
+		{"json with a wrong type", "application/json", `{"description": null}`, http.StatusUnprocessableEntity, `"/body/description"`},
+		{"unlisted media type", "text/plain", `completed`, http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reached = ""
+			r := httptest.NewRequest(http.MethodPatch, "/v1/todos/1", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, r)
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body.String())
+			}
+			if tt.wantStatus == http.StatusOK && reached != tt.body {
+				t.Errorf("handler got body %q, want %q", reached, tt.body)
+			}
+			if tt.wantBody != "" && !strings.Contains(rr.Body.String(), tt.wantBody) {
+				t.Errorf("body = %s, want it to contain %s", rr.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestReplayableHeaders(t *testing.T) {
+	headers := http.Header{}
+	headers.Set("Content-Type", "application/json")
+	headers.Set("Location", "/v1/todos/1")
+	headers.Set("X-Request-ID", "first")
+	headers.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	headers.Set("X-Read-Primary-Until", "1792000000000")
+	headers.Add("Set-Cookie", "read_primary_until=1792000000000")
+
+	replayable := replayableHeaders(headers)
+
+	for _, name := range []string{"X-Request-ID", "Traceparent", "X-Read-Primary-Until", "Set-Cookie"} {
+		if value := replayable.Get(name); value != "" {
+			t.Errorf("%s = %q, want it left out", name, value)
+		}
+	}
+	for _, name := range []string{"Content-Type", "Location"} {
+		if replayable.Get(name) != headers.Get(name) {
+			t.Errorf("%s = %q, want %q", name, replayable.Get(name), headers.Get(name))
+		}
+	}
+	// the response being recorded keeps its own headers
+	if headers.Get("X-Request-ID") != "first" {
+		t.Errorf("the recorded headers were changed")
+	}
+}
+
+func TestCheckAccept(t *testing.T) {
+	app := newTestApplication(t)
+
+	var reached bool
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+		w.WriteHeader(http.StatusCreated)
+	})
+	handler := app.checkAccept(next)
+
+	tests := []struct {
+		name       string
+		method     string
+		accept     string
+		wantStatus int
+	}{
+		{"no accept header", http.MethodPost, "", http.StatusCreated},
+		{"json", http.MethodPost, "application/json", http.StatusCreated},
+		{"xml among others", http.MethodPatch, "text/html, application/xml;q=0.5", http.StatusCreated},
+		{"any type", http.MethodDelete, "*/*", http.StatusCreated},
+		{"unsupported write", http.MethodPost, "text/html", http.StatusNotAcceptable},
+		{"refused json", http.MethodPut, "application/json;q=0, text/html", http.StatusNotAcceptable},
+		{"unsupported read", http.MethodGet, "text/event-stream", http.StatusCreated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reached = false
+			r := httptest.NewRequest(tt.method, "/v1/todos", strings.NewReader(`{"title": "a"}`))
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, r)
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body.String())
+			}
+			if reached != (tt.wantStatus != http.StatusNotAcceptable) {
+				t.Errorf("handler reached = %t", reached)
+			}
+			if tt.wantStatus == http.StatusNotAcceptable && rr.Header().Get("Content-Type") != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", rr.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestRequestFingerprint(t *testing.T) {
+	post := func(path, body string) *http.Request {
+		return httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	}
+
+	first := requestFingerprint(post("/v1/todos", ""), []byte(`{"title": "a", "completed": false}`))
+
+	tests := []struct {
+		name string
+		r    *http.Request
+		body string
+		same bool
+	}{
+		{"same body", post("/v1/todos", ""), `{"title": "a", "completed": false}`, true},
+		{"other whitespace", post("/v1/todos", ""), "{\n\t\"title\":\"a\",\n\t\"completed\":false\n}", true},
+		{"other body", post("/v1/todos", ""), `{"title": "b", "completed": false}`, false},
+		{"other path", post("/v1/todos/batch", ""), `{"title": "a", "completed": false}`, false},
+		{"other method", httptest.NewRequest(http.MethodPut, "/v1/todos", nil), `{"title": "a", "completed": false}`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := requestFingerprint(tt.r, []byte(tt.body))
+			if (got == first) != tt.same {
+				t.Errorf("fingerprint = %s, want same as the first request: %t", got, tt.same)
+			}
+		})
+	}
+}
+
+func TestStorableStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		want   bool
+	}{
+		{http.StatusOK, true},
+		{http.StatusCreated, true},
+		{http.StatusBadRequest, true},
+		{http.StatusUnprocessableEntity, true},
+		{0, false},
+		{http.StatusNotAcceptable, false},
+		{499, false},
+		{http.StatusInternalServerError, false},
+		{http.StatusGatewayTimeout, false},
+	}
+
+	for _, tt := range tests {
+		if got := storableStatus(tt.status); got != tt.want {
+			t.Errorf("storableStatus(%d) = %t, want %t", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestFingerprintRequestDecompresses(t *testing.T) {
+	body := `{"title": "a"}`
+
+	var zipped bytes.Buffer
+	zw := gzip.NewWriter(&zipped)
+	zw.Write([]byte(body))
+	zw.Close()
+
+	plain := httptest.NewRequest(http.MethodPost, "/v1/todos", strings.NewReader(body))
+	gzipped := httptest.NewRequest(http.MethodPost, "/v1/todos", &zipped)
+	gzipped.Header.Set("Content-Encoding", "gzip")
+
+	want, err := fingerprintRequest(httptest.NewRecorder(), plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := fingerprintRequest(httptest.NewRecorder(), gzipped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("gzipped fingerprint = %s, want %s", got, want)
+	}
+
+	// the handler reads the body as if it had been sent plain
+	read, _ := io.ReadAll(gzipped.Body)
+	if string(read) != body || gzipped.Header.Get("Content-Encoding") != "" {
+		t.Errorf("handler gets body %q with Content-Encoding %q", read, gzipped.Header.Get("Content-Encoding"))
+	}
+
+	bad := httptest.NewRequest(http.MethodPost, "/v1/todos", strings.NewReader(body))
+	bad.Header.Set("Content-Encoding", "gzip")
+	if _, err := fingerprintRequest(httptest.NewRecorder(), bad); err == nil {
+		t.Errorf("a body that is not gzip was accepted")
+	}
+}
+
+func TestIdempotentBeforeClaim(t *testing.T) {
+	app := newTestApplication(t)
+
+	// the requests that are answered before a key is claimed, which would need
+	// the database
+	tests := []struct {
+		name     string
+		key      string
+		encoding string
+		body     string
+		status   int
+		handled  bool
+	}{
+		{"no key", "", "", `{"title": "a"}`, http.StatusCreated, true},
+		{"key too long", strings.Repeat("k", 256), "", `{"title": "a"}`, http.StatusBadRequest, false},
+		{"body not gzip", "abc", "gzip", `{"title": "a"}`, http.StatusBadRequest, false},
+		{"body too large", "abc", "", strings.Repeat("a", 1_048_577), http.StatusBadRequest, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handled := false
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handled = true
+				w.WriteHeader(http.StatusCreated)
+			})
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/todos", strings.NewReader(tt.body))
+			if tt.key != "" {
+				r.Header.Set("Idempotency-Key", tt.key)
+			}
+			if tt.encoding != "" {
+				r.Header.Set("Content-Encoding", tt.encoding)
+			}
+			w := httptest.NewRecorder()
+
+			app.idempotent(next).ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Errorf("got status %d, want %d", w.Code, tt.status)
+			}
+			if handled != tt.handled {
+				t.Errorf("handler ran: %t, want %t", handled, tt.handled)
+			}
+		})
+	}
+}
+
+func TestResponseRecorder(t *testing.T) {
+	w := httptest.NewRecorder()
+	rec := &responseRecorder{ResponseWriter: w}
+
+	w.Header().Set("Location", "/v1/todos/1")
+	rec.WriteHeader(http.StatusCreated)
+	// headers set once the response has started are not part of it
+	w.Header().Set("X-Late", "yes")
+	rec.Write([]byte(`{"todo": `))
+	rec.Write([]byte(`{"id": 1}}`))
+
+	if rec.status != http.StatusCreated || w.Code != http.StatusCreated {
+		t.Errorf("got status %d recorded and %d sent, want %d", rec.status, w.Code, http.StatusCreated)
+	}
+	if rec.body.String() != `{"todo": {"id": 1}}` || w.Body.String() != rec.body.String() {
+		t.Errorf("got body %q recorded and %q sent", rec.body.String(), w.Body.String())
+	}
+	if rec.headers.Get("Location") != "/v1/todos/1" || rec.headers.Get("X-Late") != "" {
+		t.Errorf("got headers %v recorded", rec.headers)
+	}
+
+	// a handler that only writes the body gets a 200
+	rec = &responseRecorder{ResponseWriter: httptest.NewRecorder()}
+	rec.Write([]byte("ok"))
+	if rec.status != http.StatusOK {
+		t.Errorf("got status %d recorded, want %d", rec.status, http.StatusOK)
+	}
+}
+
+func TestRequireFeedsAdmin(t *testing.T) {
+	tests := []struct {
+		name          string
+		env           string
+		key           string
+		authorization string
+		wantStatus    int
+	}{
+		{"right key", "prd", "s3cret", "Bearer s3cret", http.StatusOK},
+		{"wrong key", "prd", "s3cret", "Bearer guess", http.StatusUnauthorized},
+		{"missing key", "prd", "s3cret", "", http.StatusUnauthorized},
+		{"not a bearer token", "prd", "s3cret", "Basic s3cret", http.StatusUnauthorized},
+		{"no key in dev", "dev", "", "", http.StatusOK},
+		{"no key in production", "prd", "", "Bearer anything", http.StatusForbidden},
+		{"key in dev", "dev", "s3cret", "", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.env = tt.env
+			app.config.feeds.adminKey = tt.key
+
+			handler := app.requireFeedsAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/feeds", strings.NewReader(`{"name": "phone"}`))
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, r)
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body.String())
+			}
+			if tt.wantStatus == http.StatusUnauthorized && rr.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("WWW-Authenticate = %q, want Bearer", rr.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
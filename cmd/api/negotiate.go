@@ -0,0 +1,194 @@
+// Filename: cmd/api/negotiate.go
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"todoapi.miguelavila.net/internals/msgpack"
+)
+
+// responseFormat is a media type responses can be encoded in
+type responseFormat struct {
+	contentType string
+	aliases     []string
+	encode      func(data envelope, pretty bool) ([]byte, error)
+}
+
+// responseFormats are the media types the API responds with, in order of
+// preference when the client accepts several equally
+var responseFormats = []responseFormat{
+	{contentType: "application/json", encode: encodeJSON},
+	{contentType: "application/xml", aliases: []string{"text/xml"}, encode: encodeXML},
+	{contentType: "application/msgpack", aliases: []string{"application/x-msgpack"}, encode: encodeMsgpack},
+}
+
+// negotiateFormat() picks the response format the Accept header of the request
+// prefers, JSON when there is no Accept header. It returns false when the
+// client accepts none of them
+func negotiateFormat(r *http.Request) (responseFormat, bool) {
+	accept := r.Header.Values("Accept")
+	if len(accept) == 0 {
+		return responseFormats[0], true
+	}
+
+	best, bestQ := responseFormat{}, 0.0
+	for _, format := range responseFormats {
+		q := acceptQuality(accept, append([]string{format.contentType}, format.aliases...))
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best, bestQ > 0
+}
+
+// acceptQuality() returns the quality the Accept header gives to any of the
+// media types, taken from the most specific range that matches
+func acceptQuality(accept []string, mediaTypes []string) float64 {
+	quality, specificity := 0.0, -1
+	for _, header := range accept {
+		for _, part := range strings.Split(header, ",") {
+			mediaRange, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			q := 1.0
+			if value, ok := params["q"]; ok {
+				q, err = strconv.ParseFloat(value, 64)
+				if err != nil {
+					continue
+				}
+			}
+
+			for _, mediaType := range mediaTypes {
+				s := -1
+				switch {
+				case mediaRange == mediaType:
+					s = 2
+				case mediaRange == "*/*":
+					s = 0
+				case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*")):
+					s = 1
+				}
+				if s > specificity {
+					quality, specificity = q, s
+				}
+			}
+		}
+	}
+	return quality
+}
+
+// genericValue() converts data to the values it has as JSON, so every format
+// uses the json field names and a type's own MarshalJSON()
+func genericValue(data envelope) (interface{}, error) {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+
+	var value interface{}
+	err = dec.Decode(&value)
+	return value, err
+}
+
+// encodeJSON() encodes compact JSON, indented when pretty
+func encodeJSON(data envelope, pretty bool) ([]byte, error) {
+	if pretty {
+		return json.MarshalIndent(data, "", "\t")
+	}
+	return json.Marshal(data)
+}
+
+// encodeMsgpack() encodes MessagePack, pretty does not apply to a binary format
+func encodeMsgpack(data envelope, pretty bool) ([]byte, error) {
+	value, err := genericValue(data)
+	if err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(value)
+}
+
+// xmlName matches the keys that can be used as XML element names as they are
+var xmlName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9._-]*$`)
+
+// encodeXML() encodes XML under a <response> root. Object keys become elements,
+// keys that are not valid element names are written as <entry key="...">,
+// array items are <item> elements and null values are left out
+func encodeXML(data envelope, pretty bool) ([]byte, error) {
+	value, err := genericValue(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	writeXMLElement(&buf, "response", value, pretty, 0)
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// writeXMLElement() writes a value as an element named after key
+func writeXMLElement(buf *bytes.Buffer, key string, value interface{}, pretty bool, depth int) {
+	if value == nil {
+		return
+	}
+
+	indent := ""
+	if pretty {
+		indent = strings.Repeat("\t", depth)
+	}
+
+	name, attr := key, ""
+	if !xmlName.MatchString(key) || strings.HasPrefix(strings.ToLower(key), "xml") {
+		var escaped bytes.Buffer
+		xml.EscapeText(&escaped, []byte(key))
+		name, attr = "entry", ` key="`+escaped.String()+`"`
+	}
+
+	buf.WriteString(indent + "<" + name + attr + ">")
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		if pretty {
+			buf.WriteString("\n")
+		}
+		for _, k := range keys {
+			writeXMLElement(buf, k, v[k], pretty, depth+1)
+		}
+		buf.WriteString(indent)
+	case []interface{}:
+		if pretty {
+			buf.WriteString("\n")
+		}
+		for _, item := range v {
+			writeXMLElement(buf, "item", item, pretty, depth+1)
+		}
+		buf.WriteString(indent)
+	case string:
+		xml.EscapeText(buf, []byte(v))
+	case json.Number:
+		buf.WriteString(v.String())
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	}
+	buf.WriteString("</" + name + ">")
+	if pretty {
+		buf.WriteString("\n")
+	}
+}
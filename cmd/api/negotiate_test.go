@@ -0,0 +1,177 @@
+// Filename: cmd/api/negotiate_test.go
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"todoapi.miguelavila.net/internals/data"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept []string
+		want   string
+		ok     bool
+	}{
+		{"no header", nil, "application/json", true},
+		{"json", []string{"application/json"}, "application/json", true},
+		{"xml", []string{"application/xml"}, "application/xml", true},
+		{"xml alias", []string{"text/xml"}, "application/xml", true},
+		{"msgpack", []string{"application/msgpack"}, "application/msgpack", true},
+		{"msgpack alias", []string{"application/x-msgpack"}, "application/msgpack", true},
+		{"anything", []string{"*/*"}, "application/json", true},
+		{"any application type", []string{"application/*"}, "application/json", true},
+		{"higher quality wins", []string{"application/json;q=0.5, application/xml"}, "application/xml", true},
+		{"tie goes to the preferred format", []string{"application/xml, application/json"}, "application/json", true},
+		{"specific range over the wildcard", []string{"application/json;q=0, */*"}, "application/xml", true},
+		{"several headers", []string{"text/html", "application/msgpack"}, "application/msgpack", true},
+		{"browser", []string{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"}, "application/xml", true},
+		{"bad quality is ignored", []string{"application/json;q=high, application/xml;q=0.2"}, "application/xml", true},
+		{"nothing acceptable", []string{"text/html"}, "", false},
+		{"everything refused", []string{"*/*;q=0"}, "", false},
+		{"malformed", []string{"not a media type"}, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/todos", nil)
+			for _, value := range tt.accept {
+				r.Header.Add("Accept", value)
+			}
+
+			format, ok := negotiateFormat(r)
+			if ok != tt.ok {
+				t.Fatalf("got ok %t, want %t", ok, tt.ok)
+			}
+			if ok && format.contentType != tt.want {
+				t.Errorf("got %s, want %s", format.contentType, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeXML(t *testing.T) {
+	tests := []struct {
+		name string
+		data envelope
+		want string
+	}{
+		{"values", envelope{"id": 1, "title": "a < b & c", "completed": false}, "<response><completed>false</completed><id>1</id><title>a &lt; b &amp; c</title></response>"},
+		{"nulls are left out", envelope{"due_at": nil, "id": 2}, "<response><id>2</id></response>"},
+		{"arrays", envelope{"tags": []string{"a", "b"}}, "<response><tags><item>a</item><item>b</item></tags></response>"},
+		{"nested", envelope{"errors": map[string]string{"title": "must be provided"}}, "<response><errors><title>must be provided</title></errors></response>"},
+		{"invalid names", envelope{"errors": map[string]string{"1st": "x", "a b": "y", "xmlns": "z"}}, `<response><errors><entry key="1st">x</entry><entry key="a b">y</entry><entry key="xmlns">z</entry></errors></response>`},
+		{"escaped keys", envelope{"<a>": "x"}, `<response><entry key="&lt;a&gt;">x</entry></response>`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := encodeXML(tt.data, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := xml.Header + tt.want; string(body) != want {
+				t.Errorf("got %s, want %s", body, want)
+			}
+
+			// the output must be well formed, pretty or not
+			for _, pretty := range []bool{false, true} {
+				body, _ := encodeXML(tt.data, pretty)
+				dec := xml.NewDecoder(bytes.NewReader(body))
+				for {
+					_, err := dec.Token()
+					if err != nil {
+						if err != io.EOF {
+							t.Errorf("pretty %t: %v in %s", pretty, err, body)
+						}
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeXMLUsesJSONNames(t *testing.T) {
+	due := time.Date(2026, 10, 20, 9, 0, 0, 0, time.UTC)
+	todo := &data.Todo{ID: 7, Title: "Write tests", DueAt: &due, Version: 1}
+
+	body, err := encodeXML(envelope{"todo": todo}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"<id>7</id>", "<title>Write tests</title>", "<due_at>2026-10-20T09:00:00Z</due_at>", "<version>1</version>"} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("%s does not contain %s", body, want)
+		}
+	}
+	if strings.Contains(string(body), "CreatedAt") || strings.Contains(string(body), "remind_at") {
+		t.Errorf("%s contains fields the JSON leaves out", body)
+	}
+}
+
+func TestEncodeMsgpack(t *testing.T) {
+	body, err := encodeMsgpack(envelope{"todo": &data.Todo{ID: 7, Title: "a", Version: 1}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// {"todo": {"completed": false, "id": 7, "title": "a", "updated_at": ..., "version": 1}}
+	want := []byte{0x81, 0xa4, 't', 'o', 'd', 'o', 0x85, 0xa9, 'c', 'o', 'm', 'p', 'l', 'e', 't', 'e', 'd', 0xc2, 0xa2, 'i', 'd', 0x07}
+	if !bytes.HasPrefix(body, want) {
+		t.Errorf("got % x, want it to start with % x", body, want)
+	}
+}
+
+func TestWriteResponseFormats(t *testing.T) {
+	app := newTestApplication(t)
+
+	tests := []struct {
+		name        string
+		accept      string
+		status      int
+		contentType string
+	}{
+		{"json", "", http.StatusOK, "application/json"},
+		{"xml", "application/xml", http.StatusOK, "application/xml"},
+		{"msgpack", "application/msgpack", http.StatusOK, "application/msgpack"},
+		{"not acceptable", "text/html", http.StatusNotAcceptable, "application/json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/healthcheck", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+
+			err := app.writeResponse(w, r, http.StatusOK, envelope{"status": "available"}, http.Header{"X-Extra": {"1"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != tt.status {
+				t.Errorf("got status %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("got Content-Type %s, want %s", got, tt.contentType)
+			}
+			if w.Header().Get("Vary") != "Accept" {
+				t.Errorf("got Vary %q, want Accept", w.Header().Get("Vary"))
+			}
+			// the headers of a response that could not be sent are dropped
+			if got := w.Header().Get("X-Extra") != ""; got != (tt.status == http.StatusOK) {
+				t.Errorf("got X-Extra %q", w.Header().Get("X-Extra"))
+			}
+		})
+	}
+}
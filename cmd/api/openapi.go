@@ -0,0 +1,712 @@
+// Filename: cmd/api/openapi.go
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"todoapi.miguelavila.net/internals/data"
+	"todoapi.miguelavila.net/internals/openapi"
+)
+
+// openAPIHandler for GET /v1/openapi.json endpoint, it serves the OpenAPI 3.1
+// document describing the API
+func (app *application) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	// the document is the whole body rather than a value in an envelope, so it
+	// is always JSON
+	js, err := json.Marshal(app.openAPI())
+	if pretty, _ := strconv.ParseBool(r.URL.Query().Get("pretty")); pretty {
+		js, err = json.MarshalIndent(app.openAPI(), "", "\t")
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	js = append(js, '\n')
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(js)
+}
+
+// checkOpenAPI() returns an error naming the registered routes the OpenAPI
+// document does not describe. It runs at startup so a route cannot be added
+// without documenting it
+func (app *application) checkOpenAPI() error {
+	missing := app.openAPI().Missing(app.routes().registered)
+	if len(missing) > 0 {
+		return fmt.Errorf("routes missing from the OpenAPI document: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// schema helpers, they keep the operations below readable
+
+func ref(name string) *openapi.Schema {
+	return &openapi.Schema{Ref: "#/components/schemas/" + name}
+}
+
+func typed(name string, format ...string) *openapi.Schema {
+	s := &openapi.Schema{Type: openapi.Types{name}}
+	if len(format) > 0 {
+		s.Format = format[0]
+	}
+	return s
+}
+
+func maxLength(s *openapi.Schema, n int) *openapi.Schema {
+	s.MaxLength = &n
+	return s
+}
+
+func nullable(s *openapi.Schema) *openapi.Schema {
+	s.Type = append(s.Type, "null")
+	return s
+}
+
+func arrayOf(items *openapi.Schema) *openapi.Schema {
+	return &openapi.Schema{Type: openapi.Types{"array"}, Items: items}
+}
+
+func enum(values ...string) *openapi.Schema {
+	s := typed("string")
+	for _, value := range values {
+		s.Enum = append(s.Enum, value)
+	}
+	return s
+}
+
+func intRange(min float64, max float64) *openapi.Schema {
+	s := typed("integer")
+	s.Minimum = &min
+	s.Maximum = &max
+	return s
+}
+
+// object() is an object schema with the given properties. Request bodies are
+// decoded with unknown fields disallowed, closed() says so in the schema
+func object(properties map[string]*openapi.Schema, required ...string) *openapi.Schema {
+	return &openapi.Schema{Type: openapi.Types{"object"}, Properties: properties, Required: required}
+}
+
+func closed(s *openapi.Schema) *openapi.Schema {
+	s.AdditionalProperties = &openapi.Schema{Not: &openapi.Schema{}}
+	return s
+}
+
+func queryParam(name string, schema *openapi.Schema, description string) *openapi.Parameter {
+	return &openapi.Parameter{Name: name, In: "query", Schema: schema, Description: description}
+}
+
+func jsonBody(schema *openapi.Schema) *openapi.RequestBody {
+	return &openapi.RequestBody{Required: true, Content: map[string]openapi.MediaType{"application/json": {Schema: schema}}}
+}
+
+func jsonResponse(description string, schema *openapi.Schema) *openapi.Response {
+	return &openapi.Response{Description: description, Content: map[string]openapi.MediaType{"application/json": {Schema: schema}}}
+}
+
+func errorRef(name string) *openapi.Response {
+	return &openapi.Response{Ref: "#/components/responses/" + name}
+}
+
+func messageSchema() *openapi.Schema {
+	return object(map[string]*openapi.Schema{"message": typed("string")}, "message")
+}
+
+// responses builds the responses of an operation, adding the error responses
+// every operation can return
+func responses(rs map[string]*openapi.Response) map[string]*openapi.Response {
+	rs["500"] = errorRef("ServerError")
+	rs["504"] = errorRef("GatewayTimeout")
+	return rs
+}
+
+// openAPI() builds the OpenAPI document. Every route registered in routes() must
+// have an operation here, checkOpenAPI() enforces it
+func (app *application) openAPI() *openapi.Document {
+	idParam := &openapi.Parameter{Name: "id", In: "path", Required: true, Schema: intRange(1, 9.2e18)}
+	ifMatch := &openapi.Parameter{Name: "If-Match", In: "header", Schema: typed("string"), Description: "ETag of the todo, the request fails with 412 when it has changed"}
+
+	todoFields := func() map[string]*openapi.Schema {
+		return map[string]*openapi.Schema{
+			"title":       maxLength(typed("string"), 100),
+			"description": maxLength(typed("string"), 1000),
+			"project":     maxLength(typed("string"), 100),
+			"completed":   typed("boolean"),
+			"due_at":      typed("string", "date-time"),
+			"remind_at":   typed("string", "date-time"),
+			"recurrence":  &openapi.Schema{Type: openapi.Types{"string"}, Description: "RRULE, e.g. FREQ=WEEKLY;BYDAY=MO"},
+		}
+	}
+
+	todoPatch := closed(object(todoFields()))
+	todoReplace := todoFields()
+	todoReplace["due_at"] = nullable(typed("string", "date-time"))
+	todoReplace["remind_at"] = nullable(typed("string", "date-time"))
+
+	batchOperation := closed(object(map[string]*openapi.Schema{
+		"op":      enum("create", "update", "delete"),
+		"id":      typed("integer"),
+		"version": typed("integer"),
+		"todo":    todoPatch,
+	}, "op"))
+
+	batchResult := object(map[string]*openapi.Schema{
+		"index":              typed("integer"),
+		"op":                 typed("string"),
+		"id":                 typed("integer"),
+		"status":             typed("integer"),
+		"version":            typed("integer"),
+		"next_occurrence_id": typed("integer"),
+		"errors":             ref("ValidationErrors"),
+	}, "index", "op", "status")
+
+	listParams := []*openapi.Parameter{
+		queryParam("title", typed("string"), "full text search on the title"),
+		queryParam("description", typed("string"), "full text search on the description"),
+		queryParam("project", typed("string"), "only todos in the project"),
+		queryParam("completed", typed("boolean"), "only completed todos when true"),
+	}
+	sortParam := queryParam("sort", enum(todoSortList...), "sort field, prefix with - for descending order")
+	pageParams := []*openapi.Parameter{
+		queryParam("page", intRange(1, 1000), "page number"),
+		queryParam("page_size", intRange(1, 100), "todos per page"),
+	}
+
+	webhookInput := func(required ...string) *openapi.Schema {
+		return closed(object(map[string]*openapi.Schema{
+			"url":    typed("string", "uri"),
+			"secret": typed("string"),
+			"events": arrayOf(enum(data.EventTypes...)),
+			"active": typed("boolean"),
+		}, required...))
+	}
+
+	ops := map[string]*openapi.Operation{
+		"GET /v1/healthcheck": {
+			Summary: "Report that the API is available",
+			Tags:    []string{"system"},
+			Responses: responses(map[string]*openapi.Response{
+				"200": jsonResponse("the API is available", object(map[string]*openapi.Schema{
+					"status": typed("string"),
+					"system_info": object(map[string]*openapi.Schema{
+						"environment": typed("string"),
+						"version":     typed("string"),
+					}, "environment", "version"),
+				}, "status", "system_info")),
+			}),
+		},
+		"GET /v1/openapi.json": {
+			Summary:   "This document",
+			Tags:      []string{"system"},
+			Responses: responses(map[string]*openapi.Response{"200": jsonResponse("the OpenAPI document", typed("object"))}),
+		},
+		"GET /debug/queries": {
+			Summary: "Show the timings of the todo queries and the recent slow queries, only served in dev",
+			Tags:    []string{"system"},
+			Responses: responses(map[string]*openapi.Response{
+				"200": jsonResponse("the query timings", object(map[string]*openapi.Schema{
+					"queries":      arrayOf(ref("QueryStats")),
+					"slow_queries": arrayOf(ref("SlowQuery")),
+				}, "queries", "slow_queries")),
+			}),
+		},
+		"GET /v1/todos": {
+			Summary:    "List todos",
+			Tags:       []string{"todos"},
+			Parameters: append(append(listParams, sortParam), pageParams...),
+			Responses: responses(map[string]*openapi.Response{
+				"200": jsonResponse("a page of todos", object(map[string]*openapi.Schema{
+					"todos":    arrayOf(ref("Todo")),
+					"metadata": ref("Metadata"),
+				}, "todos", "metadata")),
+				"304": {Description: "the listing has not changed since the ETag in If-None-Match"},
+				"422": errorRef("FailedValidation"),
+			}),
+		},
+		"POST /v1/todos": {
+			Summary: "Create a todo",
+			Tags:    []string{"todos"},
+			Parameters: []*openapi.Parameter{
+				{Name: "Idempotency-Key", In: "header", Schema: maxLength(typed("string"), 255), Description: "retries with the same key return the first response"},
+			},
+			RequestBody: jsonBody(closed(object(todoFields(), "title", "description"))),
+			Responses: responses(map[string]*openapi.Response{
+				"201": jsonResponse("the todo was created", object(map[string]*openapi.Schema{"todo": ref("Todo")}, "todo")),
+				"400": errorRef("BadRequest"),
+				"409": errorRef("Conflict"),
+				"422": errorRef("FailedValidation"),
+			}),
+		},
+		"GET /v1/todos.ics": {
+			Summary: "Calendar feed of the todos as VTODO components",
+			Tags:    []string{"calendar"},
+			Parameters: []*openapi.Parameter{
+				{Name: "token", In: "query", Required: true, Schema: typed("string"), Description: "feed token from POST /v1/feeds"},
+				queryParam("project", typed("string"), "only todos in the project"),
+				queryParam("completed", typed("boolean"), "only completed todos when true"),
+			},
+			Responses: responses(map[string]*openapi.Response{
+				"200": {Description: "an iCalendar file", Content: map[string]openapi.MediaType{"text/calendar": {Schema: typed("string")}}},
+				"401": errorRef("Unauthorized"),
+				"422": errorRef("FailedValidation"),
+			}),
+		},
+		"POST /v1/todos/batch": {
+			Summary: "Create, update and delete todos in one request",
+			Tags:    []string{"todos"},
+			RequestBody: jsonBody(closed(object(map[string]*openapi.Schema{
+				"best_effort": typed("boolean"),
+				"operations":  arrayOf(batchOperation),
+			}, "operations"))),
+			Responses: responses(map[string]*openapi.Response{
+				"200": jsonResponse("the operations were applied", object(map[string]*openapi.Schema{
+					"committed": typed("boolean"),
+					"results":   arrayOf(batchResult),
+				}, "committed", "results")),
+				"400": errorRef("BadRequest"),
+				"422": jsonResponse("an operation failed and the batch was rolled back, or the request is invalid", typed("object")),
+			}),
+		},
+		"POST /v1/todos/import": {
+			Summary: "Import todos from a CSV, JSON, todo.txt or iCalendar file",
+			Tags:    []string{"todos"},
+			RequestBody: &openapi.RequestBody{Required: true, Content: map[string]openapi.MediaType{
+				"multipart/form-data": {Schema: object(map[string]*openapi.Schema{
+					"file":    typed("string", "binary"),
+					"format":  enum(importFormats...),
+					"dry_run": typed("boolean"),
+				}, "file")},
+			}},
+			Responses: responses(map[string]*openapi.Response{
+				"200": jsonResponse("the import report", object(map[string]*openapi.Schema{
+					"dry_run":  typed("boolean"),
+					"format":   typed("string"),
+					"valid":    typed("integer"),
+					"inserted": typed("integer"),
+					"skipped":  typed("integer"),
+					"rows": arrayOf(object(map[string]*openapi.Schema{
+						"line":   typed("integer"),
+						"status": enum("inserted", "valid", "skipped"),
+						"id":     typed("integer"),
+						"title":  typed("string"),
+						"errors": ref("ValidationErrors"),
+					}, "line", "status")),
+				}, "dry_run", "format", "valid", "inserted", "skipped", "rows")),
+				"400": errorRef("BadRequest"),
+				"415": errorRef("UnsupportedMediaType"),
+				"422": errorRef("FailedValidation"),
+			}),
+		},
+		"GET /v1/todos/events": {
+			Summary: "Stream todo changes as Server-Sent Events",
+			Tags:    []string{"events"},
+			Parameters: []*openapi.Parameter{
+				{Name: "Last-Event-ID", In: "header", Schema: typed("string"), Description: "resume after this event"},
+				queryParam("last_event_id", typed("integer"), "resume after this event, for clients that cannot set headers"),
+			},
+			Responses: responses(map[string]*openapi.Response{
+				"200": {Description: "an event stream", Content: map[string]openapi.MediaType{"text/event-stream": {Schema: typed("string")}}},
+				"400": errorRef("BadRequest"),
+			}),
+		},
+		"GET /v1/todos/export": {
+			Summary:    "Export every matching todo as CSV or NDJSON",
+			Tags:       []string{"todos"},
+			Parameters: append(append(listParams, sortParam), queryParam("format", enum("csv", "ndjson"), "file format, csv by default")),
+			Responses: responses(map[string]*openapi.Response{
+				"200": {Description: "the todos", Content: map[string]openapi.MediaType{
+					"text/csv":             {Schema: typed("string")},
+					"application/x-ndjson": {Schema: typed("string")},
+				}},
+				"422": errorRef("FailedValidation"),
+			}),
+		},
+		"GET /v1/todos/:id": {
+			Summary:    "Show a todo",
+			Tags:       []string{"todos"},
+			Parameters: []*openapi.Parameter{idParam},
+			Responses: responses(map[string]*openapi.Response{
+				"200": jsonResponse("the todo", object(map[string]*openapi.Schema{"todo": ref("Todo")}, "todo")),
+				"304": {Description: "the todo has not changed since the ETag in If-None-Match"},
+				"404": errorRef("NotFound"),
+			}),
+		},
+		"PUT /v1/todos/:id": {
+			Summary:     "Replace a todo, or create it with this id when allowed",
+			Tags:        []string{"todos"},
+			Parameters:  []*openapi.Parameter{idParam, ifMatch},
+			RequestBody: jsonBody(closed(object(todoReplace, "title", "description", "project", "completed", "due_at", "remind_at", "recurrence"))),
+			Responses: responses(map[string]*openapi.Response{
+				"200": jsonResponse("the todo was replaced", object(map[string]*openapi.Schema{"todo": ref("Todo"), "next_occurrence": ref("Todo")}, "todo")),
+				"201": jsonResponse("the todo was created", object(map[string]*openapi.Schema{"todo": ref("Todo")}, "todo")),
+				"400": errorRef("BadRequest"),
+				"404": errorRef("NotFound"),
+				"409": errorRef("Conflict"),
+				"412": errorRef("PreconditionFailed"),
+				"422": errorRef("FailedValidation"),
+				"428": errorRef("PreconditionRequired"),
+			}),
+		},
+		"PATCH /v1/todos/:id": {
+			Summary:    "Update some of a todo's fields",
+			Tags:       []string{"todos"},
+			Parameters: []*openapi.Parameter{idParam, ifMatch},
+			RequestBody: &openapi.RequestBody{Required: true, Content: map[string]openapi.MediaType{
+				"application/json":             {Schema: todoPatch},
+				"application/merge-patch+json": {Schema: typed("object")},
+				"application/json-patch+json": {Schema: arrayOf(object(map[string]*openapi.Schema{
+					"op":    enum("add", "remove", "replace", "move", "copy", "test"),
+					"path":  typed("string"),
+					"from":  typed("string"),
+					"value": {},
+				}, "op", "path"))},
+			}},
+			Responses: responses(map[string]*openapi.Response{
+				"200": jsonResponse("the todo was updated", object(map[string]*openapi.Schema{"todo": ref("Todo"), "next_occurrence": ref("Todo")}, "todo")),
+				"400": errorRef("BadRequest"),
+				"404": errorRef("NotFound"),
+				"409": errorRef("Conflict"),
+				"412": errorRef("PreconditionFailed"),
+				"422": errorRef("FailedValidation"),
+				"428": errorRef("PreconditionRequired"),
+			}),
+		},
+		"DELETE /v1/todos/:id": {
+			Summary:    "Delete a todo",
+			Tags:       []string{"todos"},
+			Parameters: []*openapi.Parameter{idParam, ifMatch},
+			Responses: responses(map[string]*openapi.Response{
+				"200": jsonResponse("the todo was deleted", messageSchema()),
+				"404": errorRef("NotFound"),
+				"409": errorRef("Conflict"),
+				"412": errorRef("PreconditionFailed"),
+				"428": errorRef("PreconditionRequired"),
+			}),
+		},
+		"GET /v1/todos/:id/occurrences": {
+			Summary: "Preview the upcoming occurrences of a recurring todo",
+			Tags:    []string{"todos"},
+			Parameters: []*openapi.Parameter{
+				idParam,
+				queryParam("from", typed("string"), "RFC 3339 timestamp or date, now by default"),
+				queryParam("to", typed("string"), "RFC 3339 timestamp or date, 30 days after from by default"),
+				queryParam("limit", intRange(1, 100), "most occurrences returned"),
+			},
+			Responses: responses(map[string]*openapi.Response{
+				"200": jsonResponse("the occurrences", object(map[string]*openapi.Schema{
+					"occurrences": arrayOf(object(map[string]*openapi.Schema{
+						"occurrence": typed("integer"),
+						"due_at":     typed("string", "date-time"),
+					}, "occurrence", "due_at")),
+				}, "occurrences")),
+				"404": errorRef("NotFound"),
+				"422": errorRef("FailedValidation"),
+			}),
+		},
+		"GET /v1/todos/:id/reminders": {
+			Summary:    "List the delivery attempts of a todo's reminders",
+			Tags:       []string{"todos"},
+			Parameters: []*openapi.Parameter{idParam},
+			Responses: responses(map[string]*openapi.Response{
+				"200": jsonResponse("the delivery attempts", object(map[string]*openapi.Schema{"deliveries": arrayOf(ref("ReminderDelivery"))}, "deliveries")),
+				"404": errorRef("NotFound"),
+			}),
+		},
+		"GET /v1/sync": {
+			Summary: "Pull the todos changed and deleted since a sync token",
+			Tags:    []string{"sync"},
+			Parameters: []*openapi.Parameter{
+				queryParam("since", typed("string"), "sync token from the last pull, everything when left out"),
+				queryParam("limit", intRange(1, 1000), "most changes returned"),
+			},
+			Responses: responses(map[string]*openapi.Response{
+				"200": jsonResponse("the changes", object(map[string]*openapi.Schema{
+					"todos": arrayOf(ref("Todo")),
+					"deleted": arrayOf(object(map[string]*openapi.Schema{
+						"id":         typed("integer"),
+						"version":    typed("integer"),
+						"deleted_at": typed("string", "date-time"),
+					}, "id", "version", "deleted_at")),
+					"sync_token": typed("string"),
+					"has_more":   typed("boolean"),
+				}, "todos", "deleted", "sync_token", "has_more")),
+				"410": jsonResponse("the sync token has expired, pull again without one", ref("Error")),
+				"422": errorRef("FailedValidation"),
+			}),
+		},
+		"POST /v1/sync": {
+			Summary:     "Push changes made offline",
+			Tags:        []string{"sync"},
+			RequestBody: jsonBody(closed(object(map[string]*openapi.Schema{"changes": arrayOf(batchOperation)}, "changes"))),
+			Responses: responses(map[string]*openapi.Response{
+				"200": jsonResponse("the outcome of each change", object(map[string]*openapi.Schema{
+					"results":   arrayOf(typed("object")),
+					"conflicts": typed("integer"),
+				}, "results", "conflicts")),
+				"400": errorRef("BadRequest"),
+				"422": errorRef("FailedValidation"),
+			}),
+		},
+		"GET /v1/ws": {
+			Summary: "WebSocket for subscribing to todos and editing them",
+			Tags:    []string{"events"},
+			Responses: responses(map[string]*openapi.Response{
+				"101": {Description: "switching to the WebSocket protocol"},
+				"400": {Description: "not a WebSocket handshake"},
+				"403": {Description: "the origin is not allowed"},
+				"503": errorRef("Unavailable"),
+			}),
+		},
+		"POST /v1/graphql": {
+			Summary: "Query and change todos with GraphQL",
+			Tags:    []string{"graphql"},
+			RequestBody: jsonBody(closed(object(map[string]*openapi.Schema{
+				"query":         typed("string"),
+				"operationName": typed("string"),
+				"variables":     typed("object"),
+			}, "query"))),
+			Responses: responses(map[string]*openapi.Response{
+				"200": jsonResponse("the GraphQL result, errors include those of queries over the depth and complexity limits", object(map[string]*openapi.Schema{
+					"data":   nullable(typed("object")),
+					"errors": arrayOf(typed("object")),
+				})),
+				"400": errorRef("BadRequest"),
+				"422": errorRef("FailedValidation"),
+			}),
+		},
+		"GET /v1/feeds": {
+			Summary: "List the calendar feed tokens",
+			Tags:    []string{"calendar"},
+			Responses: responses(map[string]*openapi.Response{
+				"200": jsonResponse("the feed tokens", object(map[string]*openapi.Schema{"feeds": arrayOf(ref("FeedToken"))}, "feeds")),
+				"401": errorRef("Unauthorized"),
+				"403": errorRef("Forbidden"),
+			}),
+		},
+		"POST /v1/feeds": {
+			Summary: "Create a calendar feed token",
+			Tags:    []string{"calendar"},
+			RequestBody: jsonBody(closed(object(map[string]*openapi.Schema{
+				"name":    maxLength(typed("string"), 100),
+				"project": maxLength(typed("string"), 100),
+			}, "name"))),
+			Responses: responses(map[string]*openapi.Response{
+				"201": jsonResponse("the feed token, shown only this once", object(map[string]*openapi.Schema{
+					"feed": ref("FeedToken"),
+					"url":  typed("string"),
+				}, "feed", "url")),
+				"400": errorRef("BadRequest"),
+				"401": errorRef("Unauthorized"),
+				"403": errorRef("Forbidden"),
+				"422": errorRef("FailedValidation"),
+			}),
+		},
+		"DELETE /v1/feeds/:id": {
+			Summary:    "Revoke a calendar feed token",
+			Tags:       []string{"calendar"},
+			Parameters: []*openapi.Parameter{idParam},
+			Responses: responses(map[string]*openapi.Response{
+				"200": jsonResponse("the feed token was revoked", messageSchema()),
+				"401": errorRef("Unauthorized"),
+				"403": errorRef("Forbidden"),
+				"404": errorRef("NotFound"),
+			}),
+		},
+		"GET /v1/webhooks": {
+			Summary: "List webhooks",
+			Tags:    []string{"webhooks"},
+			Responses: responses(map[string]*openapi.Response{
+				"200": jsonResponse("the webhooks", object(map[string]*openapi.Schema{"webhooks": arrayOf(ref("Webhook"))}, "webhooks")),
+			}),
+		},
+		"POST /v1/webhooks": {
+			Summary:     "Create a webhook",
+			Tags:        []string{"webhooks"},
+			RequestBody: jsonBody(webhookInput("url", "events")),
+			Responses: responses(map[string]*openapi.Response{
+				"201": jsonResponse("the webhook, with its secret shown only this once", object(map[string]*openapi.Schema{"webhook": ref("Webhook")}, "webhook")),
+				"400": errorRef("BadRequest"),
+				"422": errorRef("FailedValidation"),
+			}),
+		},
+		"GET /v1/webhooks/:id": {
+			Summary:    "Show a webhook",
+			Tags:       []string{"webhooks"},
+			Parameters: []*openapi.Parameter{idParam},
+			Responses: responses(map[string]*openapi.Response{
+				"200": jsonResponse("the webhook", object(map[string]*openapi.Schema{"webhook": ref("Webhook")}, "webhook")),
+				"404": errorRef("NotFound"),
+			}),
+		},
+		"PATCH /v1/webhooks/:id": {
+			Summary:     "Update a webhook",
+			Tags:        []string{"webhooks"},
+			Parameters:  []*openapi.Parameter{idParam},
+			RequestBody: jsonBody(webhookInput()),
+			Responses: responses(map[string]*openapi.Response{
+				"200": jsonResponse("the webhook was updated", object(map[string]*openapi.Schema{"webhook": ref("Webhook")}, "webhook")),
+				"400": errorRef("BadRequest"),
+				"404": errorRef("NotFound"),
+				"409": errorRef("Conflict"),
+				"422": errorRef("FailedValidation"),
+			}),
+		},
+		"DELETE /v1/webhooks/:id": {
+			Summary:    "Delete a webhook",
+			Tags:       []string{"webhooks"},
+			Parameters: []*openapi.Parameter{idParam},
+			Responses: responses(map[string]*openapi.Response{
+				"200": jsonResponse("the webhook was deleted", messageSchema()),
+				"404": errorRef("NotFound"),
+			}),
+		},
+		"GET /v1/webhooks/:id/deliveries": {
+			Summary:    "List the deliveries of a webhook",
+			Tags:       []string{"webhooks"},
+			Parameters: append([]*openapi.Parameter{idParam}, pageParams...),
+			Responses: responses(map[string]*openapi.Response{
+				"200": jsonResponse("a page of deliveries", object(map[string]*openapi.Schema{
+					"deliveries": arrayOf(ref("WebhookDelivery")),
+					"metadata":   ref("Metadata"),
+				}, "deliveries", "metadata")),
+				"404": errorRef("NotFound"),
+				"422": errorRef("FailedValidation"),
+			}),
+		},
+	}
+
+	doc := &openapi.Document{
+		OpenAPI: "3.1.0",
+		Info: openapi.Info{
+			Title:       "Todo API",
+			Version:     version,
+			Description: "Every JSON response is an envelope object, errors are returned as {\"error\": ...}",
+		},
+		Paths: make(map[string]*openapi.PathItem),
+		Components: openapi.Components{
+			Schemas: map[string]*openapi.Schema{
+				"Todo": object(map[string]*openapi.Schema{
+					"id":          typed("integer"),
+					"title":       typed("string"),
+					"description": typed("string"),
+					"project":     typed("string"),
+					"completed":   typed("boolean"),
+					"due_at":      typed("string", "date-time"),
+					"remind_at":   typed("string", "date-time"),
+					"recurrence":  typed("string"),
+					"occurrence":  typed("integer"),
+					"version":     typed("integer"),
+					"updated_at":  typed("string", "date-time"),
+				}, "id", "title", "completed", "version", "updated_at"),
+				"Metadata": object(map[string]*openapi.Schema{
+					"current_page":  typed("integer"),
+					"page_size":     typed("integer"),
+					"first_page":    typed("integer"),
+					"last_page":     typed("integer"),
+					"total_records": typed("integer"),
+				}),
+				"ValidationErrors": {
+					Type:                 openapi.Types{"object"},
+					Description:          "error messages by field",
+					AdditionalProperties: typed("string"),
+				},
+				"Error": object(map[string]*openapi.Schema{
+					"error":      {OneOf: []*openapi.Schema{typed("string"), ref("ValidationErrors")}},
+					"request_id": typed("string"),
+				}, "error"),
+				"ReminderDelivery": object(map[string]*openapi.Schema{
+					"id":         typed("integer"),
+					"todo_id":    typed("integer"),
+					"notifier":   typed("string"),
+					"attempt":    typed("integer"),
+					"succeeded":  typed("boolean"),
+					"error":      typed("string"),
+					"created_at": typed("string", "date-time"),
+				}, "id", "todo_id", "notifier", "attempt", "succeeded", "created_at"),
+				"Webhook": object(map[string]*openapi.Schema{
+					"id":         typed("integer"),
+					"created_at": typed("string", "date-time"),
+					"url":        typed("string"),
+					"secret":     typed("string"),
+					"events":     arrayOf(typed("string")),
+					"active":     typed("boolean"),
+					"version":    typed("integer"),
+				}, "id", "created_at", "url", "events", "active", "version"),
+				"WebhookDelivery": object(map[string]*openapi.Schema{
+					"id":              typed("integer"),
+					"webhook_id":      typed("integer"),
+					"event_id":        typed("integer"),
+					"event_type":      typed("string"),
+					"status":          enum("pending", "delivered", "failed"),
+					"attempts":        typed("integer"),
+					"next_attempt_at": typed("string", "date-time"),
+					"response_status": typed("integer"),
+					"error":           typed("string"),
+					"created_at":      typed("string", "date-time"),
+					"delivered_at":    typed("string", "date-time"),
+				}, "id", "webhook_id", "event_id", "event_type", "status", "attempts", "next_attempt_at", "created_at"),
+				"QueryStats": object(map[string]*openapi.Schema{
+					"query":    typed("string"),
+					"count":    typed("integer"),
+					"errors":   typed("integer"),
+					"total_ms": typed("number"),
+					"mean_ms":  typed("number"),
+					"max_ms":   typed("number"),
+				}, "query", "count", "errors", "total_ms", "mean_ms", "max_ms"),
+				"SlowQuery": object(map[string]*openapi.Schema{
+					"query":       typed("string"),
+					"args":        &openapi.Schema{Type: openapi.Types{"array"}, Items: typed("string"), Description: "text arguments are replaced by their length"},
+					"duration_ms": typed("number"),
+					"time":        typed("string", "date-time"),
+					"plan":        &openapi.Schema{Description: "output of EXPLAIN (ANALYZE, FORMAT JSON)"},
+					"plan_error":  typed("string"),
+				}, "query", "args", "duration_ms", "time"),
+				"FeedToken": object(map[string]*openapi.Schema{
+					"id":           typed("integer"),
+					"created_at":   typed("string", "date-time"),
+					"name":         typed("string"),
+					"project":      typed("string"),
+					"token":        typed("string"),
+					"last_used_at": typed("string", "date-time"),
+				}, "id", "created_at", "name"),
+			},
+			Responses: map[string]*openapi.Response{
+				"BadRequest":           jsonResponse("the request body or parameters could not be read", ref("Error")),
+				"Unauthorized":         jsonResponse("the token is missing or invalid", ref("Error")),
+				"Forbidden":            jsonResponse("the server does not allow the request", ref("Error")),
+				"NotFound":             jsonResponse("the resource could not be found", ref("Error")),
+				"Conflict":             jsonResponse("the resource was changed by another request", ref("Error")),
+				"PreconditionFailed":   jsonResponse("the If-Match header does not match the resource", ref("Error")),
+				"PreconditionRequired": jsonResponse("the request must have an If-Match header", ref("Error")),
+				"UnsupportedMediaType": jsonResponse("the Content-Type of the body is not accepted", ref("Error")),
+				"FailedValidation":     jsonResponse("the input failed validation, the error is a map of messages by field", ref("Error")),
+				"Unavailable":          jsonResponse("the server cannot take the request right now", ref("Error")),
+				"ServerError":          jsonResponse("the server encountered a problem", ref("Error")),
+				"GatewayTimeout":       jsonResponse("a database query took longer than the query timeout", ref("Error")),
+			},
+		},
+	}
+
+	for route, op := range ops {
+		method, path, _ := strings.Cut(route, " ")
+		template := openapi.PathTemplate(path)
+
+		item, ok := doc.Paths[template]
+		if !ok {
+			item = &openapi.PathItem{}
+			doc.Paths[template] = item
+		}
+
+		// operation ids are derived from the route, e.g. get_v1_todos_id
+		op.OperationID = strings.ToLower(method) + strings.NewReplacer("/", "_", ":", "", ".", "_").Replace(path)
+		(*item)[strings.ToLower(method)] = op
+	}
+
+	return doc
+}
@@ -0,0 +1,45 @@
+// Filename: cmd/api/openapi_test.go
+
+package main
+
+import (
+	"testing"
+)
+
+func TestOpenAPICoversRoutes(t *testing.T) {
+	for _, env := range []string{"dev", "prd"} {
+		t.Run(env, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.env = env
+
+			err := app.checkOpenAPI()
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestRoutesRecordFixedSegments(t *testing.T) {
+	app := newTestApplication(t)
+
+	registered := map[string]bool{}
+	for _, route := range app.routes().registered {
+		registered[route] = true
+	}
+
+	for _, route := range []string{"GET /v1/todos/:id", "GET /v1/todos/events", "GET /v1/todos/export"} {
+		if !registered[route] {
+			t.Errorf("%s is not recorded", route)
+		}
+	}
+}
+
+func TestOpenAPIMissingRoute(t *testing.T) {
+	app := newTestApplication(t)
+
+	missing := app.openAPI().Missing([]string{"GET /v1/todos/:id", "GET /v1/todos/archive", "POST /v1/healthcheck"})
+	if len(missing) != 2 || missing[0] != "GET /v1/todos/archive" || missing[1] != "POST /v1/healthcheck" {
+		t.Errorf("missing = %v, want the archive and POST healthcheck routes", missing)
+	}
+}
@@ -0,0 +1,111 @@
+// Filename: cmd/api/reminders.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"time"
+
+	"todoapi.miguelavila.net/internals/data"
+	"todoapi.miguelavila.net/internals/notify"
+)
+
+// reminderTimeout is how long the notifier is given to deliver a reminder
+const reminderTimeout = 15 * time.Second
+
+// startReminderScheduler() polls for todos whose reminder is due and delivers
+// them through the configured notifier until the server shuts down
+func (app *application) startReminderScheduler() {
+	opts := data.ReminderOptions{
+		BatchSize:   app.config.reminders.batchSize,
+		MaxAttempts: app.config.reminders.maxAttempts,
+		Notifier:    app.notifier.Name(),
+		Backoff:     app.reminderBackoff,
+		Lease:       time.Duration(app.config.reminders.batchSize)*reminderTimeout + time.Minute,
+		Stop:        app.quit,
+	}
+
+	app.background(func() {
+		ticker := time.NewTicker(app.config.reminders.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-app.quit:
+				return
+			case <-ticker.C:
+			}
+
+			// keep going while full batches are being claimed, until shutdown
+			for {
+				n, err := app.models.Reminders.ProcessDue(context.Background(), opts, app.deliverReminder)
+				if err != nil {
+					app.logger.Printf("reminders: %v", err)
+				}
+				if n < opts.BatchSize || app.stopping() {
+					break
+				}
+			}
+		}
+	})
+}
+
+// deliverReminder() sends a single reminder, giving the notifier a bounded time
+func (app *application) deliverReminder(todo *data.Todo) error {
+	ctx, cancel := context.WithTimeout(context.Background(), reminderTimeout)
+	defer cancel()
+
+	err := app.notifier.Notify(ctx, notify.Reminder{
+		TodoID:      todo.ID,
+		Title:       todo.Title,
+		Description: todo.Description,
+		DueAt:       todo.DueAt,
+		RemindAt:    *todo.RemindAt,
+	})
+	if err != nil {
+		app.logger.Printf("reminders: delivering reminder for todo %d: %v", todo.ID, err)
+	}
+	return err
+}
+
+// reminderBackoff() doubles the wait after every failed attempt, up to an hour
+func (app *application) reminderBackoff(attempt int) time.Duration {
+	backoff := float64(app.config.reminders.backoff) * math.Pow(2, float64(attempt-1))
+	return time.Duration(math.Min(backoff, float64(time.Hour)))
+}
+
+// listReminderDeliveriesHandler for GET /v1/todos/{id}/reminders endpoints (shows
+// the delivery attempts made for a todo's reminders)
+func (app *application) listReminderDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	// make sure the todo exists
+	_, err = app.models.Todos.GetContext(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	deliveries, err := app.models.Reminders.GetDeliveries(id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"deliveries": deliveries}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,127 @@
+// Filename: cmd/api/replicas.go
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"todoapi.miguelavila.net/internals/data"
+)
+
+// readPrimaryCookie holds the time, in unix milliseconds, until which a client
+// that has written reads from the primary. Clients that do not keep cookies can
+// send the X-Read-Primary-Until response header back instead
+const readPrimaryCookie = "read_primary_until"
+
+// startReplicaHealthChecks() pings the read replicas until the server shuts
+// down, reads stop going to a replica while it does not answer
+func (app *application) startReplicaHealthChecks() {
+	replicas := app.models.Todos.Replicas
+
+	app.background(func() {
+		ticker := time.NewTicker(app.config.db.replicaCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-app.quit:
+				return
+			case <-ticker.C:
+			}
+
+			replicas.CheckHealth(5*time.Second, func(index int, err error) {
+				if err != nil {
+					app.logger.Printf("replicas: replica %d is down, reading from the others: %v", index, err)
+					return
+				}
+				app.logger.Printf("replicas: replica %d is back up", index)
+			})
+		}
+	})
+}
+
+// readYourWrites() sends the reads of a request to the primary when a replica
+// might not have the data it needs yet. Requests that write read from the
+// primary, as they check the current version before changing a todo, and a
+// successful write pins the client to the primary for the read-your-writes
+// window, so its next reads see what it wrote
+func (app *application) readYourWrites(next http.Handler) http.Handler {
+	if app.models.Todos.Replicas == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			if readPrimaryUntil(r, app.config.db.readYourWrites).After(time.Now()) {
+				r = r.WithContext(data.WithPrimary(r.Context()))
+			}
+			next.ServeHTTP(w, r)
+		default:
+			pw := &pinningWriter{ResponseWriter: w, window: app.config.db.readYourWrites}
+			next.ServeHTTP(pw, r.WithContext(data.WithPrimary(r.Context())))
+		}
+	})
+}
+
+// readPrimaryUntil() returns the time the client is pinned to the primary until,
+// taken from the cookie or the X-Read-Primary-Until header. The server never
+// pins a client for longer than the window, a later time was not set by it and
+// is ignored
+func readPrimaryUntil(r *http.Request, window time.Duration) time.Time {
+	value := r.Header.Get("X-Read-Primary-Until")
+	if cookie, err := r.Cookie(readPrimaryCookie); err == nil {
+		value = cookie.Value
+	}
+
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	until := time.UnixMilli(ms)
+	if until.After(time.Now().Add(window)) {
+		return time.Time{}
+	}
+	return until
+}
+
+// pinningWriter pins the client to the primary when the response shows that
+// the write succeeded
+type pinningWriter struct {
+	http.ResponseWriter
+	window      time.Duration
+	wroteHeader bool
+}
+
+func (pw *pinningWriter) WriteHeader(status int) {
+	if !pw.wroteHeader && status >= 200 {
+		pw.wroteHeader = true
+		if status < 400 && pw.window > 0 {
+			until := strconv.FormatInt(time.Now().Add(pw.window).UnixMilli(), 10)
+			pw.Header().Set("X-Read-Primary-Until", until)
+			http.SetCookie(pw.ResponseWriter, &http.Cookie{
+				Name:     readPrimaryCookie,
+				Value:    until,
+				Path:     "/",
+				MaxAge:   int(pw.window.Seconds()) + 1,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+	}
+	pw.ResponseWriter.WriteHeader(status)
+}
+
+func (pw *pinningWriter) Write(b []byte) (int, error) {
+	if !pw.wroteHeader {
+		pw.WriteHeader(http.StatusOK)
+	}
+	return pw.ResponseWriter.Write(b)
+}
+
+// Unwrap() lets http.ResponseController reach the underlying writer
+func (pw *pinningWriter) Unwrap() http.ResponseWriter {
+	return pw.ResponseWriter
+}
@@ -0,0 +1,81 @@
+// Filename: cmd/api/replicas_test.go
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestReadPrimaryUntil(t *testing.T) {
+	window := 5 * time.Second
+	ms := func(d time.Duration) string {
+		return strconv.FormatInt(time.Now().Add(d).UnixMilli(), 10)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		cookie string
+		pinned bool
+	}{
+		{"nothing sent", "", "", false},
+		{"header in the window", ms(2 * time.Second), "", true},
+		{"cookie in the window", "", ms(2 * time.Second), true},
+		{"cookie wins over the header", ms(2 * time.Second), ms(-time.Second), false},
+		{"window over", ms(-time.Second), "", false},
+		{"past the window", ms(time.Hour), "", false},
+		{"far future", "9999999999999", "", false},
+		{"not a number", "soon", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/todos", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Read-Primary-Until", tt.header)
+			}
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: readPrimaryCookie, Value: tt.cookie})
+			}
+
+			until := readPrimaryUntil(r, window)
+			if pinned := until.After(time.Now()); pinned != tt.pinned {
+				t.Errorf("pinned = %t, want %t (until %v)", pinned, tt.pinned, until)
+			}
+		})
+	}
+}
+
+func TestPinningWriter(t *testing.T) {
+	tests := []struct {
+		status int
+		pinned bool
+	}{
+		{http.StatusOK, true},
+		{http.StatusCreated, true},
+		{http.StatusBadRequest, false},
+		{http.StatusInternalServerError, false},
+	}
+
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		pw := &pinningWriter{ResponseWriter: rr, window: 5 * time.Second}
+		pw.WriteHeader(tt.status)
+
+		header := rr.Header().Get("X-Read-Primary-Until")
+		if (header != "") != tt.pinned {
+			t.Errorf("status %d: X-Read-Primary-Until = %q, want pinned %t", tt.status, header, tt.pinned)
+		}
+		if tt.pinned {
+			r := httptest.NewRequest(http.MethodGet, "/v1/todos", nil)
+			r.Header.Set("X-Read-Primary-Until", header)
+			if !readPrimaryUntil(r, 5*time.Second).After(time.Now()) {
+				t.Errorf("status %d: the value the server set is not accepted back", tt.status)
+			}
+		}
+	}
+}
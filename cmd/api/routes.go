@@ -4,19 +4,87 @@ package main
 
 import (
 	"net/http"
+	"strings"
 
 	"github.com/julienschmidt/httprouter"
 )
 
-func (app *application) routes() *httprouter.Router {
+func (app *application) routes() *recordingRouter {
 	// Create new http router instance
-	router := httprouter.New()
+	router := &recordingRouter{Router: httprouter.New()}
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/openapi.json", app.openAPIHandler)
 	router.HandlerFunc(http.MethodGet, "/v1/todos", app.listTodosHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/todos", app.createTodoHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/todos/:id", app.showTodoHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/todos.ics", app.todosFeedHandler)
+	router.Handler(http.MethodPost, "/v1/todos", app.idempotent(http.HandlerFunc(app.createTodoHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/todos/batch", app.batchTodosHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/todos/import", app.importTodosHandler)
+	router.fixedSegments(http.MethodGet, "/v1/todos/:id", app.showTodoHandler, map[string]http.HandlerFunc{
+		"events": app.todoEventsHandler,
+		"export": app.exportTodosHandler,
+	})
+	router.HandlerFunc(http.MethodPut, "/v1/todos/:id", app.replaceTodoHandler)
 	router.HandlerFunc(http.MethodPatch, "/v1/todos/:id", app.updateTodoHandler)
 	router.HandlerFunc(http.MethodDelete, "/v1/todos/:id", app.deleteTodoHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/todos/:id/occurrences", app.listOccurrencesHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/todos/:id/reminders", app.listReminderDeliveriesHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/sync", app.pullChangesHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/sync", app.pushChangesHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/ws", app.todoSocketHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/graphql", app.graphQLHandler)
+	router.Handler(http.MethodGet, "/v1/feeds", app.requireFeedsAdmin(http.HandlerFunc(app.listFeedsHandler)))
+	router.Handler(http.MethodPost, "/v1/feeds", app.requireFeedsAdmin(http.HandlerFunc(app.createFeedHandler)))
+	router.Handler(http.MethodDelete, "/v1/feeds/:id", app.requireFeedsAdmin(http.HandlerFunc(app.deleteFeedHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks", app.listWebhooksHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/webhooks", app.createWebhookHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks/:id", app.showWebhookHandler)
+	router.HandlerFunc(http.MethodPatch, "/v1/webhooks/:id", app.updateWebhookHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/webhooks/:id", app.deleteWebhookHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks/:id/deliveries", app.listWebhookDeliveriesHandler)
+
+	// query timings and plans may reveal more than production should
+	if app.config.env == "dev" {
+		router.HandlerFunc(http.MethodGet, "/debug/queries", app.debugQueriesHandler)
+	}
 
 	return router
 }
+
+// recordingRouter is an httprouter.Router that remembers the routes registered on
+// it, as "METHOD /path", so they can be checked against the OpenAPI document
+type recordingRouter struct {
+	*httprouter.Router
+	registered []string
+}
+
+// Handler() registers a handler for the method and path
+func (rr *recordingRouter) Handler(method, path string, handler http.Handler) {
+	rr.registered = append(rr.registered, method+" "+path)
+	rr.Router.Handler(method, path, handler)
+}
+
+// HandlerFunc() registers a handler function for the method and path
+func (rr *recordingRouter) HandlerFunc(method, path string, handler http.HandlerFunc) {
+	rr.Handler(method, path, handler)
+}
+
+// fixedSegments() registers next for a path ending in an :id parameter and the
+// handlers for fixed segments that sit where the parameter is, e.g.
+// /v1/todos/events next to /v1/todos/:id. httprouter does not allow both to be
+// registered, so the :id route dispatches to them and falls back to next for
+// everything else. The fixed paths are recorded as routes of their own
+func (rr *recordingRouter) fixedSegments(method, path string, next http.HandlerFunc, handlers map[string]http.HandlerFunc) {
+	base := strings.TrimSuffix(path, ":id")
+	for segment := range handlers {
+		rr.registered = append(rr.registered, method+" "+base+segment)
+	}
+
+	rr.HandlerFunc(method, path, func(w http.ResponseWriter, r *http.Request) {
+		params := httprouter.ParamsFromContext(r.Context())
+		if handler, ok := handlers[params.ByName("id")]; ok {
+			handler(w, r)
+			return
+		}
+		next(w, r)
+	})
+}
@@ -0,0 +1,102 @@
+// Filename: cmd/api/server.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// serve() runs the http server until the process receives SIGINT or SIGTERM,
+// then stops accepting requests and waits for in-flight requests and the
+// background goroutines to finish
+func (app *application) serve() error {
+	//create our http server
+	srv := &http.Server{
+		Addr:         fmt.Sprintf(":%d", app.config.port),
+		Handler:      app.requestID(app.traceRequests(app.readYourWrites(app.compress(app.checkAccept(app.validateOpenAPI(app.routes())))))),
+		IdleTimeout:  time.Minute,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+
+	// end the event streams so shutdown does not wait on them
+	srv.RegisterOnShutdown(app.events.Close)
+
+	shutdownError := make(chan error)
+
+	go func() {
+		// wait for a shutdown signal
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		s := <-quit
+
+		app.logger.Printf("shutting down server, received %s", s.String())
+
+		// give in-flight requests 20 seconds to complete
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			shutdownError <- err
+			return
+		}
+
+		// tell the background goroutines to stop and wait for them
+		app.logger.Printf("completing background tasks")
+		close(app.quit)
+		app.wg.Wait()
+		shutdownError <- nil
+	}()
+
+	app.logger.Printf("Starting %s server at %s", app.config.env, srv.Addr)
+	//start the server
+	err := srv.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	err = <-shutdownError
+	if err != nil {
+		return err
+	}
+
+	app.logger.Printf("stopped server at %s", srv.Addr)
+	return nil
+}
+
+// background() runs fn in a goroutine that is waited on during shutdown, a panic
+// in fn is logged instead of crashing the server
+func (app *application) background(fn func()) {
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.Printf("background task panic: %v", err)
+			}
+		}()
+
+		fn()
+	}()
+}
+
+// stopping() reports whether the server has started shutting down, for
+// background tasks to check between units of work
+func (app *application) stopping() bool {
+	select {
+	case <-app.quit:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,210 @@
+// Filename: cmd/api/sync.go
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"todoapi.miguelavila.net/internals/data"
+	"todoapi.miguelavila.net/internals/validator"
+)
+
+// syncResult is the outcome of a pushed change. When the change conflicts with
+// the server's copy of the todo, that copy is included so the client can merge
+type syncResult struct {
+	batchResult
+	ServerTodo *data.Todo `json:"server_todo,omitempty"`
+}
+
+// pullChangesHandler for GET /v1/sync endpoint. It returns the todos created or
+// updated and the ids of the todos deleted since the sync token, and a new token
+// to pass next time. Without a token every todo is returned. When has_more is
+// true the client should pull again straight away with the new token. A token
+// older than the tombstone retention has expired, the client must start over
+func (app *application) pullChangesHandler(w http.ResponseWriter, r *http.Request) {
+	// initialize a validator
+	v := validator.New()
+
+	// get the URL values in a map
+	qs := r.URL.Query()
+
+	since, err := decodeSyncToken(app.readString(qs, "since", ""))
+	if err != nil {
+		v.AddError("since", "invalid sync token")
+	}
+	limit := app.readInt(qs, "limit", 100, v)
+	v.Check(limit > 0, "limit", "must be greater than zero")
+	v.Check(limit <= 1000, "limit", "must be maximum of 1000")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	changes, err := app.models.Todos.GetChangesContext(r.Context(), since, limit)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrSyncTokenExpired):
+			app.syncTokenExpiredResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{
+		"todos":      changes.Todos,
+		"deleted":    changes.Deleted,
+		"sync_token": encodeSyncToken(changes.Position),
+		"has_more":   changes.More,
+	}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// pushChangesHandler for POST /v1/sync endpoint. It applies the changes a client
+// made while offline. Each change is applied on its own, updates and deletes must
+// carry the version the client last saw and are reported as conflicts when the
+// todo has changed on the server since
+func (app *application) pushChangesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Changes []batchOperation `json:"changes"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badResquestReponse(w, r, err)
+		return
+	}
+
+	// Initialize a new instance of validator
+	v := validator.New()
+
+	v.Check(len(input.Changes) > 0, "changes", "must contain at least one change")
+	v.Check(len(input.Changes) <= app.config.batch.maxSize, "changes", fmt.Sprintf("must not contain more than %d changes", app.config.batch.maxSize))
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	results := make([]syncResult, len(input.Changes))
+	conflicts := 0
+
+	for i, change := range input.Changes {
+		if change.Op != "create" && change.Version == nil {
+			results[i].batchResult = batchResult{
+				Index:  i,
+				Op:     change.Op,
+				ID:     change.ID,
+				Status: http.StatusUnprocessableEntity,
+				Errors: map[string]string{"version": "must be provided"},
+			}
+			continue
+		}
+
+		err = app.writeTodos(r.Context(), func(tw *todoWriter) error {
+			results[i].batchResult, err = app.runBatchOperation(tw, i, change)
+			return err
+		})
+		if err != nil {
+			// the changes before this one have been committed, only this one failed
+			if contextError(err) == context.Canceled {
+				app.clientClosedRequestResponse(w, r)
+				return
+			}
+			results[i].batchResult = app.batchErrorResult(r, i, change, err)
+			continue
+		}
+
+		if results[i].Status == http.StatusConflict {
+			conflicts++
+			todo, err := app.models.Todos.GetContext(r.Context(), change.ID)
+			if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			results[i].ServerTodo = todo
+		}
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"results": results, "conflicts": conflicts}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// encodeSyncToken() turns a sync position into an opaque token
+func encodeSyncToken(position data.SyncPosition) string {
+	token := fmt.Sprintf("v2:%d.%d", position.XID, position.Seq)
+	return base64.RawURLEncoding.EncodeToString([]byte(token))
+}
+
+// decodeSyncToken() returns the sync position held by a token, an empty token is
+// the start. Tokens from before changes were ordered by transaction only hold a
+// change sequence number, they decode to a position before the sync horizon so
+// that the client is told to start over
+func decodeSyncToken(token string) (data.SyncPosition, error) {
+	if token == "" {
+		return data.SyncPosition{}, nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return data.SyncPosition{}, err
+	}
+
+	var position data.SyncPosition
+	switch version, value, _ := strings.Cut(string(b), ":"); version {
+	case "v1":
+		position.Seq, err = strconv.ParseInt(value, 10, 64)
+	case "v2":
+		xid, seq, ok := strings.Cut(value, ".")
+		if !ok {
+			return data.SyncPosition{}, errors.New("invalid sync token")
+		}
+		position.XID, err = strconv.ParseInt(xid, 10, 64)
+		if err == nil {
+			position.Seq, err = strconv.ParseInt(seq, 10, 64)
+		}
+	default:
+		err = errors.New("invalid sync token")
+	}
+	if err != nil || position.XID < 0 || position.Seq < 0 {
+		return data.SyncPosition{}, errors.New("invalid sync token")
+	}
+	return position, nil
+}
+
+// startTombstonePurge() deletes the tombstones older than the retention every
+// hour until the server shuts down. Every instance may run it, a purge that finds
+// nothing left to delete does nothing
+func (app *application) startTombstonePurge() {
+	app.background(func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+
+		for {
+			purged, err := app.models.Todos.PurgeTombstones(app.config.sync.tombstoneRetention)
+			if err != nil {
+				app.logger.Printf("sync: purging tombstones: %v", err)
+			} else if purged > 0 {
+				app.logger.Printf("sync: purged %d tombstones", purged)
+			}
+
+			select {
+			case <-app.quit:
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
@@ -0,0 +1,58 @@
+// Filename: cmd/api/sync_test.go
+
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"todoapi.miguelavila.net/internals/data"
+)
+
+func TestSyncToken(t *testing.T) {
+	token := func(value string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(value))
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		want    data.SyncPosition
+		wantErr bool
+	}{
+		{"empty", "", data.SyncPosition{}, false},
+		{"position", token("v2:1042.42"), data.SyncPosition{XID: 1042, Seq: 42}, false},
+		{"start of a transaction", token("v2:1042.0"), data.SyncPosition{XID: 1042}, false},
+		{"sequence only token", token("v1:42"), data.SyncPosition{Seq: 42}, false},
+		{"not base64", "v2:1042.42", data.SyncPosition{}, true},
+		{"unknown version", token("v3:1042.42"), data.SyncPosition{}, true},
+		{"no version", token("1042.42"), data.SyncPosition{}, true},
+		{"missing sequence", token("v2:1042"), data.SyncPosition{}, true},
+		{"negative", token("v2:-1.42"), data.SyncPosition{}, true},
+		{"not a number", token("v2:1042.x"), data.SyncPosition{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeSyncToken(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("position = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncTokenRoundTrip(t *testing.T) {
+	for _, position := range []data.SyncPosition{{}, {XID: 3, Seq: 1}, {XID: 1 << 40, Seq: 1 << 50}} {
+		got, err := decodeSyncToken(encodeSyncToken(position))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != position {
+			t.Errorf("round trip of %+v = %+v", position, got)
+		}
+	}
+}
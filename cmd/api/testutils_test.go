@@ -0,0 +1,23 @@
+// Filename: cmd/api/testutils_test.go
+
+package main
+
+import (
+	"io"
+	"log"
+	"testing"
+)
+
+// newTestApplication() returns an application with the default config and no
+// database, for testing what runs before the models are reached
+func newTestApplication(t *testing.T) *application {
+	t.Helper()
+
+	app := &application{
+		logger: log.New(io.Discard, "", 0),
+		quit:   make(chan struct{}),
+	}
+	app.config.env = "dev"
+	app.config.batch.maxSize = 100
+	return app
+}
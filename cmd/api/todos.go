@@ -3,20 +3,30 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"todoapi.miguelavila.net/internals/data"
+	"todoapi.miguelavila.net/internals/jsonpatch"
+	"todoapi.miguelavila.net/internals/rrule"
 	"todoapi.miguelavila.net/internals/validator"
 )
 
 // createTodoHandler for POST v1/todos endpoint
 func (app *application) createTodoHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Title       string `json:"title"`
-		Description string `json:"description,omitempty"`
-		Completed   bool   `json:"completed"`
+		Title       string     `json:"title"`
+		Description string     `json:"description,omitempty"`
+		Project     string     `json:"project"`
+		Completed   bool       `json:"completed"`
+		DueAt       *time.Time `json:"due_at"`
+		RemindAt    *time.Time `json:"remind_at"`
+		Recurrence  string     `json:"recurrence"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -29,7 +39,11 @@ func (app *application) createTodoHandler(w http.ResponseWriter, r *http.Request
 	todo := &data.Todo{
 		Title:       input.Title,
 		Description: input.Description,
+		Project:     input.Project,
 		Completed:   input.Completed,
+		DueAt:       input.DueAt,
+		RemindAt:    input.RemindAt,
+		Recurrence:  input.Recurrence,
 	}
 
 	// Initialize a new instance of validator
@@ -42,7 +56,9 @@ func (app *application) createTodoHandler(w http.ResponseWriter, r *http.Request
 	}
 
 	// create a todo
-	err = app.models.Todos.Insert(todo)
+	err = app.writeTodos(r.Context(), func(tw *todoWriter) error {
+		return tw.insert(todo)
+	})
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -51,9 +67,10 @@ func (app *application) createTodoHandler(w http.ResponseWriter, r *http.Request
 	// create a Location header for the newly created resource/todos
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("/v1/todos/%d", todo.ID))
+	headers.Set("ETag", todoETag(todo))
 	// write the json response with 201 - created status code with the body
 	// being the todo data and the headers being the headers map
-	err = app.writeJSON(w, http.StatusCreated, envelope{"todo": todo}, headers)
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"todo": todo}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -71,7 +88,7 @@ func (app *application) showTodoHandler(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Fetch the specific todo
-	todo, err := app.models.Todos.Get(id)
+	todo, err := app.models.Todos.GetContext(r.Context(), id)
 
 	if err != nil {
 		switch {
@@ -82,26 +99,35 @@ func (app *application) showTodoHandler(w http.ResponseWriter, r *http.Request)
 		}
 		return
 	}
+	// the client already holds the current representation
+	etag := todoETag(todo)
+	if app.notModified(w, r, etag) {
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", etag)
 	// write the data return by the Get method
-	err = app.writeJSON(w, http.StatusOK, envelope{"todo": todo}, nil)
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"todo": todo}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 
 }
 
-// updateTodoHandler for PUT /v1/todos/{id} endpoints
+// updateTodoHandler for PATCH /v1/todos/{id} endpoints
 func (app *application) updateTodoHandler(w http.ResponseWriter, r *http.Request) {
 	// This method does a partial replacement
 	// get the id of the todo and update the todo
 	// Utilize Utility Methods From helpers.go
 	id, err := app.readIDParam(r)
 	if err != nil {
-		fmt.Println(err.Error())
+		app.notFoundResponse(w, r)
+		return
 	}
 
 	// fetch the original record from database
-	todo, err := app.models.Todos.Get(id)
+	todo, err := app.models.Todos.GetContext(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -112,48 +138,233 @@ func (app *application) updateTodoHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// create an input struct to hold the data read in from the client
-	// Update input struct to use pointers because pointers have a default value of nil
-	// if field remains nil then we know that the client is not interested in updating the field
-	var input struct {
-		Title       *string `json:"title"`
-		Description *string `json:"Description"`
-		Completed   *bool   `json:"Completed"`
+	// reject the update if the client's copy of the todo is stale
+	if !app.checkIfMatch(w, r, todo) {
+		return
 	}
-	// Decode the data from the client
-	err = app.readJSON(w, r, &input)
+	wasCompleted := todo.Completed
 
-	// copy / update the fields / values in the todo variable using the fields in the input struct
+	// the Content-Type of the body selects how the changes are described
+	mediaType := app.readMediaType(r)
+
+	// Initialize a new validation error instance
+	v := validator.New()
+
+	switch mediaType {
+	case "application/merge-patch+json", "application/json-patch+json":
+		// apply the patch document against the current todo
+		patchErrors, err := app.patchTodo(w, r, todo, mediaType)
+		if err != nil {
+			app.badResquestReponse(w, r, err)
+			return
+		}
+		if patchErrors != nil {
+			app.failedValidationResponse(w, r, patchErrors)
+			return
+		}
+
+		// report validation errors as JSON pointers into the patched todo
+		if data.ValidateTodo(v, todo); !v.Valid() {
+			pointers := make(map[string]string, len(v.Errors))
+			for key, message := range v.Errors {
+				pointers["/"+key] = message
+			}
+			app.failedValidationResponse(w, r, pointers)
+			return
+		}
+
+	default:
+		// any other body, including one sent without a Content-Type or with the
+		// form type curl -d uses, is read as JSON like on the other write routes
+		// create an input struct to hold the data read in from the client
+		// Update input struct to use pointers because pointers have a default value of nil
+		// if field remains nil then we know that the client is not interested in updating the field
+		var input struct {
+			Title       *string    `json:"title"`
+			Description *string    `json:"description"`
+			Project     *string    `json:"project"`
+			Completed   *bool      `json:"completed"`
+			DueAt       *time.Time `json:"due_at"`
+			RemindAt    *time.Time `json:"remind_at"`
+			Recurrence  *string    `json:"recurrence"`
+		}
+		// Decode the data from the client
+		err = app.readJSON(w, r, &input)
+
+		// copy / update the fields / values in the todo variable using the fields in the input struct
+		if err != nil {
+			app.badResquestReponse(w, r, err)
+			return
+		}
+
+		if input.Title != nil {
+			todo.Title = *input.Title
+		}
+
+		if input.Description != nil {
+			todo.Description = *input.Description
+		}
+
+		if input.Project != nil {
+			todo.Project = *input.Project
+		}
+
+		if input.Completed != nil {
+			todo.Completed = *input.Completed
+		}
+
+		if input.DueAt != nil {
+			todo.DueAt = input.DueAt
+		}
+
+		if input.RemindAt != nil {
+			todo.RemindAt = input.RemindAt
+		}
+
+		if input.Recurrence != nil {
+			todo.Recurrence = *input.Recurrence
+		}
+
+		// validate the data provided by the client, if the validation fails,
+		// then we send a 422 - Unprocessable responses to the client
+		if data.ValidateTodo(v, todo); !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	// Pass the updated todo record to the update method
+	var next *data.Todo
+	err = app.writeTodos(r.Context(), func(tw *todoWriter) error {
+		next, err = tw.update(todo, wasCompleted)
+		return err
+	})
 	if err != nil {
-		app.badResquestReponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	if input.Title != nil {
-		todo.Title = *input.Title
+	env := envelope{"todo": todo}
+	if next != nil {
+		env["next_occurrence"] = next
 	}
 
-	if input.Description != nil {
-		todo.Description = *input.Description
+	headers := make(http.Header)
+	headers.Set("ETag", todoETag(todo))
+	// write the json response by Update
+	err = app.writeResponse(w, r, http.StatusOK, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+}
+
+// replaceTodoHandler for PUT /v1/todos/{id} endpoints
+func (app *application) replaceTodoHandler(w http.ResponseWriter, r *http.Request) {
+	// This method does a full replacement, every field of the todo must be sent
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
 	}
 
-	if input.Completed != nil {
-		todo.Completed = *input.Completed
+	// pointers tell us which fields the client left out
+	var input struct {
+		Title       *string      `json:"title"`
+		Description *string      `json:"description"`
+		Project     *string      `json:"project"`
+		Completed   *bool        `json:"completed"`
+		DueAt       nullableTime `json:"due_at"`
+		RemindAt    nullableTime `json:"remind_at"`
+		Recurrence  *string      `json:"recurrence"`
 	}
 
-	// validate the data provided by the client, if the validation fails,
-	// then we send a 422 - Unprocessable responses to the client
-	// Initialize a new validation error instance
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badResquestReponse(w, r, err)
+		return
+	}
 
+	// Initialize a new validation error instance
 	v := validator.New()
 
+	// a missing field is an error rather than a field left unchanged
+	v.Check(input.Title != nil, "title", "must be provided")
+	v.Check(input.Description != nil, "description", "must be provided")
+	v.Check(input.Project != nil, "project", "must be provided, use an empty string for no project")
+	v.Check(input.Completed != nil, "completed", "must be provided")
+	v.Check(input.DueAt.Set, "due_at", "must be provided, use null for no due date")
+	v.Check(input.RemindAt.Set, "remind_at", "must be provided, use null for no reminder")
+	v.Check(input.Recurrence != nil, "recurrence", "must be provided, use an empty string for no recurrence")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// fetch the original record from database
+	todo, err := app.models.Todos.GetContext(r.Context(), id)
+	created := false
+	if err != nil {
+		switch {
+		// the client chose the id of a new todo
+		case errors.Is(err, data.ErrRecordNotFound) && app.config.allowPutCreate:
+			// If-Match can only match a todo that exists
+			if r.Header.Get("If-Match") != "" {
+				app.preconditionFailedResponse(w, r)
+				return
+			}
+			todo = &data.Todo{ID: id}
+			created = true
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+			return
+		default:
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if !created {
+		// If-None-Match: * asks for the todo to be created only
+		if etagMatches(strings.Join(r.Header.Values("If-None-Match"), ","), todoETag(todo), true) {
+			app.preconditionFailedResponse(w, r)
+			return
+		}
+		// reject the replacement if the client's copy of the todo is stale
+		if !app.checkIfMatch(w, r, todo) {
+			return
+		}
+	}
+
+	wasCompleted := todo.Completed
+	todo.Title = *input.Title
+	todo.Description = *input.Description
+	todo.Project = *input.Project
+	todo.Completed = *input.Completed
+	todo.DueAt = input.DueAt.Value
+	todo.RemindAt = input.RemindAt.Value
+	todo.Recurrence = *input.Recurrence
+
 	if data.ValidateTodo(v, todo); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	// Pass the updated todo record to the update method
-	err = app.models.Todos.Update(todo)
+	var next *data.Todo
+	err = app.writeTodos(r.Context(), func(tw *todoWriter) error {
+		if created {
+			return tw.insert(todo)
+		}
+		next, err = tw.update(todo, wasCompleted)
+		return err
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -164,13 +375,179 @@ func (app *application) updateTodoHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// write the json response by Update
-	err = app.writeJSON(w, http.StatusCreated, envelope{"todo": todo}, nil)
+	headers := make(http.Header)
+	headers.Set("ETag", todoETag(todo))
+	status := http.StatusOK
+	if created {
+		headers.Set("Location", fmt.Sprintf("/v1/todos/%d", todo.ID))
+		status = http.StatusCreated
+	}
+
+	env := envelope{"todo": todo}
+	if next != nil {
+		env["next_occurrence"] = next
+	}
+
+	err = app.writeResponse(w, r, status, env, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+}
+
+// todoDocument is the JSON representation of the editable fields of a todo that
+// JSON Merge Patch and JSON Patch documents are applied against
+type todoDocument struct {
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	Project     string     `json:"project"`
+	Completed   bool       `json:"completed"`
+	DueAt       *time.Time `json:"due_at"`
+	RemindAt    *time.Time `json:"remind_at"`
+	Recurrence  string     `json:"recurrence"`
+}
+
+// patchTodo() applies an RFC 7396 merge patch or an RFC 6902 JSON patch from the
+// request body to the todo. Problems with the patch itself are returned as a map
+// of JSON pointers to messages, an error is returned when the body can't be read
+func (app *application) patchTodo(w http.ResponseWriter, r *http.Request, todo *data.Todo, mediaType string) (map[string]string, error) {
+	var patch json.RawMessage
+	err := app.readJSON(w, r, &patch)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := json.Marshal(todoDocument{
+		Title:       todo.Title,
+		Description: todo.Description,
+		Project:     todo.Project,
+		Completed:   todo.Completed,
+		DueAt:       todo.DueAt,
+		RemindAt:    todo.RemindAt,
+		Recurrence:  todo.Recurrence,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var patched []byte
+	if mediaType == "application/merge-patch+json" {
+		patched, err = jsonpatch.MergePatch(doc, patch)
+	} else {
+		patched, err = jsonpatch.Apply(doc, patch)
+	}
+	if err != nil {
+		var patchError *jsonpatch.Error
+		if errors.As(err, &patchError) {
+			return map[string]string{patchError.Path: patchError.Message}, nil
+		}
+		return nil, err
+	}
+
+	// decode the patched document, members removed by the patch are cleared
+	var result todoDocument
+	dec := json.NewDecoder(bytes.NewReader(patched))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&result)
+	if err != nil {
+		var unmarshalTypeError *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &unmarshalTypeError) && unmarshalTypeError.Field != "":
+			return map[string]string{"/" + unmarshalTypeError.Field: fmt.Sprintf("must be a JSON %s", jsonType(unmarshalTypeError.Type.Kind()))}, nil
+		case errors.As(err, &unmarshalTypeError):
+			return map[string]string{"": "must be a JSON object"}, nil
+		case isTimeError(err):
+			return map[string]string{"": "timestamps must be in RFC 3339 format"}, nil
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			fieldName := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+			return map[string]string{"/" + fieldName: "is not a field of a todo"}, nil
+		default:
+			return nil, err
+		}
+	}
+
+	todo.Title = result.Title
+	todo.Description = result.Description
+	todo.Project = result.Project
+	todo.Completed = result.Completed
+	todo.DueAt = result.DueAt
+	todo.RemindAt = result.RemindAt
+	todo.Recurrence = result.Recurrence
+
+	return nil, nil
+}
+
+// listOccurrencesHandler for GET /v1/todos/{id}/occurrences endpoints (previews the
+// upcoming occurrences of a recurring todo)
+func (app *application) listOccurrencesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	// initialize a validator
+	v := validator.New()
+
+	// get the URL values in a map
+	qs := r.URL.Query()
+
+	from := app.readTime(qs, "from", time.Now(), v)
+	to := app.readTime(qs, "to", from.AddDate(0, 0, 30), v)
+	limit := app.readInt(qs, "limit", 20, v)
+
+	v.Check(to.After(from), "to", "must be after from")
+	v.Check(to.Sub(from) <= 366*24*time.Hour, "to", "must be no more than a year after from")
+	v.Check(limit > 0, "limit", "must be greater than zero")
+	v.Check(limit <= 100, "limit", "must be maximum of 100")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	todo, err := app.models.Todos.GetContext(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
 
+	type occurrence struct {
+		Occurrence int       `json:"occurrence"`
+		DueAt      time.Time `json:"due_at"`
+	}
+	occurrences := []occurrence{}
+
+	if todo.DueAt != nil {
+		// the current occurrence is still upcoming until it is completed
+		current := *todo.DueAt
+		if !todo.Completed && !current.Before(from) && !current.After(to) {
+			occurrences = append(occurrences, occurrence{Occurrence: int(todo.Occurrence), DueAt: current})
+		}
+
+		if todo.Recurrence != "" {
+			rule, err := rrule.Parse(todo.Recurrence)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			dates, numbers := rule.Between(current, int(todo.Occurrence), from, to, limit-len(occurrences))
+			for i := range dates {
+				occurrences = append(occurrences, occurrence{Occurrence: numbers[i], DueAt: dates[i]})
+			}
+		}
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"occurrences": occurrences}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
 
 // deleteTodoHandler for DELETE /v1/todos/{id} endpoints
@@ -184,9 +561,9 @@ func (app *application) deleteTodoHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// delete the todo from the database. send a 404 notFoundResponse status code to the client if there is no matching record
-	// fetch the original record from database
-	err = app.models.Todos.Delete(id)
+	// the version fetched here is the one deleted, a conditional delete is checked
+	// against it
+	todo, err := app.models.Todos.GetContext(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -197,8 +574,29 @@ func (app *application) deleteTodoHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if !app.checkIfMatch(w, r, todo) {
+		return
+	}
+
+	// delete the todo from the database. the todo changed after it was fetched
+	// when it is no longer at the same version
+	err = app.writeTodos(r.Context(), func(tw *todoWriter) error {
+		return tw.delete(todo)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict) && r.Header.Get("If-Match") != "":
+			app.preconditionFailedResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
 	//  return 200 status ok the client with a successful message
-	err = app.writeJSON(w, http.StatusOK, envelope{"message": "todo successfully deleted"}, nil)
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "todo successfully deleted"}, nil)
 
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -207,6 +605,9 @@ func (app *application) deleteTodoHandler(w http.ResponseWriter, r *http.Request
 
 }
 
+// todoSortList are the sort values accepted when listing todos
+var todoSortList = []string{"id", "title", "description", "project", "completed", "updated_at", "-id", "-title", "-description", "-project", "-completed", "-updated_at"}
+
 // listTodoHandler for GET /v1/todos endpoints (allows the client to see a listing of todos)
 // based on a set of criteria
 func (app *application) listTodosHandler(w http.ResponseWriter, r *http.Request) {
@@ -214,6 +615,7 @@ func (app *application) listTodosHandler(w http.ResponseWriter, r *http.Request)
 	var input struct {
 		Title       string
 		Description string
+		Project     string
 		Completed   bool
 		data.Filters
 	}
@@ -227,6 +629,7 @@ func (app *application) listTodosHandler(w http.ResponseWriter, r *http.Request)
 	// use the helper method to extract the values
 	input.Title = app.readString(qs, "title", "")
 	input.Description = app.readString(qs, "description", "")
+	input.Project = app.readString(qs, "project", "")
 	input.Completed = app.readBool(qs, "completed", false, v)
 
 	// get the  page info
@@ -237,21 +640,30 @@ func (app *application) listTodosHandler(w http.ResponseWriter, r *http.Request)
 	input.Filters.Sort = app.readString(qs, "sort", "id")
 
 	// specific the allowed sort types
-	input.Filters.SortList = []string{"id", "title", "description", "completed", "-id", "-title", "-description", "-completed"}
+	input.Filters.SortList = todoSortList
 
 	// check for validation errors
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
+		return
 	}
 
 	// Get a listing of all todos
-	todos, metadata, err := app.models.Todos.GetAll(input.Title, input.Description, input.Completed, input.Filters)
+	todos, metadata, err := app.models.Todos.GetAllContext(r.Context(), input.Title, input.Description, input.Project, input.Completed, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"todos": todos, "metadata": metadata}, nil)
+	// the client already holds the current listing
+	etag := listETag(todos, metadata)
+	if app.notModified(w, r, etag) {
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", etag)
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"todos": todos, "metadata": metadata}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -0,0 +1,165 @@
+// Filename: cmd/api/tracing.go
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+
+	"todoapi.miguelavila.net/internals/trace"
+)
+
+type contextKey string
+
+// requestIDKey is where the request id is kept in the request context
+const requestIDKey = contextKey("request_id")
+
+// requestIDPattern matches the X-Request-ID values accepted from clients, others
+// are replaced so they cannot inject anything into the logs
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:/+=-]{1,200}$`)
+
+// requestID() gives every request an id, the X-Request-ID the client or a proxy
+// sent or a new random one. It is echoed in the X-Request-ID response header and
+// included in the logs and error responses for the request
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			b := make([]byte, 16)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// requestIDFromContext() returns the id of the request a context belongs to, or
+// an empty string outside of a request
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// traceRequests() wraps every request in a server span named after its route.
+// A valid traceparent header makes the span part of the caller's trace, the
+// spans of the queries run for the request are its children
+func (app *application) traceRequests(next http.Handler) http.Handler {
+	doc := app.openAPI()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if remote, ok := trace.ParseTraceparent(r.Header.Get("traceparent")); ok {
+			ctx = trace.ContextWithRemote(ctx, remote)
+		}
+
+		name := r.Method
+		_, route, _ := doc.Find(r.Method, r.URL.Path)
+		if route != "" {
+			name += " " + route
+		}
+
+		ctx, span := trace.StartKind(ctx, name, "server")
+		span.SetAttribute("http.request.method", r.Method)
+		span.SetAttribute("url.path", r.URL.Path)
+		if route != "" {
+			span.SetAttribute("http.route", route)
+		}
+		if id := requestIDFromContext(ctx); id != "" {
+			span.SetAttribute("http.request.id", id)
+		}
+
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			// a panicking handler is answered by net/http, the span still ends
+			if p := recover(); p != nil {
+				span.SetError(fmt.Errorf("panic: %v", p))
+				span.Finish()
+				panic(p)
+			}
+
+			if sw.status == 0 {
+				sw.status = http.StatusOK
+			}
+			span.SetAttribute("http.response.status_code", sw.status)
+			if sw.status >= 500 {
+				span.SetError(errors.New(http.StatusText(sw.status)))
+			}
+			span.Finish()
+		}()
+
+		next.ServeHTTP(sw, r.WithContext(ctx))
+	})
+}
+
+// statusWriter keeps the status code of a response for its span
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 && status >= 200 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+// Flush() passes flushes through for the event streams
+func (sw *statusWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack() hands the connection over for a WebSocket, which is recorded as 101
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer does not support hijacking")
+	}
+	sw.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// Unwrap() lets http.ResponseController reach the underlying writer
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// newTraceExporter() returns the span exporter selected in the config, nil when
+// spans are not exported
+func newTraceExporter(cfg config) (trace.Exporter, error) {
+	switch cfg.trace.exporter {
+	case "none":
+		return nil, nil
+	case "stdout":
+		return trace.NewStdoutExporter(), nil
+	case "otlp-file":
+		if cfg.trace.otlpFile == "" {
+			return nil, errors.New("-trace-otlp-file must be set for the otlp-file exporter")
+		}
+		exporter, err := trace.NewOTLPFileExporter(cfg.trace.otlpFile, "todoapi")
+		if err != nil {
+			return nil, err
+		}
+		return exporter, nil
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.trace.exporter)
+	}
+}
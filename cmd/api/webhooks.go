@@ -0,0 +1,369 @@
+// Filename: cmd/api/webhooks.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"todoapi.miguelavila.net/internals/data"
+	"todoapi.miguelavila.net/internals/validator"
+)
+
+// createWebhookHandler for POST /v1/webhooks endpoint
+func (app *application) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		URL    string   `json:"url"`
+		Secret string   `json:"secret"`
+		Events []string `json:"events"`
+		Active *bool    `json:"active"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badResquestReponse(w, r, err)
+		return
+	}
+
+	webhook := &data.Webhook{
+		URL:    input.URL,
+		Secret: input.Secret,
+		Events: input.Events,
+		Active: true,
+	}
+	if input.Active != nil {
+		webhook.Active = *input.Active
+	}
+
+	// generate a signing secret if the client did not choose one
+	if webhook.Secret == "" {
+		webhook.Secret, err = generateSecret()
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	// Initialize a new instance of validator
+	v := validator.New()
+
+	if data.ValidateWebhook(v, webhook); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Webhooks.Insert(webhook)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// the secret is only returned this once
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/webhooks/%d", webhook.ID))
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"webhook": webhook}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listWebhooksHandler for GET /v1/webhooks endpoint
+func (app *application) listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := app.models.Webhooks.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	for _, webhook := range webhooks {
+		webhook.Secret = ""
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"webhooks": webhooks}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showWebhookHandler for GET /v1/webhooks/{id} endpoint
+func (app *application) showWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.fetchWebhook(w, r)
+	if !ok {
+		return
+	}
+	webhook.Secret = ""
+
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"webhook": webhook}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateWebhookHandler for PATCH /v1/webhooks/{id} endpoint
+func (app *application) updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.fetchWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	// pointers tell us which fields the client wants to change
+	var input struct {
+		URL    *string  `json:"url"`
+		Secret *string  `json:"secret"`
+		Events []string `json:"events"`
+		Active *bool    `json:"active"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badResquestReponse(w, r, err)
+		return
+	}
+
+	if input.URL != nil {
+		webhook.URL = *input.URL
+	}
+	if input.Secret != nil {
+		webhook.Secret = *input.Secret
+	}
+	if input.Events != nil {
+		webhook.Events = input.Events
+	}
+	if input.Active != nil {
+		webhook.Active = *input.Active
+	}
+
+	// Initialize a new instance of validator
+	v := validator.New()
+
+	if data.ValidateWebhook(v, webhook); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Webhooks.Update(webhook)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	webhook.Secret = ""
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"webhook": webhook}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteWebhookHandler for DELETE /v1/webhooks/{id} endpoint
+func (app *application) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Webhooks.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "webhook successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listWebhookDeliveriesHandler for GET /v1/webhooks/{id}/deliveries endpoint (the
+// delivery log of a webhook)
+func (app *application) listWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.fetchWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	// initialize a validator
+	v := validator.New()
+
+	// get the URL values in a map
+	qs := r.URL.Query()
+
+	var filters data.Filters
+	filters.Page = app.readInt(qs, "page", 1, v)
+	filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	filters.Sort = "-id"
+	filters.SortList = []string{"-id"}
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	deliveries, metadata, err := app.models.Webhooks.GetDeliveries(webhook.ID, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"deliveries": deliveries, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// fetchWebhook() loads the webhook named by the id parameter, sending a 404 when
+// it does not exist. It returns false when a response has been sent
+func (app *application) fetchWebhook(w http.ResponseWriter, r *http.Request) (*data.Webhook, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	webhook, err := app.models.Webhooks.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return webhook, true
+}
+
+// generateSecret() returns a random hex encoded webhook signing secret
+func generateSecret() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// startWebhookDispatcher() turns recorded events into deliveries and sends them
+// to the subscribed webhooks until the server shuts down
+func (app *application) startWebhookDispatcher() {
+	opts := data.WebhookOptions{
+		BatchSize:   app.config.webhooks.batchSize,
+		MaxAttempts: app.config.webhooks.maxAttempts,
+		Backoff:     app.webhookBackoff,
+		Lease:       time.Duration(app.config.webhooks.batchSize)*app.config.webhooks.timeout + time.Minute,
+		Workers:     app.config.webhooks.workers,
+	}
+
+	client := &http.Client{Timeout: app.config.webhooks.timeout}
+
+	app.background(func() {
+		ticker := time.NewTicker(app.config.webhooks.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-app.quit:
+				return
+			case <-ticker.C:
+			}
+
+			// fan the new events out to the subscribed webhooks
+			for {
+				n, err := app.models.Webhooks.FanOut(context.Background(), opts.BatchSize)
+				if err != nil {
+					app.logger.Printf("webhooks: %v", err)
+					break
+				}
+				if n < opts.BatchSize {
+					break
+				}
+			}
+
+			// send the deliveries that are due
+			for {
+				n, err := app.models.Webhooks.ProcessDeliveries(context.Background(), opts, func(message *data.WebhookMessage) (int, error) {
+					return app.deliverWebhook(client, message)
+				})
+				if err != nil {
+					app.logger.Printf("webhooks: %v", err)
+				}
+				if n < opts.BatchSize || app.stopping() {
+					break
+				}
+			}
+		}
+	})
+}
+
+// deliverWebhook() posts an event to a webhook. The body is signed with the
+// webhook's secret: X-Webhook-Signature is the hex encoded HMAC-SHA256 of the
+// X-Webhook-Timestamp header, a period and the body. It returns the response
+// status code, anything other than a 2xx is a failed delivery
+func (app *application) deliverWebhook(client *http.Client, message *data.WebhookMessage) (int, error) {
+	body, err := json.Marshal(envelope{
+		"id":         message.EventID,
+		"type":       message.EventType,
+		"created_at": message.CreatedAt,
+		"data":       message.Payload,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(message.Secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	req, err := http.NewRequest(http.MethodPost, message.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "todoapi-webhooks/"+version)
+	req.Header.Set("X-Webhook-Event", message.EventType)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(message.DeliveryID, 10))
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	// drain the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("webhook responded with status %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// webhookBackoff() doubles the wait after every failed attempt, up to six hours
+func (app *application) webhookBackoff(attempt int) time.Duration {
+	backoff := float64(app.config.webhooks.backoff) * math.Pow(2, float64(attempt-1))
+	return time.Duration(math.Min(backoff, float64(6*time.Hour)))
+}
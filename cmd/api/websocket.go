@@ -0,0 +1,302 @@
+// Filename: cmd/api/websocket.go
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"todoapi.miguelavila.net/internals/data"
+	"todoapi.miguelavila.net/internals/events"
+	"todoapi.miguelavila.net/internals/validator"
+)
+
+const (
+	// time allowed to write a message to the client
+	wsWriteWait = 10 * time.Second
+	// time allowed between pongs before the client is considered gone
+	wsPongWait = 60 * time.Second
+	// pings are sent more often than pongWait so a live client always answers in time
+	wsPingPeriod = 30 * time.Second
+	// largest message accepted from a client
+	wsMaxMessageSize = 64 * 1024
+	// replies queued for a client before it is disconnected
+	wsSendBuffer = 16
+)
+
+// wsRequest is a message sent by a client. Subscribe and unsubscribe use TodoIDs
+// and Projects, edit uses RequestID, ID, Version and Changes
+type wsRequest struct {
+	Type      string      `json:"type"`
+	RequestID string      `json:"request_id"`
+	TodoIDs   []int64     `json:"todo_ids"`
+	Projects  []string    `json:"projects"`
+	ID        int64       `json:"id"`
+	Version   *int32      `json:"version"`
+	Changes   todoChanges `json:"changes"`
+}
+
+// wsClient is a single WebSocket connection and the todos it is subscribed to
+type wsClient struct {
+	conn     *websocket.Conn
+	send     chan envelope
+	mu       sync.Mutex
+	todoIDs  map[int64]bool
+	projects map[string]bool
+}
+
+// todoSocketHandler for GET /v1/ws endpoint. It upgrades the connection to a
+// WebSocket on which the client subscribes to todos by id or project, receives
+// the changes made to them, and submits edits of its own
+func (app *application) todoSocketHandler(w http.ResponseWriter, r *http.Request) {
+	// take a connection slot, or turn the client away when there are none left
+	select {
+	case app.wsConns <- struct{}{}:
+		defer func() { <-app.wsConns }()
+	default:
+		app.tooManyConnectionsResponse(w, r)
+		return
+	}
+
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     app.checkSocketOrigin,
+	}
+
+	// the upgrader has already sent an error response when this fails
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	client := &wsClient{
+		conn:     conn,
+		send:     make(chan envelope, wsSendBuffer),
+		todoIDs:  make(map[int64]bool),
+		projects: make(map[string]bool),
+	}
+
+	sub, _, _ := app.events.Subscribe(0)
+	defer app.events.Unsubscribe(sub)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go app.writeSocket(client, sub, done)
+
+	// the read deadline is pushed back every time the client answers a ping
+	conn.SetReadLimit(wsMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		var req wsRequest
+		err := conn.ReadJSON(&req)
+		if err != nil {
+			var syntaxError *json.SyntaxError
+			var unmarshalTypeError *json.UnmarshalTypeError
+			if errors.As(err, &syntaxError) || errors.As(err, &unmarshalTypeError) {
+				client.reply(envelope{"type": "error", "error": "body contains badly-formed JSON"})
+				continue
+			}
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				app.logContext(r.Context(), "websocket: %v", err)
+			}
+			return
+		}
+
+		switch req.Type {
+		case "subscribe", "unsubscribe":
+			client.subscribe(req)
+		case "edit":
+			app.editFromSocket(r.Context(), client, req)
+		default:
+			client.reply(envelope{"type": "error", "request_id": req.RequestID, "error": "unknown message type"})
+		}
+	}
+}
+
+// writeSocket() is the only goroutine writing to the connection. It sends the
+// replies and the events the client is subscribed to, and pings the client
+func (app *application) writeSocket(client *wsClient, sub *events.Subscription, done <-chan struct{}) {
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+	// closing the connection also stops the read loop
+	defer client.conn.Close()
+
+	for {
+		var err error
+		client.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+
+		select {
+		case <-done:
+			return
+		case message := <-client.send:
+			err = client.conn.WriteJSON(message)
+		case event, ok := <-sub.C:
+			// the subscription was dropped or the server is shutting down
+			if !ok {
+				client.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+				return
+			}
+			if client.wants(event) {
+				err = client.conn.WriteJSON(envelope{"type": "event", "event": event})
+			}
+		case <-ping.C:
+			err = client.conn.WriteMessage(websocket.PingMessage, nil)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// editFromSocket() applies an edit sent over the socket. It goes through the same
+// validation and version check as PATCH /v1/todos/:id, a stale version is
+// answered with a conflict message carrying the current todo
+func (app *application) editFromSocket(ctx context.Context, client *wsClient, req wsRequest) {
+	// the version check must see the latest write, which a replica may not have
+	ctx = data.WithPrimary(ctx)
+
+	// Initialize a new instance of validator
+	v := validator.New()
+	v.Check(req.ID > 0, "id", "must be provided")
+	v.Check(req.Version != nil, "version", "must be provided")
+	if !v.Valid() {
+		client.reply(envelope{"type": "error", "request_id": req.RequestID, "error": v.Errors})
+		return
+	}
+
+	todo, err := app.models.Todos.GetContext(ctx, req.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			client.reply(envelope{"type": "error", "request_id": req.RequestID, "error": "the requested resource could not be found"})
+		default:
+			app.logContext(ctx, "websocket: %v", err)
+			client.reply(envelope{"type": "error", "request_id": req.RequestID, "error": "the server encountered a problem and could not process the request"})
+		}
+		return
+	}
+
+	if todo.Version != *req.Version {
+		client.reply(envelope{"type": "conflict", "request_id": req.RequestID, "todo": todo})
+		return
+	}
+
+	wasCompleted := todo.Completed
+	req.Changes.apply(todo)
+
+	if data.ValidateTodo(v, todo); !v.Valid() {
+		client.reply(envelope{"type": "error", "request_id": req.RequestID, "error": v.Errors})
+		return
+	}
+
+	var next *data.Todo
+	err = app.writeTodos(ctx, func(tw *todoWriter) error {
+		next, err = tw.update(todo, wasCompleted)
+		return err
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			// someone else saved first, send the client what they saved
+			current, err := app.models.Todos.GetContext(ctx, req.ID)
+			if err != nil {
+				client.reply(envelope{"type": "conflict", "request_id": req.RequestID})
+				return
+			}
+			client.reply(envelope{"type": "conflict", "request_id": req.RequestID, "todo": current})
+		default:
+			app.logContext(ctx, "websocket: %v", err)
+			client.reply(envelope{"type": "error", "request_id": req.RequestID, "error": "the server encountered a problem and could not process the request"})
+		}
+		return
+	}
+
+	env := envelope{"type": "ack", "request_id": req.RequestID, "todo": todo}
+	if next != nil {
+		env["next_occurrence"] = next
+	}
+	client.reply(env)
+}
+
+// checkSocketOrigin() allows the origins in the config, or only the same origin
+// when none are configured
+func (app *application) checkSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(app.config.websocket.allowedOrigins) == 0 || origin == "" {
+		return origin == "" || origin == "http://"+r.Host || origin == "https://"+r.Host
+	}
+	for _, allowed := range app.config.websocket.allowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// reply() queues a message for the client. A client that does not read its
+// replies fast enough is disconnected
+func (c *wsClient) reply(message envelope) {
+	select {
+	case c.send <- message:
+	default:
+		c.conn.Close()
+	}
+}
+
+// subscribe() adds or removes todo ids and projects from the client's
+// subscriptions and reports what the client is now subscribed to
+func (c *wsClient) subscribe(req wsRequest) {
+	c.mu.Lock()
+	for _, id := range req.TodoIDs {
+		if req.Type == "subscribe" {
+			c.todoIDs[id] = true
+		} else {
+			delete(c.todoIDs, id)
+		}
+	}
+	for _, project := range req.Projects {
+		if req.Type == "subscribe" {
+			c.projects[project] = true
+		} else {
+			delete(c.projects, project)
+		}
+	}
+
+	todoIDs := []int64{}
+	for id := range c.todoIDs {
+		todoIDs = append(todoIDs, id)
+	}
+	projects := []string{}
+	for project := range c.projects {
+		projects = append(projects, project)
+	}
+	c.mu.Unlock()
+
+	c.reply(envelope{"type": "subscribed", "request_id": req.RequestID, "todo_ids": todoIDs, "projects": projects})
+}
+
+// wants() reports whether the event is for a todo the client is subscribed to,
+// every client is told about a bulk import as any of its todos may be in it
+func (c *wsClient) wants(event events.Event) bool {
+	if event.Type == data.EventTodosImported {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.todoIDs[event.TodoID] || (event.Project != "" && c.projects[event.Project])
+}
@@ -0,0 +1,158 @@
+// Filename: cmd/api/writes.go
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"todoapi.miguelavila.net/internals/data"
+	"todoapi.miguelavila.net/internals/events"
+)
+
+// todoWriter makes changes to todos through models bound to a transaction. Every
+// change is recorded in the webhook outbox as part of the transaction and kept so
+// it can be published to the event hub once the transaction has committed
+type todoWriter struct {
+	ctx     context.Context
+	models  data.Models
+	changes []events.Event
+	bulk    bool
+}
+
+// writeTodos() runs fn in a transaction and publishes the changes it made to the
+// event hub if the transaction commits
+func (app *application) writeTodos(ctx context.Context, fn func(tw *todoWriter) error) error {
+	tw := &todoWriter{ctx: ctx}
+
+	err := app.models.Transaction(ctx, func(models data.Models) error {
+		tw.models = models
+		tw.changes = nil
+		tw.bulk = false
+		err := fn(tw)
+		if err != nil || !tw.bulk || len(tw.changes) == 0 {
+			return err
+		}
+		return models.Todos.NotifyBulkContext(ctx, len(tw.changes), tw.changes[len(tw.changes)-1].TodoID)
+	})
+	if err != nil {
+		return err
+	}
+
+	if tw.bulk {
+		if len(tw.changes) > 0 {
+			app.events.Publish(bulkEvent(len(tw.changes), tw.changes[len(tw.changes)-1].TodoID))
+		}
+		return nil
+	}
+	for _, change := range tw.changes {
+		app.events.Publish(change)
+	}
+	return nil
+}
+
+// startBulk() makes the rest of the transaction a bulk write, too large for
+// event stream clients to be sent one event per todo. They get a single
+// todos.imported event, from this instance and through the database from the
+// others, while the outbox still records every change for the webhooks
+func (tw *todoWriter) startBulk() error {
+	tw.bulk = true
+	return tw.models.Todos.StartBulkContext(tw.ctx)
+}
+
+// bulkEvent() is the event for count todos written at once. It is keyed on the
+// last todo written so the hub recognises the copy notified through the database
+func bulkEvent(count int, lastID int64) events.Event {
+	js, _ := json.Marshal(envelope{"imported": count})
+	return events.Event{Type: data.EventTodosImported, TodoID: lastID, Data: js}
+}
+
+// record() writes the change to the outbox and remembers it for the event hub
+func (tw *todoWriter) record(eventType string, todo *data.Todo) error {
+	payload := envelope{"todo": todo}
+	err := tw.models.Outbox.Insert(eventType, payload)
+	if err != nil {
+		return err
+	}
+
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	tw.changes = append(tw.changes, events.Event{
+		Type:    eventType,
+		TodoID:  todo.ID,
+		Project: todo.Project,
+		Version: todo.Version,
+		Data:    js,
+	})
+	return nil
+}
+
+// insert() creates a todo, a todo that already has an id was given one by the client
+func (tw *todoWriter) insert(todo *data.Todo) error {
+	var err error
+	if todo.ID > 0 {
+		err = tw.models.Todos.InsertWithIDContext(tw.ctx, todo)
+	} else {
+		err = tw.models.Todos.InsertContext(tw.ctx, todo)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tw.record(data.EventTodoCreated, todo)
+}
+
+// update() saves the changes made to a todo. When an occurrence of a recurring
+// todo is completed the next occurrence is inserted as well and returned, unless
+// it was already spawned by an earlier completion of the same occurrence
+func (tw *todoWriter) update(todo *data.Todo, wasCompleted bool) (*data.Todo, error) {
+	err := tw.models.Todos.UpdateContext(tw.ctx, todo)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tw.record(data.EventTodoUpdated, todo)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the transition to completed schedules the next occurrence
+	if wasCompleted || !todo.Completed {
+		return nil, nil
+	}
+
+	nextID, err := tw.models.Todos.NextOccurrenceIDContext(tw.ctx, todo.ID)
+	if err != nil || nextID != 0 {
+		return nil, err
+	}
+
+	next, err := data.NextOccurrence(todo)
+	if err != nil || next == nil {
+		return nil, err
+	}
+
+	err = tw.insert(next)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tw.models.Todos.SetNextOccurrenceContext(tw.ctx, todo.ID, next.ID)
+	if err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// delete() deletes a todo as the caller fetched it, it returns ErrEditConflict
+// when the todo has changed since. The event carries the todo as it was deleted
+func (tw *todoWriter) delete(todo *data.Todo) error {
+	err := tw.models.Todos.DeleteContext(tw.ctx, todo.ID, todo.Version)
+	if err != nil {
+		return err
+	}
+
+	return tw.record(data.EventTodoDeleted, todo)
+}
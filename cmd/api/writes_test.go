@@ -0,0 +1,38 @@
+// Filename: cmd/api/writes_test.go
+
+package main
+
+import (
+	"testing"
+
+	"todoapi.miguelavila.net/internals/data"
+	"todoapi.miguelavila.net/internals/events"
+)
+
+func TestBulkEventPublishedOnce(t *testing.T) {
+	hub := events.NewHub(10, 4)
+	sub, _, _ := hub.Subscribe(0)
+
+	// the importing instance publishes the event, then gets it back from the database
+	if _, ok := hub.Publish(bulkEvent(10000, 10042)); !ok {
+		t.Fatal("the bulk event was not published")
+	}
+	if _, ok := hub.Publish(bulkEvent(10000, 10042)); ok {
+		t.Errorf("the bulk event notified through the database was published again")
+	}
+	// another import is another event
+	if _, ok := hub.Publish(bulkEvent(3, 10045)); !ok {
+		t.Errorf("the next bulk event was not published")
+	}
+
+	event := <-sub.C
+	if event.Type != data.EventTodosImported || string(event.Data) != `{"imported":10000}` {
+		t.Errorf("event = %s %s, want %s {\"imported\":10000}", event.Type, event.Data, data.EventTodosImported)
+	}
+
+	// every WebSocket client is told, whatever it subscribed to
+	client := &wsClient{todoIDs: map[int64]bool{1: true}, projects: map[string]bool{}}
+	if !client.wants(event) {
+		t.Errorf("a WebSocket client subscribed to other todos does not get the bulk event")
+	}
+}
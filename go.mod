@@ -1,7 +1,24 @@
 module todoapi.miguelavila.net
 
-go 1.19
+go 1.20
 
 require github.com/julienschmidt/httprouter v1.3.0
 
 require github.com/lib/pq v1.10.2
+
+require github.com/gorilla/websocket v1.5.0
+
+require github.com/graphql-go/graphql v0.8.1
+
+require (
+	google.golang.org/grpc v1.58.3
+	google.golang.org/protobuf v1.31.0
+)
+
+require (
+	github.com/golang/protobuf v1.5.3 // indirect
+	golang.org/x/net v0.12.0 // indirect
+	golang.org/x/sys v0.10.0 // indirect
+	golang.org/x/text v0.11.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230711160842-782d3b101e98 // indirect
+)
@@ -0,0 +1,158 @@
+// Filename : internal/data/feeds.go
+
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"time"
+
+	"todoapi.miguelavila.net/internals/validator"
+)
+
+// FeedToken grants read access to the calendar feed, limited to the todos of
+// Project when it is set. Token is only set when the token has just been
+// created, afterwards only its hash is known
+type FeedToken struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Name       string     `json:"name"`
+	Project    string     `json:"project,omitempty"`
+	Token      string     `json:"token,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+func ValidateFeedToken(v *validator.Validator, feed *FeedToken) {
+	v.Check(feed.Name != "", "name", "must be provided")
+	v.Check(len(feed.Name) <= 100, "name", "must be no more than 100 characters")
+	v.Check(len(feed.Project) <= 100, "project", "must be no more than 100 characters")
+}
+
+// define a FeedsModel object that wraps a sql.DB connection pool
+type FeedsModel struct {
+	DB *sql.DB
+}
+
+// hashToken() returns the hash a token is stored and looked up by
+func hashToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+// Insert() creates a feed token with a new random secret
+func (m FeedsModel) Insert(feed *FeedToken) error {
+	b := make([]byte, 20)
+	_, err := rand.Read(b)
+	if err != nil {
+		return err
+	}
+	feed.Token = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+
+	query := `
+		INSERT INTO feed_tokens (name, project, token_hash)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+	`
+	// Create a context
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// cleanup the context to prevent memory leaks
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, feed.Name, feed.Project, hashToken(feed.Token)).Scan(&feed.ID, &feed.CreatedAt)
+}
+
+// GetByToken() returns the feed token with the given secret and records that it
+// was used. It returns ErrRecordNotFound for an unknown or revoked token
+func (m FeedsModel) GetByToken(token string) (*FeedToken, error) {
+	query := `
+		UPDATE feed_tokens
+		SET last_used_at = NOW()
+		WHERE token_hash = $1
+		RETURNING id, created_at, name, project, last_used_at
+	`
+	// Create a context
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// cleanup the context to prevent memory leaks
+	defer cancel()
+
+	var feed FeedToken
+	err := m.DB.QueryRowContext(ctx, query, hashToken(token)).Scan(&feed.ID, &feed.CreatedAt, &feed.Name, &feed.Project, &feed.LastUsedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &feed, nil
+}
+
+// GetAll() returns every feed token, oldest first
+func (m FeedsModel) GetAll() ([]*FeedToken, error) {
+	query := `
+		SELECT id, created_at, name, project, last_used_at
+		FROM feed_tokens
+		ORDER BY id
+	`
+	// create a context
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// cleanup the context to prevent memory leaks
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	// cleanup the rows to prevent memory leaks
+	defer rows.Close()
+
+	feeds := []*FeedToken{}
+	for rows.Next() {
+		var feed FeedToken
+		err := rows.Scan(&feed.ID, &feed.CreatedAt, &feed.Name, &feed.Project, &feed.LastUsedAt)
+		if err != nil {
+			return nil, err
+		}
+		feeds = append(feeds, &feed)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return feeds, nil
+}
+
+// Delete() revokes a feed token
+func (m FeedsModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM feed_tokens
+		WHERE id = $1
+	`
+	// Create a context
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// cleanup the context to prevent memory leaks
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+// Filename : internal/data/idempotency.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// IdempotencyKey holds the response stored for a client supplied Idempotency-Key.
+// A Status of zero means the first request is still being processed, until then
+// ExpiresAt is the end of its lease on the key
+type IdempotencyKey struct {
+	Key         string
+	Fingerprint string
+	Status      int
+	Headers     map[string][]string
+	Body        []byte
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+}
+
+// define a IdempotencyModel object that wraps a sql.DB connection pool
+type IdempotencyModel struct {
+	DB *sql.DB
+}
+
+// Claim() reserves the key for the request with the given fingerprint for the
+// lease, the record lives on for its ttl once Complete() has stored the response.
+// It returns false when a live record already exists for the key. Expired
+// records are taken over, so that keys can be reused once the ttl has passed and
+// a request that never finished only holds its key until the lease is over. The
+// returned time identifies the claim to Complete() and Release()
+func (m IdempotencyModel) Claim(key string, fingerprint string, lease time.Duration) (time.Time, bool, error) {
+	query := `
+		INSERT INTO idempotency_keys (key, fingerprint, expires_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO UPDATE
+		SET fingerprint = EXCLUDED.fingerprint, status = 0, headers = '{}', body = '',
+			created_at = NOW(), expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at < NOW()
+		RETURNING created_at
+	`
+	// Create a context
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// cleanup the context to prevent memory leaks
+	defer cancel()
+
+	var claimedAt time.Time
+	err := m.DB.QueryRowContext(ctx, query, key, fingerprint, time.Now().Add(lease)).Scan(&claimedAt)
+	if err != nil {
+		switch {
+		// the key is held by a live record
+		case errors.Is(err, sql.ErrNoRows):
+			return time.Time{}, false, nil
+		default:
+			return time.Time{}, false, err
+		}
+	}
+
+	return claimedAt, true, nil
+}
+
+// Get() allows us to retrieve the live record for a key
+func (m IdempotencyModel) Get(key string) (*IdempotencyKey, error) {
+	query := `
+		SELECT key, fingerprint, status, headers, body, created_at, expires_at
+		FROM idempotency_keys
+		WHERE key = $1
+		AND expires_at >= NOW()
+	`
+	var record IdempotencyKey
+	var headers []byte
+	// Create a context
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// cleanup the context to prevent memory leaks
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, key).Scan(
+		&record.Key,
+		&record.Fingerprint,
+		&record.Status,
+		&headers,
+		&record.Body,
+		&record.CreatedAt,
+		&record.ExpiresAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	err = json.Unmarshal(headers, &record.Headers)
+	if err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+// Complete() stores the response that was sent for the key so it can be replayed
+// until the ttl has passed. Nothing is stored when the claim was taken over by
+// another request after its lease ran out
+func (m IdempotencyModel) Complete(key string, claimedAt time.Time, status int, headers map[string][]string, body []byte, ttl time.Duration) error {
+	query := `
+		UPDATE idempotency_keys
+		SET status = $1, headers = $2, body = $3, expires_at = $4
+		WHERE key = $5 AND created_at = $6 AND status = 0
+	`
+	js, err := json.Marshal(headers)
+	if err != nil {
+		return err
+	}
+	// Create a context
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// cleanup the context to prevent memory leaks
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, status, js, body, time.Now().Add(ttl), key, claimedAt)
+	return err
+}
+
+// Release() removes the claim on a key so the client can retry the request,
+// it is used when the first request did not produce a response worth replaying
+func (m IdempotencyModel) Release(key string, claimedAt time.Time) error {
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE key = $1 AND created_at = $2 AND status = 0
+	`
+	// Create a context
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// cleanup the context to prevent memory leaks
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key, claimedAt)
+	return err
+}
@@ -3,23 +3,88 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
+
+	"github.com/lib/pq"
 )
 
 var (
 	ErrRecordNotFound = errors.New("record not found")
 	ErrEditConflict   = errors.New("edit conflict")
+	// ErrSyncTokenExpired means tombstones after the sync token have been purged
+	ErrSyncTokenExpired = errors.New("sync token expired")
 )
 
+// IsQueryCanceled() reports whether PostgreSQL canceled a query, which is how a
+// query fails when its context is done before it completes
+func IsQueryCanceled(err error) bool {
+	var pqError *pq.Error
+	return errors.As(err, &pqError) && pqError.Code == "57014"
+}
+
+// DBTX is implemented by both *sql.DB and *sql.Tx so that model methods can run
+// against the connection pool or inside of a transaction
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
 // A wrapper for out data models
 type Models struct {
-	Todos TodosModel
+	Todos       TodosModel
+	Idempotency IdempotencyModel
+	Reminders   RemindersModel
+	Webhooks    WebhooksModel
+	Outbox      OutboxModel
+	Feeds       FeedsModel
+	Queries     *QueryLog
+	db          *sql.DB
 }
 
-// NewModels() allows us to create new models
-func NewModels(db *sql.DB) *Models {
+// NewModels() allows us to create new models, queryTimeout limits how long a
+// todo query may run and the todo queries are recorded in queries. Todo reads
+// go to replicas when it is not nil
+func NewModels(db *sql.DB, queryTimeout time.Duration, queries *QueryLog, replicas *Replicas) *Models {
+	if replicas != nil {
+		replicas.instrument(queries)
+	}
+
 	return &Models{
-		Todos: TodosModel{DB: db},
+		Todos:       TodosModel{DB: queries.Wrap(db), Replicas: replicas, QueryTimeout: queryTimeout},
+		Idempotency: IdempotencyModel{DB: db},
+		Reminders:   RemindersModel{DB: db},
+		Webhooks:    WebhooksModel{DB: db},
+		Outbox:      OutboxModel{DB: db},
+		Feeds:       FeedsModel{DB: db},
+		Queries:     queries,
+		db:          db,
 	}
 }
+
+// Transaction() runs fn with a copy of the models whose queries all run inside a
+// single database transaction. The transaction is committed when fn returns nil
+// and rolled back otherwise
+func (m Models) Transaction(ctx context.Context, fn func(Models) error) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// rollback is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	txModels := m
+	txModels.Todos.DB = m.Queries.Wrap(tx)
+	txModels.Todos.Replicas = nil
+	txModels.Outbox.DB = tx
+
+	err = fn(txModels)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
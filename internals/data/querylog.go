@@ -0,0 +1,266 @@
+// Filename : internal/data/querylog.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSlowQueries is how many of the most recent slow queries are kept
+const maxSlowQueries = 50
+
+// QueryStats are the timings of a query, over every time it ran
+type QueryStats struct {
+	Query   string  `json:"query"`
+	Count   int64   `json:"count"`
+	Errors  int64   `json:"errors"`
+	TotalMS float64 `json:"total_ms"`
+	MeanMS  float64 `json:"mean_ms"`
+	MaxMS   float64 `json:"max_ms"`
+}
+
+// SlowQuery is a query that ran longer than the slow query threshold. Args only
+// shows the type and length of text arguments, which may hold user content. Plan
+// is the output of EXPLAIN (ANALYZE, FORMAT JSON) when it was captured
+type SlowQuery struct {
+	Query      string          `json:"query"`
+	Args       []string        `json:"args"`
+	DurationMS float64         `json:"duration_ms"`
+	Time       time.Time       `json:"time"`
+	Plan       json.RawMessage `json:"plan,omitempty"`
+	PlanError  string          `json:"plan_error,omitempty"`
+}
+
+// QueryLog records how long the queries run through the DBTX returned by Wrap()
+// take and keeps the slow ones
+type QueryLog struct {
+	slowThreshold time.Duration
+	explain       bool
+	logSlow       func(ctx context.Context, message string)
+	explaining    chan struct{}
+
+	mu    sync.Mutex
+	stats map[string]*QueryStats
+	slow  []*SlowQuery
+}
+
+// NewQueryLog() returns a query log. Queries taking longer than slowThreshold
+// are passed to logSlow, a zero threshold turns this off. With explain set the
+// plan of slow read only queries is captured by running them again under
+// EXPLAIN ANALYZE on the database that ran them, primary or replica, which is
+// meant for development as it repeats the work
+func NewQueryLog(slowThreshold time.Duration, explain bool, logSlow func(ctx context.Context, message string)) *QueryLog {
+	return &QueryLog{
+		slowThreshold: slowThreshold,
+		explain:       explain,
+		logSlow:       logSlow,
+		explaining:    make(chan struct{}, 1),
+		stats:         make(map[string]*QueryStats),
+	}
+}
+
+// Wrap() returns db with its queries recorded in the log, or db itself when
+// there is no log
+func (ql *QueryLog) Wrap(db DBTX) DBTX {
+	if ql == nil {
+		return db
+	}
+	return instrumentedDB{DBTX: db, log: ql}
+}
+
+// Stats() returns the timings of every query, the one that took the most time
+// in total first
+func (ql *QueryLog) Stats() []QueryStats {
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+
+	stats := make([]QueryStats, 0, len(ql.stats))
+	for _, s := range ql.stats {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].TotalMS > stats[j].TotalMS
+	})
+	return stats
+}
+
+// SlowQueries() returns the most recent slow queries, newest first
+func (ql *QueryLog) SlowQueries() []SlowQuery {
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+
+	slow := make([]SlowQuery, len(ql.slow))
+	for i, q := range ql.slow {
+		slow[len(ql.slow)-1-i] = *q
+	}
+	return slow
+}
+
+// record() adds a run of a query on db to its timings and keeps it when it was slow
+func (ql *QueryLog) record(ctx context.Context, db DBTX, query string, args []interface{}, duration time.Duration, err error) {
+	query = strings.Join(strings.Fields(query), " ")
+	ms := float64(duration.Microseconds()) / 1000
+
+	ql.mu.Lock()
+	s, ok := ql.stats[query]
+	if !ok {
+		s = &QueryStats{Query: query}
+		ql.stats[query] = s
+	}
+	s.Count++
+	if err != nil && err != sql.ErrNoRows {
+		s.Errors++
+	}
+	s.TotalMS += ms
+	s.MeanMS = s.TotalMS / float64(s.Count)
+	if ms > s.MaxMS {
+		s.MaxMS = ms
+	}
+
+	if ql.slowThreshold <= 0 || duration < ql.slowThreshold {
+		ql.mu.Unlock()
+		return
+	}
+
+	slow := &SlowQuery{Query: query, Args: redactArgs(args), DurationMS: ms, Time: time.Now()}
+	ql.slow = append(ql.slow, slow)
+	if len(ql.slow) > maxSlowQueries {
+		ql.slow = ql.slow[1:]
+	}
+	ql.mu.Unlock()
+
+	if ql.logSlow != nil {
+		ql.logSlow(ctx, fmt.Sprintf("slow query (%.1fms): %s args: [%s]", ms, query, strings.Join(slow.Args, ", ")))
+	}
+	if ql.explain && readOnly(query) {
+		ql.capturePlan(db, slow, query, args)
+	}
+}
+
+// capturePlan() runs EXPLAIN ANALYZE for a slow query in the background on the
+// connection pool that ran it, one at a time so that a slow database is not
+// given more work than it already has. A query run in a transaction is not
+// explained, the transaction is still in use and may see rows the pool cannot
+func (ql *QueryLog) capturePlan(db DBTX, slow *SlowQuery, query string, args []interface{}) {
+	pool, ok := db.(*sql.DB)
+	if !ok {
+		ql.mu.Lock()
+		slow.PlanError = "the query ran in a transaction, its plan is not captured"
+		ql.mu.Unlock()
+		return
+	}
+
+	select {
+	case ql.explaining <- struct{}{}:
+	default:
+		return
+	}
+
+	go func() {
+		defer func() { <-ql.explaining }()
+
+		// Create a context, the request that ran the query may be gone
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		// cleanup the context to prevent memory leaks
+		defer cancel()
+
+		var plan []byte
+		err := pool.QueryRowContext(ctx, "EXPLAIN (ANALYZE, FORMAT JSON) "+query, args...).Scan(&plan)
+
+		ql.mu.Lock()
+		defer ql.mu.Unlock()
+		if err != nil {
+			slow.PlanError = err.Error()
+			return
+		}
+		slow.Plan = plan
+	}()
+}
+
+// readOnly() reports whether a query can be run again under EXPLAIN ANALYZE,
+// which executes it, without changing or locking anything
+func readOnly(query string) bool {
+	upper := strings.ToUpper(query)
+	return strings.HasPrefix(upper, "SELECT ") && !strings.Contains(upper, " FOR UPDATE") && !strings.Contains(upper, " FOR SHARE")
+}
+
+// redactArgs() describes query arguments for the logs. Text is replaced by its
+// length so that titles and descriptions are not logged, other values are shown
+func redactArgs(args []interface{}) []string {
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		v := reflect.ValueOf(arg)
+		for v.Kind() == reflect.Pointer && !v.IsNil() {
+			v = v.Elem()
+		}
+
+		switch {
+		case !v.IsValid() || (v.Kind() == reflect.Pointer && v.IsNil()):
+			redacted[i] = "NULL"
+		case v.Kind() == reflect.String:
+			redacted[i] = fmt.Sprintf("(text, %d bytes)", v.Len())
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			redacted[i] = fmt.Sprintf("(binary, %d bytes)", v.Len())
+		case v.Type() == reflect.TypeOf(time.Time{}):
+			redacted[i] = v.Interface().(time.Time).Format(time.RFC3339)
+		case v.Kind() == reflect.Bool, v.CanInt(), v.CanUint(), v.CanFloat():
+			redacted[i] = fmt.Sprint(v.Interface())
+		default:
+			redacted[i] = fmt.Sprintf("(%s)", v.Type())
+		}
+	}
+	return redacted
+}
+
+// instrumentedDB times the queries run through it. A query is timed until the
+// database answers, the time spent reading the rows is left out
+type instrumentedDB struct {
+	DBTX
+	log *QueryLog
+}
+
+func (db instrumentedDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	result, err := db.DBTX.ExecContext(ctx, query, args...)
+	db.log.record(ctx, db.DBTX, query, args, time.Since(start), err)
+	return result, err
+}
+
+func (db instrumentedDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := db.DBTX.QueryContext(ctx, query, args...)
+	db.log.record(ctx, db.DBTX, query, args, time.Since(start), err)
+	return rows, err
+}
+
+func (db instrumentedDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	start := time.Now()
+	row := db.DBTX.QueryRowContext(ctx, query, args...)
+	db.log.record(ctx, db.DBTX, query, args, time.Since(start), row.Err())
+	return row
+}
+
+// wrapLike() returns conn with its queries recorded in the same log as the ones
+// of db, e.g. for a transaction begun on the connection pool db wraps
+func wrapLike(db DBTX, conn DBTX) DBTX {
+	if instrumented, ok := db.(instrumentedDB); ok {
+		return instrumented.log.Wrap(conn)
+	}
+	return conn
+}
+
+// unwrapDB() returns the DBTX an instrumentedDB wraps
+func unwrapDB(db DBTX) DBTX {
+	if instrumented, ok := db.(instrumentedDB); ok {
+		return instrumented.DBTX
+	}
+	return db
+}
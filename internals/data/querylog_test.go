@@ -0,0 +1,84 @@
+// Filename : internal/data/querylog_test.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForPlan() returns the plan error of the newest slow query once its plan
+// has been captured
+func waitForPlan(t *testing.T, ql *QueryLog) string {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		ql.mu.Lock()
+		planError := ql.slow[len(ql.slow)-1].PlanError
+		ql.mu.Unlock()
+		if planError != "" {
+			return planError
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("the plan was not captured")
+	return ""
+}
+
+func TestCapturePlanUsesTheDatabaseThatRanTheQuery(t *testing.T) {
+	// nothing listens on either address, the error names the one explained on
+	hosts := []string{"127.0.0.1", "127.0.0.2"}
+	for _, host := range hosts {
+		t.Run(host, func(t *testing.T) {
+			db, err := sql.Open("postgres", "postgres://todo@"+host+":1/todo?sslmode=disable&connect_timeout=1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			ql := NewQueryLog(time.Millisecond, true, nil)
+			ql.record(context.Background(), db, "SELECT id FROM todos", nil, time.Second, nil)
+
+			if planError := waitForPlan(t, ql); !strings.Contains(planError, host+":1") {
+				t.Errorf("got plan error %q, want one from %s", planError, host)
+			}
+		})
+	}
+}
+
+func TestCapturePlanSkipsTransactions(t *testing.T) {
+	ql := NewQueryLog(time.Millisecond, true, nil)
+	// a DBTX that is not a connection pool, as a *sql.Tx is not
+	tx := instrumentedDB{log: ql}
+	ql.record(context.Background(), tx, "SELECT id FROM todos", nil, time.Second, nil)
+
+	if planError := waitForPlan(t, ql); !strings.Contains(planError, "transaction") {
+		t.Errorf("got plan error %q, want the transaction noted", planError)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"SELECT id FROM todos", true},
+		{"select id from todos", true},
+		{"SELECT id FROM todos FOR UPDATE", false},
+		{"SELECT id FROM todos FOR SHARE SKIP LOCKED", false},
+		{"UPDATE todos SET completed = true", false},
+		{"WITH deleted AS (DELETE FROM todos RETURNING id) SELECT id FROM deleted", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if got := readOnly(tt.query); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+// Filename : internal/data/reminders.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ReminderDelivery records a single attempt at delivering a todo's reminder
+type ReminderDelivery struct {
+	ID        int64     `json:"id"`
+	TodoID    int64     `json:"todo_id"`
+	Notifier  string    `json:"notifier"`
+	Attempt   int       `json:"attempt"`
+	Succeeded bool      `json:"succeeded"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ReminderOptions controls how due reminders are claimed and retried
+type ReminderOptions struct {
+	BatchSize   int
+	MaxAttempts int
+	Notifier    string
+	// Lease is how long claimed reminders are held before another instance may
+	// claim them again, it should outlast delivering a whole batch
+	Lease time.Duration
+	// Backoff returns how long to wait before retrying after the given attempt failed
+	Backoff func(attempt int) time.Duration
+	// Stop is closed when the server shuts down, the reminders of the batch that
+	// have not been delivered yet are then handed back
+	Stop <-chan struct{}
+}
+
+// define a RemindersModel object that wraps a sql.DB connection pool
+type RemindersModel struct {
+	DB *sql.DB
+}
+
+// ProcessDue() claims up to BatchSize todos whose reminder is due and calls deliver
+// for each of them. Claiming counts the attempt and leases the rows until the
+// Lease is over, in a statement of its own, so no locks are held while the
+// notifier runs and rows claimed by other instances are skipped. A reminder whose
+// lease ran out, e.g. because the instance stopped, is claimed again. The result
+// of each attempt is recorded in a transaction of its own, unless the todo's
+// reminder was changed or claimed again in the meantime, an attempt that could
+// not be recorded does not hold up the rest of the batch. It returns the number
+// of reminders claimed along with the errors recording them
+func (m RemindersModel) ProcessDue(ctx context.Context, opts ReminderOptions, deliver func(*Todo) error) (int, error) {
+	query := `
+		UPDATE todos
+		SET reminder_attempts = reminder_attempts + 1, reminder_next_attempt_at = $3
+		WHERE id IN (
+			SELECT id
+			FROM todos
+			WHERE remind_at <= NOW()
+			AND reminded_at IS NULL
+			AND NOT completed
+			AND reminder_attempts < $1
+			AND (reminder_next_attempt_at IS NULL OR reminder_next_attempt_at <= NOW())
+			ORDER BY remind_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, title, description, completed, due_at, remind_at, recurrence, occurrence, version, reminder_attempts
+	`
+	rows, err := m.DB.QueryContext(ctx, query, opts.MaxAttempts, opts.BatchSize, time.Now().Add(opts.Lease))
+	if err != nil {
+		return 0, err
+	}
+
+	todos := []*Todo{}
+	attempts := []int{}
+	for rows.Next() {
+		var todo Todo
+		var attempt int
+		err := rows.Scan(
+			&todo.ID,
+			&todo.Title,
+			&todo.Description,
+			&todo.Completed,
+			&todo.DueAt,
+			&todo.RemindAt,
+			&todo.Recurrence,
+			&todo.Occurrence,
+			&todo.Version,
+			&attempt,
+		)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		todos = append(todos, &todo)
+		attempts = append(attempts, attempt)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var errs []error
+	for i, todo := range todos {
+		select {
+		case <-opts.Stop:
+			err = m.releaseClaims(ctx, todos[i:], attempts[i:])
+			return len(todos), errors.Join(append(errs, err)...)
+		default:
+		}
+
+		deliveryErr := deliver(todo)
+
+		err = m.recordAttempt(ctx, opts, todo, attempts[i], deliveryErr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("recording the reminder for todo %d: %w", todo.ID, err))
+		}
+	}
+
+	return len(todos), errors.Join(errs...)
+}
+
+// releaseClaims() hands back claimed reminders that were not delivered, taking
+// back the attempt their claim counted so they are due again straight away
+func (m RemindersModel) releaseClaims(ctx context.Context, todos []*Todo, attempts []int) error {
+	query := `
+		UPDATE todos
+		SET reminder_attempts = reminder_attempts - 1, reminder_next_attempt_at = NULL
+		FROM unnest($1::bigint[], $2::bigint[]) AS claim (id, attempt)
+		WHERE todos.id = claim.id AND todos.reminder_attempts = claim.attempt AND todos.reminded_at IS NULL
+	`
+	ids := make([]int64, len(todos))
+	claimed := make([]int64, len(todos))
+	for i, todo := range todos {
+		ids[i], claimed[i] = todo.ID, int64(attempts[i])
+	}
+
+	_, err := m.DB.ExecContext(ctx, query, pq.Array(ids), pq.Array(claimed))
+	return err
+}
+
+// recordAttempt() stores the result of a claimed reminder's delivery. The todo is
+// only updated while it still holds the claim, a todo whose remind_at changed
+// has had its attempts reset, and one claimed again has a higher attempt count
+func (m RemindersModel) recordAttempt(ctx context.Context, opts ReminderOptions, todo *Todo, attempt int, deliveryErr error) error {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// rollback is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	errMessage := ""
+	if deliveryErr != nil {
+		errMessage = deliveryErr.Error()
+	}
+
+	query := `
+		INSERT INTO reminder_deliveries (todo_id, notifier, attempt, succeeded, error)
+		VALUES ($1, $2, $3, $4, $5)
+	`
+	_, err = tx.ExecContext(ctx, query, todo.ID, opts.Notifier, attempt, deliveryErr == nil, errMessage)
+	if err != nil {
+		return err
+	}
+
+	if deliveryErr == nil {
+		query = `
+			UPDATE todos
+			SET reminded_at = NOW(), reminder_next_attempt_at = NULL
+			WHERE id = $1 AND reminder_attempts = $2 AND remind_at = $3
+		`
+		_, err = tx.ExecContext(ctx, query, todo.ID, attempt, todo.RemindAt)
+	} else {
+		query = `
+			UPDATE todos
+			SET reminder_next_attempt_at = $1
+			WHERE id = $2 AND reminder_attempts = $3 AND remind_at = $4
+		`
+		_, err = tx.ExecContext(ctx, query, time.Now().Add(opts.Backoff(attempt)), todo.ID, attempt, todo.RemindAt)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetDeliveries() returns the delivery attempts for a todo's reminders, newest first
+func (m RemindersModel) GetDeliveries(todoID int64) ([]*ReminderDelivery, error) {
+	query := `
+		SELECT id, todo_id, notifier, attempt, succeeded, error, created_at
+		FROM reminder_deliveries
+		WHERE todo_id = $1
+		ORDER BY id DESC
+		LIMIT 100
+	`
+	// create a context
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// cleanup the context to prevent memory leaks
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, todoID)
+	if err != nil {
+		return nil, err
+	}
+	// cleanup the rows to prevent memory leaks
+	defer rows.Close()
+
+	deliveries := []*ReminderDelivery{}
+	for rows.Next() {
+		var delivery ReminderDelivery
+		err := rows.Scan(
+			&delivery.ID,
+			&delivery.TodoID,
+			&delivery.Notifier,
+			&delivery.Attempt,
+			&delivery.Succeeded,
+			&delivery.Error,
+			&delivery.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, &delivery)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
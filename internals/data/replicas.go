@@ -0,0 +1,104 @@
+// Filename : internal/data/replicas.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// replica is a read replica and whether it passed its last health check
+type replica struct {
+	db      *sql.DB
+	conn    DBTX
+	healthy atomic.Bool
+}
+
+// Replicas spreads reads over the read replicas in turn, leaving out the ones
+// that failed their last health check
+type Replicas struct {
+	replicas []*replica
+	next     atomic.Uint64
+}
+
+// NewReplicas() returns the replicas, all of them healthy until checked
+func NewReplicas(dbs []*sql.DB) *Replicas {
+	r := &Replicas{}
+	for _, db := range dbs {
+		rep := &replica{db: db, conn: db}
+		rep.healthy.Store(true)
+		r.replicas = append(r.replicas, rep)
+	}
+	return r
+}
+
+// instrument() records the queries run on the replicas in queries
+func (r *Replicas) instrument(queries *QueryLog) {
+	for _, rep := range r.replicas {
+		rep.conn = queries.Wrap(rep.db)
+	}
+}
+
+// pick() returns the next healthy replica, or false when there is none
+func (r *Replicas) pick() (DBTX, bool) {
+	n := len(r.replicas)
+	start := r.next.Add(1)
+	for i := 0; i < n; i++ {
+		rep := r.replicas[(start+uint64(i))%uint64(n)]
+		if rep.healthy.Load() {
+			return rep.conn, true
+		}
+	}
+	return nil, false
+}
+
+// CheckHealth() pings every replica, each with the given timeout. onChange is
+// called with the index of a replica that went down, with the error, or came
+// back up, with a nil error
+func (r *Replicas) CheckHealth(timeout time.Duration, onChange func(index int, err error)) {
+	var wg sync.WaitGroup
+	for i, rep := range r.replicas {
+		wg.Add(1)
+		go func(i int, rep *replica) {
+			defer wg.Done()
+
+			// Create a context
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			// cleanup the context to prevent memory leaks
+			defer cancel()
+
+			err := rep.db.PingContext(ctx)
+			if rep.healthy.Swap(err == nil) != (err == nil) {
+				onChange(i, err)
+			}
+		}(i, rep)
+	}
+	wg.Wait()
+}
+
+// primaryKey marks a context whose reads must go to the primary
+const primaryKey = contextKey("primary")
+
+type contextKey string
+
+// WithPrimary() returns a context whose reads go to the primary, e.g. because
+// the client has just written and a replica may not have the change yet
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey, true)
+}
+
+// reader() returns where a read for ctx runs, a healthy replica unless ctx asks
+// for the primary or the model runs inside a transaction
+func (m TodosModel) reader(ctx context.Context) DBTX {
+	if m.Replicas == nil || ctx.Value(primaryKey) != nil {
+		return m.DB
+	}
+	db, ok := m.Replicas.pick()
+	if !ok {
+		return m.DB
+	}
+	return db
+}
@@ -0,0 +1,109 @@
+// Filename : internal/data/replicas_test.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// newTestReplicas() returns replicas whose pools point at a port nothing listens
+// on, so that pings fail straight away
+func newTestReplicas(t *testing.T, n int) (*Replicas, []*sql.DB) {
+	t.Helper()
+
+	var dbs []*sql.DB
+	for i := 0; i < n; i++ {
+		db, err := sql.Open("postgres", "postgres://todo@127.0.0.1:1/todo?sslmode=disable&connect_timeout=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		dbs = append(dbs, db)
+	}
+	return NewReplicas(dbs), dbs
+}
+
+func TestReplicasPick(t *testing.T) {
+	replicas, dbs := newTestReplicas(t, 3)
+	replicas.replicas[1].healthy.Store(false)
+
+	seen := map[DBTX]int{}
+	for i := 0; i < 6; i++ {
+		db, ok := replicas.pick()
+		if !ok {
+			t.Fatal("no replica picked")
+		}
+		seen[db]++
+	}
+	if seen[dbs[1]] != 0 {
+		t.Errorf("the unhealthy replica was picked %d times", seen[dbs[1]])
+	}
+	if seen[dbs[0]] == 0 || seen[dbs[2]] == 0 {
+		t.Errorf("reads were not spread over the healthy replicas: %v", seen)
+	}
+
+	for _, rep := range replicas.replicas {
+		rep.healthy.Store(false)
+	}
+	if _, ok := replicas.pick(); ok {
+		t.Errorf("a replica was picked with every replica down")
+	}
+}
+
+func TestReader(t *testing.T) {
+	replicas, dbs := newTestReplicas(t, 1)
+	primary, _ := newTestReplicas(t, 1)
+	m := TodosModel{DB: primary.replicas[0].db, Replicas: replicas}
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		healthy bool
+		want    DBTX
+	}{
+		{"replica", context.Background(), true, dbs[0]},
+		{"pinned to the primary", WithPrimary(context.Background()), true, m.DB},
+		{"replica down", context.Background(), false, m.DB},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replicas.replicas[0].healthy.Store(tt.healthy)
+			if got := m.reader(tt.ctx); got != tt.want {
+				t.Errorf("reader() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// a model without replicas always reads from the primary
+	m.Replicas = nil
+	if got := m.reader(context.Background()); got != m.DB {
+		t.Errorf("reader() without replicas = %v, want the primary", got)
+	}
+}
+
+func TestCheckHealthMarksDownReplicas(t *testing.T) {
+	replicas, _ := newTestReplicas(t, 2)
+
+	var down []int
+	replicas.CheckHealth(5*time.Second, func(index int, err error) {
+		if err == nil {
+			t.Errorf("replica %d reported back up", index)
+		}
+		down = append(down, index)
+	})
+	if len(down) != 2 {
+		t.Errorf("replicas reported down = %v, want both", down)
+	}
+	if _, ok := replicas.pick(); ok {
+		t.Errorf("a replica that is down was picked")
+	}
+
+	// a replica that stays down is only reported once
+	replicas.CheckHealth(5*time.Second, func(index int, err error) {
+		t.Errorf("replica %d reported again", index)
+	})
+}
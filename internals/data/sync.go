@@ -0,0 +1,230 @@
+// Filename : internal/data/sync.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Tombstone records that a todo was deleted
+type Tombstone struct {
+	ID        int64     `json:"id"`
+	Version   int32     `json:"version"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// SyncPosition is a point in the order changes are synced in: the transaction
+// that made a change, then its number in the change sequence. The zero value is
+// the start, before every change
+type SyncPosition struct {
+	XID int64
+	Seq int64
+}
+
+// Changes are the todos changed and deleted after a sync position
+type Changes struct {
+	Todos   []*Todo
+	Deleted []*Tombstone
+	// Position is the last change included, the next page starts after it
+	Position SyncPosition
+	// More is true when there are further changes after Position
+	More bool
+}
+
+// GetChanges() runs GetChangesContext() for callers without a request context
+func (m TodosModel) GetChanges(since SyncPosition, limit int) (*Changes, error) {
+	return m.GetChangesContext(context.Background(), since, limit)
+}
+
+// GetChangesContext() returns up to limit changes made after since, oldest first.
+// Only the changes of transactions older than every transaction still running
+// are returned, a transaction that commits later can then not add a change
+// before the position the client is given. A todo changed more than once is only
+// returned in its current state, and a todo that was deleted and created again
+// with the same id is only reported once, as whichever happened last. It returns
+// ErrSyncTokenExpired when tombstones after since have been purged
+func (m TodosModel) GetChangesContext(ctx context.Context, since SyncPosition, limit int) (*Changes, error) {
+	query := `
+		SELECT change_xid, change_seq, FALSE, id, title, description, project, completed, due_at, remind_at,
+			recurrence, occurrence, version, updated_at
+		FROM todos
+		WHERE (change_xid, change_seq) > ($1::xid8, $2)
+		AND change_xid < pg_snapshot_xmin(pg_current_snapshot())
+		UNION ALL
+		SELECT change_xid, change_seq, TRUE, todo_id, '', '', '', FALSE, NULL, NULL,
+			'', 0, version, deleted_at
+		FROM todo_tombstones
+		WHERE (change_xid, change_seq) > ($1::xid8, $2)
+		AND change_xid < pg_snapshot_xmin(pg_current_snapshot())
+		ORDER BY 1, 2
+		LIMIT $3
+	`
+	// create a context
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	// cleanup the context to prevent memory leaks
+	defer cancel()
+
+	// trace the query
+	ctx, span := traceQuery(ctx, "GetChanges")
+	defer span.Finish()
+
+	// one extra row tells us whether there is another page
+	rows, err := m.DB.QueryContext(ctx, query, since.XID, since.Seq, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	// cleanup the rows to prevent memory leaks
+	defer rows.Close()
+
+	changes := &Changes{Todos: []*Todo{}, Deleted: []*Tombstone{}, Position: since}
+	latest := make(map[int64]interface{})
+	order := []int64{}
+
+	for rows.Next() {
+		if len(order) == limit {
+			changes.More = true
+			break
+		}
+
+		var position SyncPosition
+		var deleted bool
+		var todo Todo
+		err := rows.Scan(
+			&position.XID,
+			&position.Seq,
+			&deleted,
+			&todo.ID,
+			&todo.Title,
+			&todo.Description,
+			&todo.Project,
+			&todo.Completed,
+			&todo.DueAt,
+			&todo.RemindAt,
+			&todo.Recurrence,
+			&todo.Occurrence,
+			&todo.Version,
+			&todo.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		changes.Position = position
+		order = append(order, todo.ID)
+		if deleted {
+			latest[todo.ID] = &Tombstone{ID: todo.ID, Version: todo.Version, DeletedAt: todo.UpdatedAt}
+		} else {
+			latest[todo.ID] = &todo
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	// the horizon is read after the changes, a purge that removed tombstones the
+	// changes should have held has moved it past since by then
+	if since != (SyncPosition{}) {
+		var expired bool
+		err = m.DB.QueryRowContext(ctx, `
+			SELECT ($1::xid8, $2::bigint) < (change_xid, change_seq) FROM todo_sync_horizon
+		`, since.XID, since.Seq).Scan(&expired)
+		if err != nil {
+			return nil, err
+		}
+		if expired {
+			return nil, ErrSyncTokenExpired
+		}
+	}
+
+	// the rows came in change order, keep the last change for each todo
+	for _, id := range order {
+		switch change := latest[id].(type) {
+		case *Todo:
+			changes.Todos = append(changes.Todos, change)
+		case *Tombstone:
+			changes.Deleted = append(changes.Deleted, change)
+		}
+		delete(latest, id)
+	}
+
+	return changes, nil
+}
+
+// GetDeleted() returns a deleted todo as it was when it was deleted at the given
+// version, which is kept with its tombstone
+func (m TodosModel) GetDeleted(id int64, version int32) (*Todo, error) {
+	query := `
+		SELECT t.id, t.title, t.description, t.project, t.completed, t.due_at, t.remind_at,
+			t.recurrence, t.occurrence, t.version, t.updated_at
+		FROM todo_tombstones, jsonb_populate_record(NULL::todos, todo) t
+		WHERE todo_id = $1 AND todo_tombstones.version = $2 AND todo IS NOT NULL
+		ORDER BY change_xid DESC, change_seq DESC
+		LIMIT 1
+	`
+	// create a context
+	ctx, cancel := context.WithTimeout(context.Background(), m.QueryTimeout)
+	// cleanup the context to prevent memory leaks
+	defer cancel()
+
+	// trace the query
+	ctx, span := traceQuery(ctx, "GetDeleted")
+	defer span.Finish()
+
+	var todo Todo
+	err := m.DB.QueryRowContext(ctx, query, id, version).Scan(
+		&todo.ID,
+		&todo.Title,
+		&todo.Description,
+		&todo.Project,
+		&todo.Completed,
+		&todo.DueAt,
+		&todo.RemindAt,
+		&todo.Recurrence,
+		&todo.Occurrence,
+		&todo.Version,
+		&todo.UpdatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &todo, nil
+}
+
+// PurgeTombstones() deletes the tombstones older than retention and moves the
+// sync horizon past them. It returns the number of tombstones deleted
+func (m TodosModel) PurgeTombstones(retention time.Duration) (int64, error) {
+	query := `
+		WITH purged AS (
+			DELETE FROM todo_tombstones
+			WHERE deleted_at < $1
+			RETURNING change_xid, change_seq
+		), last AS (
+			SELECT change_xid, change_seq FROM purged
+			ORDER BY change_xid DESC, change_seq DESC
+			LIMIT 1
+		), moved AS (
+			UPDATE todo_sync_horizon h
+			SET change_xid = last.change_xid, change_seq = last.change_seq
+			FROM last
+			WHERE (h.change_xid, h.change_seq) < (last.change_xid, last.change_seq)
+		)
+		SELECT COUNT(*) FROM purged
+	`
+	// create a context
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	// cleanup the context to prevent memory leaks
+	defer cancel()
+
+	var purged int64
+	err := m.DB.QueryRowContext(ctx, query, time.Now().Add(-retention)).Scan(&purged)
+	return purged, err
+}
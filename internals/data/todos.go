@@ -9,21 +9,35 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/lib/pq"
+	"todoapi.miguelavila.net/internals/rrule"
+	"todoapi.miguelavila.net/internals/trace"
 	"todoapi.miguelavila.net/internals/validator"
 )
 
 type Todo struct {
-	ID          int64     `json:"id"`
-	CreatedAt   time.Time `json:"-"`
-	Title       string    `json:"title"`
-	Description string    `json:"description,omitempty"`
-	Completed   bool      `json:"completed"`
-	Version     int32     `json:"version"`
+	ID          int64      `json:"id"`
+	CreatedAt   time.Time  `json:"-"`
+	Title       string     `json:"title"`
+	Description string     `json:"description,omitempty"`
+	Project     string     `json:"project,omitempty"`
+	Completed   bool       `json:"completed"`
+	DueAt       *time.Time `json:"due_at,omitempty"`
+	RemindAt    *time.Time `json:"remind_at,omitempty"`
+	Recurrence  string     `json:"recurrence,omitempty"`
+	Occurrence  int32      `json:"occurrence,omitempty"`
+	Version     int32      `json:"version"`
+	UpdatedAt   time.Time  `json:"updated_at"`
 }
 
-// define a TodosModel object that wraps a sql.DB connection pool
+// define a TodosModel object that wraps a sql.DB connection pool or a transaction.
+// The ...Context() methods stop a query when their ctx is done, e.g. because the
+// client went away, or once it has run for QueryTimeout. GetContext() and
+// GetAllContext() read from Replicas when there are any
 type TodosModel struct {
-	DB *sql.DB
+	DB           DBTX
+	Replicas     *Replicas
+	QueryTimeout time.Duration
 }
 
 func ValidateTodo(v *validator.Validator, Todo *Todo) {
@@ -34,42 +48,184 @@ func ValidateTodo(v *validator.Validator, Todo *Todo) {
 	v.Check(Todo.Description != "", "description", "must be provided")
 	v.Check(len(Todo.Description) <= 1000, "description", "must be no more than 1000 characters")
 
+	v.Check(len(Todo.Project) <= 100, "project", "must be no more than 100 characters")
+
 	v.Check(Todo.Completed || !Todo.Completed, "completed", "must be a bool")
 
+	// recurring todos need a due date to compute the next occurrence from
+	if Todo.Recurrence != "" {
+		_, err := rrule.Parse(Todo.Recurrence)
+		if err != nil {
+			v.AddError("recurrence", err.Error())
+		}
+		v.Check(Todo.DueAt != nil, "due_at", "must be provided for a recurring todo")
+	}
+
 }
 
-// insert() allows us to create a new Todo
+// NextOccurrence() returns the next occurrence of a recurring todo, due on the
+// date computed from its recurrence rule. It returns nil when the todo does not
+// recur or its series has ended
+func NextOccurrence(todo *Todo) (*Todo, error) {
+	if todo.Recurrence == "" || todo.DueAt == nil {
+		return nil, nil
+	}
+
+	rule, err := rrule.Parse(todo.Recurrence)
+	if err != nil {
+		return nil, err
+	}
+
+	dueAt, ok := rule.After(*todo.DueAt, int(todo.Occurrence))
+	if !ok {
+		return nil, nil
+	}
+
+	// the reminder keeps the same lead time before the due date
+	var remindAt *time.Time
+	if todo.RemindAt != nil {
+		next := dueAt.Add(todo.RemindAt.Sub(*todo.DueAt))
+		remindAt = &next
+	}
+
+	return &Todo{
+		Title:       todo.Title,
+		Description: todo.Description,
+		Project:     todo.Project,
+		DueAt:       &dueAt,
+		RemindAt:    remindAt,
+		Recurrence:  todo.Recurrence,
+		Occurrence:  todo.Occurrence + 1,
+	}, nil
+}
+
+// traceQuery() starts the span of a TodosModel query, it is a child of the
+// request span when ctx comes from a request
+func traceQuery(ctx context.Context, method string) (context.Context, *trace.Span) {
+	ctx, span := trace.Start(ctx, "TodosModel."+method)
+	span.SetAttribute("db.system", "postgresql")
+	return ctx, span
+}
+
+// Insert() runs InsertContext() for callers without a request context
 func (m TodosModel) Insert(todo *Todo) error {
+	return m.InsertContext(context.Background(), todo)
+}
+
+// InsertContext() allows us to create a new Todo
+func (m TodosModel) InsertContext(ctx context.Context, todo *Todo) error {
 	query := `
-		INSERT INTO todos (title, description, completed)	
-		VALUES ($1, $2, $3)
-		RETURNING id, create_at, version
+		INSERT INTO todos (title, description, completed, due_at, remind_at, recurrence, occurrence, project)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, create_at, version, updated_at
 	`
 	// Create a context
 	// Time starts when the context is created
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	// cleanup the context to prevent memory leaks
 	defer cancel()
 
+	// trace the query
+	ctx, span := traceQuery(ctx, "Insert")
+	defer span.Finish()
+
 	// collect data fields into a slice
+	// the first occurrence of a series is number 1
+	if todo.Occurrence < 1 {
+		todo.Occurrence = 1
+	}
+
 	args := []interface{}{
 		todo.Title,
 		todo.Description,
 		todo.Completed,
+		todo.DueAt,
+		todo.RemindAt,
+		todo.Recurrence,
+		todo.Occurrence,
+		todo.Project,
 	}
 	// run query ... -> expand the slice
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&todo.ID, &todo.CreatedAt, &todo.Version)
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&todo.ID, &todo.CreatedAt, &todo.Version, &todo.UpdatedAt)
+}
+
+// InsertWithID() runs InsertWithIDContext() for callers without a request context
+func (m TodosModel) InsertWithID(todo *Todo) error {
+	return m.InsertWithIDContext(context.Background(), todo)
+}
+
+// InsertWithIDContext() allows us to create a new Todo with an id chosen by the
+// client. It returns ErrEditConflict if a todo with the id already exists
+func (m TodosModel) InsertWithIDContext(ctx context.Context, todo *Todo) error {
+	query := `
+		INSERT INTO todos (id, title, description, completed, due_at, remind_at, recurrence, occurrence, project)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING create_at, version, updated_at
+	`
+	// Create a context
+	// Time starts when the context is created
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	// cleanup the context to prevent memory leaks
+	defer cancel()
+
+	// trace the query
+	ctx, span := traceQuery(ctx, "InsertWithID")
+	defer span.Finish()
+
+	if todo.Occurrence < 1 {
+		todo.Occurrence = 1
+	}
+
+	args := []interface{}{
+		todo.ID,
+		todo.Title,
+		todo.Description,
+		todo.Completed,
+		todo.DueAt,
+		todo.RemindAt,
+		todo.Recurrence,
+		todo.Occurrence,
+		todo.Project,
+	}
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&todo.CreatedAt, &todo.Version, &todo.UpdatedAt)
+	if err != nil {
+		var pqError *pq.Error
+		switch {
+		// another request created the todo first
+		case errors.As(err, &pqError) && pqError.Code == "23505":
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	// move the id sequence past the client's id so Insert() won't hand it out
+	// again. It only ever moves forward, a concurrent Insert() may have taken a
+	// number past the highest id that is in the table yet
+	query = `
+		SELECT setval(pg_get_serial_sequence('todos', 'id'), $1)
+		WHERE $1 > COALESCE(pg_sequence_last_value(pg_get_serial_sequence('todos', 'id')::regclass), 0)
+	`
+	_, err = m.DB.ExecContext(ctx, query, todo.ID)
+	return err
 }
 
-// Get() allows us to retrieve a specific todo
+// Get() runs GetContext() for callers without a request context, which read
+// from the primary as background work often follows a write
 func (m TodosModel) Get(id int64) (*Todo, error) {
+	return m.GetContext(WithPrimary(context.Background()), id)
+}
+
+// GetContext() allows us to retrieve a specific todo
+func (m TodosModel) GetContext(ctx context.Context, id int64) (*Todo, error) {
 	// Ensure that there is a valid id
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 	// Create the query for getting a specific todo
 	query := `
-        SELECT id, title, description, completed, version
+        SELECT id, title, description, project, completed, due_at, remind_at, recurrence, occurrence, version, updated_at
         FROM todos
         WHERE id = $1
     `
@@ -77,17 +233,27 @@ func (m TodosModel) Get(id int64) (*Todo, error) {
 	var todo Todo
 	// Create a context
 	// Time starts when the context is created
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	// cleanup the context to prevent memory leaks
 	defer cancel()
 
+	// trace the query
+	ctx, span := traceQuery(ctx, "Get")
+	defer span.Finish()
+
 	// Execute the query
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+	err := m.reader(ctx).QueryRowContext(ctx, query, id).Scan(
 		&todo.ID,
 		&todo.Title,
 		&todo.Description,
+		&todo.Project,
 		&todo.Completed,
+		&todo.DueAt,
+		&todo.RemindAt,
+		&todo.Recurrence,
+		&todo.Occurrence,
 		&todo.Version,
+		&todo.UpdatedAt,
 	)
 
 	if err != nil {
@@ -104,35 +270,54 @@ func (m TodosModel) Get(id int64) (*Todo, error) {
 	return &todo, nil
 }
 
-// Update() allows us to update a specific todo
+// Update() runs UpdateContext() for callers without a request context
+func (m TodosModel) Update(todo *Todo) error {
+	return m.UpdateContext(context.Background(), todo)
+}
+
+// UpdateContext() allows us to update a specific todo
 // KEY: GO's http.server handles each request in its own goroutine
 // Avoid data races
 // A: Apples 3 buys 3 so 0 remains
 // B: Apples 3 buys 2 so 1 remains
 // USING Optimistic Locking to prevent multiple Optimistic sql
-func (m TodosModel) Update(todo *Todo) error {
+func (m TodosModel) UpdateContext(ctx context.Context, todo *Todo) error {
 	query := `
 		UPDATE todos
-		SET title = $1, description = $2, completed = $3, version = version + 1
-		WHERE id = $4
-		AND version = $5
-		RETURNING version
+		SET title = $1, description = $2, completed = $3, due_at = $4, recurrence = $5,
+			remind_at = $6,
+			reminded_at = CASE WHEN remind_at IS DISTINCT FROM $6 THEN NULL ELSE reminded_at END,
+			reminder_attempts = CASE WHEN remind_at IS DISTINCT FROM $6 THEN 0 ELSE reminder_attempts END,
+			reminder_next_attempt_at = CASE WHEN remind_at IS DISTINCT FROM $6 THEN NULL ELSE reminder_next_attempt_at END,
+			project = $7, version = version + 1
+		WHERE id = $8
+		AND version = $9
+		RETURNING version, updated_at
 	`
 	// Create a context
 	// Time starts when the context is created
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 	// cleanup the context to prevent memory leaks
 	defer cancel()
+
+	// trace the query
+	ctx, span := traceQuery(ctx, "Update")
+	defer span.Finish()
+
 	args := []interface{}{
 		todo.Title,
 		todo.Description,
 		todo.Completed,
+		todo.DueAt,
+		todo.Recurrence,
+		todo.RemindAt,
+		todo.Project,
 		todo.ID,
 		todo.Version,
 	}
 
 	// check for edit conflict
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&todo.Version)
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&todo.Version, &todo.UpdatedAt)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -145,8 +330,95 @@ func (m TodosModel) Update(todo *Todo) error {
 	return nil
 }
 
-// Delete() allows us to delete a specific Todo
-func (m TodosModel) Delete(id int64) error {
+// NextOccurrenceIDContext() returns the id of the occurrence that was spawned
+// when the todo was completed, or 0 when there is none. Called after the todo
+// was updated in a transaction, its row stays locked until the transaction ends
+func (m TodosModel) NextOccurrenceIDContext(ctx context.Context, id int64) (int64, error) {
+	query := `
+		SELECT COALESCE(next_id, 0)
+		FROM todos
+		WHERE id = $1
+	`
+	// Create a context
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	// cleanup the context to prevent memory leaks
+	defer cancel()
+
+	// trace the query
+	ctx, span := traceQuery(ctx, "NextOccurrenceID")
+	defer span.Finish()
+
+	var nextID int64
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&nextID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+	return nextID, nil
+}
+
+// SetNextOccurrenceContext() records the occurrence spawned when the todo was
+// completed. The version is left alone, this is not a change made by the client
+func (m TodosModel) SetNextOccurrenceContext(ctx context.Context, id int64, nextID int64) error {
+	query := `
+		UPDATE todos
+		SET next_id = $2
+		WHERE id = $1
+	`
+	// Create a context
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	// cleanup the context to prevent memory leaks
+	defer cancel()
+
+	// trace the query
+	ctx, span := traceQuery(ctx, "SetNextOccurrence")
+	defer span.Finish()
+
+	_, err := m.DB.ExecContext(ctx, query, id, nextID)
+	return err
+}
+
+// StartBulkContext() stops the transaction the model runs in from notifying
+// every change to a todo, NotifyBulkContext() then notifies them all at once
+func (m TodosModel) StartBulkContext(ctx context.Context) error {
+	query := `SELECT set_config('todoapi.bulk', 'on', true)`
+	// Create a context
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	// cleanup the context to prevent memory leaks
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query)
+	return err
+}
+
+// NotifyBulkContext() sends a single todos_changed notification for the count
+// todos imported by the transaction, lastID is the id of the last of them
+func (m TodosModel) NotifyBulkContext(ctx context.Context, count int, lastID int64) error {
+	query := `
+		SELECT pg_notify('todos_changed', json_build_object('op', 'IMPORT', 'id', $1::bigint, 'count', $2::integer)::text)
+	`
+	// Create a context
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
+	// cleanup the context to prevent memory leaks
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, lastID, count)
+	return err
+}
+
+// Delete() runs DeleteContext() for callers without a request context
+func (m TodosModel) Delete(id int64, version int32) error {
+	return m.DeleteContext(context.Background(), id, version)
+}
+
+// DeleteContext() allows us to delete a specific Todo at the version the caller
+// last saw. It returns ErrEditConflict when the todo has been changed or deleted
+// since
+func (m TodosModel) DeleteContext(ctx context.Context, id int64, version int32) error {
 	// Ensure that there is a valid id
 	if id < 1 {
 		return nil
@@ -155,18 +427,22 @@ func (m TodosModel) Delete(id int64) error {
 	// Create the query for deleting a specific todo
 	query := `
 			DELETE FROM todos
-			WHERE id = $1
+			WHERE id = $1 AND version = $2
 		`
 
 	// Create a context
 	// Time starts when the context is created
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 
 	// cleanup the context to prevent memory leaks
 	defer cancel()
 
+	// trace the query
+	ctx, span := traceQuery(ctx, "Delete")
+	defer span.Finish()
+
 	// Execute the query
-	result, err := m.DB.ExecContext(ctx, query, id)
+	result, err := m.DB.ExecContext(ctx, query, id, version)
 	if err != nil {
 		// Check error type
 		return err
@@ -180,28 +456,40 @@ func (m TodosModel) Delete(id int64) error {
 		return err
 	}
 
-	// check if no records were deleted
+	// check if no records were deleted, the todo changed or went away
 	if rows == 0 {
-		return ErrRecordNotFound
+		return ErrEditConflict
 	}
 
 	return nil
 
 }
 
-// func GetAll() method returns a list of all todo sorted by id
-func (m TodosModel) GetAll(title string, description string, completed bool, filters Filters) ([]*Todo, Metadata, error) {
+// todosWhere filters todos by title and description (full text), completed and
+// project, taking them as the first four query arguments
+const todosWhere = `
+	WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
+	AND (to_tsvector('simple', description) @@ plainto_tsquery('simple', $2) OR $2 = '')
+	AND ((completed = $3) OR $3 = false)
+	AND (project = $4 OR $4 = '')`
+
+// GetAll() runs GetAllContext() for callers without a request context, on the
+// primary as Get() does
+func (m TodosModel) GetAll(title string, description string, project string, completed bool, filters Filters) ([]*Todo, Metadata, error) {
+	return m.GetAllContext(WithPrimary(context.Background()), title, description, project, completed, filters)
+}
+
+// GetAllContext() method returns a list of all todo sorted by id
+func (m TodosModel) GetAllContext(ctx context.Context, title string, description string, project string, completed bool, filters Filters) ([]*Todo, Metadata, error) {
 	// construct the query
 	query := fmt.Sprintf(`
 		 SELECT
 		 		COUNT(*) OVER(),
-				id, title, description, completed, version
+				id, title, description, project, completed, due_at, remind_at, recurrence, occurrence, version, updated_at
 				FROM todos
-				WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
-				AND (to_tsvector('simple', description) @@ plainto_tsquery('simple', $2) OR $2 = '')
-				AND ((completed = $3) OR $3 = false)
+				%s
 				ORDER BY %s %s, id ASC
-				LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortOrder())
+				LIMIT $5 OFFSET $6`, todosWhere, filters.sortColumn(), filters.sortOrder())
 
 	// query := fmt.Sprintf(`
 	// 		SELECT
@@ -215,15 +503,19 @@ func (m TodosModel) GetAll(title string, description string, completed bool, fil
 	// 		LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortOrder())
 
 	// create a context
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.QueryTimeout)
 
 	// cleanup the context to prevent memory leaks
 	defer cancel()
 
-	args := []interface{}{title, description, completed, filters.limit(), filters.offset()}
+	// trace the query
+	ctx, span := traceQuery(ctx, "GetAll")
+	defer span.Finish()
+
+	args := []interface{}{title, description, completed, project, filters.limit(), filters.offset()}
 
 	// execute the query
-	rows, err := m.DB.QueryContext(ctx, query, args...)
+	rows, err := m.reader(ctx).QueryContext(ctx, query, args...)
 	if err != nil {
 		// Check error type
 		return nil, Metadata{}, err
@@ -244,8 +536,14 @@ func (m TodosModel) GetAll(title string, description string, completed bool, fil
 			&todo.ID,
 			&todo.Title,
 			&todo.Description,
+			&todo.Project,
 			&todo.Completed,
+			&todo.DueAt,
+			&todo.RemindAt,
+			&todo.Recurrence,
+			&todo.Occurrence,
 			&todo.Version,
+			&todo.UpdatedAt,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
@@ -263,3 +561,82 @@ func (m TodosModel) GetAll(title string, description string, completed bool, fil
 	// return the slice of Todos
 	return todos, metadata, nil
 }
+
+// Export() calls fn for every todo matching the same filters and sort as GetAll(),
+// ignoring the page. The rows are read through a server-side cursor in batches
+// so the result is never held in memory. It stops at the first error from fn
+func (m TodosModel) Export(ctx context.Context, title string, description string, project string, completed bool, filters Filters, fn func(*Todo) error) error {
+	// trace the query
+	ctx, span := traceQuery(ctx, "Export")
+	defer span.Finish()
+
+	// a cursor only lives as long as its transaction
+	db, ok := unwrapDB(m.DB).(*sql.DB)
+	if !ok {
+		return errors.New("export cannot run inside another transaction")
+	}
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	// rollback is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	// the cursor's queries are timed like the other todo queries
+	conn := wrapLike(m.DB, tx)
+
+	query := fmt.Sprintf(`
+		DECLARE todos_export NO SCROLL CURSOR FOR
+		SELECT id, title, description, project, completed, due_at, remind_at, recurrence, occurrence, version, updated_at
+		FROM todos
+		%s
+		ORDER BY %s %s, id ASC`, todosWhere, filters.sortColumn(), filters.sortOrder())
+
+	_, err = conn.ExecContext(ctx, query, title, description, completed, project)
+	if err != nil {
+		return err
+	}
+
+	for {
+		rows, err := conn.QueryContext(ctx, "FETCH 500 FROM todos_export")
+		if err != nil {
+			return err
+		}
+
+		n := 0
+		for rows.Next() {
+			var todo Todo
+			err = rows.Scan(
+				&todo.ID,
+				&todo.Title,
+				&todo.Description,
+				&todo.Project,
+				&todo.Completed,
+				&todo.DueAt,
+				&todo.RemindAt,
+				&todo.Recurrence,
+				&todo.Occurrence,
+				&todo.Version,
+				&todo.UpdatedAt,
+			)
+			if err == nil {
+				err = fn(&todo)
+			}
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			n++
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		// the cursor is exhausted
+		if n == 0 {
+			return tx.Commit()
+		}
+	}
+}
@@ -0,0 +1,517 @@
+// Filename : internal/data/webhooks.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"todoapi.miguelavila.net/internals/validator"
+)
+
+// The todo lifecycle events webhooks can subscribe to
+const (
+	EventTodoCreated = "todo.created"
+	EventTodoUpdated = "todo.updated"
+	EventTodoDeleted = "todo.deleted"
+)
+
+// EventTodosImported tells event stream clients that many todos were created at
+// once and they should sync, instead of an event per todo. Webhooks still get
+// a todo.created event for each of them
+const EventTodosImported = "todos.imported"
+
+// EventTypes lists every event type a webhook can subscribe to
+var EventTypes = []string{EventTodoCreated, EventTodoUpdated, EventTodoDeleted}
+
+// Webhook is a subscription that receives the events listed in Events. The
+// secret is only shown when the webhook is created
+type Webhook struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	Version   int32     `json:"version"`
+}
+
+// WebhookDelivery is the attempt to deliver one event to one webhook
+type WebhookDelivery struct {
+	ID             int64      `json:"id"`
+	WebhookID      int64      `json:"webhook_id"`
+	EventID        int64      `json:"event_id"`
+	EventType      string     `json:"event_type"`
+	Status         string     `json:"status"` // pending, delivered or failed
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  time.Time  `json:"next_attempt_at"`
+	ResponseStatus int        `json:"response_status,omitempty"`
+	Error          string     `json:"error,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+}
+
+// WebhookMessage holds everything needed to send a delivery
+type WebhookMessage struct {
+	DeliveryID int64
+	Attempt    int
+	WebhookID  int64
+	URL        string
+	Secret     string
+	EventID    int64
+	EventType  string
+	CreatedAt  time.Time
+	Payload    json.RawMessage
+}
+
+// WebhookOptions controls how deliveries are claimed and retried
+type WebhookOptions struct {
+	BatchSize   int
+	MaxAttempts int
+	// Backoff returns how long to wait before retrying after the given attempt failed
+	Backoff func(attempt int) time.Duration
+	// Lease is how long claimed deliveries are held before another instance may
+	// claim them again, it should outlast delivering a whole batch
+	Lease time.Duration
+	// Workers is how many webhooks are called at the same time
+	Workers int
+}
+
+func ValidateWebhook(v *validator.Validator, webhook *Webhook) {
+	v.Check(webhook.URL != "", "url", "must be provided")
+	v.Check(len(webhook.URL) <= 2000, "url", "must be no more than 2000 characters")
+	if webhook.URL != "" {
+		u, err := url.Parse(webhook.URL)
+		v.Check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "url", "must be an absolute http or https URL")
+	}
+
+	v.Check(len(webhook.Secret) >= 16, "secret", "must be at least 16 characters")
+	v.Check(len(webhook.Secret) <= 200, "secret", "must be no more than 200 characters")
+
+	v.Check(len(webhook.Events) > 0, "events", "must contain at least one event")
+	v.Check(validator.Unique(webhook.Events), "events", "must not contain duplicate values")
+	for _, event := range webhook.Events {
+		v.Check(validator.In(event, EventTypes...), "events", "must only contain todo.created, todo.updated or todo.deleted")
+	}
+}
+
+// define a OutboxModel object that wraps a sql.DB connection pool or a transaction.
+// Events are written through it in the same transaction as the todo change
+type OutboxModel struct {
+	DB DBTX
+}
+
+// Insert() records an event to be sent to the subscribed webhooks
+func (m OutboxModel) Insert(eventType string, payload interface{}) error {
+	query := `
+		INSERT INTO webhook_events (event_type, payload)
+		VALUES ($1, $2)
+	`
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	// Create a context
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// cleanup the context to prevent memory leaks
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, eventType, js)
+	return err
+}
+
+// define a WebhooksModel object that wraps a sql.DB connection pool
+type WebhooksModel struct {
+	DB *sql.DB
+}
+
+// Insert() allows us to create a new webhook
+func (m WebhooksModel) Insert(webhook *Webhook) error {
+	query := `
+		INSERT INTO webhooks (url, secret, events, active)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, version
+	`
+	// Create a context
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// cleanup the context to prevent memory leaks
+	defer cancel()
+
+	args := []interface{}{webhook.URL, webhook.Secret, pq.Array(webhook.Events), webhook.Active}
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.ID, &webhook.CreatedAt, &webhook.Version)
+}
+
+// Get() allows us to retrieve a specific webhook
+func (m WebhooksModel) Get(id int64) (*Webhook, error) {
+	// Ensure that there is a valid id
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+		SELECT id, created_at, url, secret, events, active, version
+		FROM webhooks
+		WHERE id = $1
+	`
+	var webhook Webhook
+	// Create a context
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// cleanup the context to prevent memory leaks
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&webhook.ID,
+		&webhook.CreatedAt,
+		&webhook.URL,
+		&webhook.Secret,
+		pq.Array(&webhook.Events),
+		&webhook.Active,
+		&webhook.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &webhook, nil
+}
+
+// GetAll() returns every webhook sorted by id
+func (m WebhooksModel) GetAll() ([]*Webhook, error) {
+	query := `
+		SELECT id, created_at, url, secret, events, active, version
+		FROM webhooks
+		ORDER BY id
+	`
+	// create a context
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// cleanup the context to prevent memory leaks
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	// cleanup the rows to prevent memory leaks
+	defer rows.Close()
+
+	webhooks := []*Webhook{}
+	for rows.Next() {
+		var webhook Webhook
+		err := rows.Scan(
+			&webhook.ID,
+			&webhook.CreatedAt,
+			&webhook.URL,
+			&webhook.Secret,
+			pq.Array(&webhook.Events),
+			&webhook.Active,
+			&webhook.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, &webhook)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return webhooks, nil
+}
+
+// Update() allows us to update a specific webhook using optimistic locking
+func (m WebhooksModel) Update(webhook *Webhook) error {
+	query := `
+		UPDATE webhooks
+		SET url = $1, secret = $2, events = $3, active = $4, version = version + 1
+		WHERE id = $5
+		AND version = $6
+		RETURNING version
+	`
+	// Create a context
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// cleanup the context to prevent memory leaks
+	defer cancel()
+
+	args := []interface{}{
+		webhook.URL,
+		webhook.Secret,
+		pq.Array(webhook.Events),
+		webhook.Active,
+		webhook.ID,
+		webhook.Version,
+	}
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete() allows us to delete a specific webhook along with its deliveries
+func (m WebhooksModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	query := `
+		DELETE FROM webhooks
+		WHERE id = $1
+	`
+	// Create a context
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// cleanup the context to prevent memory leaks
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetDeliveries() returns the delivery log of a webhook, newest first
+func (m WebhooksModel) GetDeliveries(webhookID int64, filters Filters) ([]*WebhookDelivery, Metadata, error) {
+	query := `
+		SELECT COUNT(*) OVER(), d.id, d.webhook_id, d.event_id, e.event_type, d.status, d.attempts,
+			d.next_attempt_at, d.response_status, d.error, d.created_at, d.delivered_at
+		FROM webhook_deliveries d
+		INNER JOIN webhook_events e ON e.id = d.event_id
+		WHERE d.webhook_id = $1
+		ORDER BY d.id DESC
+		LIMIT $2 OFFSET $3
+	`
+	// create a context
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// cleanup the context to prevent memory leaks
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, webhookID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	// cleanup the rows to prevent memory leaks
+	defer rows.Close()
+
+	totalRecords := 0
+	deliveries := []*WebhookDelivery{}
+	for rows.Next() {
+		var delivery WebhookDelivery
+		err := rows.Scan(
+			&totalRecords,
+			&delivery.ID,
+			&delivery.WebhookID,
+			&delivery.EventID,
+			&delivery.EventType,
+			&delivery.Status,
+			&delivery.Attempts,
+			&delivery.NextAttemptAt,
+			&delivery.ResponseStatus,
+			&delivery.Error,
+			&delivery.CreatedAt,
+			&delivery.DeliveredAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		deliveries = append(deliveries, &delivery)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return deliveries, calculatesMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// FanOut() creates a pending delivery for every active webhook subscribed to the
+// events that have not been dispatched yet. It returns the number of events
+// dispatched
+func (m WebhooksModel) FanOut(ctx context.Context, limit int) (int, error) {
+	query := `
+		WITH events AS (
+			SELECT id, event_type
+			FROM webhook_events
+			WHERE dispatched_at IS NULL
+			ORDER BY id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		), deliveries AS (
+			INSERT INTO webhook_deliveries (webhook_id, event_id)
+			SELECT w.id, e.id
+			FROM events e
+			INNER JOIN webhooks w ON w.active AND e.event_type = ANY(w.events)
+		)
+		UPDATE webhook_events
+		SET dispatched_at = NOW()
+		WHERE id IN (SELECT id FROM events)
+	`
+	result, err := m.DB.ExecContext(ctx, query, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := result.RowsAffected()
+	return int(rows), err
+}
+
+// ProcessDeliveries() claims up to BatchSize pending deliveries that are due and
+// calls deliver for each of them, which returns the response status code.
+// Claiming counts the attempt and leases the rows until the Lease is over, in a
+// statement of its own, so no locks are held while the webhooks are called and
+// rows claimed by other instances are skipped. A delivery whose lease ran out is
+// claimed again. Failed deliveries are retried with the backoff until MaxAttempts
+// is reached. Up to Workers webhooks are called at the same time, the deliveries
+// to one webhook are sent one after the other, so a webhook that does not answer
+// only holds up its own deliveries. A result that could not be recorded does not
+// hold up the rest of the batch. It returns the number of deliveries claimed
+// along with the errors recording them
+func (m WebhooksModel) ProcessDeliveries(ctx context.Context, opts WebhookOptions, deliver func(*WebhookMessage) (int, error)) (int, error) {
+	query := `
+		WITH claimed AS (
+			UPDATE webhook_deliveries
+			SET attempts = attempts + 1, next_attempt_at = $2
+			WHERE id IN (
+				SELECT id
+				FROM webhook_deliveries
+				WHERE status = 'pending'
+				AND next_attempt_at <= NOW()
+				ORDER BY next_attempt_at, id
+				LIMIT $1
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING id, attempts, webhook_id, event_id
+		)
+		SELECT c.id, c.attempts, w.id, w.url, w.secret, e.id, e.event_type, e.created_at, e.payload
+		FROM claimed c
+		INNER JOIN webhooks w ON w.id = c.webhook_id
+		INNER JOIN webhook_events e ON e.id = c.event_id
+		ORDER BY c.id
+	`
+	rows, err := m.DB.QueryContext(ctx, query, opts.BatchSize, time.Now().Add(opts.Lease))
+	if err != nil {
+		return 0, err
+	}
+
+	messages := []*WebhookMessage{}
+	for rows.Next() {
+		var message WebhookMessage
+		err := rows.Scan(
+			&message.DeliveryID,
+			&message.Attempt,
+			&message.WebhookID,
+			&message.URL,
+			&message.Secret,
+			&message.EventID,
+			&message.EventType,
+			&message.CreatedAt,
+			&message.Payload,
+		)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		messages = append(messages, &message)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// the deliveries of each webhook, in the order they were claimed
+	byWebhook := map[int64][]*WebhookMessage{}
+	order := []int64{}
+	for _, message := range messages {
+		if _, ok := byWebhook[message.WebhookID]; !ok {
+			order = append(order, message.WebhookID)
+		}
+		byWebhook[message.WebhookID] = append(byWebhook[message.WebhookID], message)
+	}
+
+	size := opts.Workers
+	if size < 1 {
+		size = 1
+	}
+	workers := make(chan struct{}, size)
+	var mu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	for _, id := range order {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(messages []*WebhookMessage) {
+			defer wg.Done()
+			defer func() { <-workers }()
+
+			for _, message := range messages {
+				status, deliveryErr := deliver(message)
+
+				err := m.recordDelivery(ctx, opts, message, status, deliveryErr)
+				if err != nil {
+					mu.Lock()
+					errs = append(errs, fmt.Errorf("recording delivery %d: %w", message.DeliveryID, err))
+					mu.Unlock()
+				}
+			}
+		}(byWebhook[id])
+	}
+	wg.Wait()
+
+	return len(messages), errors.Join(errs...)
+}
+
+// recordDelivery() stores the result of a claimed delivery. It is only recorded
+// while the delivery still holds the claim, one claimed again has a higher
+// attempt count
+func (m WebhooksModel) recordDelivery(ctx context.Context, opts WebhookOptions, message *WebhookMessage, status int, deliveryErr error) error {
+	var err error
+	switch {
+	case deliveryErr == nil:
+		query := `
+			UPDATE webhook_deliveries
+			SET status = 'delivered', response_status = $1, error = '', delivered_at = NOW()
+			WHERE id = $2 AND attempts = $3 AND status = 'pending'
+		`
+		_, err = m.DB.ExecContext(ctx, query, status, message.DeliveryID, message.Attempt)
+	case message.Attempt >= opts.MaxAttempts:
+		query := `
+			UPDATE webhook_deliveries
+			SET status = 'failed', response_status = $1, error = $2
+			WHERE id = $3 AND attempts = $4 AND status = 'pending'
+		`
+		_, err = m.DB.ExecContext(ctx, query, status, deliveryErr.Error(), message.DeliveryID, message.Attempt)
+	default:
+		query := `
+			UPDATE webhook_deliveries
+			SET response_status = $1, error = $2, next_attempt_at = $3
+			WHERE id = $4 AND attempts = $5 AND status = 'pending'
+		`
+		nextAttempt := time.Now().Add(opts.Backoff(message.Attempt))
+		_, err = m.DB.ExecContext(ctx, query, status, deliveryErr.Error(), nextAttempt, message.DeliveryID, message.Attempt)
+	}
+	return err
+}
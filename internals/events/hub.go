@@ -0,0 +1,169 @@
+// Filename : internal/events/hub.go
+
+package events
+
+import (
+	"encoding/json"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// epochBits is the size of the epoch at the top of an event ID, the IDs stay
+// below 2^53 so that JavaScript clients can hold them as numbers
+const (
+	epochBits  = 20
+	epochShift = 32
+)
+
+// Event is a change to a todo. The ID is assigned by the hub and increases by one
+// for every event published, so clients can resume from the last one they saw.
+// Its upper bits are the epoch of the hub, which is picked at random when the hub
+// is created, so an ID handed out by another instance or an earlier run of the
+// server is never mistaken for one of ours
+type Event struct {
+	ID      int64           `json:"id"`
+	Type    string          `json:"type"`
+	TodoID  int64           `json:"todo_id"`
+	Project string          `json:"project,omitempty"`
+	Version int32           `json:"version"`
+	Time    time.Time       `json:"time"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// Subscription receives the events published after it was created on C. C is
+// closed when the subscriber falls too far behind or the hub is closed, the
+// subscriber should then resume with the ID of the last event it received
+type Subscription struct {
+	C  <-chan Event
+	ch chan Event
+}
+
+// Hub fans events out to many subscribers. Publishing never blocks on a slow
+// subscriber, and the most recent events are kept in a bounded log for resuming
+type Hub struct {
+	mu          sync.Mutex
+	epoch       int64
+	lastID      int64
+	log         []Event
+	logSize     int
+	buffer      int
+	closed      bool
+	subscribers map[*Subscription]struct{}
+}
+
+// NewHub() creates a hub that keeps the last logSize events and buffers up to
+// buffer events for each subscriber
+func NewHub(logSize int, buffer int) *Hub {
+	epoch := 1 + rand.Int63n(1<<epochBits-1)
+	return &Hub{
+		epoch:       epoch,
+		lastID:      epoch << epochShift,
+		logSize:     logSize,
+		buffer:      buffer,
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+// Publish() assigns the event an ID, adds it to the log and sends it to every
+// subscriber. Subscribers whose buffer is full are dropped. A change can reach
+// the hub twice, from the request that made it and from the database, so an
+// event of the same type for the same todo id and version as one in the log is
+// ignored. It returns false when the event was not published
+func (h *Hub) Publish(event Event) (Event, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return event, false
+	}
+
+	for i := len(h.log) - 1; i >= 0; i-- {
+		logged := h.log[i]
+		if logged.TodoID == event.TodoID && logged.Version == event.Version && logged.Type == event.Type {
+			return logged, false
+		}
+	}
+
+	h.lastID++
+	event.ID = h.lastID
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	h.log = append(h.log, event)
+	if len(h.log) > h.logSize {
+		h.log = h.log[len(h.log)-h.logSize:]
+	}
+
+	for sub := range h.subscribers {
+		select {
+		case sub.ch <- event:
+		default:
+			// the subscriber can catch up from the log when it reconnects
+			delete(h.subscribers, sub)
+			close(sub.ch)
+		}
+	}
+
+	return event, true
+}
+
+// Subscribe() creates a subscription along with the logged events that came
+// after lastID. It returns false when events after lastID have already left the
+// log or lastID was not handed out by this hub, the subscriber has missed changes
+// and must fetch the todos again
+func (h *Hub) Subscribe(lastID int64) (*Subscription, []Event, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan Event, h.buffer)
+	sub := &Subscription{C: ch, ch: ch}
+	if h.closed {
+		close(ch)
+		return sub, nil, true
+	}
+	h.subscribers[sub] = struct{}{}
+
+	// a new subscriber only wants what happens from now on
+	if lastID <= 0 {
+		return sub, nil, true
+	}
+
+	// the client saw events from another instance or an earlier run of the server
+	if lastID>>epochShift != h.epoch || lastID > h.lastID {
+		return sub, nil, false
+	}
+
+	complete := len(h.log) == 0 || h.log[0].ID <= lastID+1
+	backlog := []Event{}
+	for _, event := range h.log {
+		if event.ID > lastID {
+			backlog = append(backlog, event)
+		}
+	}
+	return sub, backlog, complete
+}
+
+// Unsubscribe() stops the subscription, it is safe to call more than once
+func (h *Hub) Unsubscribe(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subscribers[sub]; ok {
+		delete(h.subscribers, sub)
+		close(sub.ch)
+	}
+}
+
+// Close() ends every subscription, it is used when the server shuts down
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for sub := range h.subscribers {
+		delete(h.subscribers, sub)
+		close(sub.ch)
+	}
+}
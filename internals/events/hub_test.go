@@ -0,0 +1,35 @@
+// Filename : internal/events/hub_test.go
+
+package events
+
+import "testing"
+
+func TestSubscribeResume(t *testing.T) {
+	hub := NewHub(10, 10)
+	first, _ := hub.Publish(Event{Type: "todo.updated", TodoID: 1, Version: 2})
+	second, _ := hub.Publish(Event{Type: "todo.updated", TodoID: 1, Version: 3})
+
+	// resuming on the same hub sends the events that were missed
+	_, backlog, ok := hub.Subscribe(first.ID)
+	if !ok || len(backlog) != 1 || backlog[0].ID != second.ID {
+		t.Fatalf("got %v, %v, want the second event", backlog, ok)
+	}
+
+	// an id from another instance or an earlier run is never resumed from, even
+	// when it is lower than the ids of this hub
+	other := NewHub(10, 10)
+	for other.epoch == hub.epoch {
+		other = NewHub(10, 10)
+	}
+	otherEvent, _ := other.Publish(Event{Type: "todo.updated", TodoID: 1, Version: 2})
+	for _, lastID := range []int64{otherEvent.ID, first.ID - 1<<epochShift, first.ID + 1<<epochShift} {
+		_, backlog, ok = hub.Subscribe(lastID)
+		if ok || len(backlog) != 0 {
+			t.Errorf("Subscribe(%d) = %v, %v, want a reset", lastID, backlog, ok)
+		}
+	}
+
+	if second.ID >= 1<<53 {
+		t.Errorf("id %d is not a safe JavaScript integer", second.ID)
+	}
+}
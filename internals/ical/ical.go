@@ -0,0 +1,301 @@
+// Filename : internal/ical/ical.go
+
+package ical
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the longest line allowed by RFC 5545 section 3.1, in octets without the CRLF
+const maxLineLength = 75
+
+// Property is a content line such as DUE;TZID=Europe/Paris:20261020T090000. Param
+// names are upper case and Value is as written, TEXT values are still escaped
+type Property struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// Component is a BEGIN/END block such as VCALENDAR or VTODO. Line is the line of
+// the file its BEGIN is on
+type Component struct {
+	Name       string
+	Line       int
+	Properties []Property
+	Components []*Component
+}
+
+// Get() returns the first property with the given name, or nil
+func (c *Component) Get(name string) *Property {
+	for i := range c.Properties {
+		if c.Properties[i].Name == name {
+			return &c.Properties[i]
+		}
+	}
+	return nil
+}
+
+// Parse() reads the components of an iCalendar file, usually a single VCALENDAR.
+// Folded lines are joined back together
+func Parse(r io.Reader) ([]*Component, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	top := []*Component{}
+	stack := []*Component{}
+
+	// a content line is complete once the next line does not continue it
+	line, start, n := "", 0, 0
+	handle := func() error {
+		if line == "" {
+			return nil
+		}
+		prop, err := parseLine(line)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", start, err)
+		}
+
+		switch prop.Name {
+		case "BEGIN":
+			c := &Component{Name: strings.ToUpper(prop.Value), Line: start}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Components = append(parent.Components, c)
+			} else {
+				top = append(top, c)
+			}
+			stack = append(stack, c)
+		case "END":
+			if len(stack) == 0 || stack[len(stack)-1].Name != strings.ToUpper(prop.Value) {
+				return fmt.Errorf("line %d: unexpected END:%s", start, prop.Value)
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			if len(stack) == 0 {
+				return fmt.Errorf("line %d: property %s outside of a component", start, prop.Name)
+			}
+			c := stack[len(stack)-1]
+			c.Properties = append(c.Properties, prop)
+		}
+		return nil
+	}
+
+	for scanner.Scan() {
+		n++
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if strings.HasPrefix(text, " ") || strings.HasPrefix(text, "\t") {
+			line += text[1:]
+			continue
+		}
+
+		err := handle()
+		if err != nil {
+			return nil, err
+		}
+		line, start = text, n
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := handle(); err != nil {
+		return nil, err
+	}
+
+	if len(stack) > 0 {
+		return nil, fmt.Errorf("line %d: %s is missing its END", stack[len(stack)-1].Line, stack[len(stack)-1].Name)
+	}
+	return top, nil
+}
+
+// parseLine() splits a content line into its name, params and value
+func parseLine(line string) (Property, error) {
+	prop := Property{Params: make(map[string]string)}
+
+	// the value starts at the first colon outside of a quoted param value
+	quoted := false
+	colon := -1
+	for i, r := range line {
+		if r == '"' {
+			quoted = !quoted
+		}
+		if r == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return prop, errors.New("missing ':' in content line")
+	}
+
+	parts := strings.Split(line[:colon], ";")
+	prop.Name = strings.ToUpper(parts[0])
+	prop.Value = line[colon+1:]
+	if prop.Name == "" {
+		return prop, errors.New("missing property name")
+	}
+
+	for _, param := range parts[1:] {
+		name, value, _ := strings.Cut(param, "=")
+		prop.Params[strings.ToUpper(name)] = strings.Trim(value, `"`)
+	}
+	return prop, nil
+}
+
+// Writer writes an iCalendar file, folding long lines and ending every line with
+// CRLF. The first error is kept and returned by Err()
+type Writer struct {
+	w   *bufio.Writer
+	err error
+}
+
+// NewWriter() creates a Writer
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Begin() starts a component
+func (w *Writer) Begin(name string) {
+	w.Line("BEGIN", name)
+}
+
+// End() ends a component
+func (w *Writer) End(name string) {
+	w.Line("END", name)
+}
+
+// Text() writes a property with a TEXT value, escaping it
+func (w *Writer) Text(name string, value string) {
+	w.Line(name, EscapeText(value))
+}
+
+// Time() writes a property with a UTC DATE-TIME value
+func (w *Writer) Time(name string, t time.Time) {
+	w.Line(name, FormatTime(t))
+}
+
+// Line() writes a content line, name may include params (DUE;VALUE=DATE). The
+// value must already be escaped
+func (w *Writer) Line(name string, value string) {
+	if w.err != nil {
+		return
+	}
+
+	line := name + ":" + value
+	for len(line) > maxLineLength {
+		// don't split a multi-byte character
+		cut := maxLineLength
+		for cut > 0 && !isRuneStart(line[cut]) {
+			cut--
+		}
+		_, w.err = w.w.WriteString(line[:cut] + "\r\n")
+		if w.err != nil {
+			return
+		}
+		// continuation lines start with a space, which counts towards their length
+		line = " " + line[cut:]
+	}
+	_, w.err = w.w.WriteString(line + "\r\n")
+}
+
+// Flush() writes any buffered data to the underlying writer
+func (w *Writer) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
+
+// isRuneStart() reports whether b is the first byte of a UTF-8 character
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+// textEscaper escapes TEXT values as described in RFC 5545 section 3.3.11
+var textEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// EscapeText() escapes a TEXT value
+func EscapeText(s string) string {
+	return textEscaper.Replace(s)
+}
+
+// UnescapeText() reverses EscapeText()
+func UnescapeText(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			switch s[i] {
+			case 'n', 'N':
+				b.WriteByte('\n')
+			default:
+				b.WriteByte(s[i])
+			}
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// FormatTime() formats a time as a UTC DATE-TIME value
+func FormatTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// Time() converts a DATE or DATE-TIME property value to a time. A value with
+// the TZID param is in that time zone, a floating time without one is taken as UTC
+func (p *Property) Time() (time.Time, error) {
+	if p.Params["VALUE"] == "DATE" || len(p.Value) == 8 {
+		return time.Parse("20060102", p.Value)
+	}
+
+	if strings.HasSuffix(p.Value, "Z") {
+		return time.Parse("20060102T150405Z", p.Value)
+	}
+
+	loc := time.UTC
+	if tzid := p.Params["TZID"]; tzid != "" {
+		l, err := time.LoadLocation(tzid)
+		if err == nil {
+			loc = l
+		}
+	}
+	return time.ParseInLocation("20060102T150405", p.Value, loc)
+}
+
+// durationPattern matches a DURATION value (RFC 5545 section 3.3.6)
+var durationPattern = regexp.MustCompile(`^([+-])?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// ParseDuration() converts a DURATION value such as -PT15M to a time.Duration
+func ParseDuration(value string) (time.Duration, error) {
+	match := durationPattern.FindStringSubmatch(value)
+	if match == nil || value == "P" || strings.HasSuffix(value, "T") {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+	var d time.Duration
+	for i, unit := range units {
+		if match[i+2] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(match[i+2])
+		if err != nil {
+			return 0, err
+		}
+		d += time.Duration(n) * unit
+	}
+
+	if match[1] == "-" {
+		d = -d
+	}
+	return d, nil
+}
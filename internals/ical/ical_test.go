@@ -0,0 +1,257 @@
+// Filename : internal/ical/ical_test.go
+
+package ical
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestWriterFolding(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"short", "Buy milk"},
+		{"exactly the limit", strings.Repeat("a", maxLineLength-len("SUMMARY:"))},
+		{"one over", strings.Repeat("a", maxLineLength-len("SUMMARY:")+1)},
+		{"several folds", strings.Repeat("abcdefghij", 30)},
+		{"multi-byte characters", strings.Repeat("é日本", 40)},
+		{"escaped", "a; b, c\\d\nnext line\r\nlast"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewWriter(&buf)
+			w.Begin("VTODO")
+			w.Text("SUMMARY", tt.value)
+			w.End("VTODO")
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			out := buf.String()
+			if !strings.HasSuffix(out, "\r\n") {
+				t.Errorf("got %q, want lines ending with CRLF", out)
+			}
+			for _, line := range strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n") {
+				if len(line) > maxLineLength {
+					t.Errorf("line of %d octets: %q", len(line), line)
+				}
+				if !utf8.ValidString(line) {
+					t.Errorf("line splits a character: %q", line)
+				}
+			}
+
+			// what is written reads back the same
+			components, err := Parse(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			summary := components[0].Get("SUMMARY")
+			if summary == nil {
+				t.Fatal("no SUMMARY read back")
+			}
+			if got := UnescapeText(summary.Value); got != strings.ReplaceAll(tt.value, "\r\n", "\n") {
+				t.Errorf("got %q back, want %q", got, tt.value)
+			}
+		})
+	}
+}
+
+func TestWriterTime(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip("no time zone database")
+	}
+	w.Time("DUE", time.Date(2026, 10, 20, 11, 0, 0, 0, paris))
+	w.Flush()
+
+	if buf.String() != "DUE:20261020T090000Z\r\n" {
+		t.Errorf("got %q", buf.String())
+	}
+}
+
+// failingWriter fails every write
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, bytes.ErrTooLarge
+}
+
+func TestWriterKeepsFirstError(t *testing.T) {
+	// larger than the buffer so the write reaches the failing writer
+	w := NewWriter(failingWriter{})
+	w.Text("DESCRIPTION", strings.Repeat("a", 8192))
+	w.Text("SUMMARY", "after the error")
+	if err := w.Flush(); err != bytes.ErrTooLarge {
+		t.Errorf("got %v, want the write error", err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	input := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"BEGIN:vtodo",
+		"SUMMARY:Write a long",
+		"  summary",
+		"DUE;TZID=\"Europe/Paris\";VALUE=DATE-TIME:20261020T110000",
+		"X-URL;ALTREP=\"https://a.example:8080/x\":https://b.example",
+		"BEGIN:VALARM",
+		"TRIGGER:-PT15M",
+		"END:VALARM",
+		"END:VTODO",
+		"END:VCALENDAR",
+	}, "\r\n")
+
+	components, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(components) != 1 || components[0].Name != "VCALENDAR" {
+		t.Fatalf("got %d components", len(components))
+	}
+	vtodo := components[0].Components[0]
+	if vtodo.Name != "VTODO" || vtodo.Line != 3 {
+		t.Errorf("got %s on line %d, want VTODO on line 3", vtodo.Name, vtodo.Line)
+	}
+	if got := vtodo.Get("SUMMARY").Value; got != "Write a long summary" {
+		t.Errorf("got SUMMARY %q", got)
+	}
+
+	due := vtodo.Get("DUE")
+	if due.Params["TZID"] != "Europe/Paris" || due.Params["VALUE"] != "DATE-TIME" || due.Value != "20261020T110000" {
+		t.Errorf("got DUE %+v", due)
+	}
+	// the colon in a quoted param value does not start the value
+	if got := vtodo.Get("X-URL"); got.Value != "https://b.example" || got.Params["ALTREP"] != "https://a.example:8080/x" {
+		t.Errorf("got X-URL %+v", got)
+	}
+	if vtodo.Get("RRULE") != nil {
+		t.Error("got a property that is not there")
+	}
+	if len(vtodo.Components) != 1 || vtodo.Components[0].Get("TRIGGER").Value != "-PT15M" {
+		t.Errorf("got the VALARM %+v", vtodo.Components)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"missing END", "BEGIN:VCALENDAR\nBEGIN:VTODO\nEND:VTODO", "line 1: VCALENDAR is missing its END"},
+		{"wrong END", "BEGIN:VCALENDAR\nBEGIN:VTODO\nEND:VCALENDAR", "line 3: unexpected END:VCALENDAR"},
+		{"property outside", "SUMMARY:loose", "line 1: property SUMMARY outside of a component"},
+		{"no colon", "BEGIN:VTODO\nSUMMARY\nEND:VTODO", "line 2: missing ':' in content line"},
+		{"no name", "BEGIN:VTODO\n:value\nEND:VTODO", "line 2: missing property name"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tt.input))
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("got %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEscapeText(t *testing.T) {
+	tests := []struct {
+		text    string
+		escaped string
+	}{
+		{"plain", "plain"},
+		{`a\b`, `a\\b`},
+		{"a;b,c", `a\;b\,c`},
+		{"line\nbreak", `line\nbreak`},
+	}
+
+	for _, tt := range tests {
+		if got := EscapeText(tt.text); got != tt.escaped {
+			t.Errorf("EscapeText(%q) = %q, want %q", tt.text, got, tt.escaped)
+		}
+		if got := UnescapeText(tt.escaped); got != tt.text {
+			t.Errorf("UnescapeText(%q) = %q, want %q", tt.escaped, got, tt.text)
+		}
+	}
+
+	// other clients write \N and leave a trailing backslash
+	if got := UnescapeText(`a\Nb\`); got != "a\nb\\" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestPropertyTime(t *testing.T) {
+	tests := []struct {
+		name   string
+		params map[string]string
+		value  string
+		want   string
+		err    bool
+	}{
+		{"utc", nil, "20261020T090000Z", "2026-10-20T09:00:00Z", false},
+		{"date", map[string]string{"VALUE": "DATE"}, "20261020", "2026-10-20T00:00:00Z", false},
+		{"date without the param", nil, "20261020", "2026-10-20T00:00:00Z", false},
+		{"floating", nil, "20261020T090000", "2026-10-20T09:00:00Z", false},
+		{"time zone", map[string]string{"TZID": "Europe/Paris"}, "20261020T110000", "2026-10-20T09:00:00Z", false},
+		{"unknown time zone", map[string]string{"TZID": "Mars/Olympus"}, "20261020T090000", "2026-10-20T09:00:00Z", false},
+		{"invalid", nil, "tomorrow", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := Property{Params: tt.params, Value: tt.value}
+			if p.Params == nil {
+				p.Params = map[string]string{}
+			}
+			got, err := p.Time()
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v", err)
+			}
+			if err == nil && got.UTC().Format(time.RFC3339) != tt.want {
+				t.Errorf("got %s, want %s", got.UTC().Format(time.RFC3339), tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		err   bool
+	}{
+		{"PT15M", 15 * time.Minute, false},
+		{"-PT15M", -15 * time.Minute, false},
+		{"+P1D", 24 * time.Hour, false},
+		{"P1W", 7 * 24 * time.Hour, false},
+		{"P1DT2H3M4S", 26*time.Hour + 3*time.Minute + 4*time.Second, false},
+		{"P", 0, true},
+		{"PT", 0, true},
+		{"P1DT", 0, true},
+		{"15M", 0, true},
+		{"P1.5D", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseDuration(tt.value)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,419 @@
+// Filename : internal/jsonpatch/jsonpatch.go
+
+package jsonpatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Error describes why a patch could not be applied. Path is a JSON pointer into
+// the patch document that identifies the offending member
+type Error struct {
+	Path    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// MergePatch() applies an RFC 7396 JSON Merge Patch to the document
+func MergePatch(doc []byte, patch []byte) ([]byte, error) {
+	target, err := decode(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	mergePatch, err := decode(patch)
+	if err != nil {
+		return nil, &Error{Path: "", Message: "patch must be a valid JSON value"}
+	}
+
+	return json.Marshal(merge(target, mergePatch))
+}
+
+// merge() implements the MergePatch algorithm from section 2 of RFC 7396
+func merge(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+			continue
+		}
+		targetObject[name] = merge(targetObject[name], value)
+	}
+	return targetObject
+}
+
+// operation is a single RFC 6902 operation, Path and From are pointers so that
+// missing members can be told apart from empty ones
+type operation struct {
+	Op    string    `json:"op"`
+	Path  *string   `json:"path"`
+	From  *string   `json:"from"`
+	Value jsonValue `json:"value"`
+}
+
+// jsonValue holds the value member of an operation. A pointer would be left nil
+// for a null value, which is a value like any other in a patch, so whether the
+// member was given is tracked on its own
+type jsonValue struct {
+	raw     json.RawMessage
+	present bool
+}
+
+// UnmarshalJSON() is called for every value the member holds, null included
+func (v *jsonValue) UnmarshalJSON(data []byte) error {
+	v.raw = append(v.raw[:0], data...)
+	v.present = true
+	return nil
+}
+
+// Apply() applies an RFC 6902 JSON Patch to the document. The operations are
+// applied in order and the first failure aborts the whole patch
+func Apply(doc []byte, patch []byte) ([]byte, error) {
+	target, err := decode(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var ops []operation
+	err = json.Unmarshal(patch, &ops)
+	if err != nil {
+		return nil, &Error{Path: "", Message: "patch must be an array of operations"}
+	}
+
+	for i, op := range ops {
+		if op.Path == nil {
+			return nil, &Error{Path: fmt.Sprintf("/%d/path", i), Message: "must be provided"}
+		}
+
+		path, err := parsePointer(*op.Path)
+		if err != nil {
+			return nil, &Error{Path: fmt.Sprintf("/%d/path", i), Message: err.Error()}
+		}
+
+		var value interface{}
+		switch op.Op {
+		case "add", "replace", "test":
+			if !op.Value.present {
+				return nil, &Error{Path: fmt.Sprintf("/%d/value", i), Message: "must be provided"}
+			}
+			value, err = decode(op.Value.raw)
+			if err != nil {
+				return nil, &Error{Path: fmt.Sprintf("/%d/value", i), Message: "must be a valid JSON value"}
+			}
+		}
+
+		var from []string
+		switch op.Op {
+		case "move", "copy":
+			if op.From == nil {
+				return nil, &Error{Path: fmt.Sprintf("/%d/from", i), Message: "must be provided"}
+			}
+			from, err = parsePointer(*op.From)
+			if err != nil {
+				return nil, &Error{Path: fmt.Sprintf("/%d/from", i), Message: err.Error()}
+			}
+		}
+
+		switch op.Op {
+		case "add":
+			target, err = add(target, path, value)
+		case "remove":
+			target, _, err = remove(target, path)
+		case "replace":
+			target, _, err = remove(target, path)
+			if err == nil {
+				target, err = add(target, path, value)
+			}
+		case "move":
+			if isPrefix(from, path) && len(from) < len(path) {
+				return nil, &Error{Path: fmt.Sprintf("/%d/from", i), Message: "must not be a parent of path"}
+			}
+			var moved interface{}
+			target, moved, err = remove(target, from)
+			if err != nil {
+				return nil, &Error{Path: fmt.Sprintf("/%d/from", i), Message: err.Error()}
+			}
+			target, err = add(target, path, moved)
+		case "copy":
+			var copied interface{}
+			copied, err = get(target, from)
+			if err != nil {
+				return nil, &Error{Path: fmt.Sprintf("/%d/from", i), Message: err.Error()}
+			}
+			target, err = add(target, path, deepCopy(copied))
+		case "test":
+			var current interface{}
+			current, err = get(target, path)
+			if err == nil && !equal(current, value) {
+				return nil, &Error{Path: fmt.Sprintf("/%d/value", i), Message: fmt.Sprintf("does not match the value at %s", *op.Path)}
+			}
+		default:
+			return nil, &Error{Path: fmt.Sprintf("/%d/op", i), Message: "must be one of add, remove, replace, move, copy or test"}
+		}
+
+		if err != nil {
+			return nil, &Error{Path: fmt.Sprintf("/%d/path", i), Message: err.Error()}
+		}
+	}
+
+	return json.Marshal(target)
+}
+
+// decode() unmarshals a JSON value keeping numbers as json.Number so they survive
+// the round trip unchanged
+func decode(js []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+
+	var value interface{}
+	err := dec.Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// parsePointer() splits an RFC 6901 JSON pointer into its unescaped reference tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%q is not a valid JSON pointer", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return tokens, nil
+}
+
+// arrayIndex() converts a reference token into an index of an array of the given
+// length, "-" refers to the position after the last element when allowed
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if token == "-" && allowEnd {
+		return length, nil
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("%q is not a valid array index", token)
+	}
+
+	max := length - 1
+	if allowEnd {
+		max = length
+	}
+	if index > max {
+		return 0, fmt.Errorf("array index %d is out of bounds", index)
+	}
+	return index, nil
+}
+
+// get() returns the value the pointer refers to
+func get(doc interface{}, path []string) (interface{}, error) {
+	current := doc
+	for _, token := range path {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("member %q does not exist", token)
+			}
+			current = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			current = node[index]
+		default:
+			return nil, fmt.Errorf("%q does not refer to an object or array", token)
+		}
+	}
+	return current, nil
+}
+
+// add() inserts the value at the location the pointer refers to and returns the
+// new document
+func add(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	parent, err := get(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+		return doc, nil
+	case []interface{}:
+		index, err := arrayIndex(last, len(node), true)
+		if err != nil {
+			return nil, err
+		}
+		node = append(node, nil)
+		copy(node[index+1:], node[index:])
+		node[index] = value
+		return replaceParent(doc, path[:len(path)-1], node)
+	default:
+		return nil, fmt.Errorf("%q does not refer to an object or array", last)
+	}
+}
+
+// remove() deletes the value at the location the pointer refers to and returns
+// the new document along with the removed value
+func remove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+
+	parent, err := get(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	last := path[len(path)-1]
+
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		value, ok := node[last]
+		if !ok {
+			return nil, nil, fmt.Errorf("member %q does not exist", last)
+		}
+		delete(node, last)
+		return doc, value, nil
+	case []interface{}:
+		index, err := arrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		value := node[index]
+		node = append(node[:index], node[index+1:]...)
+		doc, err = replaceParent(doc, path[:len(path)-1], node)
+		return doc, value, err
+	default:
+		return nil, nil, fmt.Errorf("%q does not refer to an object or array", last)
+	}
+}
+
+// replaceParent() stores a resized array back into its parent, arrays are values
+// in Go so growing or shrinking one does not update the document in place
+func replaceParent(doc interface{}, path []string, array []interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return array, nil
+	}
+	parent, err := get(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	last := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = array
+	case []interface{}:
+		index, err := arrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		node[index] = array
+	}
+	return doc, nil
+}
+
+// isPrefix() reports whether the prefix path is an ancestor of (or equal to) path
+func isPrefix(prefix []string, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// deepCopy() copies a decoded JSON value so the copy can be modified on its own
+func deepCopy(value interface{}) interface{} {
+	switch node := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(node))
+		for name, member := range node {
+			copied[name] = deepCopy(member)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(node))
+		for i, element := range node {
+			copied[i] = deepCopy(element)
+		}
+		return copied
+	default:
+		return value
+	}
+}
+
+// equal() compares two decoded JSON values as described for the test operation,
+// numbers are equal when their numeric values are
+func equal(a interface{}, b interface{}) bool {
+	numberA, okA := a.(json.Number)
+	numberB, okB := b.(json.Number)
+	if okA && okB {
+		floatA, errA := numberA.Float64()
+		floatB, errB := numberB.Float64()
+		if errA == nil && errB == nil {
+			return floatA == floatB
+		}
+		return numberA == numberB
+	}
+
+	switch nodeA := a.(type) {
+	case map[string]interface{}:
+		nodeB, ok := b.(map[string]interface{})
+		if !ok || len(nodeA) != len(nodeB) {
+			return false
+		}
+		for name, member := range nodeA {
+			other, ok := nodeB[name]
+			if !ok || !equal(member, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		nodeB, ok := b.([]interface{})
+		if !ok || len(nodeA) != len(nodeB) {
+			return false
+		}
+		for i := range nodeA {
+			if !equal(nodeA[i], nodeB[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(a, b)
+	}
+}
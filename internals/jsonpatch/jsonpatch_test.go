@@ -0,0 +1,141 @@
+// Filename : internal/jsonpatch/jsonpatch_test.go
+
+package jsonpatch
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	doc := `{"title": "a", "description": "b", "due_at": "2026-10-20T09:00:00Z", "tags": ["x", "y"], "meta": {"n": 1}}`
+
+	tests := []struct {
+		name    string
+		patch   string
+		want    string
+		wantErr string
+	}{
+		// null is a value, not a missing member
+		{"replace with null", `[{"op": "replace", "path": "/due_at", "value": null}]`,
+			`{"title": "a", "description": "b", "due_at": null, "tags": ["x", "y"], "meta": {"n": 1}}`, ""},
+		{"add null", `[{"op": "add", "path": "/remind_at", "value": null}]`,
+			`{"title": "a", "description": "b", "due_at": "2026-10-20T09:00:00Z", "remind_at": null, "tags": ["x", "y"], "meta": {"n": 1}}`, ""},
+		{"test null", `[{"op": "replace", "path": "/due_at", "value": null}, {"op": "test", "path": "/due_at", "value": null}]`,
+			`{"title": "a", "description": "b", "due_at": null, "tags": ["x", "y"], "meta": {"n": 1}}`, ""},
+		{"test null against a value", `[{"op": "test", "path": "/due_at", "value": null}]`, "", "/0/value"},
+		{"missing value", `[{"op": "replace", "path": "/due_at"}]`, "", "/0/value"},
+		{"missing path", `[{"op": "remove"}]`, "", "/0/path"},
+		{"unknown op", `[{"op": "rename", "path": "/title"}]`, "", "/0/op"},
+
+		// add, remove and replace
+		{"add", `[{"op": "add", "path": "/project", "value": "home"}]`,
+			`{"title": "a", "description": "b", "due_at": "2026-10-20T09:00:00Z", "project": "home", "tags": ["x", "y"], "meta": {"n": 1}}`, ""},
+		{"remove", `[{"op": "remove", "path": "/due_at"}]`,
+			`{"title": "a", "description": "b", "tags": ["x", "y"], "meta": {"n": 1}}`, ""},
+		{"remove a missing member", `[{"op": "remove", "path": "/project"}]`, "", "/0/path"},
+		{"replace a missing member", `[{"op": "replace", "path": "/project", "value": "home"}]`, "", "/0/path"},
+
+		// test
+		{"test", `[{"op": "test", "path": "/title", "value": "a"}, {"op": "replace", "path": "/title", "value": "c"}]`,
+			`{"title": "c", "description": "b", "due_at": "2026-10-20T09:00:00Z", "tags": ["x", "y"], "meta": {"n": 1}}`, ""},
+		{"test numbers", `[{"op": "test", "path": "/meta/n", "value": 1.0}]`,
+			`{"title": "a", "description": "b", "due_at": "2026-10-20T09:00:00Z", "tags": ["x", "y"], "meta": {"n": 1}}`, ""},
+		{"failed test aborts the patch", `[{"op": "replace", "path": "/title", "value": "c"}, {"op": "test", "path": "/title", "value": "a"}]`, "", "/1/value"},
+
+		// move and copy
+		{"move", `[{"op": "move", "from": "/description", "path": "/notes"}]`,
+			`{"title": "a", "notes": "b", "due_at": "2026-10-20T09:00:00Z", "tags": ["x", "y"], "meta": {"n": 1}}`, ""},
+		{"move within an array", `[{"op": "move", "from": "/tags/0", "path": "/tags/-"}]`,
+			`{"title": "a", "description": "b", "due_at": "2026-10-20T09:00:00Z", "tags": ["y", "x"], "meta": {"n": 1}}`, ""},
+		{"move into a child", `[{"op": "move", "from": "/meta", "path": "/meta/inner"}]`, "", "/0/from"},
+		{"move a missing member", `[{"op": "move", "from": "/project", "path": "/notes"}]`, "", "/0/from"},
+		{"copy", `[{"op": "copy", "from": "/title", "path": "/description"}]`,
+			`{"title": "a", "description": "a", "due_at": "2026-10-20T09:00:00Z", "tags": ["x", "y"], "meta": {"n": 1}}`, ""},
+		{"copy is independent", `[{"op": "copy", "from": "/meta", "path": "/other"}, {"op": "replace", "path": "/other/n", "value": 2}]`,
+			`{"title": "a", "description": "b", "due_at": "2026-10-20T09:00:00Z", "tags": ["x", "y"], "meta": {"n": 1}, "other": {"n": 2}}`, ""},
+		{"copy without from", `[{"op": "copy", "path": "/notes"}]`, "", "/0/from"},
+
+		// array indexes
+		{"append with -", `[{"op": "add", "path": "/tags/-", "value": "z"}]`,
+			`{"title": "a", "description": "b", "due_at": "2026-10-20T09:00:00Z", "tags": ["x", "y", "z"], "meta": {"n": 1}}`, ""},
+		{"insert at an index", `[{"op": "add", "path": "/tags/1", "value": "z"}]`,
+			`{"title": "a", "description": "b", "due_at": "2026-10-20T09:00:00Z", "tags": ["x", "z", "y"], "meta": {"n": 1}}`, ""},
+		{"add at the end index", `[{"op": "add", "path": "/tags/2", "value": "z"}]`,
+			`{"title": "a", "description": "b", "due_at": "2026-10-20T09:00:00Z", "tags": ["x", "y", "z"], "meta": {"n": 1}}`, ""},
+		{"remove from an array", `[{"op": "remove", "path": "/tags/0"}]`,
+			`{"title": "a", "description": "b", "due_at": "2026-10-20T09:00:00Z", "tags": ["y"], "meta": {"n": 1}}`, ""},
+		{"remove with -", `[{"op": "remove", "path": "/tags/-"}]`, "", "/0/path"},
+		{"test with -", `[{"op": "test", "path": "/tags/-", "value": "y"}]`, "", "/0/path"},
+		{"index out of bounds", `[{"op": "add", "path": "/tags/3", "value": "z"}]`, "", "/0/path"},
+		{"index with a leading zero", `[{"op": "replace", "path": "/tags/01", "value": "z"}]`, "", "/0/path"},
+
+		// pointers
+		{"escaped pointer", `[{"op": "add", "path": "/a~1b~0c", "value": 1}]`,
+			`{"title": "a", "description": "b", "due_at": "2026-10-20T09:00:00Z", "tags": ["x", "y"], "meta": {"n": 1}, "a/b~c": 1}`, ""},
+		{"invalid pointer", `[{"op": "remove", "path": "title"}]`, "", "/0/path"},
+		{"not an array", `{"op": "remove", "path": "/title"}`, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Apply([]byte(doc), []byte(tt.patch))
+			if tt.want == "" {
+				var patchErr *Error
+				if !errors.As(err, &patchErr) {
+					t.Fatalf("got %s, %v, want an *Error", got, err)
+				}
+				if patchErr.Path != tt.wantErr {
+					t.Fatalf("error path = %q, want %q (%v)", patchErr.Path, tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assertJSON(t, got, tt.want)
+		})
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	doc := `{"title": "a", "description": "b", "meta": {"n": 1, "m": 2}}`
+
+	tests := []struct {
+		name  string
+		patch string
+		want  string
+	}{
+		{"replace", `{"title": "c"}`, `{"title": "c", "description": "b", "meta": {"n": 1, "m": 2}}`},
+		{"null removes", `{"description": null}`, `{"title": "a", "meta": {"n": 1, "m": 2}}`},
+		{"nested", `{"meta": {"n": null, "o": 3}}`, `{"title": "a", "description": "b", "meta": {"m": 2, "o": 3}}`},
+		{"not an object replaces", `["x"]`, `["x"]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MergePatch([]byte(doc), []byte(tt.patch))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assertJSON(t, got, tt.want)
+		})
+	}
+}
+
+// assertJSON() fails the test unless got and want hold the same JSON value
+func assertJSON(t *testing.T, got []byte, want string) {
+	t.Helper()
+
+	gotValue, err := decode(got)
+	if err != nil {
+		t.Fatalf("result is not valid JSON: %s", got)
+	}
+	wantValue, err := decode([]byte(want))
+	if err != nil {
+		t.Fatalf("want is not valid JSON: %s", want)
+	}
+	if !equal(gotValue, wantValue) {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,103 @@
+// Filename : internal/msgpack/msgpack_test.go
+
+package msgpack
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestMarshal(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  []byte
+	}{
+		{"nil", nil, []byte{0xc0}},
+		{"false", false, []byte{0xc2}},
+		{"true", true, []byte{0xc3}},
+		{"positive fixint", json.Number("127"), []byte{0x7f}},
+		{"negative fixint", json.Number("-32"), []byte{0xe0}},
+		{"int8", json.Number("-33"), []byte{0xd0, 0xdf}},
+		{"int16", json.Number("128"), []byte{0xd1, 0x00, 0x80}},
+		{"int32", json.Number("65536"), []byte{0xd2, 0x00, 0x01, 0x00, 0x00}},
+		{"int64", json.Number("4294967296"), []byte{0xd3, 0, 0, 0, 0x01, 0, 0, 0, 0}},
+		{"float", json.Number("1.5"), []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{"fixstr", "abc", []byte{0xa3, 'a', 'b', 'c'}},
+		{"empty string", "", []byte{0xa0}},
+		{"fixarray", []interface{}{true, nil}, []byte{0x92, 0xc3, 0xc0}},
+		{"fixmap sorted", map[string]interface{}{"b": json.Number("2"), "a": json.Number("1")}, []byte{0x82, 0xa1, 'a', 0x01, 0xa1, 'b', 0x02}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Marshal(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("got % x, want % x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarshalLengths(t *testing.T) {
+	items := func(n int) []interface{} {
+		return make([]interface{}, n)
+	}
+	entries := func(n int) map[string]interface{} {
+		m := make(map[string]interface{}, n)
+		for i := 0; i < n; i++ {
+			m[strings.Repeat("k", i+1)] = nil
+		}
+		return m
+	}
+
+	tests := []struct {
+		name   string
+		value  interface{}
+		header []byte
+	}{
+		{"str8", strings.Repeat("a", 32), []byte{0xd9, 32}},
+		{"str16", strings.Repeat("a", 256), []byte{0xda, 0x01, 0x00}},
+		{"str32", strings.Repeat("a", 65536), []byte{0xdb, 0x00, 0x01, 0x00, 0x00}},
+		{"array16", items(16), []byte{0xdc, 0x00, 0x10}},
+		{"array32", items(65536), []byte{0xdd, 0x00, 0x01, 0x00, 0x00}},
+		{"map16", entries(16), []byte{0xde, 0x00, 0x10}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Marshal(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(got, tt.header) {
+				t.Errorf("got header % x, want % x", got[:len(tt.header)], tt.header)
+			}
+		})
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+	}{
+		{"unsupported type", 1},
+		{"bad number", json.Number("one")},
+		{"nested in an array", []interface{}{struct{}{}}},
+		{"nested in a map", map[string]interface{}{"a": 1.5}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Marshal(tt.value); err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
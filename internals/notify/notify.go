@@ -0,0 +1,135 @@
+// Filename : internal/notify/notify.go
+
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reminder is the message sent when a todo's reminder is due
+type Reminder struct {
+	TodoID      int64      `json:"todo_id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description,omitempty"`
+	DueAt       *time.Time `json:"due_at,omitempty"`
+	RemindAt    time.Time  `json:"remind_at"`
+}
+
+// Notifier delivers reminders. An error means the delivery should be retried
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, reminder Reminder) error
+}
+
+// LogNotifier writes reminders to a logger, it is useful in development
+type LogNotifier struct {
+	Logger *log.Logger
+}
+
+func (n LogNotifier) Name() string {
+	return "log"
+}
+
+func (n LogNotifier) Notify(ctx context.Context, reminder Reminder) error {
+	n.Logger.Printf("reminder: todo %d %q is due", reminder.TodoID, reminder.Title)
+	return nil
+}
+
+// WebhookNotifier posts reminders as JSON to a URL, any response other than a
+// 2xx status code is a failed delivery
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func (n WebhookNotifier) Name() string {
+	return "webhook"
+}
+
+func (n WebhookNotifier) Notify(ctx context.Context, reminder Reminder) error {
+	js, err := json.Marshal(map[string]interface{}{"reminder": reminder})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := n.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// SMTPNotifier emails reminders to a fixed list of recipients
+type SMTPNotifier struct {
+	Host       string
+	Port       int
+	Username   string
+	Password   string
+	Sender     string
+	Recipients []string
+}
+
+func (n SMTPNotifier) Name() string {
+	return "smtp"
+}
+
+func (n SMTPNotifier) Notify(ctx context.Context, reminder Reminder) error {
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: %s\r\n", n.Sender)
+	fmt.Fprintf(&body, "To: %s\r\n", strings.Join(n.Recipients, ", "))
+	fmt.Fprintf(&body, "Subject: Reminder: %s\r\n", strings.ReplaceAll(reminder.Title, "\n", " "))
+	fmt.Fprintf(&body, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&body, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	fmt.Fprintf(&body, "%s\r\n", reminder.Title)
+	if reminder.Description != "" {
+		fmt.Fprintf(&body, "\r\n%s\r\n", reminder.Description)
+	}
+	if reminder.DueAt != nil {
+		fmt.Fprintf(&body, "\r\nDue: %s\r\n", reminder.DueAt.Format(time.RFC1123))
+	}
+
+	var auth smtp.Auth
+	if n.Username != "" {
+		auth = smtp.PlainAuth("", n.Username, n.Password, n.Host)
+	}
+
+	// smtp.SendMail does not take a context so it is run in its own goroutine
+	done := make(chan error, 1)
+	go func() {
+		addr := net.JoinHostPort(n.Host, strconv.Itoa(n.Port))
+		done <- smtp.SendMail(addr, auth, n.Sender, n.Recipients, []byte(body.String()))
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,295 @@
+// Filename : internal/openapi/validate.go
+
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Errors maps the JSON pointer of every invalid value to what is wrong with it,
+// only the first problem found for a value is kept
+type Errors map[string]string
+
+func (e Errors) add(pointer string, message string) {
+	if _, exists := e[pointer]; !exists {
+		e[pointer] = message
+	}
+}
+
+// Find() returns the operation serving a request, its path template and the
+// values of its path parameters. A path matching several templates goes to the
+// one with the fewest parameters, so /v1/todos/events is not taken for
+// /v1/todos/{id}
+func (d *Document) Find(method string, path string) (*Operation, string, map[string]string) {
+	segments := strings.Split(path, "/")
+
+	var found *Operation
+	var route string
+	var params map[string]string
+	for template, item := range d.Paths {
+		op := (*item)[strings.ToLower(method)]
+		if op == nil {
+			continue
+		}
+		values, ok := matchTemplate(strings.Split(template, "/"), segments)
+		if !ok || (found != nil && len(values) >= len(params)) {
+			continue
+		}
+		found, route, params = op, template, values
+	}
+	return found, route, params
+}
+
+// matchTemplate() matches the segments of a path against those of a path
+// template, returning the values of the {name} segments
+func matchTemplate(template []string, segments []string) (map[string]string, bool) {
+	if len(template) != len(segments) {
+		return nil, false
+	}
+	values := map[string]string{}
+	for i, t := range template {
+		if strings.HasPrefix(t, "{") && strings.HasSuffix(t, "}") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			values[t[1:len(t)-1]] = segments[i]
+			continue
+		}
+		if t != segments[i] {
+			return nil, false
+		}
+	}
+	return values, true
+}
+
+// ResolveResponse() follows the $ref of a response to the shared response
+func (d *Document) ResolveResponse(r *Response) *Response {
+	if r != nil && strings.HasPrefix(r.Ref, "#/components/responses/") {
+		return d.Components.Responses[strings.TrimPrefix(r.Ref, "#/components/responses/")]
+	}
+	return r
+}
+
+// resolve() follows the $ref of a schema to the shared schema
+func (d *Document) resolve(s *Schema) *Schema {
+	for s != nil && strings.HasPrefix(s.Ref, "#/components/schemas/") {
+		s = d.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+	}
+	return s
+}
+
+// ParamValue() converts the text of a path, query or header parameter to the
+// JSON value its schema expects so it can be validated. Text that is not a
+// number or boolean is kept as a string and fails the type check
+func (d *Document) ParamValue(s *Schema, text string) interface{} {
+	s = d.resolve(s)
+	if s == nil {
+		return text
+	}
+	switch {
+	case s.Type.Has("integer") || s.Type.Has("number"):
+		if _, err := strconv.ParseFloat(text, 64); err == nil {
+			return json.Number(text)
+		}
+	case s.Type.Has("boolean"):
+		if b, err := strconv.ParseBool(text); err == nil {
+			return b
+		}
+	}
+	return text
+}
+
+// Validate() checks a JSON value, decoded with numbers as json.Number, against
+// a schema and adds the problems to errs under pointer
+func (d *Document) Validate(s *Schema, value interface{}, pointer string, errs Errors) {
+	s = d.resolve(s)
+	if s == nil {
+		return
+	}
+
+	if s.Not != nil && d.valid(s.Not, value, pointer) {
+		errs.add(pointer, "is not allowed")
+		return
+	}
+
+	if len(s.OneOf) > 0 {
+		matches := 0
+		for _, option := range s.OneOf {
+			if d.valid(option, value, pointer) {
+				matches++
+			}
+		}
+		if matches != 1 {
+			errs.add(pointer, "must match exactly one of the allowed schemas")
+			return
+		}
+	}
+
+	if len(s.Type) > 0 && !hasType(s.Type, value) {
+		errs.add(pointer, "must be "+describeTypes(s.Type))
+		return
+	}
+
+	if len(s.Enum) > 0 && !inEnum(s.Enum, value) {
+		allowed := make([]string, len(s.Enum))
+		for i, e := range s.Enum {
+			allowed[i] = fmt.Sprint(e)
+		}
+		errs.add(pointer, "must be one of "+strings.Join(allowed, ", "))
+		return
+	}
+
+	switch v := value.(type) {
+	case json.Number:
+		n, _ := v.Float64()
+		if s.Minimum != nil && n < *s.Minimum {
+			errs.add(pointer, fmt.Sprintf("must be at least %v", *s.Minimum))
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			errs.add(pointer, fmt.Sprintf("must not be more than %v", *s.Maximum))
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.MinLength != nil && length < *s.MinLength {
+			errs.add(pointer, fmt.Sprintf("must be at least %d characters long", *s.MinLength))
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			errs.add(pointer, fmt.Sprintf("must not be more than %d characters long", *s.MaxLength))
+		}
+		if message := checkFormat(s.Format, v); message != "" {
+			errs.add(pointer, message)
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			errs.add(pointer, fmt.Sprintf("must contain at least %d items", *s.MinItems))
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			errs.add(pointer, fmt.Sprintf("must not contain more than %d items", *s.MaxItems))
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				d.Validate(s.Items, item, pointer+"/"+strconv.Itoa(i), errs)
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				errs.add(pointer+"/"+escapePointer(name), "must be provided")
+			}
+		}
+		for name, field := range v {
+			property, ok := s.Properties[name]
+			if !ok {
+				property = s.AdditionalProperties
+			}
+			if property != nil {
+				d.Validate(property, field, pointer+"/"+escapePointer(name), errs)
+			}
+		}
+	}
+}
+
+// valid() reports whether a value matches a schema
+func (d *Document) valid(s *Schema, value interface{}, pointer string) bool {
+	errs := Errors{}
+	d.Validate(s, value, pointer, errs)
+	return len(errs) == 0
+}
+
+// hasType() reports whether a value is one of the JSON types
+func hasType(types Types, value interface{}) bool {
+	for _, t := range types {
+		switch value.(type) {
+		case nil:
+			if t == "null" {
+				return true
+			}
+		case bool:
+			if t == "boolean" {
+				return true
+			}
+		case string:
+			if t == "string" {
+				return true
+			}
+		case []interface{}:
+			if t == "array" {
+				return true
+			}
+		case map[string]interface{}:
+			if t == "object" {
+				return true
+			}
+		case json.Number:
+			if t == "number" {
+				return true
+			}
+			n, err := value.(json.Number).Float64()
+			if t == "integer" && err == nil && n == math.Trunc(n) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// describeTypes() names the types for an error message, e.g. "a string or null"
+func describeTypes(types Types) string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		switch t {
+		case "null":
+			names[i] = "null"
+		case "integer", "object", "array":
+			names[i] = "an " + t
+		default:
+			names[i] = "a " + t
+		}
+	}
+	return strings.Join(names, " or ")
+}
+
+// inEnum() reports whether a value is one of the allowed values
+func inEnum(enum []interface{}, value interface{}) bool {
+	for _, e := range enum {
+		if n, ok := value.(json.Number); ok {
+			if fmt.Sprint(e) == n.String() {
+				return true
+			}
+			continue
+		}
+		if e == value {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFormat() checks the formats the document uses, it returns what is wrong
+// with the value or an empty string
+func checkFormat(format string, value string) string {
+	switch format {
+	case "date-time":
+		if _, err := time.Parse(time.RFC3339, value); err != nil {
+			return "must be an RFC 3339 date-time"
+		}
+	case "uri":
+		u, err := url.Parse(value)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return "must be an absolute URI"
+		}
+	}
+	return ""
+}
+
+// escapePointer() escapes a name for use in a JSON pointer (RFC 6901)
+func escapePointer(name string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+}
@@ -0,0 +1,343 @@
+// Filename : internal/rrule/rrule.go
+
+package rrule
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// weekdays maps the iCalendar day names to time.Weekday values
+var weekdays = map[string]time.Weekday{
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+	"SU": time.Sunday,
+}
+
+// Rule is the subset of an iCalendar RRULE (RFC 5545 section 3.3.10) we support:
+// FREQ, INTERVAL, BYDAY, COUNT and UNTIL. Weeks start on a Monday
+type Rule struct {
+	Freq     string
+	Interval int
+	ByDay    []time.Weekday
+	Count    int
+	Until    *time.Time
+}
+
+// Parse() reads a rule such as "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,TH;COUNT=10".
+// The optional "RRULE:" prefix is accepted
+func Parse(value string) (*Rule, error) {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "RRULE:")
+	if value == "" {
+		return nil, errors.New("must not be empty")
+	}
+
+	rule := &Rule{Interval: 1}
+	seen := make(map[string]bool)
+
+	for _, part := range strings.Split(value, ";") {
+		name, val, ok := strings.Cut(part, "=")
+		if !ok || val == "" {
+			return nil, fmt.Errorf("%q must be written as NAME=VALUE", part)
+		}
+		name = strings.ToUpper(name)
+		if seen[name] {
+			return nil, fmt.Errorf("%s must only be given once", name)
+		}
+		seen[name] = true
+
+		switch name {
+		case "FREQ":
+			val = strings.ToUpper(val)
+			switch val {
+			case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+				rule.Freq = val
+			default:
+				return nil, errors.New("FREQ must be one of DAILY, WEEKLY, MONTHLY or YEARLY")
+			}
+		case "INTERVAL":
+			interval, err := strconv.Atoi(val)
+			if err != nil || interval < 1 || interval > 1000 {
+				return nil, errors.New("INTERVAL must be a number between 1 and 1000")
+			}
+			rule.Interval = interval
+		case "COUNT":
+			count, err := strconv.Atoi(val)
+			if err != nil || count < 1 {
+				return nil, errors.New("COUNT must be a positive number")
+			}
+			rule.Count = count
+		case "UNTIL":
+			until, err := parseUntil(val)
+			if err != nil {
+				return nil, err
+			}
+			rule.Until = &until
+		case "BYDAY":
+			for _, day := range strings.Split(strings.ToUpper(val), ",") {
+				weekday, ok := weekdays[day]
+				if !ok {
+					return nil, fmt.Errorf("BYDAY contains an unsupported day %q", day)
+				}
+				rule.ByDay = append(rule.ByDay, weekday)
+			}
+		default:
+			return nil, fmt.Errorf("%s is not supported, use FREQ, INTERVAL, BYDAY, COUNT or UNTIL", name)
+		}
+	}
+
+	switch {
+	case rule.Freq == "":
+		return nil, errors.New("FREQ must be provided")
+	case rule.Count > 0 && rule.Until != nil:
+		return nil, errors.New("COUNT and UNTIL must not both be given")
+	case len(rule.ByDay) > 0 && rule.Freq != "DAILY" && rule.Freq != "WEEKLY":
+		return nil, errors.New("BYDAY is only supported with FREQ=DAILY or FREQ=WEEKLY")
+	}
+
+	return rule, nil
+}
+
+// parseUntil() accepts the DATE and UTC DATE-TIME forms of UNTIL, a date means
+// the end of that day
+func parseUntil(value string) (time.Time, error) {
+	if until, err := time.Parse("20060102T150405Z", value); err == nil {
+		return until, nil
+	}
+	if until, err := time.Parse("20060102", value); err == nil {
+		return until.Add(24*time.Hour - time.Second), nil
+	}
+	return time.Time{}, errors.New("UNTIL must be a date (20060102) or a UTC date-time (20060102T150405Z)")
+}
+
+// String() writes the rule back out in RRULE form
+func (r *Rule) String() string {
+	parts := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if len(r.ByDay) > 0 {
+		days := make([]string, 0, len(r.ByDay))
+		for _, weekday := range r.ByDay {
+			for name, day := range weekdays {
+				if day == weekday {
+					days = append(days, name)
+				}
+			}
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if r.Until != nil {
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format("20060102T150405Z"))
+	}
+	return strings.Join(parts, ";")
+}
+
+// After() returns the occurrence that follows the given one. The occurrence
+// number is 1 for the first occurrence of the series and is used for COUNT. It
+// returns false once the series has ended
+func (r *Rule) After(due time.Time, occurrence int) (time.Time, bool) {
+	if r.Count > 0 && occurrence >= r.Count {
+		return time.Time{}, false
+	}
+
+	next, ok := r.next(due)
+	if !ok || (r.Until != nil && next.After(*r.Until)) {
+		return time.Time{}, false
+	}
+	return next, true
+}
+
+// Between() lists the occurrences after the given one that fall within [from, to],
+// up to limit of them. The numbers of the occurrences are returned alongside.
+// Whole periods of the rule before from are skipped rather than stepped through
+func (r *Rule) Between(due time.Time, occurrence int, from time.Time, to time.Time, limit int) ([]time.Time, []int) {
+	var dates []time.Time
+	var numbers []int
+
+	due, occurrence = r.skip(due, occurrence, from)
+
+	for len(dates) < limit {
+		next, ok := r.After(due, occurrence)
+		if !ok || next.After(to) {
+			break
+		}
+		due, occurrence = next, occurrence+1
+		if !due.Before(from) {
+			dates = append(dates, due)
+			numbers = append(numbers, occurrence)
+		}
+	}
+	return dates, numbers
+}
+
+// skip() moves the series forward by whole periods to the last one that starts
+// before from, and the occurrence number on by the occurrences in them. A period
+// is a stretch after which the rule repeats itself, e.g. seven intervals for a
+// DAILY rule with BYDAY. The date skipped to need not be an occurrence itself,
+// what follows it is the same as what follows due, a whole number of periods on.
+// Monthly rules on the 29th and yearly rules on February 29, which depend on leap
+// years, are left to be stepped through
+func (r *Rule) skip(due time.Time, occurrence int, from time.Time) (time.Time, int) {
+	if !due.Before(from) {
+		return due, occurrence
+	}
+
+	// count() returns how many of the first steps candidates after due are occurrences
+	count := func(steps int, candidate func(k int) time.Time, occurs func(time.Time) bool) int {
+		n := 0
+		for k := 1; k <= steps; k++ {
+			if occurs(candidate(k)) {
+				n++
+			}
+		}
+		return n
+	}
+
+	var days, months, perPeriod int
+	switch r.Freq {
+	case "DAILY":
+		days, perPeriod = r.Interval, 1
+		if len(r.ByDay) > 0 {
+			days = 7 * r.Interval
+			perPeriod = count(7, func(k int) time.Time { return due.AddDate(0, 0, k*r.Interval) }, r.onDay)
+		}
+	case "WEEKLY":
+		days, perPeriod = 7*r.Interval, 1
+		if len(r.ByDay) > 0 {
+			// each listed day once, BYDAY=MO,MO is a single occurrence a week
+			perPeriod = count(7, func(k int) time.Time { return due.AddDate(0, 0, k) }, r.onDay)
+		}
+	case "MONTHLY":
+		switch {
+		case due.Day() <= 28:
+			months, perPeriod = r.Interval, 1
+		case due.Day() >= 30:
+			months = 12 * r.Interval
+			perPeriod = count(12, func(k int) time.Time { return due.AddDate(0, k*r.Interval, 0) },
+				func(t time.Time) bool { return t.Day() == due.Day() })
+		}
+	case "YEARLY":
+		if due.Month() != time.February || due.Day() != 29 {
+			months, perPeriod = 12*r.Interval, 1
+		}
+	}
+	if perPeriod == 0 {
+		return due, occurrence
+	}
+
+	// stop a period short of from, so stepping on from there reaches it
+	var n int
+	switch {
+	case days > 0:
+		n = daysBetween(due, from)/days - 1
+	case months > 0:
+		start := due.In(from.Location())
+		n = ((from.Year()-start.Year())*12+int(from.Month()-start.Month()))/months - 1
+	}
+	if n <= 0 {
+		return due, occurrence
+	}
+	if r.Count > 0 && occurrence+n*perPeriod >= r.Count {
+		// the series ends before from
+		return due, r.Count
+	}
+	return due.AddDate(0, n*months, n*days), occurrence + n*perPeriod
+}
+
+// daysBetween() returns the number of calendar days from a to b, in a's time zone
+func daysBetween(a time.Time, b time.Time) int {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.In(a.Location()).Date()
+	start := time.Date(ay, am, ad, 0, 0, 0, 0, time.UTC)
+	end := time.Date(by, bm, bd, 0, 0, 0, 0, time.UTC)
+	// a Duration only spans about 290 years, Unix seconds go further
+	return int((end.Unix() - start.Unix()) / (24 * 60 * 60))
+}
+
+// next() computes the candidate after t without applying COUNT or UNTIL. It
+// returns false when the rule has no occurrence after t
+func (r *Rule) next(t time.Time) (time.Time, bool) {
+	switch r.Freq {
+	case "DAILY":
+		next := t.AddDate(0, 0, r.Interval)
+		if len(r.ByDay) == 0 {
+			return next, true
+		}
+		// the weekday repeats after at most seven intervals, when none of them
+		// lands on a listed day, e.g. INTERVAL=7 from an unlisted day, none will
+		for i := 0; i < 7; i++ {
+			if r.onDay(next) {
+				return next, true
+			}
+			next = next.AddDate(0, 0, r.Interval)
+		}
+		return time.Time{}, false
+	case "WEEKLY":
+		if len(r.ByDay) == 0 {
+			return t.AddDate(0, 0, 7*r.Interval), true
+		}
+		// the remaining listed days of the current week come first
+		days := r.sortedDays()
+		for _, day := range days {
+			if day > isoWeekday(t) {
+				return t.AddDate(0, 0, day-isoWeekday(t)), true
+			}
+		}
+		// otherwise the first listed day of the next week in the interval
+		weekStart := t.AddDate(0, 0, 1-isoWeekday(t))
+		return weekStart.AddDate(0, 0, 7*r.Interval+days[0]-1), true
+	case "MONTHLY":
+		// months without the day of the month are skipped, as in RFC 5545
+		for i := 1; ; i++ {
+			next := t.AddDate(0, i*r.Interval, 0)
+			if next.Day() == t.Day() {
+				return next, true
+			}
+		}
+	default:
+		// yearly, February 29 only occurs in leap years
+		for i := 1; ; i++ {
+			next := t.AddDate(i*r.Interval, 0, 0)
+			if next.Day() == t.Day() {
+				return next, true
+			}
+		}
+	}
+}
+
+// onDay() reports whether t falls on one of the BYDAY days
+func (r *Rule) onDay(t time.Time) bool {
+	for _, day := range r.ByDay {
+		if t.Weekday() == day {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedDays() returns the BYDAY days as ISO day numbers (Monday is 1) in order
+func (r *Rule) sortedDays() []int {
+	days := make([]int, 0, len(r.ByDay))
+	for _, day := range r.ByDay {
+		days = append(days, (int(day)+6)%7+1)
+	}
+	sort.Ints(days)
+	return days
+}
+
+// isoWeekday() returns the ISO day number of t, Monday is 1 and Sunday is 7
+func isoWeekday(t time.Time) int {
+	return (int(t.Weekday())+6)%7 + 1
+}
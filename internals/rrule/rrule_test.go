@@ -0,0 +1,219 @@
+// Filename : internal/rrule/rrule_test.go
+
+package rrule
+
+import (
+	"testing"
+	"time"
+)
+
+// day() returns 9:00 UTC on the given date
+func day(t *testing.T, value string) time.Time {
+	t.Helper()
+
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return date.Add(9 * time.Hour)
+}
+
+func TestAfter(t *testing.T) {
+	// 2026-10-20 is a Tuesday
+	tests := []struct {
+		rule  string
+		start string
+		want  []string
+	}{
+		// DAILY
+		{"FREQ=DAILY", "2026-10-20", []string{"2026-10-21", "2026-10-22", "2026-10-23"}},
+		{"FREQ=DAILY;INTERVAL=2", "2026-10-20", []string{"2026-10-22", "2026-10-24", "2026-10-26"}},
+		{"FREQ=DAILY;INTERVAL=7", "2026-10-20", []string{"2026-10-27", "2026-11-03", "2026-11-10"}},
+		{"FREQ=DAILY;BYDAY=MO,WE,FR", "2026-10-20", []string{"2026-10-21", "2026-10-23", "2026-10-26"}},
+		{"FREQ=DAILY;BYDAY=TU", "2026-10-20", []string{"2026-10-27", "2026-11-03", "2026-11-10"}},
+		{"FREQ=DAILY;INTERVAL=2;BYDAY=MO", "2026-10-20", []string{"2026-10-26", "2026-11-09", "2026-11-23"}},
+		{"FREQ=DAILY;INTERVAL=3;BYDAY=SA,SU", "2026-10-20", []string{"2026-11-01", "2026-11-07", "2026-11-22"}},
+		{"FREQ=DAILY;INTERVAL=7;BYDAY=TU", "2026-10-20", []string{"2026-10-27", "2026-11-03", "2026-11-10"}},
+		{"FREQ=DAILY;INTERVAL=7;BYDAY=MO", "2026-10-20", nil},
+		{"FREQ=DAILY;INTERVAL=14;BYDAY=MO,TU", "2026-10-20", []string{"2026-11-03", "2026-11-17", "2026-12-01"}},
+		{"FREQ=DAILY;INTERVAL=14;BYDAY=WE", "2026-10-20", nil},
+
+		// WEEKLY
+		{"FREQ=WEEKLY", "2026-10-20", []string{"2026-10-27", "2026-11-03", "2026-11-10"}},
+		{"FREQ=WEEKLY;INTERVAL=2", "2026-10-20", []string{"2026-11-03", "2026-11-17", "2026-12-01"}},
+		{"FREQ=WEEKLY;BYDAY=TU", "2026-10-20", []string{"2026-10-27", "2026-11-03", "2026-11-10"}},
+		{"FREQ=WEEKLY;BYDAY=MO,TH", "2026-10-20", []string{"2026-10-22", "2026-10-26", "2026-10-29"}},
+		{"FREQ=WEEKLY;BYDAY=TH,MO", "2026-10-20", []string{"2026-10-22", "2026-10-26", "2026-10-29"}},
+		{"FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,FR", "2026-10-20", []string{"2026-10-23", "2026-11-02", "2026-11-06"}},
+		{"FREQ=WEEKLY;INTERVAL=3;BYDAY=SU", "2026-10-20", []string{"2026-10-25", "2026-11-15", "2026-12-06"}},
+		{"FREQ=WEEKLY;INTERVAL=2;BYDAY=MO", "2026-10-20", []string{"2026-11-02", "2026-11-16", "2026-11-30"}},
+
+		// MONTHLY
+		{"FREQ=MONTHLY", "2026-10-20", []string{"2026-11-20", "2026-12-20", "2027-01-20"}},
+		{"FREQ=MONTHLY", "2026-01-31", []string{"2026-03-31", "2026-05-31", "2026-07-31"}},
+		{"FREQ=MONTHLY;INTERVAL=2", "2026-10-20", []string{"2026-12-20", "2027-02-20", "2027-04-20"}},
+		{"FREQ=MONTHLY;INTERVAL=12", "2026-01-31", []string{"2027-01-31", "2028-01-31", "2029-01-31"}},
+
+		// YEARLY
+		{"FREQ=YEARLY", "2026-10-20", []string{"2027-10-20", "2028-10-20", "2029-10-20"}},
+		{"FREQ=YEARLY", "2024-02-29", []string{"2028-02-29", "2032-02-29", "2036-02-29"}},
+		{"FREQ=YEARLY;INTERVAL=2", "2026-10-20", []string{"2028-10-20", "2030-10-20", "2032-10-20"}},
+		{"FREQ=YEARLY;INTERVAL=3", "2024-02-29", []string{"2036-02-29", "2048-02-29", "2060-02-29"}},
+
+		// COUNT and UNTIL
+		{"FREQ=DAILY;COUNT=3", "2026-10-20", []string{"2026-10-21", "2026-10-22"}},
+		{"FREQ=DAILY;COUNT=1", "2026-10-20", nil},
+		{"FREQ=WEEKLY;UNTIL=20261103", "2026-10-20", []string{"2026-10-27", "2026-11-03"}},
+		{"FREQ=WEEKLY;UNTIL=20261103T000000Z", "2026-10-20", []string{"2026-10-27"}},
+		{"RRULE:FREQ=DAILY;INTERVAL=2;BYDAY=MO;COUNT=2", "2026-10-20", []string{"2026-10-26"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rule+" from "+tt.start, func(t *testing.T) {
+			rule, err := Parse(tt.rule)
+			if err != nil {
+				t.Fatalf("Parse() error: %v", err)
+			}
+
+			var got []string
+			due, occurrence := day(t, tt.start), 1
+			for len(got) < 3 {
+				next, ok := rule.After(due, occurrence)
+				if !ok {
+					break
+				}
+				got = append(got, next.Format("2006-01-02"))
+				due, occurrence = next, occurrence+1
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"INTERVAL=2",
+		"FREQ=HOURLY",
+		"FREQ=DAILY;INTERVAL=0",
+		"FREQ=DAILY;INTERVAL=1001",
+		"FREQ=DAILY;COUNT=0",
+		"FREQ=DAILY;COUNT=2;UNTIL=20261103",
+		"FREQ=DAILY;FREQ=WEEKLY",
+		"FREQ=WEEKLY;BYDAY=XX",
+		"FREQ=MONTHLY;BYDAY=MO",
+		"FREQ=YEARLY;BYDAY=MO",
+		"FREQ=DAILY;BYMONTH=1",
+		"FREQ=DAILY;UNTIL=tomorrow",
+	}
+
+	for _, value := range tests {
+		if _, err := Parse(value); err == nil {
+			t.Errorf("Parse(%q) returned no error", value)
+		}
+	}
+}
+
+func TestBetween(t *testing.T) {
+	rule, err := Parse("FREQ=DAILY;INTERVAL=7;BYDAY=MO")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a rule with no occurrences after the start must not loop or invent dates
+	dates, _ := rule.Between(day(t, "2026-10-20"), 1, day(t, "2026-10-01"), day(t, "2027-12-31"), 10)
+	if len(dates) != 0 {
+		t.Errorf("got %v, want no occurrences", dates)
+	}
+}
+
+func TestBetweenSkipsAhead(t *testing.T) {
+	// 2026-10-20 is a Tuesday
+	tests := []struct {
+		rule  string
+		start string
+		from  string
+	}{
+		{"FREQ=DAILY", "2026-10-20", "2031-03-14"},
+		{"FREQ=DAILY;INTERVAL=3", "2026-10-20", "2029-01-01"},
+		{"FREQ=DAILY;BYDAY=MO,WE,FR", "2026-10-20", "2030-06-01"},
+		{"FREQ=DAILY;INTERVAL=3;BYDAY=SA,SU", "2026-10-20", "2028-02-28"},
+		{"FREQ=DAILY;INTERVAL=7;BYDAY=MO", "2026-10-20", "2028-02-28"},
+		{"FREQ=WEEKLY", "2026-10-20", "2030-01-01"},
+		{"FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,TH", "2026-10-20", "2029-07-04"},
+		{"FREQ=WEEKLY;BYDAY=MO,MO,FR", "2026-10-20", "2029-07-04"},
+		{"FREQ=WEEKLY;BYDAY=SU", "2026-10-20", "2029-07-04"},
+		{"FREQ=MONTHLY", "2026-10-20", "2035-05-01"},
+		{"FREQ=MONTHLY;INTERVAL=5", "2026-10-20", "2035-05-01"},
+		{"FREQ=MONTHLY", "2026-10-31", "2035-05-01"},
+		{"FREQ=MONTHLY;INTERVAL=5", "2026-10-30", "2035-05-01"},
+		{"FREQ=MONTHLY", "2027-01-29", "2035-05-01"},
+		{"FREQ=YEARLY", "2026-10-20", "2060-01-01"},
+		{"FREQ=YEARLY", "2028-02-29", "2060-01-01"},
+		{"FREQ=DAILY;COUNT=500", "2026-10-20", "2027-12-01"},
+		{"FREQ=DAILY;COUNT=500", "2026-10-20", "2029-01-01"},
+		{"FREQ=WEEKLY;BYDAY=MO,FR;UNTIL=20281231T000000Z", "2026-10-20", "2028-12-01"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rule+" from "+tt.from, func(t *testing.T) {
+			rule, err := Parse(tt.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			start, from := day(t, tt.start), day(t, tt.from)
+			to := from.AddDate(0, 2, 0)
+
+			// step through every occurrence for the expected result
+			var want []time.Time
+			var wantNumbers []int
+			due, occurrence := start, 1
+			for len(want) < 20 {
+				next, ok := rule.After(due, occurrence)
+				if !ok || next.After(to) {
+					break
+				}
+				due, occurrence = next, occurrence+1
+				if !due.Before(from) {
+					want = append(want, due)
+					wantNumbers = append(wantNumbers, occurrence)
+				}
+			}
+
+			dates, numbers := rule.Between(start, 1, from, to, 20)
+			if len(dates) != len(want) {
+				t.Fatalf("got %d occurrences %v, want %d %v", len(dates), dates, len(want), want)
+			}
+			for i := range want {
+				if !dates[i].Equal(want[i]) || numbers[i] != wantNumbers[i] {
+					t.Errorf("occurrence %d: got %s (#%d), want %s (#%d)", i, dates[i], numbers[i], want[i], wantNumbers[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBetweenFarAhead(t *testing.T) {
+	rule, err := Parse("FREQ=DAILY")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stepping through each of the three million days would take a while
+	start, from := day(t, "2026-10-20"), day(t, "9000-01-01")
+	dates, numbers := rule.Between(start, 1, from, from.AddDate(0, 0, 2), 10)
+	if len(dates) != 3 || !dates[0].Equal(from) {
+		t.Fatalf("got %v, want three days from %s", dates, from)
+	}
+	if want := int(from.Unix()-start.Unix())/(24*60*60) + 1; numbers[0] != want {
+		t.Errorf("got occurrence %d, want %d", numbers[0], want)
+	}
+}
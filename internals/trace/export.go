@@ -0,0 +1,201 @@
+// Filename : internal/trace/export.go
+
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StdoutExporter writes each finished span as a line of JSON
+type StdoutExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewStdoutExporter() returns an exporter writing to standard output
+func NewStdoutExporter() *StdoutExporter {
+	return &StdoutExporter{w: os.Stdout}
+}
+
+// Export() writes a span
+func (e *StdoutExporter) Export(span *Span) error {
+	line := struct {
+		TraceID    string                 `json:"trace_id"`
+		SpanID     string                 `json:"span_id"`
+		ParentID   string                 `json:"parent_id,omitempty"`
+		Name       string                 `json:"name"`
+		Kind       string                 `json:"kind"`
+		Start      time.Time              `json:"start"`
+		DurationMS float64                `json:"duration_ms"`
+		Attributes map[string]interface{} `json:"attributes,omitempty"`
+		Error      string                 `json:"error,omitempty"`
+	}{
+		TraceID:    span.Context.TraceID.String(),
+		SpanID:     span.Context.SpanID.String(),
+		Name:       span.Name,
+		Kind:       span.Kind,
+		Start:      span.Start,
+		DurationMS: float64(span.End.Sub(span.Start).Microseconds()) / 1000,
+		Error:      span.Error,
+	}
+	if span.Parent != (SpanID{}) {
+		line.ParentID = span.Parent.String()
+	}
+	if len(span.Attributes) > 0 {
+		line.Attributes = make(map[string]interface{}, len(span.Attributes))
+		for _, attr := range span.Attributes {
+			line.Attributes[attr.Key] = attr.Value
+		}
+	}
+
+	return e.write(line)
+}
+
+func (e *StdoutExporter) write(v interface{}) error {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.w.Write(append(js, '\n'))
+	return err
+}
+
+// Close() does nothing, standard output stays open
+func (e *StdoutExporter) Close() error {
+	return nil
+}
+
+// OTLPFileExporter appends each finished span to a file as a line holding an
+// OTLP/JSON ExportTraceServiceRequest, the format the OpenTelemetry collector's
+// otlpjsonfile receiver reads
+type OTLPFileExporter struct {
+	mu          sync.Mutex
+	file        *os.File
+	serviceName string
+}
+
+// NewOTLPFileExporter() opens the file to append spans to
+func NewOTLPFileExporter(path string, serviceName string) (*OTLPFileExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &OTLPFileExporter{file: file, serviceName: serviceName}, nil
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+// otlpKinds maps span kinds to the OTLP SpanKind values
+var otlpKinds = map[string]int{"internal": 1, "server": 2, "client": 3}
+
+// Export() appends a span
+func (e *OTLPFileExporter) Export(span *Span) error {
+	s := otlpSpan{
+		TraceID:           span.Context.TraceID.String(),
+		SpanID:            span.Context.SpanID.String(),
+		Name:              span.Name,
+		Kind:              otlpKinds[span.Kind],
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+	}
+	if span.Parent != (SpanID{}) {
+		s.ParentSpanID = span.Parent.String()
+	}
+	for _, attr := range span.Attributes {
+		s.Attributes = append(s.Attributes, otlpAttribute{Key: attr.Key, Value: toOTLPValue(attr.Value)})
+	}
+	if span.Error != "" {
+		// STATUS_CODE_ERROR
+		s.Status = otlpStatus{Code: 2, Message: span.Error}
+	}
+
+	service := e.serviceName
+	request := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{{Key: "service.name", Value: otlpValue{StringValue: &service}}},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "todoapi.miguelavila.net/internals/trace"},
+				"spans": []otlpSpan{s},
+			}},
+		}},
+	}
+
+	js, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.file.Write(append(js, '\n'))
+	return err
+}
+
+// toOTLPValue() converts an attribute value, 64 bit integers are strings in OTLP/JSON
+func toOTLPValue(value interface{}) otlpValue {
+	switch v := value.(type) {
+	case string:
+		return otlpValue{StringValue: &v}
+	case bool:
+		return otlpValue{BoolValue: &v}
+	case int:
+		s := strconv.Itoa(v)
+		return otlpValue{IntValue: &s}
+	case int32:
+		s := strconv.FormatInt(int64(v), 10)
+		return otlpValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return otlpValue{IntValue: &s}
+	case float64:
+		return otlpValue{DoubleValue: &v}
+	default:
+		s := fmt.Sprint(v)
+		return otlpValue{StringValue: &s}
+	}
+}
+
+// Close() closes the file
+func (e *OTLPFileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.file.Close()
+}
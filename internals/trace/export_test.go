@@ -0,0 +1,195 @@
+// Filename : internal/trace/export_test.go
+
+package trace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testSpan() returns a finished child span with an attribute of each kind
+func testSpan(t *testing.T) *Span {
+	t.Helper()
+
+	sc, ok := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok {
+		t.Fatal("the test span context was not parsed")
+	}
+	start := time.Date(2026, 10, 20, 9, 0, 0, 0, time.UTC)
+	return &Span{
+		Context: SpanContext{TraceID: sc.TraceID, SpanID: SpanID{1, 2, 3, 4, 5, 6, 7, 8}, Flags: 1},
+		Parent:  sc.SpanID,
+		Name:    "GET /v1/todos/:id",
+		Kind:    "server",
+		Start:   start,
+		End:     start.Add(1500 * time.Microsecond),
+		Attributes: []Attribute{
+			{Key: "http.route", Value: "/v1/todos/:id"},
+			{Key: "http.response.status_code", Value: 500},
+			{Key: "todo.id", Value: int64(9007199254740993)},
+			{Key: "db.rows", Value: int32(3)},
+			{Key: "ratio", Value: 0.5},
+			{Key: "cached", Value: false},
+			{Key: "duration", Value: time.Second},
+		},
+		Error: "Internal Server Error",
+	}
+}
+
+func TestOTLPFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	exporter, err := NewOTLPFileExporter(path, "todoapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	span := testSpan(t)
+	for i := 0; i < 2; i++ {
+		if err := exporter.Export(span); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := exporter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSuffix(file, []byte("\n")), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want one per span", len(lines))
+	}
+
+	var request struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpAttribute `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Scope struct {
+					Name string `json:"name"`
+				} `json:"scope"`
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(lines[0], &request); err != nil {
+		t.Fatal(err)
+	}
+
+	resource := request.ResourceSpans[0].Resource.Attributes
+	if len(resource) != 1 || resource[0].Key != "service.name" || *resource[0].Value.StringValue != "todoapi" {
+		t.Errorf("got resource attributes %+v", resource)
+	}
+	if name := request.ResourceSpans[0].ScopeSpans[0].Scope.Name; name != "todoapi.miguelavila.net/internals/trace" {
+		t.Errorf("got scope %s", name)
+	}
+
+	s := request.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	want := otlpSpan{
+		TraceID:           "4bf92f3577b34da6a3ce929d0e0e4736",
+		SpanID:            "0102030405060708",
+		ParentSpanID:      "00f067aa0ba902b7",
+		Name:              "GET /v1/todos/:id",
+		Kind:              2,
+		StartTimeUnixNano: "1792486800000000000",
+		EndTimeUnixNano:   "1792486800001500000",
+		Status:            otlpStatus{Code: 2, Message: "Internal Server Error"},
+	}
+	got := s
+	got.Attributes = nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got span %+v, want %+v", got, want)
+	}
+
+	attributes, _ := json.Marshal(s.Attributes)
+	wantAttributes := `[{"key":"http.route","value":{"stringValue":"/v1/todos/:id"}},` +
+		`{"key":"http.response.status_code","value":{"intValue":"500"}},` +
+		`{"key":"todo.id","value":{"intValue":"9007199254740993"}},` +
+		`{"key":"db.rows","value":{"intValue":"3"}},` +
+		`{"key":"ratio","value":{"doubleValue":0.5}},` +
+		`{"key":"cached","value":{"boolValue":false}},` +
+		`{"key":"duration","value":{"stringValue":"1s"}}]`
+	if string(attributes) != wantAttributes {
+		t.Errorf("got attributes %s, want %s", attributes, wantAttributes)
+	}
+}
+
+func TestOTLPFileExporterRootSpan(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	exporter, err := NewOTLPFileExporter(path, "todoapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exporter.Close()
+
+	span := testSpan(t)
+	span.Parent, span.Kind, span.Error, span.Attributes = SpanID{}, "internal", "", nil
+	if err := exporter.Export(span); err != nil {
+		t.Fatal(err)
+	}
+
+	file, _ := os.ReadFile(path)
+	for _, left := range []string{"parentSpanId", "attributes\":[{\"key\":\"http", "message"} {
+		if bytes.Contains(file, []byte(left)) {
+			t.Errorf("%s is in %s", left, file)
+		}
+	}
+	if !bytes.Contains(file, []byte(`"kind":1`)) || !bytes.Contains(file, []byte(`"status":{}`)) {
+		t.Errorf("got %s, want an internal span with an unset status", file)
+	}
+}
+
+func TestNewOTLPFileExporterError(t *testing.T) {
+	_, err := NewOTLPFileExporter(filepath.Join(t.TempDir(), "missing", "spans.json"), "todoapi")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got %v, want a missing directory error", err)
+	}
+}
+
+func TestStdoutExporter(t *testing.T) {
+	var buf bytes.Buffer
+	exporter := &StdoutExporter{w: &buf}
+
+	span := testSpan(t)
+	exporter.Export(span)
+	span.Parent = SpanID{}
+	span.Attributes = nil
+	exporter.Export(span)
+
+	scanner := bufio.NewScanner(&buf)
+	var lines []map[string]interface{}
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2", len(lines))
+	}
+
+	first := lines[0]
+	if first["trace_id"] != "4bf92f3577b34da6a3ce929d0e0e4736" || first["parent_id"] != "00f067aa0ba902b7" || first["duration_ms"] != 1.5 {
+		t.Errorf("got %v", first)
+	}
+	if attributes, _ := first["attributes"].(map[string]interface{}); attributes["http.route"] != "/v1/todos/:id" {
+		t.Errorf("got attributes %v", first["attributes"])
+	}
+	if _, ok := lines[1]["parent_id"]; ok {
+		t.Errorf("got a parent id on a root span: %v", lines[1])
+	}
+	if _, ok := lines[1]["attributes"]; ok {
+		t.Errorf("got attributes on a span without any: %v", lines[1])
+	}
+}
@@ -0,0 +1,190 @@
+// Filename : internal/trace/trace.go
+
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a trace, the spans of a request across services
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// SpanContext is what is propagated to child spans and other services
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+}
+
+// traceparentPattern matches a version 00 W3C traceparent header
+var traceparentPattern = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// ParseTraceparent() reads a W3C traceparent header. It returns false for a
+// header that is malformed or has an all zero trace or span id
+func ParseTraceparent(header string) (SpanContext, bool) {
+	var sc SpanContext
+	match := traceparentPattern.FindStringSubmatch(header)
+	if match == nil {
+		return sc, false
+	}
+
+	hex.Decode(sc.TraceID[:], []byte(match[1]))
+	hex.Decode(sc.SpanID[:], []byte(match[2]))
+	flags, _ := hex.DecodeString(match[3])
+	sc.Flags = flags[0]
+
+	if sc.TraceID == (TraceID{}) || sc.SpanID == (SpanID{}) {
+		return sc, false
+	}
+	return sc, true
+}
+
+// Traceparent() formats the span context as a W3C traceparent header
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// Attribute is a key and value describing a span
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Span is a timed operation. Kind is "server" for the span of a request handled
+// by the API and "internal" otherwise
+type Span struct {
+	Context    SpanContext
+	Parent     SpanID
+	Name       string
+	Kind       string
+	Start      time.Time
+	End        time.Time
+	Attributes []Attribute
+	Error      string
+
+	mu    sync.Mutex
+	ended bool
+}
+
+// SetAttribute() adds an attribute to the span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes = append(s.Attributes, Attribute{Key: key, Value: value})
+}
+
+// SetError() marks the span as failed
+func (s *Span) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Error = err.Error()
+}
+
+// Finish() ends the span and exports it, only the first call has an effect
+func (s *Span) Finish() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mu.Unlock()
+
+	export(s)
+}
+
+// Exporter sends finished spans somewhere, it must be safe for concurrent use
+type Exporter interface {
+	Export(span *Span) error
+	Close() error
+}
+
+var (
+	exporterMu sync.RWMutex
+	exporter   Exporter
+	onError    func(error)
+)
+
+// SetExporter() sets where finished spans go, when it is nil spans are still
+// created and propagated but dropped. errorLog is called when a span cannot be
+// exported
+func SetExporter(e Exporter, errorLog func(error)) {
+	exporterMu.Lock()
+	defer exporterMu.Unlock()
+	exporter, onError = e, errorLog
+}
+
+func export(s *Span) {
+	exporterMu.RLock()
+	defer exporterMu.RUnlock()
+	if exporter == nil {
+		return
+	}
+	err := exporter.Export(s)
+	if err != nil && onError != nil {
+		onError(err)
+	}
+}
+
+type contextKey string
+
+const (
+	spanKey   = contextKey("span")
+	remoteKey = contextKey("remote")
+)
+
+// ContextWithRemote() returns a context whose next span continues the trace of
+// another service, as received in a traceparent header
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey, sc)
+}
+
+// FromContext() returns the current span, or nil
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey).(*Span)
+	return span
+}
+
+// Start() starts a span that is a child of the span in ctx, or of the remote
+// span context, or the root of a new trace. It returns a context holding the
+// span, which must be finished with Finish()
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	return StartKind(ctx, name, "internal")
+}
+
+// StartKind() starts a span of the given kind
+func StartKind(ctx context.Context, name string, kind string) (context.Context, *Span) {
+	span := &Span{Name: name, Kind: kind, Start: time.Now()}
+
+	if parent := FromContext(ctx); parent != nil {
+		span.Context.TraceID = parent.Context.TraceID
+		span.Context.Flags = parent.Context.Flags
+		span.Parent = parent.Context.SpanID
+	} else if remote, ok := ctx.Value(remoteKey).(SpanContext); ok {
+		span.Context.TraceID = remote.TraceID
+		span.Context.Flags = remote.Flags
+		span.Parent = remote.SpanID
+	} else {
+		rand.Read(span.Context.TraceID[:])
+		span.Context.Flags = 0x01
+	}
+	rand.Read(span.Context.SpanID[:])
+
+	return context.WithValue(ctx, spanKey, span), span
+}
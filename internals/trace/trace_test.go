@@ -0,0 +1,140 @@
+// Filename : internal/trace/trace_test.go
+
+package trace
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		ok     bool
+	}{
+		{"sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"not sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true},
+		{"empty", "", false},
+		{"other version", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"upper case", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00F067AA0BA902B7-01", false},
+		{"short trace id", "00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", false},
+		{"short span id", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b-01", false},
+		{"not hex", "00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01", false},
+		{"trailing data", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false},
+		{"zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"zero span id", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, ok := ParseTraceparent(tt.header)
+			if ok != tt.ok {
+				t.Fatalf("got ok %t, want %t", ok, tt.ok)
+			}
+			// a valid header is written back as it was read
+			if ok && sc.Traceparent() != tt.header {
+				t.Errorf("got %s back, want %s", sc.Traceparent(), tt.header)
+			}
+		})
+	}
+}
+
+func TestParseTraceparentFields(t *testing.T) {
+	sc, ok := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-03")
+	if !ok {
+		t.Fatal("the header was not parsed")
+	}
+	if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("got trace id %s", sc.TraceID)
+	}
+	if sc.SpanID.String() != "00f067aa0ba902b7" {
+		t.Errorf("got span id %s", sc.SpanID)
+	}
+	if sc.Flags != 0x03 {
+		t.Errorf("got flags %02x, want 03", sc.Flags)
+	}
+}
+
+// recordingExporter keeps the spans exported to it
+type recordingExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+	err   error
+}
+
+func (e *recordingExporter) Export(span *Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, span)
+	return e.err
+}
+
+func (e *recordingExporter) Close() error {
+	return nil
+}
+
+func TestStart(t *testing.T) {
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+
+	// a new trace is sampled
+	_, root := Start(context.Background(), "root")
+	if root.Context.TraceID == (TraceID{}) || root.Context.SpanID == (SpanID{}) || root.Parent != (SpanID{}) || root.Context.Flags != 0x01 {
+		t.Errorf("got root span context %+v with parent %s", root.Context, root.Parent)
+	}
+
+	// the remote span is the parent of the first span
+	ctx, server := StartKind(ContextWithRemote(context.Background(), remote), "GET /v1/todos", "server")
+	if server.Context.TraceID != remote.TraceID || server.Parent != remote.SpanID || server.Context.Flags != remote.Flags {
+		t.Errorf("got server span context %+v with parent %s, want it to continue %+v", server.Context, server.Parent, remote)
+	}
+	if server.Context.SpanID == remote.SpanID || server.Kind != "server" {
+		t.Errorf("got server span %s of kind %s", server.Context.SpanID, server.Kind)
+	}
+	if FromContext(ctx) != server {
+		t.Error("the context does not hold the server span")
+	}
+
+	// and the span in the context of the ones after it
+	_, child := Start(ctx, "db.query")
+	if child.Context.TraceID != remote.TraceID || child.Parent != server.Context.SpanID || child.Kind != "internal" {
+		t.Errorf("got child span context %+v with parent %s", child.Context, child.Parent)
+	}
+	if FromContext(context.Background()) != nil {
+		t.Error("got a span from an empty context")
+	}
+}
+
+func TestFinish(t *testing.T) {
+	exporter := &recordingExporter{err: errors.New("collector down")}
+	var exportErrors []error
+	SetExporter(exporter, func(err error) { exportErrors = append(exportErrors, err) })
+	defer SetExporter(nil, nil)
+
+	_, span := Start(context.Background(), "work")
+	span.SetAttribute("todo.id", int64(7))
+	span.SetError(nil)
+	span.SetError(errors.New("failed"))
+	span.Finish()
+	span.Finish()
+
+	if len(exporter.spans) != 1 {
+		t.Fatalf("got %d spans exported, want 1", len(exporter.spans))
+	}
+	if span.End.Before(span.Start) || span.Error != "failed" || len(span.Attributes) != 1 {
+		t.Errorf("got span %+v", span)
+	}
+	if len(exportErrors) != 1 {
+		t.Errorf("got %d export errors reported, want 1", len(exportErrors))
+	}
+
+	// without an exporter spans are dropped
+	SetExporter(nil, nil)
+	_, span = Start(context.Background(), "dropped")
+	span.Finish()
+	if len(exporter.spans) != 1 {
+		t.Errorf("got %d spans exported, want the one from before", len(exporter.spans))
+	}
+}
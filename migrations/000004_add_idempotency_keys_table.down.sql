@@ -0,0 +1,3 @@
+-- Filename new_migrations/000004_add_idempotency_keys_table.down.sql
+
+DROP TABLE IF EXISTS idempotency_keys;
@@ -0,0 +1,13 @@
+-- Filename new_migrations/000004_add_idempotency_keys_table.up.sql
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key text primary key,
+    fingerprint text NOT NULL,
+    status integer NOT NULL DEFAULT 0,
+    headers jsonb NOT NULL DEFAULT '{}',
+    body bytea NOT NULL DEFAULT '',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    expires_at timestamp(0) with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
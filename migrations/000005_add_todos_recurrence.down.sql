@@ -0,0 +1,5 @@
+-- Filename new_migrations/000005_add_todos_recurrence.down.sql
+
+ALTER TABLE todos DROP COLUMN IF EXISTS occurrence;
+ALTER TABLE todos DROP COLUMN IF EXISTS recurrence;
+ALTER TABLE todos DROP COLUMN IF EXISTS due_at;
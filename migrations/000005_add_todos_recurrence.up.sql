@@ -0,0 +1,5 @@
+-- Filename new_migrations/000005_add_todos_recurrence.up.sql
+
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS due_at timestamp(0) with time zone;
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS recurrence text NOT NULL DEFAULT '';
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS occurrence integer NOT NULL DEFAULT 1;
@@ -0,0 +1,8 @@
+-- Filename new_migrations/000006_add_todos_reminders.down.sql
+
+DROP TABLE IF EXISTS reminder_deliveries;
+DROP INDEX IF EXISTS todo_pending_reminders_idx;
+ALTER TABLE todos DROP COLUMN IF EXISTS reminder_next_attempt_at;
+ALTER TABLE todos DROP COLUMN IF EXISTS reminder_attempts;
+ALTER TABLE todos DROP COLUMN IF EXISTS reminded_at;
+ALTER TABLE todos DROP COLUMN IF EXISTS remind_at;
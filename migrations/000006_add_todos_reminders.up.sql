@@ -0,0 +1,18 @@
+-- Filename new_migrations/000006_add_todos_reminders.up.sql
+
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS remind_at timestamp(0) with time zone;
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS reminded_at timestamp(0) with time zone;
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS reminder_attempts integer NOT NULL DEFAULT 0;
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS reminder_next_attempt_at timestamp(0) with time zone;
+
+CREATE INDEX IF NOT EXISTS todo_pending_reminders_idx ON todos (remind_at) WHERE reminded_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS reminder_deliveries (
+    id bigserial primary key,
+    todo_id bigint NOT NULL REFERENCES todos ON DELETE CASCADE,
+    notifier text NOT NULL,
+    attempt integer NOT NULL,
+    succeeded boolean NOT NULL,
+    error text NOT NULL DEFAULT '',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,5 @@
+-- Filename new_migrations/000007_add_webhooks_tables.down.sql
+
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhook_events;
+DROP TABLE IF EXISTS webhooks;
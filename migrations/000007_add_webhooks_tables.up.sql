@@ -0,0 +1,38 @@
+-- Filename new_migrations/000007_add_webhooks_tables.up.sql
+
+CREATE TABLE IF NOT EXISTS webhooks (
+    id bigserial primary key,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    url text NOT NULL,
+    secret text NOT NULL,
+    events text[] NOT NULL,
+    active boolean NOT NULL DEFAULT TRUE,
+    version integer NOT NULL DEFAULT 1
+);
+
+-- events are written in the same transaction as the todo they describe
+CREATE TABLE IF NOT EXISTS webhook_events (
+    id bigserial primary key,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    event_type text NOT NULL,
+    payload jsonb NOT NULL,
+    dispatched_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS webhook_events_pending_idx ON webhook_events (id) WHERE dispatched_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id bigserial primary key,
+    webhook_id bigint NOT NULL REFERENCES webhooks ON DELETE CASCADE,
+    event_id bigint NOT NULL REFERENCES webhook_events ON DELETE CASCADE,
+    status text NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    next_attempt_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    response_status integer NOT NULL DEFAULT 0,
+    error text NOT NULL DEFAULT '',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    delivered_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_pending_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_idx ON webhook_deliveries (webhook_id);
@@ -0,0 +1,4 @@
+-- Filename new_migrations/000008_add_todos_project.down.sql
+
+DROP INDEX IF EXISTS todo_project_idx;
+ALTER TABLE todos DROP COLUMN IF EXISTS project;
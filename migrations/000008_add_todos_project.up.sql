@@ -0,0 +1,5 @@
+-- Filename new_migrations/000008_add_todos_project.up.sql
+
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS project text NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS todo_project_idx ON todos (project);
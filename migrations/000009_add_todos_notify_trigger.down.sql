@@ -0,0 +1,5 @@
+-- Filename new_migrations/000009_add_todos_notify_trigger.down.sql
+
+DROP TRIGGER IF EXISTS todos_changed_update ON todos;
+DROP TRIGGER IF EXISTS todos_changed_insert_delete ON todos;
+DROP FUNCTION IF EXISTS notify_todos_changed();
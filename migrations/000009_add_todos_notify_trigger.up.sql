@@ -0,0 +1,32 @@
+-- Filename new_migrations/000009_add_todos_notify_trigger.up.sql
+
+-- tell every API instance listening on todos_changed about committed changes
+CREATE OR REPLACE FUNCTION notify_todos_changed() RETURNS trigger AS $$
+DECLARE
+    changed todos%ROWTYPE;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        changed := OLD;
+    ELSE
+        changed := NEW;
+    END IF;
+
+    PERFORM pg_notify('todos_changed', json_build_object(
+        'op', TG_OP,
+        'id', changed.id,
+        'version', changed.version,
+        'project', changed.project
+    )::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER todos_changed_insert_delete
+    AFTER INSERT OR DELETE ON todos
+    FOR EACH ROW EXECUTE PROCEDURE notify_todos_changed();
+
+-- updates that leave the version alone (e.g. reminder bookkeeping) are not changes
+CREATE TRIGGER todos_changed_update
+    AFTER UPDATE ON todos
+    FOR EACH ROW WHEN (OLD.version IS DISTINCT FROM NEW.version)
+    EXECUTE PROCEDURE notify_todos_changed();
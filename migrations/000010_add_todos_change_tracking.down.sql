@@ -0,0 +1,11 @@
+-- Filename new_migrations/000010_add_todos_change_tracking.down.sql
+
+DROP TRIGGER IF EXISTS todos_change_delete ON todos;
+DROP TRIGGER IF EXISTS todos_change_update ON todos;
+DROP TRIGGER IF EXISTS todos_change_insert ON todos;
+DROP FUNCTION IF EXISTS record_todo_change();
+DROP TABLE IF EXISTS todo_tombstones;
+DROP INDEX IF EXISTS todo_change_seq_idx;
+ALTER TABLE todos DROP COLUMN IF EXISTS change_seq;
+ALTER TABLE todos DROP COLUMN IF EXISTS updated_at;
+DROP SEQUENCE IF EXISTS todo_changes_seq;
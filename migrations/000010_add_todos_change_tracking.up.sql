@@ -0,0 +1,50 @@
+-- Filename new_migrations/000010_add_todos_change_tracking.up.sql
+
+-- every change to a todo takes the next number from the sequence, the delta sync
+-- token is the last number a client has seen
+CREATE SEQUENCE IF NOT EXISTS todo_changes_seq;
+
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS change_seq bigint NOT NULL DEFAULT nextval('todo_changes_seq');
+
+CREATE INDEX IF NOT EXISTS todo_change_seq_idx ON todos (change_seq);
+
+-- deleted todos are remembered so clients can remove their copies
+CREATE TABLE IF NOT EXISTS todo_tombstones (
+    todo_id bigint NOT NULL,
+    version integer NOT NULL,
+    deleted_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    change_seq bigint NOT NULL DEFAULT nextval('todo_changes_seq')
+);
+
+CREATE INDEX IF NOT EXISTS todo_tombstones_change_seq_idx ON todo_tombstones (change_seq);
+
+-- the lock makes writers take their sequence numbers in commit order, otherwise a
+-- client could sync past a change that commits after one with a higher number
+CREATE OR REPLACE FUNCTION record_todo_change() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('todo_changes'));
+
+    IF TG_OP = 'DELETE' THEN
+        INSERT INTO todo_tombstones (todo_id, version) VALUES (OLD.id, OLD.version);
+        RETURN OLD;
+    END IF;
+
+    NEW.change_seq := nextval('todo_changes_seq');
+    NEW.updated_at := NOW();
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER todos_change_insert
+    BEFORE INSERT ON todos
+    FOR EACH ROW EXECUTE PROCEDURE record_todo_change();
+
+CREATE TRIGGER todos_change_update
+    BEFORE UPDATE ON todos
+    FOR EACH ROW WHEN (OLD.version IS DISTINCT FROM NEW.version)
+    EXECUTE PROCEDURE record_todo_change();
+
+CREATE TRIGGER todos_change_delete
+    AFTER DELETE ON todos
+    FOR EACH ROW EXECUTE PROCEDURE record_todo_change();
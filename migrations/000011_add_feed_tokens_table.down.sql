@@ -0,0 +1,3 @@
+-- Filename new_migrations/000011_add_feed_tokens_table.down.sql
+
+DROP TABLE IF EXISTS feed_tokens;
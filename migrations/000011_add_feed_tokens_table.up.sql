@@ -0,0 +1,10 @@
+-- Filename new_migrations/000011_add_feed_tokens_table.up.sql
+
+-- only a hash of each token is kept, the token itself is shown once on creation
+CREATE TABLE IF NOT EXISTS feed_tokens (
+    id bigserial primary key,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    name text NOT NULL,
+    token_hash bytea NOT NULL UNIQUE,
+    last_used_at timestamp(0) with time zone
+);
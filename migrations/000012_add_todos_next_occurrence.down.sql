@@ -0,0 +1,3 @@
+-- Filename new_migrations/000012_add_todos_next_occurrence.down.sql
+
+ALTER TABLE todos DROP COLUMN IF EXISTS next_id;
@@ -0,0 +1,5 @@
+-- Filename new_migrations/000012_add_todos_next_occurrence.up.sql
+
+-- the occurrence spawned when a recurring todo was completed, so completing it
+-- again after unchecking it does not spawn another one
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS next_id bigint REFERENCES todos ON DELETE SET NULL;
@@ -0,0 +1,19 @@
+-- Filename new_migrations/000013_add_todo_tombstones_todo.down.sql
+
+CREATE OR REPLACE FUNCTION record_todo_change() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('todo_changes'));
+
+    IF TG_OP = 'DELETE' THEN
+        INSERT INTO todo_tombstones (todo_id, version) VALUES (OLD.id, OLD.version);
+        RETURN OLD;
+    END IF;
+
+    NEW.change_seq := nextval('todo_changes_seq');
+    NEW.updated_at := NOW();
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP INDEX IF EXISTS todo_tombstones_todo_id_idx;
+ALTER TABLE todo_tombstones DROP COLUMN IF EXISTS todo;
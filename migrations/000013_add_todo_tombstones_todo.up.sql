@@ -0,0 +1,22 @@
+-- Filename new_migrations/000013_add_todo_tombstones_todo.up.sql
+
+-- the deleted todo is kept with its tombstone, so instances told about the delete
+-- can send the same event as the instance that made it
+ALTER TABLE todo_tombstones ADD COLUMN IF NOT EXISTS todo jsonb;
+
+CREATE INDEX IF NOT EXISTS todo_tombstones_todo_id_idx ON todo_tombstones (todo_id);
+
+CREATE OR REPLACE FUNCTION record_todo_change() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('todo_changes'));
+
+    IF TG_OP = 'DELETE' THEN
+        INSERT INTO todo_tombstones (todo_id, version, todo) VALUES (OLD.id, OLD.version, to_jsonb(OLD));
+        RETURN OLD;
+    END IF;
+
+    NEW.change_seq := nextval('todo_changes_seq');
+    NEW.updated_at := NOW();
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
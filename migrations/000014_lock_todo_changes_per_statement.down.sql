@@ -0,0 +1,23 @@
+-- Filename new_migrations/000014_lock_todo_changes_per_statement.down.sql
+
+DROP INDEX IF EXISTS todo_tombstones_deleted_at_idx;
+DROP TABLE IF EXISTS todo_sync_horizon;
+
+CREATE OR REPLACE FUNCTION record_todo_change() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('todo_changes'));
+
+    IF TG_OP = 'DELETE' THEN
+        INSERT INTO todo_tombstones (todo_id, version, todo) VALUES (OLD.id, OLD.version, to_jsonb(OLD));
+        RETURN OLD;
+    END IF;
+
+    NEW.change_seq := nextval('todo_changes_seq');
+    NEW.updated_at := NOW();
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS todos_change_lock_update ON todos;
+DROP TRIGGER IF EXISTS todos_change_lock_insert_delete ON todos;
+DROP FUNCTION IF EXISTS lock_todo_changes();
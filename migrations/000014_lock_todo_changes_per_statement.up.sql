@@ -0,0 +1,43 @@
+-- Filename new_migrations/000014_lock_todo_changes_per_statement.up.sql
+
+-- the change lock is taken before a statement locks any row. Taken by the row
+-- triggers, after the row lock, two transactions changing the same todos could
+-- each hold what the other waits for. Updates that leave the version alone (e.g.
+-- reminder bookkeeping) are not changes and do not wait for the lock
+CREATE OR REPLACE FUNCTION lock_todo_changes() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('todo_changes'));
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER todos_change_lock_insert_delete
+    BEFORE INSERT OR DELETE ON todos
+    FOR EACH STATEMENT EXECUTE PROCEDURE lock_todo_changes();
+
+CREATE TRIGGER todos_change_lock_update
+    BEFORE UPDATE OF version ON todos
+    FOR EACH STATEMENT EXECUTE PROCEDURE lock_todo_changes();
+
+CREATE OR REPLACE FUNCTION record_todo_change() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        INSERT INTO todo_tombstones (todo_id, version, todo) VALUES (OLD.id, OLD.version, to_jsonb(OLD));
+        RETURN OLD;
+    END IF;
+
+    NEW.change_seq := nextval('todo_changes_seq');
+    NEW.updated_at := NOW();
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+-- tombstones are purged once they are older than the retention, sync tokens from
+-- before the last purged tombstone have expired as their client may miss deletes
+CREATE TABLE IF NOT EXISTS todo_sync_horizon (
+    change_seq bigint NOT NULL
+);
+
+INSERT INTO todo_sync_horizon (change_seq) SELECT 0 WHERE NOT EXISTS (SELECT 1 FROM todo_sync_horizon);
+
+CREATE INDEX IF NOT EXISTS todo_tombstones_deleted_at_idx ON todo_tombstones (deleted_at);
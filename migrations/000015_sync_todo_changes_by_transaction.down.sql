@@ -0,0 +1,39 @@
+-- Filename new_migrations/000015_sync_todo_changes_by_transaction.down.sql
+
+ALTER TABLE todo_sync_horizon DROP COLUMN IF EXISTS change_xid;
+
+CREATE OR REPLACE FUNCTION record_todo_change() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        INSERT INTO todo_tombstones (todo_id, version, todo) VALUES (OLD.id, OLD.version, to_jsonb(OLD));
+        RETURN OLD;
+    END IF;
+
+    NEW.change_seq := nextval('todo_changes_seq');
+    NEW.updated_at := NOW();
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP INDEX IF EXISTS todo_tombstones_change_xid_seq_idx;
+DROP INDEX IF EXISTS todo_change_xid_seq_idx;
+CREATE INDEX IF NOT EXISTS todo_tombstones_change_seq_idx ON todo_tombstones (change_seq);
+CREATE INDEX IF NOT EXISTS todo_change_seq_idx ON todos (change_seq);
+
+ALTER TABLE todo_tombstones DROP COLUMN IF EXISTS change_xid;
+ALTER TABLE todos DROP COLUMN IF EXISTS change_xid;
+
+CREATE OR REPLACE FUNCTION lock_todo_changes() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('todo_changes'));
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER todos_change_lock_insert_delete
+    BEFORE INSERT OR DELETE ON todos
+    FOR EACH STATEMENT EXECUTE PROCEDURE lock_todo_changes();
+
+CREATE TRIGGER todos_change_lock_update
+    BEFORE UPDATE OF version ON todos
+    FOR EACH STATEMENT EXECUTE PROCEDURE lock_todo_changes();
@@ -0,0 +1,38 @@
+-- Filename new_migrations/000015_sync_todo_changes_by_transaction.up.sql
+
+-- changes are synced in the order of the transactions that made them, with the
+-- change sequence ordering the changes inside a transaction. Every transaction
+-- older than the xmin of a snapshot has finished, so a pull that stops short of
+-- it cannot skip a change that commits later, and writers no longer take turns
+-- on a lock to hand out the sequence in commit order. A long transaction holds
+-- back what pulls see until it finishes but does not hold up other writers
+DROP TRIGGER IF EXISTS todos_change_lock_update ON todos;
+DROP TRIGGER IF EXISTS todos_change_lock_insert_delete ON todos;
+DROP FUNCTION IF EXISTS lock_todo_changes();
+
+ALTER TABLE todos ADD COLUMN IF NOT EXISTS change_xid xid8 NOT NULL DEFAULT pg_current_xact_id();
+ALTER TABLE todo_tombstones ADD COLUMN IF NOT EXISTS change_xid xid8 NOT NULL DEFAULT pg_current_xact_id();
+
+DROP INDEX IF EXISTS todo_change_seq_idx;
+DROP INDEX IF EXISTS todo_tombstones_change_seq_idx;
+CREATE INDEX IF NOT EXISTS todo_change_xid_seq_idx ON todos (change_xid, change_seq);
+CREATE INDEX IF NOT EXISTS todo_tombstones_change_xid_seq_idx ON todo_tombstones (change_xid, change_seq);
+
+CREATE OR REPLACE FUNCTION record_todo_change() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        INSERT INTO todo_tombstones (todo_id, version, todo) VALUES (OLD.id, OLD.version, to_jsonb(OLD));
+        RETURN OLD;
+    END IF;
+
+    NEW.change_xid := pg_current_xact_id();
+    NEW.change_seq := nextval('todo_changes_seq');
+    NEW.updated_at := NOW();
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+-- the horizon becomes a position in the new order, tokens that only hold a
+-- change sequence number are before it and have expired
+ALTER TABLE todo_sync_horizon ADD COLUMN IF NOT EXISTS change_xid xid8 NOT NULL DEFAULT '0';
+UPDATE todo_sync_horizon SET change_xid = pg_current_xact_id(), change_seq = 0;
@@ -0,0 +1,3 @@
+-- Filename new_migrations/000016_add_feed_tokens_project.down.sql
+
+ALTER TABLE feed_tokens DROP COLUMN IF EXISTS project;
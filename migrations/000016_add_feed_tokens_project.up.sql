@@ -0,0 +1,5 @@
+-- Filename new_migrations/000016_add_feed_tokens_project.up.sql
+
+-- a token may be scoped to the todos of one project, an empty project gives the
+-- token the whole list
+ALTER TABLE feed_tokens ADD COLUMN IF NOT EXISTS project text NOT NULL DEFAULT '';
@@ -0,0 +1,21 @@
+-- Filename new_migrations/000017_skip_todo_notifications_in_bulk.down.sql
+
+CREATE OR REPLACE FUNCTION notify_todos_changed() RETURNS trigger AS $$
+DECLARE
+    changed todos%ROWTYPE;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        changed := OLD;
+    ELSE
+        changed := NEW;
+    END IF;
+
+    PERFORM pg_notify('todos_changed', json_build_object(
+        'op', TG_OP,
+        'id', changed.id,
+        'version', changed.version,
+        'project', changed.project
+    )::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
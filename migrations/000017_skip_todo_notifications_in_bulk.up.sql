@@ -0,0 +1,28 @@
+-- Filename new_migrations/000017_skip_todo_notifications_in_bulk.up.sql
+
+-- a transaction that sets todoapi.bulk, e.g. an import, sends one notification
+-- for all of its changes itself instead of one per todo, which would flood the
+-- event streams of every instance
+CREATE OR REPLACE FUNCTION notify_todos_changed() RETURNS trigger AS $$
+DECLARE
+    changed todos%ROWTYPE;
+BEGIN
+    IF current_setting('todoapi.bulk', true) = 'on' THEN
+        RETURN NULL;
+    END IF;
+
+    IF TG_OP = 'DELETE' THEN
+        changed := OLD;
+    ELSE
+        changed := NEW;
+    END IF;
+
+    PERFORM pg_notify('todos_changed', json_build_object(
+        'op', TG_OP,
+        'id', changed.id,
+        'version', changed.version,
+        'project', changed.project
+    )::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;